@@ -0,0 +1,57 @@
+package keyvaluestore
+
+// A backend is where a store keeps its keys and values. `OpenNew` and `OpenFile` use a plain Go map;
+// `OpenMapped` uses a hash table in a memory-mapped file (see mapped.go).
+// Everything else (locking, indexes, hooks, the store file and change feed) is the same for both.
+//
+// The store lock covers the backend: `get`, `count` and `each` need at least the read lock,
+// and everything else needs the write lock. Values handed out by a backend are only good until
+// the next `set`, and a collection changed in place must be `set` again to keep the change.
+type backend interface {
+	get(key StoreKey) (StoreValue, bool)
+	set(key StoreKey, value StoreValue) error
+	remove(key StoreKey)
+	count() int
+	each(visit func(key StoreKey, value StoreValue) bool) // `visit` may remove the key it is given, but must not add any; return false to stop
+	flush() error   // make sure everything written so far is on disk
+	compact() error // reclaim the space held by old values
+	close() error
+	reopen() error
+}
+
+// newCore makes the backend for `OpenNew`. The tests swap it, to run everything against a mapped file as well.
+var newCore = func() backend {
+	return mapBackend{} // or `mapBackend(make(map[StoreKey]StoreValue))`, but this is considered 'oldthink'
+}
+
+// mapBackend keeps everything on the Go heap
+type mapBackend map[StoreKey]StoreValue
+
+func (core mapBackend) get(key StoreKey) (StoreValue, bool) {
+	value, ok := core[key]
+	return value, ok
+}
+
+func (core mapBackend) set(key StoreKey, value StoreValue) error {
+	core[key] = value
+	return nil
+}
+
+func (core mapBackend) remove(key StoreKey) {
+	delete(core, key)
+}
+
+func (core mapBackend) count() int {
+	return len(core)
+}
+
+func (core mapBackend) each(visit func(key StoreKey, value StoreValue) bool) {
+	for key, value := range core {
+		if !visit(key, value) {return}
+	}
+}
+
+func (core mapBackend) flush() error   { return NotPersistedError }
+func (core mapBackend) compact() error { return NotPersistedError }
+func (core mapBackend) close() error   { return nil }
+func (core mapBackend) reopen() error  { return nil }
@@ -0,0 +1,26 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestMain runs every test twice: once with values in a Go map, and again with them in mapped files
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code != 0 {os.Exit(code)}
+
+	dir, err := os.MkdirTemp("", "kvs-mapped")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if kvs.UseMappedBackendForTests(dir) {
+		fmt.Println("Running again with the mapped backend")
+		code = m.Run()
+	}
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,295 @@
+package keyvaluestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Change data capture.
+// With a change feed enabled, every change to the store is given the next sequence number and
+// appended to the feed file (in the same frame format as store files) before it is applied.
+// Consumers remember the last sequence number they processed, and resume from the one after it.
+// The feed is never compacted, so it holds the whole history since it was enabled, and sequence
+// numbers carry on from where they left off when the feed is enabled again after a restart.
+// For file-backed stores, the feed is compressed and encrypted with the same options as the store file.
+// The feed keeps a sparse index of where its frames start, so readers go straight to the frames they
+// want instead of reading the whole history every time.
+//
+// The feed is as durable as the store file: each change is written to the feed before the store file,
+// and `Sync` and `Close` flush the feed first. So once a change is on disk in the store file, it's on
+// disk in the feed too. The reverse isn't quite true: if writing the store file fails after the feed
+// was written, the change is in the feed but not the store, and the store refuses every later write.
+
+var ChangeFeedNotEnabledError = errors.New("the store does not have a change feed")
+var ChangeFeedAlreadyEnabledError = errors.New("the store already has a change feed")
+
+// feedMarkEvery is how many changes apart the feed's index marks are
+const feedMarkEvery = 256
+
+type changeFeed struct {
+	path    string
+	file    *os.File
+	lastSeq uint64
+	marks   []feedMark // in sequence order
+	options FileOptions
+	changed chan struct{} // closed and replaced every time a change is added
+	failed  error
+}
+
+// feedMark says where in the feed file the frame for a change starts
+type feedMark struct {
+	seq    uint64
+	offset int64
+}
+
+// EnableChangeFeed starts writing every change to the feed file at `path`, creating it if needed
+func (receiver *IndependentStore) EnableChangeFeed(path string) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	if receiver.feed != nil {return ChangeFeedAlreadyEnabledError}
+
+	feed := &changeFeed{
+		path:    path,
+		changed: make(chan struct{}),
+	}
+	if receiver.log != nil {feed.options = receiver.log.options}
+
+	file, err := openFrameFile(path, feed.options, func(line RecordLine, offset int64) error {
+		if line.Seq > feed.lastSeq {
+			feed.lastSeq = line.Seq
+			feed.markLocked(line.Seq, offset)
+		}
+		return nil
+	})
+	if err != nil {return err}
+
+	feed.file = file
+	receiver.feed = feed
+	return nil
+}
+
+// LastSequence returns the sequence number of the latest change, or zero if there have been none
+func (receiver *IndependentStore) LastSequence() (uint64, error) {
+	return receiver.LastSequenceContext(context.Background())
+}
+
+// LastSequenceContext is `LastSequence`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) LastSequenceContext(ctx context.Context) (uint64, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return 0, err}
+	defer receiver.mutex.RUnlock()
+
+	if receiver.feed == nil {return 0, ChangeFeedNotEnabledError}
+	return receiver.feed.lastSeq, nil
+}
+
+// ChangeSignal returns a channel that is closed once there is a change with a sequence number after `seq`
+func (receiver *IndependentStore) ChangeSignal(seq uint64) (<-chan struct{}, error) {
+	return receiver.ChangeSignalContext(context.Background(), seq)
+}
+
+// ChangeSignalContext is `ChangeSignal`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ChangeSignalContext(ctx context.Context, seq uint64) (<-chan struct{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
+	defer receiver.mutex.RUnlock()
+
+	if receiver.feed == nil {return nil, ChangeFeedNotEnabledError}
+	if receiver.feed.lastSeq > seq {
+		ready := make(chan struct{})
+		close(ready)
+		return ready, nil
+	}
+	return receiver.feed.changed, nil
+}
+
+// ReadChanges calls `handle` with every change from sequence number `from` onwards, in order.
+// Returns the sequence number to start from next time.
+func (receiver *IndependentStore) ReadChanges(from uint64, handle func(change RecordLine) error) (uint64, error) {
+	return receiver.ReadChangesContext(context.Background(), from, handle)
+}
+
+// ReadChangesContext is `ReadChanges`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ReadChangesContext(ctx context.Context, from uint64, handle func(change RecordLine) error) (uint64, error) {
+	if receiver == nil || !receiver.isOpen {return from, StoreNotOpenError}
+	if from < 1 {from = 1}
+
+	if err := receiver.rLockContext(ctx); err != nil {return from, err}
+	feed := receiver.feed
+	var options FileOptions
+	var start int64
+	if feed != nil {options, start = feed.options, feed.offsetBefore(from)}
+	receiver.mutex.RUnlock()
+	if feed == nil {return from, ChangeFeedNotEnabledError}
+
+	// Read with our own handle, so we're not holding up writers.
+	// Frames are written whole, so at worst we see a partial frame at the end, which is skipped until next time.
+	file, err := os.Open(feed.path)
+	if err != nil {return from, err}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	next := from
+	_, _, err = readFramesFrom(file, start, options, func(line RecordLine, _ int64) error {
+		if err := checkContext(ctx); err != nil {return err}
+		if line.Seq < next {return nil}
+		next = line.Seq + 1
+		return handle(line)
+	})
+	return next, err
+}
+
+// WriteChanges writes every change from sequence number `from` onwards as JSON lines.
+// Returns the sequence number to start from next time.
+func (receiver *IndependentStore) WriteChanges(target io.Writer, from uint64) (uint64, error) {
+	return receiver.WriteChangesContext(context.Background(), target, from)
+}
+
+// WriteChangesContext is `WriteChanges`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) WriteChangesContext(ctx context.Context, target io.Writer, from uint64) (uint64, error) {
+	encoder := json.NewEncoder(target)
+	return receiver.ReadChangesContext(ctx, from, func(change RecordLine) error {
+		return encoder.Encode(change)
+	})
+}
+
+// FollowChanges writes every change from sequence number `from` onwards as JSON lines,
+// then waits for more, until `ctx` is cancelled. Use it to tail the feed to a file or a network connection.
+func (receiver *IndependentStore) FollowChanges(ctx context.Context, target io.Writer, from uint64) error {
+	if from < 1 {from = 1}
+	flusher, canFlush := target.(http.Flusher)
+
+	for {
+		// get the signal first, so we can't miss a change that lands while we're writing
+		signal, err := receiver.ChangeSignalContext(ctx, from - 1)
+		if err != nil {return err}
+
+		if from, err = receiver.WriteChangesContext(ctx, target, from); err != nil {return err}
+		if canFlush {flusher.Flush()}
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx.Err())
+		case <-signal:
+		}
+	}
+}
+
+// ChangeFeedHandler serves the change feed as JSON lines.
+// Query parameters are `from` (the first sequence number to send, default 1) and
+// `follow` (if true, keep the response open and send changes as they happen).
+func (receiver *IndependentStore) ChangeFeedHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			response.Header().Set("Allow", http.MethodGet)
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		from := uint64(1)
+		if fromStr := request.URL.Query().Get("from"); fromStr != "" {
+			parsed, err := strconv.ParseUint(fromStr, 10, 64)
+			if err != nil {
+				http.Error(response, "invalid 'from' sequence number", http.StatusBadRequest)
+				return
+			}
+			from = parsed
+		}
+		follow, _ := strconv.ParseBool(request.URL.Query().Get("follow"))
+
+		if _, err := receiver.LastSequenceContext(request.Context()); err != nil {
+			http.Error(response, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/x-ndjson")
+		response.WriteHeader(http.StatusOK)
+
+		// Once we've started writing, errors can only be reported by cutting the response short
+		if follow {
+			_ = receiver.FollowChanges(request.Context(), response, from)
+		} else {
+			_, _ = receiver.WriteChangesContext(request.Context(), response, from)
+		}
+	})
+}
+
+func (feed *changeFeed) append(line RecordLine) error {
+	if feed.failed != nil {return feed.failed}
+	if feed.file == nil {return StoreNotOpenError}
+
+	line.Seq = feed.lastSeq + 1
+	offset := int64(-1)
+	if feed.markDue(line.Seq) {
+		var err error
+		if offset, err = feed.file.Seek(0, io.SeekEnd); err != nil { // where this frame will go
+			feed.failed = err
+			return err
+		}
+	}
+	if err := writeFrame(feed.file, line, feed.options); err != nil {
+		feed.failed = err
+		return err
+	}
+
+	feed.lastSeq = line.Seq
+	if offset >= 0 {feed.markLocked(line.Seq, offset)}
+	close(feed.changed)
+	feed.changed = make(chan struct{})
+	return nil
+}
+
+func (feed *changeFeed) markDue(seq uint64) bool {
+	return len(feed.marks) < 1 || seq >= feed.marks[len(feed.marks)-1].seq+feedMarkEvery
+}
+
+// markLocked notes where the frame for `seq` starts, if it's time for another mark.
+// Caller must hold the store's write lock.
+func (feed *changeFeed) markLocked(seq uint64, offset int64) {
+	if feed.markDue(seq) {feed.marks = append(feed.marks, feedMark{seq: seq, offset: offset})}
+}
+
+// offsetBefore finds where to start reading for the changes from `seq` onwards: the latest mark at or before it,
+// or zero for the start of the file. Caller must hold the store's lock.
+func (feed *changeFeed) offsetBefore(seq uint64) int64 {
+	found := sort.Search(len(feed.marks), func(i int) bool { return feed.marks[i].seq > seq })
+	if found == 0 {return 0}
+	return feed.marks[found-1].offset
+}
+
+func (feed *changeFeed) sync() error {
+	if feed.failed != nil {return feed.failed}
+	if feed.file == nil {return StoreNotOpenError}
+	return feed.file.Sync()
+}
+
+func (feed *changeFeed) reopen() error {
+	if feed.file != nil {return nil}
+
+	file, err := os.OpenFile(feed.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {return err}
+
+	feed.file = file
+	feed.failed = nil
+	return nil
+}
+
+func (feed *changeFeed) close() error {
+	if feed.file == nil {return nil}
+
+	err := feed.file.Sync()
+	if closeErr := feed.file.Close(); err == nil {err = closeErr}
+	feed.file = nil
+	if err == nil {err = feed.failed}
+	return err
+}
@@ -0,0 +1,150 @@
+package keyvaluestore_test
+
+import (
+	"bufio"
+	kvs "KeyValueStore"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEveryChangeGetsASequenceNumber(t *testing.T){
+	store := kvs.OpenNew()
+	if err := store.EnableChangeFeed(filepath.Join(t.TempDir(), "changes.kvs")); err != nil {
+		t.Fatalf("EnableChangeFeed failed with %v", err)
+	}
+
+	_ = store.Put("a", 1)
+	_ = store.Put("b", 2)
+	_ = store.Delete("a")
+	_, _ = store.ListPushRight("list", "x")
+	_, _ = store.Get("b") // reads are not changes
+
+	changes := []kvs.RecordLine{}
+	next, err := store.ReadChanges(0, func(change kvs.RecordLine) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {t.Fatalf("ReadChanges failed with %v", err)}
+
+	if len(changes) != 4 || next != 5 {t.Fatalf("Expected 4 changes and next=5, but got %d and %d", len(changes), next)}
+	for i, change := range changes {
+		if change.Seq != uint64(i+1) {t.Errorf("Expected seq %d, but got %d", i+1, change.Seq)}
+	}
+	if changes[2].Op != kvs.OpDelete || changes[2].Key != "a" {t.Errorf("Unexpected third change %+v", changes[2])}
+	if changes[3].Type != "list" {t.Errorf("Expected collection change to carry the list, but got %+v", changes[3])}
+
+	// resume part way through
+	resumed := 0
+	_, _ = store.ReadChanges(3, func(change kvs.RecordLine) error {
+		resumed++
+		return nil
+	})
+	if resumed != 2 {t.Errorf("Expected 2 changes from seq 3, but got %d", resumed)}
+}
+
+func TestSequenceCarriesOnAfterRestart(t *testing.T){
+	dir := t.TempDir()
+	store, _ := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	_ = store.EnableChangeFeed(filepath.Join(dir, "changes.kvs"))
+	_ = store.Put("a", 1)
+	_ = store.Put("b", 2)
+	_ = store.Close()
+
+	reopened, _ := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	if err := reopened.EnableChangeFeed(filepath.Join(dir, "changes.kvs")); err != nil {
+		t.Fatalf("EnableChangeFeed failed with %v", err)
+	}
+	_ = reopened.Put("c", 3)
+
+	if last, _ := reopened.LastSequence(); last != 3 {t.Errorf("Expected last sequence 3, but got %d", last)}
+}
+
+func TestReadingTheFeedSkipsEarlierHistory(t *testing.T){
+	dir := t.TempDir()
+	store, _ := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	_ = store.EnableChangeFeed(filepath.Join(dir, "changes.kvs"))
+	for i := 0; i < 1000; i++ {
+		_ = store.Put("key", i)
+	}
+
+	check := func(store *kvs.IndependentStore, from uint64) {
+		t.Helper()
+		seqs := []uint64{}
+		next, err := store.ReadChanges(from, func(change kvs.RecordLine) error {
+			seqs = append(seqs, change.Seq)
+			return nil
+		})
+		if err != nil || next != 1001 || len(seqs) != int(1001-from) || seqs[0] != from {
+			t.Errorf("Expected changes %d to 1000, but got %d of them from %v (next %d, %v)", from, len(seqs), seqs[:1], next, err)
+		}
+		if offset := kvs.FeedOffsetForTests(store, from); from > 256 && offset < 1 {t.Errorf("Expected reading from %d to skip some of the file", from)}
+	}
+	check(store, 1)
+	check(store, 700)
+	check(store, 1000)
+
+	// the index is rebuilt when the feed is opened again
+	_ = store.Close()
+	reopened, _ := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	defer func() { _ = reopened.Close() }()
+	if err := reopened.EnableChangeFeed(filepath.Join(dir, "changes.kvs")); err != nil {t.Fatalf("EnableChangeFeed failed with %v", err)}
+	check(reopened, 513)
+	check(reopened, 999)
+}
+
+func TestChangesMissingFromTheFeedAreNotStored(t *testing.T){
+	dir := t.TempDir()
+	store, _ := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	_ = store.EnableChangeFeed(filepath.Join(dir, "changes.kvs"))
+	_ = store.Put("a", 1)
+	if err := store.Sync(); err != nil {t.Fatalf("Sync failed with %v", err)}
+
+	kvs.BreakChangeFeedForTests(store)
+	if err := store.Put("b", 2); err == nil {t.Fatalf("Expected the put to fail with the feed")}
+	if store.Contains("b") {t.Errorf("Expected 'b' not to be stored")}
+	_ = store.Close()
+
+	reopened, err := kvs.OpenFile(filepath.Join(dir, "store.kvs"), kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = reopened.Close() }()
+	if !reopened.Contains("a") || reopened.Contains("b") {t.Errorf("Expected only the change in the feed to be in the store file")}
+}
+
+func TestChangeFeedCanBeFollowedOverHttp(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.EnableChangeFeed(filepath.Join(t.TempDir(), "changes.kvs"))
+	_ = store.Put("before", 1)
+
+	server := httptest.NewServer(store.ChangeFeedHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?from=1&follow=true", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {t.Fatalf("Request failed with %v", err)}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected content type %s", response.Header.Get("Content-Type"))
+	}
+
+	lines := bufio.NewScanner(response.Body)
+	readChange := func() kvs.RecordLine {
+		change := kvs.RecordLine{}
+		if !lines.Scan() {t.Fatalf("Feed ended early: %v", lines.Err())}
+		if err := json.Unmarshal(lines.Bytes(), &change); err != nil {t.Fatalf("Bad line: %v", err)}
+		return change
+	}
+
+	if change := readChange(); change.Key != "before" || change.Seq != 1 {t.Errorf("Unexpected change %+v", change)}
+
+	// a change made while we're waiting should be pushed to us
+	_ = store.Put("after", 2)
+	if change := readChange(); change.Key != "after" || change.Seq != 2 {t.Errorf("Unexpected change %+v", change)}
+}
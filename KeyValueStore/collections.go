@@ -0,0 +1,611 @@
+package keyvaluestore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Redis-style collection values.
+// These live in the store like any other value, but they are only ever changed through the
+// methods in this file, which hold the store's write lock for the whole read-modify-write.
+// The concrete types are unexported, so anything handed back by `Get` can't be mutated
+// from outside the package (and so can't be mutated outside the lock).
+// Collections are changed in place, so for a file-backed store the whole collection is
+// written out after each change. If that write fails, the error is returned but the
+// in-memory change stays.
+
+var WrongTypeError = errors.New("the value at this key is not the requested collection type")
+var FieldNotPresentError = errors.New("the given field is not present in this hash")
+
+type storeList struct {
+	items []interface{}
+}
+
+type storeSet struct {
+	members map[string]struct{}
+}
+
+type storeHash struct {
+	fields map[string]interface{}
+}
+
+type storeSortedSet struct {
+	scores map[string]float64
+}
+
+// ScoredMember is a single entry from a sorted set
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+//<editor-fold desc="Lookup helpers (caller must hold the lock)">
+
+// findCollectionLocked finds the value at `key`.
+// If the key is missing and `create` is not nil, a new collection is made and stored.
+// If the key is missing and `create` is nil, this returns (nil, nil)
+func (receiver *IndependentStore) findCollectionLocked(key StoreKey, create func() interface{}) (interface{}, error) {
+	wrapper, ok := receiver.core.get(key)
+	if ok && isExpired(wrapper, time.Now()) {
+		receiver.removeLocked(key, ReasonExpired)
+		ok = false
+	}
+	if !ok {
+		if create == nil {return nil, nil}
+		// not `putLocked`: the caller persists the collection once it has been filled in
+		value := create()
+		err := receiver.core.set(key, &timestampWrapper{
+			lastAccess: time.Now(),
+			value:      value,
+		})
+		if err != nil {return nil, err}
+		receiver.enforceCapacityLocked(key)
+		return value, nil
+	}
+
+	wrapper.SetTimestamp(time.Now())
+	return wrapper.GetValue(), nil
+}
+
+func (receiver *IndependentStore) findListLocked(key StoreKey, create bool) (*storeList, error) {
+	var maker func() interface{}
+	if create {maker = func() interface{} { return &storeList{} }}
+
+	value, err := receiver.findCollectionLocked(key, maker)
+	if err != nil || value == nil {return nil, err}
+
+	list, ok := value.(*storeList)
+	if !ok {return nil, WrongTypeError}
+	return list, nil
+}
+
+func (receiver *IndependentStore) findSetLocked(key StoreKey, create bool) (*storeSet, error) {
+	var maker func() interface{}
+	if create {maker = func() interface{} { return &storeSet{members: map[string]struct{}{}} }}
+
+	value, err := receiver.findCollectionLocked(key, maker)
+	if err != nil || value == nil {return nil, err}
+
+	set, ok := value.(*storeSet)
+	if !ok {return nil, WrongTypeError}
+	return set, nil
+}
+
+func (receiver *IndependentStore) findHashLocked(key StoreKey, create bool) (*storeHash, error) {
+	var maker func() interface{}
+	if create {maker = func() interface{} { return &storeHash{fields: map[string]interface{}{}} }}
+
+	value, err := receiver.findCollectionLocked(key, maker)
+	if err != nil || value == nil {return nil, err}
+
+	hash, ok := value.(*storeHash)
+	if !ok {return nil, WrongTypeError}
+	return hash, nil
+}
+
+func (receiver *IndependentStore) findSortedSetLocked(key StoreKey, create bool) (*storeSortedSet, error) {
+	var maker func() interface{}
+	if create {maker = func() interface{} { return &storeSortedSet{scores: map[string]float64{}} }}
+
+	value, err := receiver.findCollectionLocked(key, maker)
+	if err != nil || value == nil {return nil, err}
+
+	sorted, ok := value.(*storeSortedSet)
+	if !ok {return nil, WrongTypeError}
+	return sorted, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Lists">
+
+// ListPushLeft adds values to the start of the list at `key`, creating it if needed.
+// Values are pushed one at a time, so `ListPushLeft(k, 1, 2)` gives [2, 1, ...]. Returns the new length.
+func (receiver *IndependentStore) ListPushLeft(key StoreKey, values ...interface{}) (int, error) {
+	return receiver.ListPushLeftContext(context.Background(), key, values...)
+}
+
+// ListPushLeftContext is `ListPushLeft`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListPushLeftContext(ctx context.Context, key StoreKey, values ...interface{}) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, true)
+	if err != nil {return 0, err}
+
+	items := make([]interface{}, 0, len(values)+len(list.items))
+	for i := len(values) - 1; i >= 0; i-- {
+		items = append(items, values[i])
+	}
+	list.items = append(items, list.items...)
+	return len(list.items), receiver.persistLocked(key, list)
+}
+
+// ListPushRight adds values to the end of the list at `key`, creating it if needed. Returns the new length.
+func (receiver *IndependentStore) ListPushRight(key StoreKey, values ...interface{}) (int, error) {
+	return receiver.ListPushRightContext(context.Background(), key, values...)
+}
+
+// ListPushRightContext is `ListPushRight`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListPushRightContext(ctx context.Context, key StoreKey, values ...interface{}) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, true)
+	if err != nil {return 0, err}
+
+	list.items = append(list.items, values...)
+	return len(list.items), receiver.persistLocked(key, list)
+}
+
+// ListPopLeft removes and returns the first value in the list.
+// The key is removed when the list becomes empty.
+func (receiver *IndependentStore) ListPopLeft(key StoreKey) (interface{}, error) {
+	return receiver.ListPopLeftContext(context.Background(), key)
+}
+
+// ListPopLeftContext is `ListPopLeft`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListPopLeftContext(ctx context.Context, key StoreKey) (interface{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, false)
+	if err != nil {return nil, err}
+	if list == nil || len(list.items) < 1 {return nil, KeyNotPresentError}
+
+	value := list.items[0]
+	list.items[0] = nil // don't hold a reference in the backing array
+	list.items = list.items[1:]
+	if len(list.items) < 1 {return value, receiver.removeLocked(key, ReasonDeleted)}
+	return value, receiver.persistLocked(key, list)
+}
+
+// ListPopRight removes and returns the last value in the list.
+// The key is removed when the list becomes empty.
+func (receiver *IndependentStore) ListPopRight(key StoreKey) (interface{}, error) {
+	return receiver.ListPopRightContext(context.Background(), key)
+}
+
+// ListPopRightContext is `ListPopRight`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListPopRightContext(ctx context.Context, key StoreKey) (interface{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, false)
+	if err != nil {return nil, err}
+	if list == nil || len(list.items) < 1 {return nil, KeyNotPresentError}
+
+	last := len(list.items) - 1
+	value := list.items[last]
+	list.items[last] = nil
+	list.items = list.items[:last]
+	if len(list.items) < 1 {return value, receiver.removeLocked(key, ReasonDeleted)}
+	return value, receiver.persistLocked(key, list)
+}
+
+// ListRange returns a copy of the values from `start` to `stop` inclusive.
+// Negative indexes count back from the end, so `ListRange(k, 0, -1)` is the whole list.
+// A missing key gives an empty result.
+func (receiver *IndependentStore) ListRange(key StoreKey, start, stop int) ([]interface{}, error) {
+	return receiver.ListRangeContext(context.Background(), key, start, stop)
+}
+
+// ListRangeContext is `ListRange`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListRangeContext(ctx context.Context, key StoreKey, start, stop int) ([]interface{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err} // not RLock: reading updates the timestamp
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, false)
+	if err != nil || list == nil {return []interface{}{}, err}
+
+	length := len(list.items)
+	if start < 0 {start += length}
+	if stop < 0 {stop += length}
+	if start < 0 {start = 0}
+	if stop >= length {stop = length - 1}
+	if start > stop {return []interface{}{}, nil}
+
+	result := make([]interface{}, stop-start+1)
+	copy(result, list.items[start:stop+1])
+	return result, nil
+}
+
+// ListLength returns the number of items in the list at `key`, or zero if the key is missing
+func (receiver *IndependentStore) ListLength(key StoreKey) (int, error) {
+	return receiver.ListLengthContext(context.Background(), key)
+}
+
+// ListLengthContext is `ListLength`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ListLengthContext(ctx context.Context, key StoreKey) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	list, err := receiver.findListLocked(key, false)
+	if err != nil || list == nil {return 0, err}
+	return len(list.items), nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Sets">
+
+// SetAdd adds members to the set at `key`, creating it if needed.
+// Returns how many of the members were not already in the set.
+func (receiver *IndependentStore) SetAdd(key StoreKey, members ...string) (int, error) {
+	return receiver.SetAddContext(context.Background(), key, members...)
+}
+
+// SetAddContext is `SetAdd`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetAddContext(ctx context.Context, key StoreKey, members ...string) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	set, err := receiver.findSetLocked(key, len(members) > 0)
+	if err != nil || set == nil {return 0, err}
+
+	added := 0
+	for _, member := range members {
+		if _, found := set.members[member]; found {continue}
+		set.members[member] = struct{}{}
+		added++
+	}
+	if added < 1 {return 0, nil} // nothing changed, so there's nothing to write
+	return added, receiver.persistLocked(key, set)
+}
+
+// SetRemove takes members out of the set at `key`, returning how many were removed.
+// The key is removed when the set becomes empty.
+func (receiver *IndependentStore) SetRemove(key StoreKey, members ...string) (int, error) {
+	return receiver.SetRemoveContext(context.Background(), key, members...)
+}
+
+// SetRemoveContext is `SetRemove`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetRemoveContext(ctx context.Context, key StoreKey, members ...string) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	set, err := receiver.findSetLocked(key, false)
+	if err != nil || set == nil {return 0, err}
+
+	removed := 0
+	for _, member := range members {
+		if _, found := set.members[member]; !found {continue}
+		delete(set.members, member)
+		removed++
+	}
+	if removed < 1 {return 0, nil}
+	if len(set.members) < 1 {return removed, receiver.removeLocked(key, ReasonDeleted)}
+	return removed, receiver.persistLocked(key, set)
+}
+
+// SetIsMember returns true if `member` is in the set at `key`
+func (receiver *IndependentStore) SetIsMember(key StoreKey, member string) (bool, error) {
+	return receiver.SetIsMemberContext(context.Background(), key, member)
+}
+
+// SetIsMemberContext is `SetIsMember`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetIsMemberContext(ctx context.Context, key StoreKey, member string) (bool, error) {
+	if receiver == nil || !receiver.isOpen {return false, StoreNotOpenError}
+	if receiver.core == nil {return false, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return false, err}
+	defer receiver.unlockAndNotify()
+
+	set, err := receiver.findSetLocked(key, false)
+	if err != nil || set == nil {return false, err}
+
+	_, found := set.members[member]
+	return found, nil
+}
+
+// SetMembers returns the members of the set at `key`, in sorted order
+func (receiver *IndependentStore) SetMembers(key StoreKey) ([]string, error) {
+	return receiver.SetMembersContext(context.Background(), key)
+}
+
+// SetMembersContext is `SetMembers`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetMembersContext(ctx context.Context, key StoreKey) ([]string, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	set, err := receiver.findSetLocked(key, false)
+	if err != nil || set == nil {return []string{}, err}
+
+	result := make([]string, 0, len(set.members))
+	for member := range set.members {
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// SetIntersect returns the members that are in every one of the given sets, in sorted order.
+// A missing key counts as an empty set.
+func (receiver *IndependentStore) SetIntersect(keys ...StoreKey) ([]string, error) {
+	return receiver.SetIntersectContext(context.Background(), keys...)
+}
+
+// SetIntersectContext is `SetIntersect`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetIntersectContext(ctx context.Context, keys ...StoreKey) ([]string, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+	if len(keys) < 1 {return []string{}, nil}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	sets := make([]*storeSet, 0, len(keys))
+	for _, key := range keys {
+		set, err := receiver.findSetLocked(key, false)
+		if err != nil {return nil, err}
+		if set == nil {return []string{}, nil}
+		sets = append(sets, set)
+	}
+
+	// walk the smallest set, and check the others
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i].members) < len(sets[j].members) })
+	result := []string{}
+	for member := range sets[0].members {
+		inAll := true
+		for _, other := range sets[1:] {
+			if _, found := other.members[member]; !found {
+				inAll = false
+				break
+			}
+		}
+		if inAll {result = append(result, member)}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Hashes">
+
+// HashSet sets a single field in the hash at `key`, creating the hash if needed
+func (receiver *IndependentStore) HashSet(key StoreKey, field string, value interface{}) error {
+	return receiver.HashSetContext(context.Background(), key, field, value)
+}
+
+// HashSetContext is `HashSet`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) HashSetContext(ctx context.Context, key StoreKey, field string, value interface{}) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	hash, err := receiver.findHashLocked(key, true)
+	if err != nil {return err}
+
+	hash.fields[field] = value
+	return receiver.persistLocked(key, hash)
+}
+
+// HashGet reads a single field from the hash at `key`
+func (receiver *IndependentStore) HashGet(key StoreKey, field string) (interface{}, error) {
+	return receiver.HashGetContext(context.Background(), key, field)
+}
+
+// HashGetContext is `HashGet`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) HashGetContext(ctx context.Context, key StoreKey, field string) (interface{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	hash, err := receiver.findHashLocked(key, false)
+	if err != nil {return nil, err}
+	if hash == nil {return nil, KeyNotPresentError}
+
+	value, ok := hash.fields[field]
+	if !ok {return nil, FieldNotPresentError}
+	return value, nil
+}
+
+// HashDelete removes fields from the hash at `key`, returning how many were removed.
+// The key is removed when the hash becomes empty.
+func (receiver *IndependentStore) HashDelete(key StoreKey, fields ...string) (int, error) {
+	return receiver.HashDeleteContext(context.Background(), key, fields...)
+}
+
+// HashDeleteContext is `HashDelete`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) HashDeleteContext(ctx context.Context, key StoreKey, fields ...string) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	hash, err := receiver.findHashLocked(key, false)
+	if err != nil || hash == nil {return 0, err}
+
+	removed := 0
+	for _, field := range fields {
+		if _, found := hash.fields[field]; !found {continue}
+		delete(hash.fields, field)
+		removed++
+	}
+	if removed < 1 {return 0, nil}
+	if len(hash.fields) < 1 {return removed, receiver.removeLocked(key, ReasonDeleted)}
+	return removed, receiver.persistLocked(key, hash)
+}
+
+// HashGetAll returns a copy of every field in the hash at `key`
+func (receiver *IndependentStore) HashGetAll(key StoreKey) (map[string]interface{}, error) {
+	return receiver.HashGetAllContext(context.Background(), key)
+}
+
+// HashGetAllContext is `HashGetAll`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) HashGetAllContext(ctx context.Context, key StoreKey) (map[string]interface{}, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	hash, err := receiver.findHashLocked(key, false)
+	if err != nil || hash == nil {return map[string]interface{}{}, err}
+
+	result := make(map[string]interface{}, len(hash.fields))
+	for field, value := range hash.fields {
+		result[field] = value
+	}
+	return result, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Sorted sets">
+
+// SortedSetAdd adds `member` to the sorted set at `key`, or updates its score if it's already there
+func (receiver *IndependentStore) SortedSetAdd(key StoreKey, member string, score float64) error {
+	return receiver.SortedSetAddContext(context.Background(), key, member, score)
+}
+
+// SortedSetAddContext is `SortedSetAdd`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SortedSetAddContext(ctx context.Context, key StoreKey, member string, score float64) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	sorted, err := receiver.findSortedSetLocked(key, true)
+	if err != nil {return err}
+
+	sorted.scores[member] = score
+	return receiver.persistLocked(key, sorted)
+}
+
+// SortedSetRemove takes members out of the sorted set at `key`, returning how many were removed.
+// The key is removed when the sorted set becomes empty.
+func (receiver *IndependentStore) SortedSetRemove(key StoreKey, members ...string) (int, error) {
+	return receiver.SortedSetRemoveContext(context.Background(), key, members...)
+}
+
+// SortedSetRemoveContext is `SortedSetRemove`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SortedSetRemoveContext(ctx context.Context, key StoreKey, members ...string) (int, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	sorted, err := receiver.findSortedSetLocked(key, false)
+	if err != nil || sorted == nil {return 0, err}
+
+	removed := 0
+	for _, member := range members {
+		if _, found := sorted.scores[member]; !found {continue}
+		delete(sorted.scores, member)
+		removed++
+	}
+	if removed < 1 {return 0, nil}
+	if len(sorted.scores) < 1 {return removed, receiver.removeLocked(key, ReasonDeleted)}
+	return removed, receiver.persistLocked(key, sorted)
+}
+
+// SortedSetScore returns the score of `member` in the sorted set at `key`
+func (receiver *IndependentStore) SortedSetScore(key StoreKey, member string) (float64, error) {
+	return receiver.SortedSetScoreContext(context.Background(), key, member)
+}
+
+// SortedSetScoreContext is `SortedSetScore`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SortedSetScoreContext(ctx context.Context, key StoreKey, member string) (float64, error) {
+	if receiver == nil || !receiver.isOpen {return 0, StoreNotOpenError}
+	if receiver.core == nil {return 0, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return 0, err}
+	defer receiver.unlockAndNotify()
+
+	sorted, err := receiver.findSortedSetLocked(key, false)
+	if err != nil {return 0, err}
+	if sorted == nil {return 0, KeyNotPresentError}
+
+	score, ok := sorted.scores[member]
+	if !ok {return 0, FieldNotPresentError}
+	return score, nil
+}
+
+// SortedSetRangeByScore returns the members with `min <= score <= max`, lowest score first.
+// Members with equal scores are ordered by name.
+func (receiver *IndependentStore) SortedSetRangeByScore(key StoreKey, min, max float64) ([]ScoredMember, error) {
+	return receiver.SortedSetRangeByScoreContext(context.Background(), key, min, max)
+}
+
+// SortedSetRangeByScoreContext is `SortedSetRangeByScore`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SortedSetRangeByScoreContext(ctx context.Context, key StoreKey, min, max float64) ([]ScoredMember, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return nil, err}
+	defer receiver.unlockAndNotify()
+
+	sorted, err := receiver.findSortedSetLocked(key, false)
+	if err != nil || sorted == nil {return []ScoredMember{}, err}
+
+	result := []ScoredMember{}
+	for member, score := range sorted.scores {
+		if score < min || score > max {continue}
+		result = append(result, ScoredMember{Member: member, Score: score})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {return result[i].Score < result[j].Score}
+		return result[i].Member < result[j].Member
+	})
+	return result, nil
+}
+
+//</editor-fold>
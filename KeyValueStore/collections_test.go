@@ -0,0 +1,214 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestListPushPopAndRange(t *testing.T){
+	store := kvs.OpenNew()
+
+	if n, err := store.ListPushRight("list", "b", "c"); err != nil || n != 2 {
+		t.Errorf("Expected length 2, but got %d, %v", n, err)
+	}
+	if n, err := store.ListPushLeft("list", "a", "z"); err != nil || n != 4 {
+		t.Errorf("Expected length 4, but got %d, %v", n, err)
+	}
+
+	// left push is one-at-a-time, like Redis, so 'z' ends up first
+	expected := "[z a b c]"
+	if v, err := store.ListRange("list", 0, -1); err != nil {
+		t.Errorf("Range failed with %v", err)
+	} else if fmt.Sprint(v) != expected {
+		t.Errorf("Expected %s, but got %v", expected, v)
+	}
+
+	if v, err := store.ListRange("list", 1, 2); err != nil || fmt.Sprint(v) != "[a b]" {
+		t.Errorf("Expected [a b], but got %v, %v", v, err)
+	}
+	if v, err := store.ListRange("list", -2, 100); err != nil || fmt.Sprint(v) != "[b c]" {
+		t.Errorf("Expected [b c], but got %v, %v", v, err)
+	}
+
+	if v, err := store.ListPopLeft("list"); err != nil || v != "z" {
+		t.Errorf("Expected 'z', but got %v, %v", v, err)
+	}
+	if v, err := store.ListPopRight("list"); err != nil || v != "c" {
+		t.Errorf("Expected 'c', but got %v, %v", v, err)
+	}
+	_, _ = store.ListPopRight("list")
+	_, _ = store.ListPopRight("list")
+
+	// empty lists are removed
+	if found := store.Contains("list"); found {t.Errorf("Expected empty list to be removed")}
+	if _, err := store.ListPopLeft("list"); err != kvs.KeyNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)
+	}
+}
+
+func TestCollectionsRejectWrongType(t *testing.T){
+	store := kvs.OpenNew()
+
+	if err := store.Put("plain", "value"); err != nil {t.Errorf("Put failed with %v", err)}
+
+	if _, err := store.ListPushRight("plain", 1); err != kvs.WrongTypeError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)
+	}
+	if _, err := store.SetAdd("plain", "x"); err != kvs.WrongTypeError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)
+	}
+	if err := store.HashSet("plain", "f", 1); err != kvs.WrongTypeError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)
+	}
+	if err := store.SortedSetAdd("plain", "m", 1); err != kvs.WrongTypeError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)
+	}
+
+	if v, err := store.Get("plain"); err != nil || v != "value" {
+		t.Errorf("Original value should be untouched, but got %v, %v", v, err)
+	}
+}
+
+func TestSetsAndIntersection(t *testing.T){
+	store := kvs.OpenNew()
+
+	if n, err := store.SetAdd("a", "x", "y", "z", "x"); err != nil || n != 3 {
+		t.Errorf("Expected 3 added, but got %d, %v", n, err)
+	}
+	if n, err := store.SetAdd("b", "y", "z", "w"); err != nil || n != 3 {
+		t.Errorf("Expected 3 added, but got %d, %v", n, err)
+	}
+
+	if v, err := store.SetIntersect("a", "b"); err != nil || fmt.Sprint(v) != "[y z]" {
+		t.Errorf("Expected [y z], but got %v, %v", v, err)
+	}
+	if v, err := store.SetIntersect("a", "b", "missing"); err != nil || len(v) != 0 {
+		t.Errorf("Expected empty intersection, but got %v, %v", v, err)
+	}
+
+	if n, err := store.SetRemove("a", "x", "q"); err != nil || n != 1 {
+		t.Errorf("Expected 1 removed, but got %d, %v", n, err)
+	}
+	if v, err := store.SetMembers("a"); err != nil || fmt.Sprint(v) != "[y z]" {
+		t.Errorf("Expected [y z], but got %v, %v", v, err)
+	}
+	if found, _ := store.SetIsMember("b", "w"); !found {
+		t.Errorf("Expected 'w' to be a member")
+	}
+}
+
+func TestHashFields(t *testing.T){
+	store := kvs.OpenNew()
+
+	if err := store.HashSet("user:1", "name", "Sam"); err != nil {t.Errorf("HashSet failed with %v", err)}
+	if err := store.HashSet("user:1", "age", 31); err != nil {t.Errorf("HashSet failed with %v", err)}
+
+	if v, err := store.HashGet("user:1", "age"); err != nil || v != 31 {
+		t.Errorf("Expected 31, but got %v, %v", v, err)
+	}
+	if _, err := store.HashGet("user:1", "email"); err != kvs.FieldNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.FieldNotPresentError, err)
+	}
+	if _, err := store.HashGet("user:2", "name"); err != kvs.KeyNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)
+	}
+
+	// the copy we get back should be detached from the store
+	all, _ := store.HashGetAll("user:1")
+	all["name"] = "Changed"
+	if v, _ := store.HashGet("user:1", "name"); v != "Sam" {
+		t.Errorf("Expected 'Sam', but got %v", v)
+	}
+
+	if n, err := store.HashDelete("user:1", "name", "age"); err != nil || n != 2 {
+		t.Errorf("Expected 2 removed, but got %d, %v", n, err)
+	}
+	if found := store.Contains("user:1"); found {t.Errorf("Expected empty hash to be removed")}
+}
+
+func TestSortedSetRangeByScore(t *testing.T){
+	store := kvs.OpenNew()
+
+	_ = store.SortedSetAdd("scores", "carol", 30)
+	_ = store.SortedSetAdd("scores", "alice", 10)
+	_ = store.SortedSetAdd("scores", "bob", 20)
+	_ = store.SortedSetAdd("scores", "dave", 20)
+	_ = store.SortedSetAdd("scores", "alice", 25) // update
+
+	expected := "[{bob 20} {dave 20} {alice 25}]"
+	if v, err := store.SortedSetRangeByScore("scores", 15, 25); err != nil {
+		t.Errorf("Range failed with %v", err)
+	} else if fmt.Sprint(v) != expected {
+		t.Errorf("Expected %s, but got %v", expected, v)
+	}
+
+	if score, err := store.SortedSetScore("scores", "carol"); err != nil || score != 30 {
+		t.Errorf("Expected 30, but got %v, %v", score, err)
+	}
+}
+
+func TestParallelListPushes(t *testing.T){
+	store := kvs.OpenNew()
+
+	wait := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 250; j++ {
+				_, _ = store.ListPushRight("shared", j)
+				_, _ = store.SetAdd("shared-set", s(j))
+			}
+		}()
+	}
+	wait.Wait()
+
+	if n, err := store.ListLength("shared"); err != nil || n != 1000 {
+		t.Errorf("Expected 1000 items, but got %d, %v", n, err)
+	}
+	if v, err := store.SetMembers("shared-set"); err != nil || len(v) != 250 {
+		t.Errorf("Expected 250 members, but got %d, %v", len(v), err)
+	}
+}
+
+func TestEmptiedCollectionsAreDeleted(t *testing.T){
+	store := kvs.OpenNew()
+	if err := store.EnableChangeFeed(filepath.Join(t.TempDir(), "changes.kvs")); err != nil {
+		t.Fatalf("EnableChangeFeed failed with %v", err)
+	}
+	deleted := []kvs.StoreKey{}
+	store.OnDelete(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		deleted = append(deleted, key)
+	})
+
+	_, _ = store.ListPushRight("list", "x")
+	_, _ = store.SetAdd("set", "x")
+	_ = store.HashSet("hash", "x", 1)
+	_ = store.SortedSetAdd("sorted", "x", 1)
+	before, _ := store.LastSequence()
+
+	// adding members that are already there changes nothing, so writes nothing
+	if n, err := store.SetAdd("set", "x"); err != nil || n != 0 {t.Errorf("Expected 0 added, but got %d, %v", n, err)}
+	if n, err := store.SetAdd("empty"); err != nil || n != 0 {t.Errorf("Expected 0 added, but got %d, %v", n, err)}
+	if store.Contains("empty") {t.Errorf("Expected adding no members to make no set")}
+	if after, _ := store.LastSequence(); after != before {t.Errorf("Expected no changes, but the feed went from %d to %d", before, after)}
+
+	_, _ = store.ListPopLeft("list")
+	_, _ = store.SetRemove("set", "x")
+	_, _ = store.HashDelete("hash", "x")
+	_, _ = store.SortedSetRemove("sorted", "x")
+
+	if fmt.Sprint(deleted) != "[list set hash sorted]" {t.Errorf("Expected the delete hook for each emptied collection, but got %v", deleted)}
+	changes := []kvs.RecordLine{}
+	_, _ = store.ReadChanges(before+1, func(change kvs.RecordLine) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if len(changes) != 4 {t.Fatalf("Expected a delete in the feed for each collection, but got %+v", changes)}
+	for _, change := range changes {
+		if change.Op != kvs.OpDelete {t.Errorf("Expected a delete, but got %+v", change)}
+	}
+}
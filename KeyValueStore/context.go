@@ -0,0 +1,65 @@
+package keyvaluestore
+
+import (
+	"context"
+	"fmt"
+)
+
+// Context-aware versions of the store operations.
+// Every operation has an `XxxContext` twin that takes a `context.Context` first, and gives up if the
+// context is done before the store is free (or before a long-running query or feed read finishes).
+// The plain methods are the same as calling the twin with `context.Background()`, which never gives up
+// and costs nothing extra.
+//
+// When the context ends first, the error wraps `ctx.Err()`, so check it with
+// `errors.Is(err, context.Canceled)` or `errors.Is(err, context.DeadlineExceeded)`.
+// Everything else returns the usual sentinel errors, which still match with `==` and `errors.Is`.
+// Nothing is changed when an operation gives up while waiting.
+
+// lockContext takes the write lock, unless `ctx` is done first
+func (receiver *IndependentStore) lockContext(ctx context.Context) error {
+	return waitForLock(ctx, receiver.mutex.Lock, receiver.mutex.Unlock)
+}
+
+// rLockContext takes the read lock, unless `ctx` is done first
+func (receiver *IndependentStore) rLockContext(ctx context.Context) error {
+	return waitForLock(ctx, receiver.mutex.RLock, receiver.mutex.RUnlock)
+}
+
+func waitForLock(ctx context.Context, lock, unlock func()) error {
+	if err := ctx.Err(); err != nil {return contextError(err)}
+
+	// a context that can never be cancelled doesn't need the extra goroutine
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		// we can't stop waiting for a mutex, so hand the lock straight back once we get it
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return contextError(ctx.Err())
+	}
+}
+
+// checkContext is for long operations that already hold the lock, to see if they should stop early
+func checkContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {return contextError(err)}
+	return nil
+}
+
+func contextError(err error) error {
+	return fmt.Errorf("key value store operation abandoned: %w", err)
+}
@@ -0,0 +1,62 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowValue holds up whoever is writing it to a file, which happens while the store is locked
+type slowValue struct{ release chan struct{} }
+
+func (value slowValue) MarshalJSON() ([]byte, error) {
+	<-value.release
+	return []byte(`"slow"`), nil
+}
+
+func TestCancelledContextChangesNothing(t *testing.T){
+	store := kvs.OpenNew()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.PutContext(ctx, "a", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected '%v', but got '%v'", context.Canceled, err)
+	}
+	if store.Contains("a") {t.Errorf("Expected cancelled put to do nothing")}
+
+	// sentinel errors are unchanged, and come before the context is looked at
+	_ = store.Close()
+	if _, err := store.GetContext(ctx, "a"); err != kvs.StoreNotOpenError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.StoreNotOpenError, err)
+	}
+}
+
+func TestWaitingForTheLockCanTimeOut(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.EnableChangeFeed(filepath.Join(t.TempDir(), "changes.kvs"))
+
+	slow := slowValue{release: make(chan struct{})}
+	putDone := make(chan error)
+	go func() { putDone <- store.Put("slow", slow) }()
+	time.Sleep(50 * time.Millisecond) // let the slow put take the lock
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := store.ListPushRightContext(ctx, "list", "x"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected '%v', but got '%v'", context.DeadlineExceeded, err)
+	}
+	if waited := time.Since(started); waited > time.Second {t.Errorf("Expected to give up promptly, but waited %v", waited)}
+
+	// the store is still usable once the slow writer is done, and the abandoned push never happened
+	close(slow.release)
+	if err := <-putDone; err != nil {t.Fatalf("Slow put failed with %v", err)}
+	if err := store.PutContext(context.Background(), "after", 1); err != nil || !store.Contains("after") {
+		t.Errorf("Expected store to work after an abandoned wait, but got %v", err)
+	}
+	if length, _ := store.ListLength("list"); length != 0 {t.Errorf("Expected abandoned push to do nothing, but list has %d items", length)}
+}
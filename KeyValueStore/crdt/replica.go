@@ -0,0 +1,280 @@
+package crdt
+
+import (
+	kvs "KeyValueStore"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var InvalidReplicaIdError = errors.New("a replica needs a non-empty ID that no other replica uses")
+
+const defaultMaxDeltas = 10000
+
+// Replica is one site's copy of the replicated values, kept in a KeyValueStore.
+// Use an `OpenFile` store to keep the values over restarts. All changes to the store should go through the replica.
+type Replica struct {
+	id          string
+	incarnation string // changes every time the replica is made, so peers know our sequence numbers have started again
+	store       *kvs.IndependentStore
+
+	mutex    sync.Mutex
+	nextTag  uint64
+	seq      uint64       // number of the last change made here, local or merged in
+	deltas   []deltaEntry // recent changes, oldest first, so peers can be sent just what they missed
+	received map[string]position // how far we've got with each peer's changes
+
+	// MaxDeltas is how many recent changes to keep for peers. A peer further behind than this is sent the full state.
+	MaxDeltas int
+}
+
+type deltaEntry struct {
+	seq    uint64
+	key    kvs.StoreKey
+	delta  Value
+	origin string // the peer we merged this from, which doesn't need it back; empty for local changes
+}
+
+// position is a point in another replica's sequence of changes
+type position struct {
+	Incarnation string `json:"incarnation"`
+	Seq         uint64 `json:"seq"`
+}
+
+// NewReplica makes a replica with a unique ID (say, the site name), over a store that already holds its values
+func NewReplica(id string, store *kvs.IndependentStore) (*Replica, error) {
+	if id == "" {return nil, InvalidReplicaIdError}
+	if store == nil {return nil, kvs.StoreNotOpenError}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {return nil, err}
+
+	return &Replica{
+		id:          id,
+		incarnation: hex.EncodeToString(random),
+		store:       store,
+		received:    map[string]position{},
+		MaxDeltas:   defaultMaxDeltas,
+	}, nil
+}
+
+// ID returns the replica's ID
+func (replica *Replica) ID() string {
+	return replica.id
+}
+
+//<editor-fold desc="Registers">
+
+// SetRegister sets an LWW register to `value` (as JSON)
+func (replica *Replica) SetRegister(key kvs.StoreKey, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {return err}
+
+	return replica.update(key, KindLWWRegister, func(current Value) Value {
+		register := current.(*LWWRegister)
+		register.Set(raw, time.Now(), replica.id)
+		return register.Clone()
+	})
+}
+
+// Register reads an LWW register into `target`, as `json.Unmarshal` would
+func (replica *Replica) Register(key kvs.StoreKey, target interface{}) error {
+	value, err := replica.read(key, KindLWWRegister)
+	if err != nil {return err}
+	return json.Unmarshal(value.(*LWWRegister).Value, target)
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Counters">
+
+// IncrementGCounter adds to a grow-only counter
+func (replica *Replica) IncrementGCounter(key kvs.StoreKey, amount uint64) error {
+	return replica.update(key, KindGCounter, func(current Value) Value {
+		return current.(*GCounter).Increment(replica.id, amount)
+	})
+}
+
+// AddToPNCounter adds to a counter that can go up and down. Use a negative amount to take away.
+func (replica *Replica) AddToPNCounter(key kvs.StoreKey, amount int64) error {
+	return replica.update(key, KindPNCounter, func(current Value) Value {
+		return current.(*PNCounter).Add(replica.id, amount)
+	})
+}
+
+// Counter reads either kind of counter
+func (replica *Replica) Counter(key kvs.StoreKey) (int64, error) {
+	value, err := replica.Value(key)
+	if err != nil {return 0, err}
+
+	switch counter := value.(type) {
+	case *GCounter:
+		return int64(counter.Total()), nil
+	case *PNCounter:
+		return counter.Total(), nil
+	default:
+		return 0, kvs.WrongTypeError
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Sets">
+
+// ORSetAdd adds members to an OR-set
+func (replica *Replica) ORSetAdd(key kvs.StoreKey, members ...string) error {
+	return replica.update(key, KindORSet, func(current Value) Value {
+		set, delta := current.(*ORSet), &ORSet{}
+		for _, member := range members {
+			_ = delta.Merge(set.Add(member, replica.newTagLocked()))
+		}
+		return delta
+	})
+}
+
+// ORSetRemove removes members from an OR-set. Adds on other replicas that this one hasn't seen yet are not removed.
+func (replica *Replica) ORSetRemove(key kvs.StoreKey, members ...string) error {
+	return replica.update(key, KindORSet, func(current Value) Value {
+		set, delta := current.(*ORSet), &ORSet{}
+		for _, member := range members {
+			_ = delta.Merge(set.Remove(member))
+		}
+		return delta
+	})
+}
+
+// ORSetMembers returns the members of an OR-set, sorted
+func (replica *Replica) ORSetMembers(key kvs.StoreKey) ([]string, error) {
+	value, err := replica.read(key, KindORSet)
+	if err != nil {return nil, err}
+	return value.(*ORSet).Members(), nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Maps">
+
+// MapSet sets a field of an OR-map to `value` (as JSON)
+func (replica *Replica) MapSet(key kvs.StoreKey, field string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {return err}
+
+	return replica.update(key, KindORMap, func(current Value) Value {
+		return current.(*ORMap).Set(field, raw, time.Now(), replica.id, replica.newTagLocked())
+	})
+}
+
+// MapDelete removes a field from an OR-map
+func (replica *Replica) MapDelete(key kvs.StoreKey, field string) error {
+	return replica.update(key, KindORMap, func(current Value) Value {
+		return current.(*ORMap).Delete(field)
+	})
+}
+
+// MapGet reads a field of an OR-map into `target`, as `json.Unmarshal` would
+func (replica *Replica) MapGet(key kvs.StoreKey, field string, target interface{}) error {
+	value, err := replica.read(key, KindORMap)
+	if err != nil {return err}
+
+	raw, ok := value.(*ORMap).Get(field)
+	if !ok {return kvs.FieldNotPresentError}
+	return json.Unmarshal(raw, target)
+}
+
+// MapFields returns the names of the fields in an OR-map, sorted
+func (replica *Replica) MapFields(key kvs.StoreKey) ([]string, error) {
+	value, err := replica.read(key, KindORMap)
+	if err != nil {return nil, err}
+	return value.(*ORMap).FieldNames(), nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Any value">
+
+// Value returns a copy of the value at `key`, whatever kind it is
+func (replica *Replica) Value(key kvs.StoreKey) (Value, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	value, err := replica.loadLocked(key)
+	if err != nil {return nil, err}
+	if value == nil {return nil, kvs.KeyNotPresentError}
+	return value, nil
+}
+
+// Merge folds a value (or a delta) from elsewhere into the value at `key`
+func (replica *Replica) Merge(key kvs.StoreKey, incoming Value) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	return replica.mergeLocked(key, incoming, "")
+}
+
+func (replica *Replica) read(key kvs.StoreKey, kind string) (Value, error) {
+	value, err := replica.Value(key)
+	if err != nil {return nil, err}
+	if value.Kind() != kind {return nil, kvs.WrongTypeError}
+	return value, nil
+}
+
+// update changes the value at `key` (making an empty one of `kind` if needed), and records the delta that `change` returns
+func (replica *Replica) update(key kvs.StoreKey, kind string, change func(current Value) (delta Value)) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	current, err := replica.loadLocked(key)
+	if err != nil {return err}
+	if current == nil {current, _ = newValue(kind)}
+	if current.Kind() != kind {return kvs.WrongTypeError}
+
+	delta := change(current)
+	return replica.saveLocked(key, current, delta, "")
+}
+
+func (replica *Replica) mergeLocked(key kvs.StoreKey, incoming Value, origin string) error {
+	current, err := replica.loadLocked(key)
+	if err != nil {return err}
+	if current == nil {
+		current = incoming.Clone()
+	} else if err = current.Merge(incoming); err != nil {
+		return err
+	}
+	return replica.saveLocked(key, current, incoming.Clone(), origin)
+}
+
+// loadLocked gets a copy of the value at `key` that's safe to change, or nil if there isn't one.
+// Caller must hold the replica lock.
+func (replica *Replica) loadLocked(key kvs.StoreKey) (Value, error) {
+	stored, err := replica.store.Get(key)
+	if errors.Is(err, kvs.KeyNotPresentError) {return nil, nil}
+	if err != nil {return nil, err}
+
+	value, ok := stored.(Value)
+	if !ok {return nil, kvs.WrongTypeError}
+	return value.Clone(), nil // others may be reading the stored one, so never change it in place
+}
+
+// saveLocked stores the new value, and remembers the delta for peers. Caller must hold the replica lock.
+func (replica *Replica) saveLocked(key kvs.StoreKey, value, delta Value, origin string) error {
+	if err := replica.store.Put(key, value); err != nil {return err}
+
+	replica.seq++
+	replica.deltas = append(replica.deltas, deltaEntry{seq: replica.seq, key: key, delta: delta, origin: origin})
+	if max := replica.MaxDeltas; max > 0 && len(replica.deltas) > max {
+		replica.deltas = append([]deltaEntry(nil), replica.deltas[len(replica.deltas)-max:]...)
+	}
+	return nil
+}
+
+// newTagLocked makes a tag no other add (on any replica, before or after a restart) will have
+func (replica *Replica) newTagLocked() string {
+	replica.nextTag++
+	return replica.id + "/" + replica.incarnation + "/" + strconv.FormatUint(replica.nextTag, 10)
+}
+
+//</editor-fold>
@@ -0,0 +1,86 @@
+package crdt_test
+
+import (
+	kvs "KeyValueStore"
+	"KeyValueStore/crdt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newReplica(t *testing.T, id string) *crdt.Replica {
+	t.Helper()
+	replica, err := crdt.NewReplica(id, kvs.OpenNew())
+	if err != nil {t.Fatalf("NewReplica failed with %v", err)}
+	return replica
+}
+
+func TestReplicaUpdatesAndReads(t *testing.T){
+	replica := newReplica(t, "a")
+
+	_ = replica.SetRegister("greeting", "hello")
+	greeting := ""
+	if err := replica.Register("greeting", &greeting); err != nil || greeting != "hello" {
+		t.Errorf("Expected 'hello', but got '%v' (%v)", greeting, err)
+	}
+
+	_ = replica.IncrementGCounter("visits", 2)
+	_ = replica.IncrementGCounter("visits", 3)
+	if total, _ := replica.Counter("visits"); total != 5 {t.Errorf("Expected 5, but got %d", total)}
+
+	_ = replica.AddToPNCounter("stock", 10)
+	_ = replica.AddToPNCounter("stock", -4)
+	if total, _ := replica.Counter("stock"); total != 6 {t.Errorf("Expected 6, but got %d", total)}
+
+	_ = replica.ORSetAdd("tags", "red", "green", "blue")
+	_ = replica.ORSetRemove("tags", "green")
+	if members, _ := replica.ORSetMembers("tags"); !reflect.DeepEqual(members, []string{"blue", "red"}) {
+		t.Errorf("Expected [blue red], but got %v", members)
+	}
+
+	_ = replica.MapSet("user", "name", "Sam")
+	_ = replica.MapSet("user", "age", 22)
+	_ = replica.MapDelete("user", "age")
+	name, age := "", 0
+	if err := replica.MapGet("user", "name", &name); err != nil || name != "Sam" {t.Errorf("Expected 'Sam', but got '%v' (%v)", name, err)}
+	if err := replica.MapGet("user", "age", &age); err != kvs.FieldNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.FieldNotPresentError, err)
+	}
+}
+
+func TestReplicaRejectsWrongKinds(t *testing.T){
+	replica := newReplica(t, "a")
+	_ = replica.ORSetAdd("tags", "red")
+
+	if err := replica.IncrementGCounter("tags", 1); err != kvs.WrongTypeError {t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)}
+	if _, err := replica.Counter("tags"); err != kvs.WrongTypeError {t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)}
+	if _, err := replica.Counter("missing"); err != kvs.KeyNotPresentError {t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)}
+	if _, err := crdt.NewReplica("", kvs.OpenNew()); err != crdt.InvalidReplicaIdError {
+		t.Errorf("Expected '%v', but got '%v'", crdt.InvalidReplicaIdError, err)
+	}
+}
+
+func TestReplicaValuesSurviveReopen(t *testing.T){
+	path := filepath.Join(t.TempDir(), "replica.kvs")
+	store, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+
+	replica, _ := crdt.NewReplica("a", store)
+	_ = replica.AddToPNCounter("stock", 7)
+	_ = replica.ORSetAdd("tags", "red")
+	_ = replica.MapSet("user", "name", "Sam")
+	if err = store.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = reopened.Close() }()
+	replica, _ = crdt.NewReplica("a", reopened)
+
+	if total, err := replica.Counter("stock"); err != nil || total != 7 {t.Errorf("Expected 7, but got %d (%v)", total, err)}
+	if members, _ := replica.ORSetMembers("tags"); !reflect.DeepEqual(members, []string{"red"}) {t.Errorf("Expected [red], but got %v", members)}
+
+	// new adds after a restart get new tags, so they can't be mistaken for removed ones
+	_ = replica.ORSetRemove("tags", "red")
+	_ = replica.ORSetAdd("tags", "red")
+	if members, _ := replica.ORSetMembers("tags"); !reflect.DeepEqual(members, []string{"red"}) {t.Errorf("Expected [red], but got %v", members)}
+}
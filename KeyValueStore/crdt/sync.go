@@ -0,0 +1,206 @@
+package crdt
+
+import (
+	kvs "KeyValueStore"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Replicas sync over TCP, one connection per sync, both ways at once. The conversation is JSON lines:
+//
+//     each side:  {"replica":..., "incarnation":..., "have":{replica ID: position}}
+//     each side:  {"key":..., "kind":..., "state":...}   zero or more
+//     each side:  {"done":true, "full":..., "upTo":...}
+//     each side:  {"ack":true}   once it has merged everything the other sent
+//
+// Each side tells the other how far it has got with the other's changes. If that's within the recent
+// changes we've kept, we send just the deltas since then; otherwise (first contact, a restart on either
+// side, or a long time offline) we send every value in full. Merged-in changes are passed on too,
+// so a change reaches every replica as long as the replicas are connected by some chain of syncs.
+
+// SyncStats describes one sync, from this replica's side
+type SyncStats struct {
+	Sent              int  // values or deltas sent
+	Received          int  // values or deltas received
+	SentFullState     bool // we sent every value, rather than just the changes
+	ReceivedFullState bool
+}
+
+// DefaultSyncTimeout limits a sync when the context has no deadline of its own
+const DefaultSyncTimeout = time.Minute
+
+type helloMessage struct {
+	Replica     string              `json:"replica"`
+	Incarnation string              `json:"incarnation"`
+	Have        map[string]position `json:"have"`
+}
+
+type changeMessage struct {
+	Key   kvs.StoreKey    `json:"key,omitempty"`
+	Kind  string          `json:"kind,omitempty"`
+	State json.RawMessage `json:"state,omitempty"`
+	Done  bool            `json:"done,omitempty"`
+	Full  bool            `json:"full,omitempty"`
+	UpTo  uint64          `json:"upTo,omitempty"`
+	Ack   bool            `json:"ack,omitempty"`
+}
+
+// SyncWith connects to a replica that is serving at `address`, and swaps changes with it
+func (replica *Replica) SyncWith(ctx context.Context, address string) (SyncStats, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {return SyncStats{}, err}
+	defer func(conn net.Conn) { _ = conn.Close() }(conn)
+
+	return replica.exchange(ctx, conn)
+}
+
+// Serve syncs with every replica that connects, until the listener is closed
+func (replica *Replica) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {return nil}
+		if err != nil {return err}
+
+		go func(conn net.Conn) {
+			defer func(conn net.Conn) { _ = conn.Close() }(conn)
+			_, _ = replica.exchange(context.Background(), conn) // the other side sees any failure too, and can retry
+		}(conn)
+	}
+}
+
+func (replica *Replica) exchange(ctx context.Context, conn net.Conn) (SyncStats, error) {
+	stats := SyncStats{}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {deadline = time.Now().Add(DefaultSyncTimeout)}
+	if err := conn.SetDeadline(deadline); err != nil {return stats, err}
+
+	// unblock reads and writes if the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+
+	replica.mutex.Lock()
+	hello := helloMessage{Replica: replica.id, Incarnation: replica.incarnation, Have: map[string]position{}}
+	for peer, at := range replica.received {
+		hello.Have[peer] = at
+	}
+	replica.mutex.Unlock()
+
+	if err := encoder.Encode(hello); err != nil {return stats, err}
+	theirs := helloMessage{}
+	if err := decoder.Decode(&theirs); err != nil {return stats, err}
+	if theirs.Replica == "" || theirs.Replica == replica.id {return stats, InvalidReplicaIdError}
+
+	changes, full, upTo, err := replica.changesFor(theirs.Replica, theirs.Have[replica.id])
+	if err != nil {return stats, err}
+	stats.Sent, stats.SentFullState = len(changes), full
+
+	// send and receive at the same time, so neither side can fill its buffers and stall
+	sent := make(chan error, 1)
+	go func() {
+		for _, change := range changes {
+			if err := encoder.Encode(change); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- encoder.Encode(changeMessage{Done: true, Full: full, UpTo: upTo})
+	}()
+
+	var mergeErr error
+	for {
+		message := changeMessage{}
+		if err := decoder.Decode(&message); err != nil {
+			<-sent
+			return stats, err
+		}
+		if message.Done {
+			stats.ReceivedFullState = message.Full
+			if mergeErr == nil {
+				replica.mutex.Lock()
+				replica.received[theirs.Replica] = position{Incarnation: theirs.Incarnation, Seq: message.UpTo}
+				replica.mutex.Unlock()
+			}
+			break
+		}
+
+		stats.Received++
+		value, err := decodeValue(message.Kind, message.State)
+		if err == nil {err = replica.mergeFrom(theirs.Replica, message.Key, value)}
+		if err != nil && mergeErr == nil {
+			// carry on with the rest, but don't move our position on, so this key is sent again next time
+			mergeErr = fmt.Errorf("could not merge key '%s' from replica '%s': %w", message.Key, theirs.Replica, err)
+		}
+	}
+
+	if err := <-sent; err != nil {return stats, err}
+
+	// don't finish until the other side has merged what we sent, so callers can rely on it being there
+	if err := encoder.Encode(changeMessage{Ack: true}); err != nil {return stats, err}
+	ack := changeMessage{}
+	if err := decoder.Decode(&ack); err != nil {return stats, err}
+	if !ack.Ack {return stats, fmt.Errorf("replica '%s' did not acknowledge the sync", theirs.Replica)}
+	return stats, mergeErr
+}
+
+func (replica *Replica) mergeFrom(peer string, key kvs.StoreKey, incoming Value) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	return replica.mergeLocked(key, incoming, peer)
+}
+
+// changesFor works out what to send a peer that has our changes up to `have`
+func (replica *Replica) changesFor(peer string, have position) ([]changeMessage, bool, uint64, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	upTo := replica.seq
+	canSendDeltas := have.Incarnation == replica.incarnation && have.Seq <= replica.seq &&
+		(have.Seq == replica.seq || (len(replica.deltas) > 0 && have.Seq+1 >= replica.deltas[0].seq))
+
+	var changes []changeMessage
+	if canSendDeltas {
+		for _, entry := range replica.deltas {
+			if entry.seq <= have.Seq || entry.origin == peer {continue}
+			change, err := changeFor(entry.key, entry.delta)
+			if err != nil {return nil, false, 0, err}
+			changes = append(changes, change)
+		}
+		return changes, false, upTo, nil
+	}
+
+	for _, key := range replica.store.Keys() {
+		value, err := replica.loadLocked(key)
+		if errors.Is(err, kvs.WrongTypeError) {continue} // not one of ours
+		if err != nil {return nil, false, 0, err}
+		if value == nil {continue} // expired or deleted since listing
+
+		change, err := changeFor(key, value)
+		if err != nil {return nil, false, 0, err}
+		changes = append(changes, change)
+	}
+	return changes, true, upTo, nil
+}
+
+func changeFor(key kvs.StoreKey, value Value) (changeMessage, error) {
+	state, err := json.Marshal(value)
+	if err != nil {return changeMessage{}, err}
+	return changeMessage{Key: key, Kind: value.Kind(), State: state}, nil
+}
@@ -0,0 +1,87 @@
+package crdt_test
+
+import (
+	"KeyValueStore/crdt"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serve starts a replica listening on a free local port, and returns its address
+func serve(t *testing.T, replica *crdt.Replica) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {t.Fatalf("Listen failed with %v", err)}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() { _ = replica.Serve(listener) }()
+	return listener.Addr().String()
+}
+
+func syncWith(t *testing.T, replica *crdt.Replica, address string) crdt.SyncStats {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := replica.SyncWith(ctx, address)
+	if err != nil {t.Fatalf("SyncWith failed with %v", err)}
+	return stats
+}
+
+func TestReplicasConvergeAfterWritingOffline(t *testing.T){
+	a, b, c := newReplica(t, "a"), newReplica(t, "b"), newReplica(t, "c")
+	addressB := serve(t, b)
+
+	// each site takes writes while it can't reach the others
+	_ = a.AddToPNCounter("stock", 10)
+	_ = a.ORSetAdd("tags", "red", "green")
+	_ = a.MapSet("user", "name", "Sam")
+	_ = b.AddToPNCounter("stock", -3)
+	_ = b.ORSetAdd("tags", "blue")
+	_ = c.AddToPNCounter("stock", 5)
+	_ = c.MapSet("user", "city", "Leeds")
+
+	// a and c never talk directly; b passes changes along
+	syncWith(t, a, addressB)
+	syncWith(t, c, addressB)
+	syncWith(t, a, addressB)
+
+	for _, replica := range []*crdt.Replica{a, b, c} {
+		if total, _ := replica.Counter("stock"); total != 12 {t.Errorf("Replica '%s': expected 12, but got %d", replica.ID(), total)}
+		if members, _ := replica.ORSetMembers("tags"); !reflect.DeepEqual(members, []string{"blue", "green", "red"}) {
+			t.Errorf("Replica '%s': expected [blue green red], but got %v", replica.ID(), members)
+		}
+		if fields, _ := replica.MapFields("user"); !reflect.DeepEqual(fields, []string{"city", "name"}) {
+			t.Errorf("Replica '%s': expected [city name], but got %v", replica.ID(), fields)
+		}
+	}
+}
+
+func TestLaterSyncsSendOnlyDeltas(t *testing.T){
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	addressB := serve(t, b)
+
+	for i := 0; i < 10; i++ {
+		_ = a.IncrementGCounter("visits", 1)
+	}
+	if stats := syncWith(t, a, addressB); !stats.SentFullState || stats.Sent != 1 {
+		t.Errorf("Expected first sync to send full state of one value, but got %+v", stats)
+	}
+
+	_ = a.IncrementGCounter("visits", 1)
+	stats := syncWith(t, a, addressB)
+	if stats.SentFullState || stats.Sent != 1 {t.Errorf("Expected one delta, but got %+v", stats)}
+	if stats.ReceivedFullState || stats.Received != 0 {t.Errorf("Expected our own change not to be sent back, but got %+v", stats)}
+	if total, _ := b.Counter("visits"); total != 11 {t.Errorf("Expected 11, but got %d", total)}
+
+	// once a peer falls further behind than we keep deltas for, it gets everything again
+	a.MaxDeltas = 2
+	_ = a.IncrementGCounter("visits", 1)
+	_ = a.ORSetAdd("tags", "x")
+	_ = a.ORSetAdd("tags", "y")
+	if stats := syncWith(t, a, addressB); !stats.SentFullState || stats.Sent != 2 {
+		t.Errorf("Expected full state of two values, but got %+v", stats)
+	}
+}
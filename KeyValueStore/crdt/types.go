@@ -0,0 +1,353 @@
+// Package crdt gives KeyValueStore a multi-master mode, for sites that must keep taking writes while cut off from each other.
+//
+// Each site runs a `Replica` over its own store. Values are conflict-free replicated data types:
+// any two copies can be merged, in any order and any number of times, and every replica that has
+// seen the same changes ends up with the same value. Replicas swap changes over TCP whenever they can
+// reach each other (see sync.go), so it doesn't matter how long a site was offline.
+//
+// The types are:
+//
+//     LWWRegister  a single value; the latest write wins
+//     GCounter     a counter that only goes up
+//     PNCounter    a counter that goes up and down
+//     ORSet        a set of strings; if an add and a remove of the same member race, the add wins
+//     ORMap        a map of LWW registers, whose fields are added and removed like an ORSet
+package crdt
+
+import (
+	kvs "KeyValueStore"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	KindLWWRegister = "lww"
+	KindGCounter    = "gcounter"
+	KindPNCounter   = "pncounter"
+	KindORSet       = "orset"
+	KindORMap       = "ormap"
+)
+
+// Value is a replicated value. `Merge` must be commutative, associative and idempotent.
+type Value interface {
+	Kind() string
+	Merge(other Value) error // fails with WrongTypeError if `other` is a different kind
+	Clone() Value
+}
+
+func init() {
+	// so values come back as the right types when the store is read from a file
+	kvs.RegisterType(&LWWRegister{})
+	kvs.RegisterType(&GCounter{})
+	kvs.RegisterType(&PNCounter{})
+	kvs.RegisterType(&ORSet{})
+	kvs.RegisterType(&ORMap{})
+}
+
+// newValue makes an empty value of a kind
+func newValue(kind string) (Value, error) {
+	switch kind {
+	case KindLWWRegister:
+		return &LWWRegister{}, nil
+	case KindGCounter:
+		return &GCounter{}, nil
+	case KindPNCounter:
+		return &PNCounter{}, nil
+	case KindORSet:
+		return &ORSet{}, nil
+	case KindORMap:
+		return &ORMap{}, nil
+	default:
+		return nil, fmt.Errorf("unknown crdt kind '%s'", kind)
+	}
+}
+
+// decodeValue reads a value sent by another replica
+func decodeValue(kind string, state json.RawMessage) (Value, error) {
+	value, err := newValue(kind)
+	if err != nil {return nil, err}
+	if err = json.Unmarshal(state, value); err != nil {return nil, err}
+	return value, nil
+}
+
+//<editor-fold desc="LWW register">
+
+// LWWRegister holds a single JSON value. Merging keeps the one written latest, with ties going to the higher replica ID.
+// Timestamps are wall-clock, like the store's own timestamps, but a replica never writes a timestamp
+// earlier than the one it already has, so a slow clock can't lose its own writes.
+type LWWRegister struct {
+	Value     json.RawMessage `json:"value"`
+	Timestamp time.Time       `json:"ts"`
+	Replica   string          `json:"replica"`
+}
+
+func (register *LWWRegister) Kind() string { return KindLWWRegister }
+
+// Set changes the value, with a timestamp later than any the register has seen
+func (register *LWWRegister) Set(value json.RawMessage, now time.Time, replica string) {
+	now = now.Round(0) // drop the monotonic reading; it doesn't survive being sent anywhere
+	if !now.After(register.Timestamp) {now = register.Timestamp.Add(time.Nanosecond)}
+
+	register.Value = value
+	register.Timestamp = now
+	register.Replica = replica
+}
+
+func (register *LWWRegister) Merge(other Value) error {
+	theirs, ok := other.(*LWWRegister)
+	if !ok {return kvs.WrongTypeError}
+	if theirs.winsOver(register) {*register = *theirs.Clone().(*LWWRegister)}
+	return nil
+}
+
+func (register *LWWRegister) winsOver(other *LWWRegister) bool {
+	if !register.Timestamp.Equal(other.Timestamp) {return register.Timestamp.After(other.Timestamp)}
+	if register.Replica != other.Replica {return register.Replica > other.Replica}
+	return bytes.Compare(register.Value, other.Value) > 0 // same replica and time shouldn't happen, but stay deterministic
+}
+
+func (register *LWWRegister) Clone() Value {
+	clone := *register
+	clone.Value = append(json.RawMessage(nil), register.Value...)
+	return &clone
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Counters">
+
+// GCounter is a grow-only counter. Each replica only ever adds to its own count, and merging takes the highest of each.
+type GCounter struct {
+	Counts map[string]uint64 `json:"counts"`
+}
+
+func (counter *GCounter) Kind() string { return KindGCounter }
+
+// Increment adds to this replica's count, and returns the change as a delta
+func (counter *GCounter) Increment(replica string, amount uint64) *GCounter {
+	if counter.Counts == nil {counter.Counts = map[string]uint64{}}
+	counter.Counts[replica] += amount
+	return &GCounter{Counts: map[string]uint64{replica: counter.Counts[replica]}}
+}
+
+// Total is the value of the counter
+func (counter *GCounter) Total() uint64 {
+	total := uint64(0)
+	for _, count := range counter.Counts {
+		total += count
+	}
+	return total
+}
+
+func (counter *GCounter) Merge(other Value) error {
+	theirs, ok := other.(*GCounter)
+	if !ok {return kvs.WrongTypeError}
+	counter.mergeCounts(theirs)
+	return nil
+}
+
+func (counter *GCounter) mergeCounts(theirs *GCounter) {
+	if counter.Counts == nil {counter.Counts = map[string]uint64{}}
+	for replica, count := range theirs.Counts {
+		if count > counter.Counts[replica] {counter.Counts[replica] = count}
+	}
+}
+
+func (counter *GCounter) Clone() Value {
+	clone := &GCounter{Counts: make(map[string]uint64, len(counter.Counts))}
+	for replica, count := range counter.Counts {
+		clone.Counts[replica] = count
+	}
+	return clone
+}
+
+// PNCounter is a counter that can go down as well as up: one grow-only counter for increments, and one for decrements
+type PNCounter struct {
+	Increments GCounter `json:"inc"`
+	Decrements GCounter `json:"dec"`
+}
+
+func (counter *PNCounter) Kind() string { return KindPNCounter }
+
+// Add changes the counter by `amount`, which can be negative, and returns the change as a delta
+func (counter *PNCounter) Add(replica string, amount int64) *PNCounter {
+	delta := &PNCounter{}
+	if amount >= 0 {
+		delta.Increments = *counter.Increments.Increment(replica, uint64(amount))
+	} else {
+		delta.Decrements = *counter.Decrements.Increment(replica, uint64(-amount))
+	}
+	return delta
+}
+
+// Total is the value of the counter
+func (counter *PNCounter) Total() int64 {
+	return int64(counter.Increments.Total()) - int64(counter.Decrements.Total())
+}
+
+func (counter *PNCounter) Merge(other Value) error {
+	theirs, ok := other.(*PNCounter)
+	if !ok {return kvs.WrongTypeError}
+	counter.Increments.mergeCounts(&theirs.Increments)
+	counter.Decrements.mergeCounts(&theirs.Decrements)
+	return nil
+}
+
+func (counter *PNCounter) Clone() Value {
+	return &PNCounter{
+		Increments: *counter.Increments.Clone().(*GCounter),
+		Decrements: *counter.Decrements.Clone().(*GCounter),
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="OR-set">
+
+// ORSet is an observed-remove set. Every add gets a unique tag, and a remove only removes the tags it has seen,
+// so an add that happened concurrently with a remove (on another replica) survives the merge.
+// Removed tags are kept as tombstones.
+type ORSet struct {
+	Tags    map[string]map[string]bool `json:"tags"`    // member => tags from adds
+	Removed map[string]bool            `json:"removed"` // tags that have been removed
+}
+
+func (set *ORSet) Kind() string { return KindORSet }
+
+// Add adds a member under a new unique tag, and returns the change as a delta
+func (set *ORSet) Add(member, tag string) *ORSet {
+	set.ensure()
+	if set.Tags[member] == nil {set.Tags[member] = map[string]bool{}}
+	set.Tags[member][tag] = true
+	return &ORSet{Tags: map[string]map[string]bool{member: {tag: true}}, Removed: map[string]bool{}}
+}
+
+// Remove removes every tag this replica has seen for a member, and returns the change as a delta
+func (set *ORSet) Remove(member string) *ORSet {
+	set.ensure()
+	delta := &ORSet{Tags: map[string]map[string]bool{}, Removed: map[string]bool{}}
+	for tag := range set.Tags[member] {
+		set.Removed[tag] = true
+		delta.Removed[tag] = true
+	}
+	return delta
+}
+
+// Contains is true if the member has a tag that hasn't been removed
+func (set *ORSet) Contains(member string) bool {
+	for tag := range set.Tags[member] {
+		if !set.Removed[tag] {return true}
+	}
+	return false
+}
+
+// Members returns every member in the set, sorted
+func (set *ORSet) Members() []string {
+	members := []string{}
+	for member := range set.Tags {
+		if set.Contains(member) {members = append(members, member)}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (set *ORSet) Merge(other Value) error {
+	theirs, ok := other.(*ORSet)
+	if !ok {return kvs.WrongTypeError}
+
+	set.ensure()
+	for member, tags := range theirs.Tags {
+		if set.Tags[member] == nil {set.Tags[member] = map[string]bool{}}
+		for tag := range tags {
+			set.Tags[member][tag] = true
+		}
+	}
+	for tag := range theirs.Removed {
+		set.Removed[tag] = true
+	}
+	return nil
+}
+
+func (set *ORSet) Clone() Value {
+	clone := &ORSet{}
+	_ = clone.Merge(set)
+	return clone
+}
+
+func (set *ORSet) ensure() {
+	if set.Tags == nil {set.Tags = map[string]map[string]bool{}}
+	if set.Removed == nil {set.Removed = map[string]bool{}}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="OR-map">
+
+// ORMap is a map of LWW registers. Which fields exist is tracked like an ORSet, so setting a field
+// at the same time as another replica deletes it leaves the field in place.
+type ORMap struct {
+	Keys   ORSet                   `json:"keys"`
+	Fields map[string]*LWWRegister `json:"fields"`
+}
+
+func (orMap *ORMap) Kind() string { return KindORMap }
+
+// Set sets a field, and returns the change as a delta
+func (orMap *ORMap) Set(field string, value json.RawMessage, now time.Time, replica, tag string) *ORMap {
+	if orMap.Fields == nil {orMap.Fields = map[string]*LWWRegister{}}
+	register := orMap.Fields[field]
+	if register == nil {
+		register = &LWWRegister{}
+		orMap.Fields[field] = register
+	}
+	register.Set(value, now, replica)
+
+	return &ORMap{
+		Keys:   *orMap.Keys.Add(field, tag),
+		Fields: map[string]*LWWRegister{field: register.Clone().(*LWWRegister)},
+	}
+}
+
+// Delete removes a field, and returns the change as a delta. The register is kept, so that a later merge
+// of an older write can't bring back an older value.
+func (orMap *ORMap) Delete(field string) *ORMap {
+	return &ORMap{Keys: *orMap.Keys.Remove(field), Fields: map[string]*LWWRegister{}}
+}
+
+// Get returns the JSON value of a field, if it's present
+func (orMap *ORMap) Get(field string) (json.RawMessage, bool) {
+	if !orMap.Keys.Contains(field) || orMap.Fields[field] == nil {return nil, false}
+	return orMap.Fields[field].Value, true
+}
+
+// FieldNames returns every field present, sorted
+func (orMap *ORMap) FieldNames() []string {
+	return orMap.Keys.Members()
+}
+
+func (orMap *ORMap) Merge(other Value) error {
+	theirs, ok := other.(*ORMap)
+	if !ok {return kvs.WrongTypeError}
+
+	_ = orMap.Keys.Merge(&theirs.Keys)
+	if orMap.Fields == nil {orMap.Fields = map[string]*LWWRegister{}}
+	for field, register := range theirs.Fields {
+		if mine := orMap.Fields[field]; mine != nil {
+			_ = mine.Merge(register)
+		} else {
+			orMap.Fields[field] = register.Clone().(*LWWRegister)
+		}
+	}
+	return nil
+}
+
+func (orMap *ORMap) Clone() Value {
+	clone := &ORMap{}
+	_ = clone.Merge(orMap)
+	return clone
+}
+
+//</editor-fold>
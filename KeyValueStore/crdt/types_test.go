@@ -0,0 +1,104 @@
+package crdt_test
+
+import (
+	kvs "KeyValueStore"
+	"KeyValueStore/crdt"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mergeBothWays merges copies of two values in each order, and checks they come out the same
+func mergeBothWays(t *testing.T, a, b crdt.Value) crdt.Value {
+	t.Helper()
+	ab, ba := a.Clone(), b.Clone()
+	if err := ab.Merge(b); err != nil {t.Fatalf("Merge failed with %v", err)}
+	if err := ba.Merge(a); err != nil {t.Fatalf("Merge failed with %v", err)}
+	if !reflect.DeepEqual(ab, ba) {t.Fatalf("Merge is not commutative:\r\n%#v\r\n%#v", ab, ba)}
+
+	again := ab.Clone()
+	if err := again.Merge(b); err != nil || !reflect.DeepEqual(again, ab) {t.Fatalf("Merge is not idempotent")}
+	return ab
+}
+
+func TestLatestRegisterWriteWins(t *testing.T){
+	now := time.Now()
+	early, late := &crdt.LWWRegister{}, &crdt.LWWRegister{}
+	early.Set(json.RawMessage(`"early"`), now, "a")
+	late.Set(json.RawMessage(`"late"`), now.Add(time.Second), "b")
+
+	merged := mergeBothWays(t, early, late).(*crdt.LWWRegister)
+	if string(merged.Value) != `"late"` {t.Errorf("Expected the later write to win, but got %s", merged.Value)}
+
+	// a register never goes back in time, even if the clock does
+	late.Set(json.RawMessage(`"again"`), now, "b")
+	if !late.Timestamp.After(now.Add(time.Second)) {t.Errorf("Expected timestamp to move forward, but got %v", late.Timestamp)}
+
+	// equal times are settled by replica ID, the same way everywhere
+	tieA, tieB := &crdt.LWWRegister{}, &crdt.LWWRegister{}
+	tieA.Set(json.RawMessage(`1`), now, "a")
+	tieB.Set(json.RawMessage(`2`), now, "b")
+	if merged := mergeBothWays(t, tieA, tieB).(*crdt.LWWRegister); string(merged.Value) != "2" {
+		t.Errorf("Expected replica 'b' to win the tie, but got %s", merged.Value)
+	}
+}
+
+func TestCountersAddUpAcrossReplicas(t *testing.T){
+	a, b := &crdt.PNCounter{}, &crdt.PNCounter{}
+	a.Add("a", 10)
+	a.Add("a", -3)
+	b.Add("b", 5)
+
+	if total := mergeBothWays(t, a, b).(*crdt.PNCounter).Total(); total != 12 {
+		t.Errorf("Expected 12, but got %d", total)
+	}
+
+	g := &crdt.GCounter{}
+	delta := g.Increment("a", 2)
+	g.Increment("a", 3)
+	if err := g.Merge(delta); err != nil || g.Total() != 5 {t.Errorf("Expected an old delta to change nothing, but got %d", g.Total())}
+}
+
+func TestORSetAddWinsOverConcurrentRemove(t *testing.T){
+	a := &crdt.ORSet{}
+	a.Add("x", "a1")
+	b := a.Clone().(*crdt.ORSet)
+
+	// a removes x, while b adds it again without having seen the remove
+	a.Remove("x")
+	b.Add("x", "b1")
+	b.Add("y", "b2")
+
+	merged := mergeBothWays(t, a, b).(*crdt.ORSet)
+	if members := merged.Members(); !reflect.DeepEqual(members, []string{"x", "y"}) {
+		t.Errorf("Expected [x y], but got %v", members)
+	}
+
+	// a remove after seeing every add does stick
+	merged.Remove("x")
+	if merged.Contains("x") {t.Errorf("Expected x to be removed")}
+}
+
+func TestORMapFields(t *testing.T){
+	now := time.Now()
+	a := &crdt.ORMap{}
+	a.Set("name", json.RawMessage(`"Sam"`), now, "a", "a1")
+	a.Set("city", json.RawMessage(`"Leeds"`), now, "a", "a2")
+	b := a.Clone().(*crdt.ORMap)
+
+	a.Delete("city")
+	b.Set("name", json.RawMessage(`"Samantha"`), now.Add(time.Second), "b", "b1")
+
+	merged := mergeBothWays(t, a, b).(*crdt.ORMap)
+	if fields := merged.FieldNames(); !reflect.DeepEqual(fields, []string{"name"}) {
+		t.Errorf("Expected [name], but got %v", fields)
+	}
+	if name, _ := merged.Get("name"); string(name) != `"Samantha"` {t.Errorf("Expected the later name, but got %s", name)}
+}
+
+func TestMergingDifferentKindsFails(t *testing.T){
+	if err := (&crdt.GCounter{}).Merge(&crdt.ORSet{}); err != kvs.WrongTypeError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongTypeError, err)
+	}
+}
@@ -0,0 +1,182 @@
+package keyvaluestore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Compression and encryption at rest.
+// Each frame's flags byte says how its body was written:
+//
+//     bit 0: the body is compressed with flate (set when the value is over `FileOptions.CompressAbove` bytes)
+//     bit 1: the body is encrypted with AES-GCM, as [12 byte nonce][sealed body]
+//
+// Compression happens before encryption, and the flags byte is authenticated along with the body.
+// The whole record is encrypted, key and all; only the file marker and frame lengths are left in the clear.
+// Files can hold a mix of plain and encrypted frames, so turning encryption on for an existing file just works,
+// but only `RewriteFile` gets rid of the older plain records.
+//
+// To rotate a key, open the file with the old key, then call `RewriteFile` with the new one.
+// The file is rewritten from scratch and swapped in whole, so a crash part way through leaves the old file intact.
+
+var InvalidEncryptionKeyError = errors.New("encryption keys must be 16, 24 or 32 bytes long")
+var EncryptionKeyNeededError = errors.New("the store file is encrypted, but no key was given")
+var WrongEncryptionKeyError = errors.New("none of the given keys can decrypt the store file")
+var RecordTooLargeError = errors.New("the record is too large to write to a store file")
+
+// renameFile swaps a rewritten file in. The tests swap it, to make the rename fail.
+var renameFile = os.Rename
+
+const (
+	flagCompressed byte = 1 << 0
+	flagEncrypted  byte = 1 << 1
+	knownFlags          = flagCompressed | flagEncrypted
+)
+
+// RewriteFile rewrites the store file with different options, and uses them for all later writes.
+// Use this to rotate the encryption key, or to encrypt or compress a file that was written without.
+// If there is a change feed, its new records use the new options too (the old key is kept in memory
+// to read older feed records, but must be passed in `OldEncryptionKeys` after a restart).
+func (receiver *IndependentStore) RewriteFile(options FileOptions) error {
+	return receiver.RewriteFileContext(context.Background(), options)
+}
+
+// RewriteFileContext is `RewriteFile`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) RewriteFileContext(ctx context.Context, options FileOptions) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if err := options.validate(); err != nil {return err}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.mutex.Unlock()
+
+	if receiver.log == nil {return NotPersistedError}
+	if err := receiver.rewriteLocked(options); err != nil {return err}
+
+	if feed := receiver.feed; feed != nil {
+		previousKey := feed.options.EncryptionKey
+		oldKeys := append([][]byte{}, options.OldEncryptionKeys...)
+		oldKeys = append(oldKeys, feed.options.OldEncryptionKeys...)
+		if previousKey != nil {oldKeys = append(oldKeys, previousKey)}
+
+		feed.options = options
+		feed.options.OldEncryptionKeys = oldKeys
+	}
+	return nil
+}
+
+// validate checks that any keys given are usable
+func (options FileOptions) validate() error {
+	keys := append([][]byte{options.EncryptionKey}, options.OldEncryptionKeys...)
+	for i, key := range keys {
+		if i == 0 && key == nil {continue} // no encryption
+		if _, err := aes.NewCipher(key); err != nil {return InvalidEncryptionKeyError}
+	}
+	return nil
+}
+
+// rewriteLocked replaces the store file with a snapshot written with `options`.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) rewriteLocked(options FileOptions) error {
+	tempPath := receiver.log.path + ".compact"
+	if err := receiver.writeSnapshotLocked(tempPath, options); err != nil {return err}
+
+	// swap the new file in, and carry on appending to it
+	if err := receiver.log.close(); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := renameFile(tempPath, receiver.log.path); err != nil {
+		// the old file is still in place, so carry on appending to that
+		_ = os.Remove(tempPath)
+		if reopenErr := receiver.log.reopen(); reopenErr != nil {return fmt.Errorf("%w (and reopening the store file failed: %v)", err, reopenErr)}
+		return err
+	}
+
+	receiver.log.options = options
+	return receiver.log.reopen()
+}
+
+// encodeBody compresses and encrypts a record body as the options say, and returns the flags to go with it
+func encodeBody(body []byte, valueLength int, options FileOptions) (byte, []byte, error) {
+	flags := byte(0)
+
+	if options.CompressAbove > 0 && valueLength > options.CompressAbove {
+		compressed := &bytes.Buffer{}
+		writer, err := flate.NewWriter(compressed, flate.DefaultCompression)
+		if err != nil {return 0, nil, err}
+		if _, err = writer.Write(body); err != nil {return 0, nil, err}
+		if err = writer.Close(); err != nil {return 0, nil, err}
+
+		if compressed.Len() < len(body) { // not everything gets smaller
+			body = compressed.Bytes()
+			flags |= flagCompressed
+		}
+	}
+
+	if options.EncryptionKey != nil {
+		flags |= flagEncrypted
+		aead, err := newAead(options.EncryptionKey)
+		if err != nil {return 0, nil, err}
+
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {return 0, nil, err}
+		body = aead.Seal(nonce, nonce, body, []byte{flags})
+	}
+
+	return flags, body, nil
+}
+
+// decodeBody undoes `encodeBody`. Key problems are returned as `EncryptionKeyNeededError` or `WrongEncryptionKeyError`.
+func decodeBody(flags byte, body []byte, options FileOptions) ([]byte, error) {
+	if flags&^knownFlags != 0 {return nil, fmt.Errorf("unsupported record flags %x", flags)}
+
+	if flags&flagEncrypted != 0 {
+		keys := options.OldEncryptionKeys
+		if options.EncryptionKey != nil {keys = append([][]byte{options.EncryptionKey}, keys...)}
+		if len(keys) < 1 {return nil, EncryptionKeyNeededError}
+
+		opened, err := openSealed(flags, body, keys)
+		if err != nil {return nil, err}
+		body = opened
+	}
+
+	if flags&flagCompressed != 0 {
+		reader := flate.NewReader(bytes.NewReader(body))
+		decompressed, err := io.ReadAll(io.LimitReader(reader, maxFrameLen+1))
+		_ = reader.Close()
+		if err != nil {return nil, err}
+		if len(decompressed) > maxFrameLen {return nil, RecordTooLargeError}
+		body = decompressed
+	}
+
+	return body, nil
+}
+
+// openSealed tries each key in turn on an encrypted body
+func openSealed(flags byte, body []byte, keys [][]byte) ([]byte, error) {
+	for _, key := range keys {
+		aead, err := newAead(key)
+		if err != nil {return nil, err}
+		if len(body) < aead.NonceSize()+aead.Overhead() {return nil, errors.New("encrypted record is too short")}
+
+		nonce, sealed := body[:aead.NonceSize()], body[aead.NonceSize():]
+		if opened, err := aead.Open(nil, nonce, sealed, []byte{flags}); err == nil {return opened, nil}
+	}
+
+	// the checksum matched, so the body is what was written; the key must be wrong
+	return nil, WrongEncryptionKeyError
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {return nil, InvalidEncryptionKeyError}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,117 @@
+package keyvaluestore_test
+
+import (
+	"bytes"
+	kvs "KeyValueStore"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var oldKey = bytes.Repeat([]byte{1}, 32)
+var newKey = bytes.Repeat([]byte{2}, 32)
+
+func TestEncryptedAndCompressedRecordsRoundTrip(t *testing.T){
+	path := filepath.Join(t.TempDir(), "secret.kvs")
+	options := kvs.FileOptions{EncryptionKey: oldKey, CompressAbove: 64}
+	large := strings.Repeat("customer address, ", 100)
+
+	store, err := kvs.OpenFile(path, options)
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	_ = store.Put("customer:1", "Sam Smith")
+	_ = store.Put("customer:2", large)
+	_ = store.Close()
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("Sam Smith")) || bytes.Contains(data, []byte("customer:1")) {
+		t.Errorf("Expected keys and values to be encrypted in the file")
+	}
+	if len(data) > len(large) {t.Errorf("Expected large value to be compressed, but file is %d bytes", len(data))}
+
+	reopened, err := kvs.OpenFile(path, options)
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	if v, _ := reopened.Get("customer:1"); v != "Sam Smith" {t.Errorf("Expected 'Sam Smith', but got '%v'", v)}
+	if v, _ := reopened.Get("customer:2"); v != large {t.Errorf("Expected large value to survive, but got '%v'", v)}
+	_ = reopened.Close()
+
+	stats, err := kvs.VerifyFile(path, options)
+	if err != nil || stats.Encrypted != 2 || stats.Compressed != 1 {
+		t.Errorf("Expected 2 encrypted and 1 compressed records, but got %+v, %v", stats, err)
+	}
+}
+
+func TestEncryptedFilesNeedTheRightKey(t *testing.T){
+	path := filepath.Join(t.TempDir(), "secret.kvs")
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{EncryptionKey: oldKey})
+	_ = store.Put("a", 1)
+	_ = store.Close()
+
+	if _, err := kvs.OpenFile(path, kvs.FileOptions{}); err != kvs.EncryptionKeyNeededError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.EncryptionKeyNeededError, err)
+	}
+
+	// a wrong key is not corruption, so skipping corrupt records must not throw the data away
+	if _, err := kvs.OpenFile(path, kvs.FileOptions{EncryptionKey: newKey, SkipCorruptRecords: true}); err != kvs.WrongEncryptionKeyError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.WrongEncryptionKeyError, err)
+	}
+
+	if _, err := kvs.OpenFile(path, kvs.FileOptions{EncryptionKey: []byte("too short")}); err != kvs.InvalidEncryptionKeyError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.InvalidEncryptionKeyError, err)
+	}
+}
+
+func TestKeyRotationByRewriting(t *testing.T){
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.kvs")
+
+	// start with a plain file, then turn encryption on
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{})
+	_ = store.EnableChangeFeed(filepath.Join(dir, "changes.kvs"))
+	_ = store.Put("a", "first")
+
+	if err := store.RewriteFile(kvs.FileOptions{EncryptionKey: oldKey}); err != nil {t.Fatalf("RewriteFile failed with %v", err)}
+	_ = store.Put("b", "second")
+
+	if err := store.RewriteFile(kvs.FileOptions{EncryptionKey: newKey}); err != nil {t.Fatalf("RewriteFile failed with %v", err)}
+	_ = store.Put("c", "third")
+
+	// the feed has records from all three eras, and can still read them all
+	changes := 0
+	if _, err := store.ReadChanges(0, func(kvs.RecordLine) error { changes++; return nil }); err != nil || changes != 3 {
+		t.Errorf("Expected 3 readable changes, but got %d, %v", changes, err)
+	}
+	_ = store.Close()
+
+	if _, err := kvs.OpenFile(path, kvs.FileOptions{EncryptionKey: oldKey}); err != kvs.WrongEncryptionKeyError {
+		t.Errorf("Expected old key to be useless after rotation, but got '%v'", err)
+	}
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{EncryptionKey: newKey})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	if keys := reopened.Keys(); len(keys) != 3 {t.Errorf("Expected 3 keys, but got %v", keys)}
+
+	stats, _ := kvs.VerifyFile(path, kvs.FileOptions{EncryptionKey: newKey})
+	if stats.Encrypted != stats.Records {t.Errorf("Expected every record to be encrypted, but got %+v", stats)}
+}
+
+func TestFailedRewriteKeepsTheOldFile(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{})
+	_ = store.Put("a", "first")
+
+	restore := kvs.FailRenamesForTests()
+	err := store.RewriteFile(kvs.FileOptions{EncryptionKey: newKey})
+	restore()
+	if err == nil {t.Fatalf("Expected RewriteFile to fail")}
+	if _, err = os.Stat(path + ".compact"); !os.IsNotExist(err) {t.Errorf("Expected the rewritten file to be removed, but got '%v'", err)}
+
+	// still writing to the old file, with the old options
+	if err = store.Put("b", "second"); err != nil {t.Errorf("Expected writes to carry on, but got '%v'", err)}
+	_ = store.Close()
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = reopened.Close() }()
+	if keys := reopened.Keys(); len(keys) != 2 {t.Errorf("Expected 2 keys, but got %v", keys)}
+}
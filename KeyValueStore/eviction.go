@@ -0,0 +1,204 @@
+package keyvaluestore
+
+import (
+	"context"
+	"time"
+)
+
+// RemovalReason says why a key was taken out of the store
+type RemovalReason int
+
+const (
+	ReasonDeleted  RemovalReason = iota // `Delete` or `DeleteValue` was called
+	ReasonEvicted                       // removed by `EvictOlderThan`
+	ReasonCapacity                      // pushed out to keep the store under its capacity
+	ReasonExpired                       // the expiry time given to `PutWithExpiry` passed
+)
+
+func (reason RemovalReason) String() string {
+	switch reason {
+	case ReasonDeleted:
+		return "deleted"
+	case ReasonEvicted:
+		return "evicted"
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// RemovalHook is called with the key and value that were removed.
+// Hooks run after the store lock is released, so it's safe to call back into the store from one.
+type RemovalHook func(key StoreKey, value interface{}, reason RemovalReason)
+
+type storeHooks struct {
+	onDelete []RemovalHook
+	onEvict  []RemovalHook
+	onExpire []RemovalHook
+}
+
+type removal struct {
+	key    StoreKey
+	value  interface{}
+	reason RemovalReason
+}
+
+// OnDelete registers a hook to run when a key is deleted
+func (receiver *IndependentStore) OnDelete(hook RemovalHook) {
+	if receiver == nil || hook == nil {return}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.hooks.onDelete = append(receiver.hooks.onDelete, hook)
+}
+
+// OnEvict registers a hook to run when a key is removed by `EvictOlderThan`, or by the capacity limit
+func (receiver *IndependentStore) OnEvict(hook RemovalHook) {
+	if receiver == nil || hook == nil {return}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.hooks.onEvict = append(receiver.hooks.onEvict, hook)
+}
+
+// OnExpire registers a hook to run when a key that was stored with `PutWithExpiry` is removed after its time is up
+func (receiver *IndependentStore) OnExpire(hook RemovalHook) {
+	if receiver == nil || hook == nil {return}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.hooks.onExpire = append(receiver.hooks.onExpire, hook)
+}
+
+// unlockAndNotify releases the write lock, then runs the hooks for anything that was removed while it was held.
+// Use this in place of `mutex.Unlock()` anywhere that might call `removeLocked`.
+func (receiver *IndependentStore) unlockAndNotify() {
+	removed := receiver.pendingRemovals
+	receiver.pendingRemovals = nil
+	hooks := receiver.hooks // slices only ever get appended to, so this copy is stable once we let go of the lock
+	receiver.mutex.Unlock()
+
+	for _, item := range removed {
+		var toRun []RemovalHook
+		switch item.reason {
+		case ReasonDeleted:
+			toRun = hooks.onDelete
+		case ReasonEvicted, ReasonCapacity:
+			toRun = hooks.onEvict
+		case ReasonExpired:
+			toRun = hooks.onExpire
+		}
+
+		for _, hook := range toRun {
+			hook(item.key, item.value, item.reason)
+		}
+	}
+}
+
+// SetCapacity limits the number of keys in the store. Zero or less means no limit.
+// When a put goes over the limit, the least recently accessed keys are evicted.
+func (receiver *IndependentStore) SetCapacity(maxKeys int) error {
+	return receiver.SetCapacityContext(context.Background(), maxKeys)
+}
+
+// SetCapacityContext is `SetCapacity`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SetCapacityContext(ctx context.Context, maxKeys int) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	receiver.capacity = maxKeys
+	receiver.enforceCapacityLocked("")
+	return nil
+}
+
+// enforceCapacityLocked evicts the oldest keys until the store is within capacity.
+// `keep` is never evicted, so a put can't push out its own value.
+// This is a full scan per eviction, which is fine for small stores but won't scale well.
+func (receiver *IndependentStore) enforceCapacityLocked(keep StoreKey) {
+	if receiver.capacity <= 0 {return}
+
+	for receiver.core.count() > receiver.capacity {
+		var oldestKey StoreKey
+		var oldestTime time.Time
+		found := false
+
+		receiver.core.each(func(key StoreKey, value StoreValue) bool {
+			if key == keep {return true}
+			if stamp := value.GetTimestamp(); !found || stamp.Before(oldestTime) {
+				oldestKey, oldestTime, found = key, stamp, true
+			}
+			return true
+		})
+
+		if !found {return}
+		if err := receiver.removeLocked(oldestKey, ReasonCapacity); err != nil {return}
+	}
+}
+
+// PutWithExpiry stores a value that stops being visible after `ttl`.
+// Expired keys are removed (and `OnExpire` hooks run) by `EvictExpired`.
+func (receiver *IndependentStore) PutWithExpiry(key StoreKey, value interface{}, ttl time.Duration) error {
+	return receiver.PutWithExpiryContext(context.Background(), key, value, ttl)
+}
+
+// PutWithExpiryContext is `PutWithExpiry`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) PutWithExpiryContext(ctx context.Context, key StoreKey, value interface{}, ttl time.Duration) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	now := time.Now()
+	return receiver.putLocked(key, &timestampWrapper{
+		lastAccess: now,
+		expires:    now.Add(ttl),
+		value:      value,
+	})
+}
+
+// EvictExpired removes every key whose expiry time has passed, and any leases that have run out
+func (receiver *IndependentStore) EvictExpired() {
+	_ = receiver.EvictExpiredContext(context.Background())
+}
+
+// EvictExpiredContext is `EvictExpired`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) EvictExpiredContext(ctx context.Context) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	now := time.Now()
+	receiver.core.each(func(key StoreKey, value StoreValue) bool {
+		if isExpired(value, now) {
+			_ = receiver.removeLocked(key, ReasonExpired)
+		}
+		return true
+	})
+	receiver.evictExpiredLeasesLocked(now)
+	return nil
+}
+
+func isExpired(value StoreValue, now time.Time) bool {
+	expires := expiryOf(value)
+	if expires.IsZero() {return false}
+	return !now.Before(expires)
+}
+
+// expiryOf returns when a stored value expires, or the zero time for never
+func expiryOf(value StoreValue) time.Time {
+	expiring, ok := value.(interface{ expiresAt() time.Time })
+	if !ok {return time.Time{}}
+	return expiring.expiresAt()
+}
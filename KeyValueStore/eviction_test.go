@@ -0,0 +1,99 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"testing"
+	"time"
+)
+
+type closeTracker struct {
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDeleteHookGetsKeyValueAndReason(t *testing.T){
+	store := kvs.OpenNew()
+	resource := &closeTracker{}
+
+	var gotKey kvs.StoreKey
+	var gotReason kvs.RemovalReason
+	store.OnDelete(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		gotKey, gotReason = key, reason
+		if closer, ok := value.(*closeTracker); ok {_ = closer.Close()}
+	})
+
+	if err := store.Put("file", resource); err != nil {t.Errorf("Put failed with %v", err)}
+	if err := store.Delete("file"); err != nil {t.Errorf("Delete failed with %v", err)}
+
+	if !resource.closed {t.Errorf("Expected hook to close the stored value")}
+	if gotKey != "file" {t.Errorf("Expected key 'file', but got '%v'", gotKey)}
+	if gotReason != kvs.ReasonDeleted {t.Errorf("Expected '%v', but got '%v'", kvs.ReasonDeleted, gotReason)}
+}
+
+func TestEvictHookCanCallBackIntoStore(t *testing.T){
+	store := kvs.OpenNew()
+
+	// if hooks ran under the lock, this would deadlock
+	store.OnEvict(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		_ = store.Put(kvs.StoreKey("tombstone-"+string(key)), reason.String())
+	})
+
+	if err := store.PutWithAge("lose-key", "value", time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("Put failed with %v", err)
+	}
+	store.EvictOlderThan(time.Now().Add(time.Second * 30))
+
+	if found := store.Contains("lose-key"); found {t.Errorf("Expected 'lose-key' to be evicted")}
+	if v, err := store.Get("tombstone-lose-key"); err != nil || v != "evicted" {
+		t.Errorf("Expected 'evicted', but got %v, %v", v, err)
+	}
+}
+
+func TestCapacityEvictsLeastRecentlyUsed(t *testing.T){
+	store := kvs.OpenNew()
+	evicted := []kvs.StoreKey{}
+	store.OnEvict(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		if reason != kvs.ReasonCapacity {t.Errorf("Expected '%v', but got '%v'", kvs.ReasonCapacity, reason)}
+		evicted = append(evicted, key)
+	})
+
+	if err := store.SetCapacity(2); err != nil {t.Errorf("SetCapacity failed with %v", err)}
+
+	base := time.Now()
+	_ = store.PutWithAge("a", 1, base.Add(-3*time.Minute))
+	_ = store.PutWithAge("b", 2, base.Add(-2*time.Minute))
+	_ = store.Put("c", 3)
+
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("Expected only 'a' to be evicted, but got %v", evicted)
+	}
+	if found := store.Contains("b"); !found {t.Errorf("Expected 'b' to be kept")}
+	if found := store.Contains("c"); !found {t.Errorf("Expected 'c' to be kept")}
+}
+
+func TestExpiredKeysAreHiddenThenEvicted(t *testing.T){
+	store := kvs.OpenNew()
+	expired := 0
+	store.OnExpire(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		expired++
+	})
+	store.OnDelete(func(key kvs.StoreKey, value interface{}, reason kvs.RemovalReason) {
+		t.Errorf("Delete hook should not run for expiry")
+	})
+
+	_ = store.PutWithExpiry("short", "value", time.Millisecond)
+	_ = store.PutWithExpiry("long", "value", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := store.Get("short"); err != kvs.KeyNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)
+	}
+	if found := store.Contains("long"); !found {t.Errorf("Expected 'long' to still be present")}
+
+	store.EvictExpired()
+	if expired != 1 {t.Errorf("Expected one expiry, but got %d", expired)}
+}
@@ -0,0 +1,43 @@
+package keyvaluestore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// BreakChangeFeedForTests closes the change feed's file behind the store's back, so the next write to it fails
+func BreakChangeFeedForTests(store *IndependentStore) {
+	_ = store.feed.file.Close()
+}
+
+// FeedOffsetForTests is where a read of the change feed from `seq` onwards starts in the feed file
+func FeedOffsetForTests(store *IndependentStore, seq uint64) int64 {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.feed.offsetBefore(seq)
+}
+
+// FailRenamesForTests makes every rename of a rewritten store file fail, until the returned function is called
+func FailRenamesForTests() (restore func()) {
+	renameFile = func(string, string) error { return errors.New("rename failed for the test") }
+	return func() { renameFile = os.Rename }
+}
+
+// UseMappedBackendForTests makes every store from `OpenNew` (and so `OpenFile`) keep its values in a new
+// mapped file under `dir`. Returns false if this platform can't map files.
+func UseMappedBackendForTests(dir string) bool {
+	probe, err := openMappedBackend(filepath.Join(dir, "probe.kvm"), MappedOptions{})
+	if err != nil {return false}
+	_ = probe.close()
+
+	count := 0
+	newCore = func() backend {
+		count++
+		core, err := openMappedBackend(filepath.Join(dir, fmt.Sprintf("store-%d.kvm", count)), MappedOptions{})
+		if err != nil {panic(err)}
+		return core
+	}
+	return true
+}
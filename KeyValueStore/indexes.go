@@ -0,0 +1,247 @@
+package keyvaluestore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Secondary indexes on struct values.
+// Tag the fields you want to look up by, and give each index a name:
+//
+//     type User struct {
+//         ID    int
+//         Name  string `kvindex:"name"`
+//         Email string `kvindex:"email"`
+//     }
+//
+// Any struct (or pointer to struct) stored in the store is indexed by its tagged fields,
+// including fields of embedded structs. The index is kept up to date on every put and delete,
+// and `FindBy("email", "sam@example.com")` returns the keys of the matching values.
+// Numbers are compared by value, so an `int` field can be found with an `int64` or `float64`.
+// For file-backed stores, use `RegisterType` so values come back as structs (and get re-indexed) on open.
+
+var IndexNotFoundError = errors.New("no stored value has declared this index")
+
+const indexTag = "kvindex"
+
+type indexEntry struct {
+	name      string
+	value     interface{}
+	queryable bool // see indexedField
+}
+
+type indexedField struct {
+	name      string
+	fieldPath []int
+	queryable bool // a query on `name` reads this field and compares it the way the index does; see `queryMatchesIndex`
+}
+
+// indexedFieldCache maps reflect.Type => []indexedField, so we only walk each type's tags once
+var indexedFieldCache = sync.Map{}
+
+// FindBy returns the keys of every value whose field tagged with `index` equals `value`, in sorted order
+func (receiver *IndependentStore) FindBy(index string, value interface{}) ([]StoreKey, error) {
+	return receiver.FindByContext(context.Background(), index, value)
+}
+
+// FindByContext is `FindBy`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) FindByContext(ctx context.Context, index string, value interface{}) ([]StoreKey, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
+	defer receiver.mutex.RUnlock()
+
+	return receiver.findByLocked(index, value)
+}
+
+// Indexes returns the names of every index that stored values have declared, in sorted order
+func (receiver *IndependentStore) Indexes() []string {
+	names, _ := receiver.IndexesContext(context.Background())
+	return names
+}
+
+// IndexesContext is `Indexes`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) IndexesContext(ctx context.Context) ([]string, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
+	defer receiver.mutex.RUnlock()
+
+	names := make([]string, 0, len(receiver.indexes))
+	for name := range receiver.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// findByLocked looks up an index. Caller must hold the lock.
+func (receiver *IndependentStore) findByLocked(index string, value interface{}) ([]StoreKey, error) {
+	entries, ok := receiver.indexes[index]
+	if !ok {return nil, IndexNotFoundError}
+
+	lookup, ok := indexValue(reflect.ValueOf(value))
+	if !ok {return []StoreKey{}, nil}
+
+	now := time.Now()
+	keys := make([]StoreKey, 0, len(entries[lookup]))
+	for key := range entries[lookup] {
+		// expired values stay indexed until they're removed, but `Get` can't see them, so neither can we
+		if stored, ok := receiver.core.get(key); !ok || isExpired(stored, now) {continue}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
+// reindexLocked replaces the index entries for `key` with those for `value`.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) reindexLocked(key StoreKey, value interface{}) {
+	receiver.unindexLocked(key)
+
+	entries := indexEntriesFor(value)
+	if len(entries) < 1 {return}
+
+	for _, entry := range entries {
+		byValue, ok := receiver.indexes[entry.name]
+		if !ok {
+			byValue = map[interface{}]map[StoreKey]struct{}{}
+			receiver.indexes[entry.name] = byValue
+		}
+		keys, ok := byValue[entry.value]
+		if !ok {
+			keys = map[StoreKey]struct{}{}
+			byValue[entry.value] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	receiver.indexedKeys[key] = entries
+}
+
+// unindexLocked removes any index entries for `key`. Caller must hold the write lock.
+func (receiver *IndependentStore) unindexLocked(key StoreKey) {
+	entries, ok := receiver.indexedKeys[key]
+	if !ok {return}
+
+	for _, entry := range entries {
+		byValue := receiver.indexes[entry.name]
+		delete(byValue[entry.value], key)
+		if len(byValue[entry.value]) < 1 {delete(byValue, entry.value)}
+	}
+	delete(receiver.indexedKeys, key)
+}
+
+// indexEntriesFor reads the tagged fields out of a struct value
+func indexEntriesFor(value interface{}) []indexEntry {
+	structValue := reflect.ValueOf(value)
+	for structValue.Kind() == reflect.Ptr || structValue.Kind() == reflect.Interface {
+		if structValue.IsNil() {return nil}
+		structValue = structValue.Elem()
+	}
+	if structValue.Kind() != reflect.Struct {return nil}
+
+	fields := indexedFieldsOf(structValue.Type())
+	if len(fields) < 1 {return nil}
+
+	entries := make([]indexEntry, 0, len(fields))
+	for _, field := range fields {
+		fieldValue, ok := fieldByPath(structValue, field.fieldPath)
+		if !ok {continue}
+		if lookup, ok := indexValue(fieldValue); ok {
+			entries = append(entries, indexEntry{name: field.name, value: lookup, queryable: field.queryable})
+		}
+	}
+	return entries
+}
+
+// indexedFieldsOf finds the tagged fields of a struct type, including those in embedded structs
+func indexedFieldsOf(structType reflect.Type) []indexedField {
+	if cached, ok := indexedFieldCache.Load(structType); ok {
+		return cached.([]indexedField)
+	}
+
+	var fields []indexedField
+	onPath := map[reflect.Type]bool{} // a struct can embed a pointer to itself, so stop when we come back round
+	var walk func(t reflect.Type, path []int)
+	walk = func(t reflect.Type, path []int) {
+		onPath[t] = true
+		defer delete(onPath, t)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fieldPath := append(append([]int{}, path...), i)
+
+			if field.Anonymous {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Ptr {embedded = embedded.Elem()}
+				if embedded.Kind() == reflect.Struct {
+					if !onPath[embedded] {walk(embedded, fieldPath)}
+					continue
+				}
+			}
+
+			name, tagged := field.Tag.Lookup(indexTag)
+			if !tagged || name == "" || name == "-" || field.PkgPath != "" {continue} // PkgPath is only set for unexported fields
+			fields = append(fields, indexedField{name: name, fieldPath: fieldPath})
+		}
+	}
+	walk(structType, nil)
+	for i := range fields {
+		fields[i].queryable = queryMatchesIndex(structType, fields[i])
+	}
+
+	indexedFieldCache.Store(structType, fields)
+	return fields
+}
+
+// fieldByPath is like `reflect.Value.FieldByIndex`, but gives up on nil embedded pointers instead of panicking
+func fieldByPath(structValue reflect.Value, path []int) (reflect.Value, bool) {
+	current := structValue
+	for _, i := range path {
+		if current.Kind() == reflect.Ptr {
+			if current.IsNil() {return reflect.Value{}, false}
+			current = current.Elem()
+		}
+		current = current.Field(i)
+	}
+	return current, true
+}
+
+// indexValue converts a field value to something we can use as a map key.
+// Numbers are kept exact, as an int64 if they fit, or a uint64 if they're too big for that, and only non-whole
+// floats stay float64. So an index on an `int` field can be searched with any number type, even past 2^53.
+func indexValue(value reflect.Value) (interface{}, bool) {
+	if !value.IsValid() {return nil, false}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if number := value.Uint(); number > math.MaxInt64 {return number, true} else {return int64(number), true}
+	case reflect.Float32, reflect.Float64:
+		number := value.Float()
+		if number != math.Trunc(number) {return number, true} // and NaN
+		switch {
+		case number >= -(1<<63) && number < 1<<63:
+			return int64(number), true
+		case number >= 0 && number < 1<<64:
+			return uint64(number), true
+		}
+		return number, true // infinities
+	case reflect.String:
+		return value.String(), true
+	case reflect.Bool:
+		return value.Bool(), true
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {return nil, false}
+		return indexValue(value.Elem())
+	default:
+		if value.Type().Comparable() && value.CanInterface() {return value.Interface(), true}
+		return nil, false
+	}
+}
@@ -0,0 +1,155 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type indexedPerson struct {
+	Name string `json:"name" kvindex:"name"`
+	Age  int    `json:"age" kvindex:"age"`
+}
+
+type indexedUser struct {
+	indexedPerson        // embedded fields are indexed too
+	ID            string `json:"id"`
+	Email         string `json:"email" kvindex:"email"`
+	Notes         string `json:"notes"`
+}
+
+func TestFindByIndexedField(t *testing.T){
+	store := kvs.OpenNew()
+
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam", Age: 30}, ID: "1", Email: "sam@example.com"})
+	_ = store.Put("user:2", &indexedUser{indexedPerson: indexedPerson{Name: "Alex", Age: 30}, ID: "2", Email: "alex@example.com"})
+	_ = store.Put("user:3", indexedUser{indexedPerson: indexedPerson{Name: "Sam", Age: 41}, ID: "3", Email: "sam.b@example.com"})
+	_ = store.Put("not-a-struct", "Sam")
+
+	if keys, err := store.FindBy("name", "Sam"); err != nil || fmt.Sprint(keys) != "[user:1 user:3]" {
+		t.Errorf("Expected [user:1 user:3], but got %v, %v", keys, err)
+	}
+	if keys, err := store.FindBy("email", "alex@example.com"); err != nil || fmt.Sprint(keys) != "[user:2]" {
+		t.Errorf("Expected [user:2], but got %v, %v", keys, err)
+	}
+
+	// numbers match by value, not by Go type
+	if keys, err := store.FindBy("age", int64(30)); err != nil || fmt.Sprint(keys) != "[user:1 user:2]" {
+		t.Errorf("Expected [user:1 user:2], but got %v, %v", keys, err)
+	}
+
+	if _, err := store.FindBy("notes", "x"); err != kvs.IndexNotFoundError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.IndexNotFoundError, err)
+	}
+	if names := store.Indexes(); fmt.Sprint(names) != "[age email name]" {
+		t.Errorf("Expected [age email name], but got %v", names)
+	}
+}
+
+func TestIndexFollowsUpdatesAndDeletes(t *testing.T){
+	store := kvs.OpenNew()
+
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam"}, Email: "old@example.com"})
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam"}, Email: "new@example.com"})
+
+	if keys, _ := store.FindBy("email", "old@example.com"); len(keys) != 0 {
+		t.Errorf("Expected old email to be unindexed, but got %v", keys)
+	}
+	if keys, _ := store.FindBy("email", "new@example.com"); len(keys) != 1 {
+		t.Errorf("Expected new email to be indexed, but got %v", keys)
+	}
+
+	// replacing with a non-struct drops the entries too
+	_ = store.Put("user:1", "plain")
+	if keys, _ := store.FindBy("name", "Sam"); len(keys) != 0 {
+		t.Errorf("Expected entries to go when value is replaced, but got %v", keys)
+	}
+
+	_ = store.Put("user:2", indexedUser{indexedPerson: indexedPerson{Name: "Alex"}})
+	_ = store.Delete("user:2")
+	if keys, _ := store.FindBy("name", "Alex"); len(keys) != 0 {
+		t.Errorf("Expected deleted key to be unindexed, but got %v", keys)
+	}
+}
+
+func TestIndexesAreRebuiltOnOpen(t *testing.T){
+	kvs.RegisterType(indexedUser{})
+	path := filepath.Join(t.TempDir(), "users.kvs")
+
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{})
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam"}, Email: "sam@example.com"})
+	_ = store.Close()
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+
+	if keys, err := reopened.FindBy("email", "sam@example.com"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected index to be rebuilt, but got %v, %v", keys, err)
+	}
+	if v, _ := reopened.Get("user:1"); v.(indexedUser).Name != "Sam" {
+		t.Errorf("Expected registered type to come back as a struct, but got %#v", v)
+	}
+}
+
+func TestFindBySkipsExpiredValues(t *testing.T){
+	store := kvs.OpenNew()
+
+	_ = store.PutWithExpiry("user:1", indexedPerson{Name: "Sam", Age: 30}, time.Millisecond)
+	_ = store.PutWithExpiry("user:2", indexedPerson{Name: "Sam", Age: 41}, time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := store.Get("user:1"); err != kvs.KeyNotPresentError {t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)}
+	if keys, err := store.FindBy("name", "Sam"); err != nil || fmt.Sprint(keys) != "[user:2]" {
+		t.Errorf("Expected [user:2], but got %v, %v", keys, err)
+	}
+}
+
+type indexedAccount struct {
+	ID      uint64  `kvindex:"id"`
+	Balance float64 `kvindex:"balance"`
+}
+
+func TestIndexesKeepLargeNumbersApart(t *testing.T){
+	store := kvs.OpenNew()
+
+	// these are the same number as a float64
+	_ = store.Put("account:1", indexedAccount{ID: 1<<53, Balance: 2.5})
+	_ = store.Put("account:2", indexedAccount{ID: 1<<53 + 1, Balance: 30})
+	_ = store.Put("account:3", indexedAccount{ID: 1<<64 - 1})
+
+	if keys, err := store.FindBy("id", int64(1<<53+1)); err != nil || fmt.Sprint(keys) != "[account:2]" {
+		t.Errorf("Expected [account:2], but got %v, %v", keys, err)
+	}
+	if keys, err := store.FindBy("id", uint64(1<<53)); err != nil || fmt.Sprint(keys) != "[account:1]" {
+		t.Errorf("Expected [account:1], but got %v, %v", keys, err)
+	}
+	if keys, err := store.FindBy("id", uint64(1<<64-1)); err != nil || fmt.Sprint(keys) != "[account:3]" {
+		t.Errorf("Expected [account:3], but got %v, %v", keys, err)
+	}
+
+	// whole floats still match integers, and the other way round
+	if keys, err := store.FindBy("balance", 30); err != nil || fmt.Sprint(keys) != "[account:2]" {
+		t.Errorf("Expected [account:2], but got %v, %v", keys, err)
+	}
+	if keys, err := store.FindBy("balance", float32(2.5)); err != nil || fmt.Sprint(keys) != "[account:1]" {
+		t.Errorf("Expected [account:1], but got %v, %v", keys, err)
+	}
+}
+
+type indexedNode struct {
+	*indexedNode
+	Name string `kvindex:"name"`
+}
+
+func TestSelfEmbeddingStructsCanBeIndexed(t *testing.T){
+	store := kvs.OpenNew()
+
+	if err := store.Put("node:1", indexedNode{indexedNode: &indexedNode{Name: "parent"}, Name: "child"}); err != nil {
+		t.Fatalf("Put failed with %v", err)
+	}
+	if keys, err := store.FindBy("name", "child"); err != nil || fmt.Sprint(keys) != "[node:1]" {
+		t.Errorf("Expected [node:1], but got %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,140 @@
+package keyvaluestore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Lease-based locks.
+// Leases live beside the stored values, not in them, so a lease on "job:1" doesn't stop anyone
+// reading or writing the value at "job:1". It's up to callers to agree on what a lease protects.
+//
+// Every lease that is granted gets a fencing token higher than any before it. If a holder
+// stalls long enough for its lease to expire and be taken by someone else, whatever it is
+// protecting can reject the stale holder by refusing tokens lower than the latest it has seen.
+// A store opened with `OpenFile` writes each token to its file before granting the lease, so tokens
+// keep increasing after it's reopened. For an in-memory store they only increase for the life of the instance.
+
+var LeaseHeldError = errors.New("the lease is held by another owner")
+var LeaseNotHeldError = errors.New("the lease is not held, or has expired")
+var InvalidLeaseError = errors.New("lease owner and duration must be given")
+
+// Lease is a time-limited lock on a key
+type Lease struct {
+	Key     StoreKey
+	Owner   string
+	Token   uint64 // fencing token
+	Expires time.Time
+}
+
+// Acquire takes the lease on `key` for `owner`, lasting for `ttl`.
+// Fails with LeaseHeldError if another owner has an unexpired lease.
+// If `owner` already holds it, a new lease is granted with a new token, and the old one stops being valid.
+func (receiver *IndependentStore) Acquire(key StoreKey, owner string, ttl time.Duration) (Lease, error) {
+	return receiver.AcquireContext(context.Background(), key, owner, ttl)
+}
+
+// AcquireContext is `Acquire`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) AcquireContext(ctx context.Context, key StoreKey, owner string, ttl time.Duration) (Lease, error) {
+	if receiver == nil || !receiver.isOpen {return Lease{}, StoreNotOpenError}
+	if owner == "" || ttl <= 0 {return Lease{}, InvalidLeaseError}
+
+	if err := receiver.lockContext(ctx); err != nil {return Lease{}, err}
+	defer receiver.mutex.Unlock()
+
+	now := time.Now()
+	if current, ok := receiver.leases[key]; ok && now.Before(current.Expires) && current.Owner != owner {
+		return Lease{}, LeaseHeldError
+	}
+
+	token := receiver.fencingToken + 1
+	if receiver.log != nil {
+		if err := receiver.log.write(RecordLine{Op: OpFence, Token: token, Timestamp: now}); err != nil {return Lease{}, err}
+	}
+	receiver.fencingToken = token
+	lease := Lease{
+		Key:     key,
+		Owner:   owner,
+		Token:   token,
+		Expires: now.Add(ttl),
+	}
+	receiver.leases[key] = lease
+	return lease, nil
+}
+
+// Renew extends a lease that is still held, keeping its token.
+// Fails with LeaseNotHeldError if the lease has expired or been replaced.
+func (receiver *IndependentStore) Renew(lease Lease, ttl time.Duration) (Lease, error) {
+	return receiver.RenewContext(context.Background(), lease, ttl)
+}
+
+// RenewContext is `Renew`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) RenewContext(ctx context.Context, lease Lease, ttl time.Duration) (Lease, error) {
+	if receiver == nil || !receiver.isOpen {return Lease{}, StoreNotOpenError}
+	if ttl <= 0 {return Lease{}, InvalidLeaseError}
+
+	if err := receiver.lockContext(ctx); err != nil {return Lease{}, err}
+	defer receiver.mutex.Unlock()
+
+	now := time.Now()
+	current, ok := receiver.currentLeaseLocked(lease.Key, now)
+	if !ok || current.Token != lease.Token {return Lease{}, LeaseNotHeldError}
+
+	current.Expires = now.Add(ttl)
+	receiver.leases[lease.Key] = current
+	return current, nil
+}
+
+// Release gives up a lease early, so others can acquire it.
+// Fails with LeaseNotHeldError if the lease has already expired or been replaced.
+func (receiver *IndependentStore) Release(lease Lease) error {
+	return receiver.ReleaseContext(context.Background(), lease)
+}
+
+// ReleaseContext is `Release`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ReleaseContext(ctx context.Context, lease Lease) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.mutex.Unlock()
+
+	current, ok := receiver.currentLeaseLocked(lease.Key, time.Now())
+	if !ok || current.Token != lease.Token {return LeaseNotHeldError}
+
+	delete(receiver.leases, lease.Key)
+	return nil
+}
+
+// CurrentLease returns the unexpired lease on `key`, if there is one
+func (receiver *IndependentStore) CurrentLease(key StoreKey) (Lease, error) {
+	return receiver.CurrentLeaseContext(context.Background(), key)
+}
+
+// CurrentLeaseContext is `CurrentLease`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) CurrentLeaseContext(ctx context.Context, key StoreKey) (Lease, error) {
+	if receiver == nil || !receiver.isOpen {return Lease{}, StoreNotOpenError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return Lease{}, err}
+	defer receiver.mutex.RUnlock()
+
+	current, ok := receiver.currentLeaseLocked(key, time.Now())
+	if !ok {return Lease{}, LeaseNotHeldError}
+	return current, nil
+}
+
+// currentLeaseLocked finds an unexpired lease. Expired leases are left for `evictExpiredLeasesLocked`,
+// so this is safe to call under a read lock. Caller must hold the lock.
+func (receiver *IndependentStore) currentLeaseLocked(key StoreKey, now time.Time) (Lease, bool) {
+	current, ok := receiver.leases[key]
+	if !ok || !now.Before(current.Expires) {return Lease{}, false}
+	return current, true
+}
+
+// evictExpiredLeasesLocked drops every lease whose holder has stopped renewing it.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) evictExpiredLeasesLocked(now time.Time) {
+	for key, lease := range receiver.leases {
+		if !now.Before(lease.Expires) {delete(receiver.leases, key)}
+	}
+}
@@ -0,0 +1,106 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaseIsExclusiveUntilReleased(t *testing.T){
+	store := kvs.OpenNew()
+
+	first, err := store.Acquire("job:1", "worker-a", time.Minute)
+	if err != nil {t.Fatalf("Acquire failed with %v", err)}
+
+	if _, err = store.Acquire("job:1", "worker-b", time.Minute); err != kvs.LeaseHeldError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.LeaseHeldError, err)
+	}
+
+	if err = store.Release(first); err != nil {t.Errorf("Release failed with %v", err)}
+
+	second, err := store.Acquire("job:1", "worker-b", time.Minute)
+	if err != nil {t.Fatalf("Acquire failed with %v", err)}
+	if second.Token <= first.Token {
+		t.Errorf("Expected fencing token to increase, but got %d then %d", first.Token, second.Token)
+	}
+
+	// the old lease can't be used to release the new one
+	if err = store.Release(first); err != kvs.LeaseNotHeldError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.LeaseNotHeldError, err)
+	}
+}
+
+func TestLeaseExpiresWhenNotRenewed(t *testing.T){
+	store := kvs.OpenNew()
+
+	stale, err := store.Acquire("job:1", "worker-a", 10*time.Millisecond)
+	if err != nil {t.Fatalf("Acquire failed with %v", err)}
+
+	renewed, err := store.Renew(stale, 20*time.Millisecond)
+	if err != nil {t.Fatalf("Renew failed with %v", err)}
+	if renewed.Token != stale.Token {t.Errorf("Renew should keep the token")}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err = store.CurrentLease("job:1"); err != kvs.LeaseNotHeldError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.LeaseNotHeldError, err)
+	}
+	if _, err = store.Renew(renewed, time.Minute); err != kvs.LeaseNotHeldError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.LeaseNotHeldError, err)
+	}
+
+	takeover, err := store.Acquire("job:1", "worker-b", time.Minute)
+	if err != nil {t.Fatalf("Acquire after expiry failed with %v", err)}
+	if takeover.Owner != "worker-b" || takeover.Token <= stale.Token {
+		t.Errorf("Unexpected lease after takeover: %+v", takeover)
+	}
+}
+
+func TestOnlyOneOwnerWinsARace(t *testing.T){
+	store := kvs.OpenNew()
+
+	wait := &sync.WaitGroup{}
+	winners := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(owner string) {
+			defer wait.Done()
+			if _, err := store.Acquire("singleton", owner, time.Minute); err == nil {winners <- owner}
+		}("worker-" + s(i))
+	}
+	wait.Wait()
+	close(winners)
+
+	count := 0
+	for range winners {count++}
+	if count != 1 {t.Errorf("Expected exactly one winner, but got %d", count)}
+}
+
+func TestFencingTokensKeepIncreasingAfterReopen(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	store, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+
+	_, _ = store.Acquire("job:1", "worker-a", time.Minute)
+	stale, err := store.Acquire("job:2", "worker-a", time.Minute)
+	if err != nil {t.Fatalf("Acquire failed with %v", err)}
+	if err = store.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	fresh, err := reopened.Acquire("job:2", "worker-b", time.Minute)
+	if err != nil {t.Fatalf("Acquire failed with %v", err)}
+	if fresh.Token <= stale.Token {t.Errorf("Expected a token above %d after reopening, but got %d", stale.Token, fresh.Token)}
+
+	// compacting keeps the latest token too
+	if err = reopened.Compact(); err != nil {t.Fatalf("Compact failed with %v", err)}
+	if err = reopened.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+	compacted, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = compacted.Close() }()
+	if next, _ := compacted.Acquire("job:3", "worker-c", time.Minute); next.Token <= fresh.Token {
+		t.Errorf("Expected a token above %d after compacting, but got %d", fresh.Token, next.Token)
+	}
+}
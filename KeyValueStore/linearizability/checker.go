@@ -0,0 +1,192 @@
+package linearizability
+
+import (
+	kvs "KeyValueStore"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The checker is the Wing & Gong search, with the state cache from Lowe's
+// "Testing for linearizability" (the same approach as the Porcupine checker).
+// Keys are independent, so each key's operations are checked on their own, which keeps the search small.
+
+var NotLinearizableError = errors.New("the history is not linearizable")
+
+// Check looks for a valid order of the operations on every key.
+// The error names the first key it couldn't find one for; use `history.ForKey` to see what happened.
+func Check(history History) error {
+	byKey := map[kvs.StoreKey]History{}
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]kvs.StoreKey, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if !checkKey(byKey[key]) {
+			return fmt.Errorf("%w: no valid order for the %d operations on key '%s'", NotLinearizableError, len(byKey[key]), key)
+		}
+	}
+	return nil
+}
+
+//<editor-fold desc="Sequential model">
+
+// modelState is what a single key in a plain map holds
+type modelState struct {
+	present bool
+	value   int
+}
+
+// step plays one operation against the model. Returns false if the store could not have given the recorded result.
+func step(state modelState, op Operation) (modelState, bool) {
+	switch op.Kind {
+	case OpPut:
+		return modelState{present: true, value: op.Value}, true
+
+	case OpGet:
+		if !op.Found {return state, !state.present}
+		return state, state.present && state.value == op.Output
+
+	case OpDelete:
+		if !op.Found {return state, !state.present}
+		return modelState{}, state.present
+
+	case OpCompareAndSwap:
+		if !op.Found {return state, !state.present}
+		if !state.present {return state, false}
+		if !op.Swapped {return state, state.value != op.Expected}
+		if state.value != op.Expected {return state, false}
+		return modelState{present: true, value: op.Value}, true
+	}
+	return state, false
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Search">
+
+// event is a call or a return, in a linked list ordered by time
+type event struct {
+	op         int
+	isCall     bool
+	match      *event // the return for a call, and the call for a return
+	prev, next *event
+}
+
+type frame struct {
+	call  *event
+	state modelState
+}
+
+func checkKey(ops History) bool {
+	head := buildEvents(ops)
+	linearized := make([]uint64, (len(ops)+63)/64)
+	seen := map[string]struct{}{}
+	var stack []frame
+
+	state := modelState{}
+	current := head.next
+	for head.next != nil {
+		if current.isCall {
+			if next, ok := step(state, ops[current.op]); ok {
+				setBit(linearized, current.op)
+				cacheKey := stateKey(linearized, next)
+				if _, done := seen[cacheKey]; !done {
+					// take this operation as the next one, and start again from the earliest remaining call
+					seen[cacheKey] = struct{}{}
+					stack = append(stack, frame{call: current, state: state})
+					state = next
+					lift(current)
+					current = head.next
+					continue
+				}
+				clearBit(linearized, current.op)
+			}
+			current = current.next
+			continue
+		}
+
+		// reached a return whose call we couldn't place: undo the last choice and try the one after it
+		if len(stack) < 1 {return false}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		clearBit(linearized, top.call.op)
+		unlift(top.call)
+		current = top.call.next
+	}
+	return true
+}
+
+// buildEvents makes the time-ordered list of calls and returns, behind a dummy head
+func buildEvents(ops History) *event {
+	events := make([]*event, 0, len(ops)*2)
+	for i := range ops {
+		call := &event{op: i, isCall: true}
+		ret := &event{op: i, match: call}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+
+	timeOf := func(e *event) int64 {
+		if e.isCall {return ops[e.op].Call.UnixNano()}
+		return ops[e.op].Return.UnixNano()
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		left, right := timeOf(events[i]), timeOf(events[j])
+		if left != right {return left < right}
+		return events[i].isCall && !events[j].isCall // a tie counts as overlapping, which gives the store the benefit of the doubt
+	})
+
+	head := &event{}
+	previous := head
+	for _, e := range events {
+		e.prev = previous
+		previous.next = e
+		previous = e
+	}
+	return head
+}
+
+// lift takes a call and its return out of the list
+func lift(call *event) {
+	call.prev.next = call.next
+	call.next.prev = call.prev // a call is always followed by at least its own return
+
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {ret.next.prev = ret.prev}
+}
+
+// unlift puts back what `lift` took out
+func unlift(call *event) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {ret.next.prev = ret}
+
+	call.prev.next = call
+	call.next.prev = call
+}
+
+func setBit(bits []uint64, i int)   { bits[i/64] |= 1 << uint(i%64) }
+func clearBit(bits []uint64, i int) { bits[i/64] &^= 1 << uint(i%64) }
+
+// stateKey identifies a point in the search: which operations are done, and what the key holds after them
+func stateKey(bits []uint64, state modelState) string {
+	buffer := make([]byte, len(bits)*8+9)
+	for i, word := range bits {
+		binary.LittleEndian.PutUint64(buffer[i*8:], word)
+	}
+	if state.present {buffer[len(bits)*8] = 1}
+	binary.LittleEndian.PutUint64(buffer[len(bits)*8+1:], uint64(state.value))
+	return string(buffer)
+}
+
+//</editor-fold>
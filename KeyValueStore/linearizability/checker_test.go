@@ -0,0 +1,62 @@
+package linearizability_test
+
+import (
+	kvs "KeyValueStore"
+	"KeyValueStore/linearizability"
+	"errors"
+	"testing"
+	"time"
+)
+
+// at gives a time `n` ticks into a made-up history
+func at(n int) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(n) * time.Millisecond)
+}
+
+func put(client, value, call, ret int) linearizability.Operation {
+	return linearizability.Operation{Client: client, Kind: linearizability.OpPut, Key: "k", Value: value, Call: at(call), Return: at(ret)}
+}
+
+func get(client, output int, found bool, call, ret int) linearizability.Operation {
+	return linearizability.Operation{Client: client, Kind: linearizability.OpGet, Key: "k", Found: found, Output: output, Call: at(call), Return: at(ret)}
+}
+
+func TestCheckerAllowsAnyOrderOfOverlappingCalls(t *testing.T){
+	// the get overlaps both puts, so it could have seen either, or nothing at all
+	for _, output := range []int{1, 2} {
+		history := linearizability.History{put(0, 1, 0, 10), put(1, 2, 2, 12), get(2, output, true, 1, 20)}
+		if err := linearizability.Check(history); err != nil {t.Errorf("Expected get of %d to be allowed, but got %v", output, err)}
+	}
+	history := linearizability.History{put(0, 1, 0, 10), get(1, 0, false, 1, 5)}
+	if err := linearizability.Check(history); err != nil {t.Errorf("Expected get before put to be allowed, but got %v", err)}
+}
+
+func TestCheckerRejectsStaleReads(t *testing.T){
+	history := linearizability.History{put(0, 1, 0, 1), put(0, 2, 2, 3), get(1, 1, true, 4, 5)}
+	if err := linearizability.Check(history); !errors.Is(err, linearizability.NotLinearizableError) {
+		t.Errorf("Expected '%v', but got '%v'", linearizability.NotLinearizableError, err)
+	}
+
+	// two reads that disagree on the order of the puts
+	history = linearizability.History{put(0, 1, 0, 10), put(1, 2, 0, 10), get(2, 1, true, 11, 12), get(3, 2, true, 13, 14), get(2, 1, true, 15, 16)}
+	if err := linearizability.Check(history); !errors.Is(err, linearizability.NotLinearizableError) {
+		t.Errorf("Expected '%v', but got '%v'", linearizability.NotLinearizableError, err)
+	}
+}
+
+// forgetfulStore says deletes worked, but doesn't do them
+type forgetfulStore struct{ *kvs.IndependentStore }
+
+func (store forgetfulStore) Delete(key kvs.StoreKey) error {
+	if !store.Contains(key) {return kvs.KeyNotPresentError}
+	return nil
+}
+
+func TestCheckerCatchesABrokenStore(t *testing.T){
+	history, err := linearizability.Run(forgetfulStore{kvs.OpenNew()}, linearizability.Config{Clients: 2, OperationsPerClient: 100, Seed: 1})
+	if err != nil {t.Fatalf("Run failed with %v", err)}
+
+	if err = linearizability.Check(history); !errors.Is(err, linearizability.NotLinearizableError) {
+		t.Errorf("Expected '%v', but got '%v'", linearizability.NotLinearizableError, err)
+	}
+}
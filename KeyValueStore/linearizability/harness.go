@@ -0,0 +1,179 @@
+// Package linearizability checks that a store behaves like a single copy of the data, even under concurrent use.
+//
+// `Run` sets several clients loose on a store at once, doing random puts, gets, deletes and
+// compare-and-swaps over a few keys, and records when each call started and finished and what it returned.
+// `Check` then searches for a one-at-a-time order of those operations that gives the same results
+// when played against a plain map, where each operation takes effect at some instant between its call and its return.
+// If there's no such order, some client saw something that a correctly locked store could never show it.
+//
+// Run the tests with `-race` as well: this finds wrong answers, the race detector finds lucky ones.
+package linearizability
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store is the part of a store that the harness exercises. `*keyvaluestore.IndependentStore` is one.
+type Store interface {
+	Put(key kvs.StoreKey, value interface{}) error
+	Get(key kvs.StoreKey) (interface{}, error)
+	Delete(key kvs.StoreKey) error
+	CompareAndSwap(key kvs.StoreKey, expected, replacement interface{}) (bool, error)
+}
+
+// OpKind is the kind of call a client made
+type OpKind int
+
+const (
+	OpPut OpKind = iota
+	OpGet
+	OpDelete
+	OpCompareAndSwap
+)
+
+func (kind OpKind) String() string {
+	switch kind {
+	case OpPut:
+		return "put"
+	case OpGet:
+		return "get"
+	case OpDelete:
+		return "delete"
+	case OpCompareAndSwap:
+		return "cas"
+	default:
+		return "unknown"
+	}
+}
+
+// Operation is one call made by a client, and what came back
+type Operation struct {
+	Client   int
+	Kind     OpKind
+	Key      kvs.StoreKey
+	Value    int // the value put, or the replacement for a compare-and-swap
+	Expected int // the value a compare-and-swap expected
+
+	Call   time.Time
+	Return time.Time
+
+	Found   bool // the key was there (get, delete and compare-and-swap)
+	Output  int  // the value a get read
+	Swapped bool // a compare-and-swap made its change
+}
+
+// History is every operation from a run, in no particular order
+type History []Operation
+
+// Config controls the random workload. Zero fields get sensible defaults.
+type Config struct {
+	Clients             int
+	OperationsPerClient int
+	Keys                int   // fewer keys means more contention
+	Values              int   // fewer values means more compare-and-swaps succeed
+	Seed                int64 // runs with the same seed make the same calls, but the interleaving is up to the scheduler
+}
+
+func (op Operation) String() string {
+	timing := fmt.Sprintf("[%d..%d]", op.Call.UnixNano(), op.Return.UnixNano())
+	switch op.Kind {
+	case OpPut:
+		return fmt.Sprintf("client %d %s put(%s, %d)", op.Client, timing, op.Key, op.Value)
+	case OpGet:
+		if !op.Found {return fmt.Sprintf("client %d %s get(%s) -> not present", op.Client, timing, op.Key)}
+		return fmt.Sprintf("client %d %s get(%s) -> %d", op.Client, timing, op.Key, op.Output)
+	case OpDelete:
+		return fmt.Sprintf("client %d %s delete(%s) -> found=%v", op.Client, timing, op.Key, op.Found)
+	default:
+		return fmt.Sprintf("client %d %s cas(%s, %d, %d) -> found=%v swapped=%v",
+			op.Client, timing, op.Key, op.Expected, op.Value, op.Found, op.Swapped)
+	}
+}
+
+// ForKey picks out the operations on one key, which is all `Check` needs to look at together
+func (history History) ForKey(key kvs.StoreKey) History {
+	result := History{}
+	for _, op := range history {
+		if op.Key == key {result = append(result, op)}
+	}
+	return result
+}
+
+// Run has `config.Clients` goroutines make random calls to the store at the same time, and records them all.
+// Any error other than KeyNotPresentError stops the run, as the store is not working at all.
+func Run(store Store, config Config) (History, error) {
+	if config.Clients < 1 {config.Clients = 4}
+	if config.OperationsPerClient < 1 {config.OperationsPerClient = 100}
+	if config.Keys < 1 {config.Keys = 3}
+	if config.Values < 1 {config.Values = 4}
+
+	histories := make([]History, config.Clients)
+	errs := make([]error, config.Clients)
+	start := make(chan struct{})
+	waitGroup := sync.WaitGroup{}
+
+	for client := 0; client < config.Clients; client++ {
+		waitGroup.Add(1)
+		go func(client int) {
+			defer waitGroup.Done()
+			random := rand.New(rand.NewSource(config.Seed*1000 + int64(client)))
+			<-start // line everyone up, so the calls really do overlap
+
+			for i := 0; i < config.OperationsPerClient; i++ {
+				op, err := runOne(store, client, random, config)
+				if err != nil {
+					errs[client] = err
+					return
+				}
+				histories[client] = append(histories[client], op)
+			}
+		}(client)
+	}
+	close(start)
+	waitGroup.Wait()
+
+	history := History{}
+	for client := range histories {
+		if errs[client] != nil {return history, fmt.Errorf("client %d: %w", client, errs[client])}
+		history = append(history, histories[client]...)
+	}
+	return history, nil
+}
+
+func runOne(store Store, client int, random *rand.Rand, config Config) (Operation, error) {
+	op := Operation{
+		Client:   client,
+		Kind:     OpKind(random.Intn(4)),
+		Key:      kvs.StoreKey("key-" + strconv.Itoa(random.Intn(config.Keys))),
+		Value:    random.Intn(config.Values),
+		Expected: random.Intn(config.Values),
+	}
+
+	var err error
+	op.Call = time.Now()
+	switch op.Kind {
+	case OpPut:
+		err = store.Put(op.Key, op.Value)
+	case OpGet:
+		var value interface{}
+		if value, err = store.Get(op.Key); err == nil {
+			output, isInt := value.(int)
+			if !isInt {return op, fmt.Errorf("get(%s) returned %#v, which was never put", op.Key, value)}
+			op.Found, op.Output = true, output
+		}
+	case OpDelete:
+		if err = store.Delete(op.Key); err == nil {op.Found = true}
+	case OpCompareAndSwap:
+		if op.Swapped, err = store.CompareAndSwap(op.Key, op.Expected, op.Value); err == nil {op.Found = true}
+	}
+	op.Return = time.Now()
+
+	if errors.Is(err, kvs.KeyNotPresentError) {err = nil}
+	return op, err
+}
@@ -0,0 +1,38 @@
+package linearizability_test
+
+import (
+	kvs "KeyValueStore"
+	"KeyValueStore/linearizability"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndependentStoreIsLinearizable(t *testing.T){
+	for seed := int64(1); seed <= 10; seed++ {
+		store := kvs.OpenNew()
+		history, err := linearizability.Run(store, linearizability.Config{Clients: 8, OperationsPerClient: 200, Keys: 4, Values: 3, Seed: seed})
+		if err != nil {t.Fatalf("Run failed with %v", err)}
+
+		if len(history) != 8*200 {t.Errorf("Expected 1600 operations, but got %d", len(history))}
+		if err = linearizability.Check(history); err != nil {t.Fatalf("Seed %d: %v", seed, err)}
+	}
+}
+
+func TestFileBackedStoreIsLinearizable(t *testing.T){
+	store, err := kvs.OpenFile(filepath.Join(t.TempDir(), "store.kvs"), kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = store.Close() }()
+
+	history, err := linearizability.Run(store, linearizability.Config{Clients: 6, OperationsPerClient: 100, Keys: 2})
+	if err != nil {t.Fatalf("Run failed with %v", err)}
+	if err = linearizability.Check(history); err != nil {t.Fatal(err)}
+}
+
+func TestRunStopsOnStoreErrors(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.Close()
+
+	if _, err := linearizability.Run(store, linearizability.Config{}); err == nil {
+		t.Errorf("Expected a closed store to fail the run")
+	}
+}
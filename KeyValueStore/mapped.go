@@ -0,0 +1,576 @@
+package keyvaluestore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// A mapped store keeps its keys and values in a file that is memory-mapped, rather than on the Go heap,
+// so the garbage collector never has to walk them and opening the store doesn't load anything.
+// The file is a hash table with open addressing, followed by the records it points to:
+//
+//     header   64 bytes: [magic "KVSMAP01"][slot count][end of data][live keys][tombstones][dead bytes][closed cleanly][spare]
+//     slots    32 bytes each: [key hash][record offset][last access, unix ns][expiry, unix ns]
+//     records  [key length: uint32][type name length: uint32][value length: uint32][key][type name][value JSON]
+//
+// Numbers are little-endian uint64s, except the lengths in records, and the last access time, which is
+// in the machine's own byte order because `Get` updates it atomically under the read lock.
+// A slot's hash is 0 if it has never been used, and 1 if its key was removed (a tombstone), which lookups
+// step over. Lookups probe linearly from the key's hash.
+// Records are only ever appended: changing a value writes a new record, and the old one is dead space.
+// When the slots get three quarters full, or half the records are dead, the whole table is copied into
+// a new file (twice the size, or the same size to drop the dead space) which then replaces the old one.
+//
+// Values are written with `EncodeValue`, so as with `OpenFile` your own types must be registered with
+// `RegisterType` to come back as themselves. Values that would come back as something else are also
+// kept on the heap while the store is open, so nothing changes until the store is opened again.
+
+var MappedFileError = errors.New("the file is not a mapped key value store, or is damaged")
+var MappingNotSupportedError = errors.New("memory-mapped stores are not supported on this platform")
+
+// MappedOptions change how a mapped store file is created
+type MappedOptions struct {
+	// ExpectedKeys sizes the hash table of a new file, to save rebuilding it as the keys go in. Ignored for existing files.
+	ExpectedKeys int
+}
+
+const (
+	mappedMagic           = "KVSMAP01"
+	mappedHeaderLen       = 64
+	mappedSlotLen         = 32
+	mappedRecordHeaderLen = 12
+	minMappedSlots        = 1024
+	minMappedData         = 64 << 10
+
+	headerSlotCount  = 8
+	headerDataEnd    = 16
+	headerUsed       = 24
+	headerTombstones = 32
+	headerDead       = 40
+	headerClean      = 48
+
+	slotHash    = 0
+	slotRecord  = 8
+	slotAccess  = 16
+	slotExpires = 24
+
+	emptySlot     = 0
+	tombstoneSlot = 1
+)
+
+// mappedBackend is a backend in a memory-mapped file
+type mappedBackend struct {
+	path       string
+	file       *os.File
+	data       []byte                   // the whole file; nil when closed
+	generation uint64                   // goes up whenever slots move, so entries know to look their key up again
+	live       map[StoreKey]interface{} // values the file can't give back as the same type
+}
+
+// mappedEntry is a stored value, read from the file as needed
+type mappedEntry struct {
+	core       *mappedBackend
+	key        StoreKey
+	slot       int // offset of the key's slot
+	generation uint64
+}
+
+//<editor-fold desc="Opening and closing">
+
+// OpenMapped opens a store whose keys and values live in a memory-mapped file at `path`, creating the file if needed.
+// Opening is quick however big the file is, and the data set can be bigger than memory.
+// Every read decodes the value from the file, so this is slower than `OpenFile` for small stores that fit in memory.
+// Changes go straight into the file; `Sync` makes sure they are on disk, and `Close` does too.
+func OpenMapped(path string, options MappedOptions) (*IndependentStore, error) {
+	core, err := openMappedBackend(path, options)
+	if err != nil {return nil, err}
+
+	store := OpenNew()
+	store.core = core
+
+	// indexes are only kept in memory, so put back any for indexed types that were stored
+	core.each(func(key StoreKey, value StoreValue) bool {
+		if isIndexedType(value.(*mappedEntry).typeName()) {store.reindexLocked(key, value.GetValue())}
+		return true
+	})
+	return store, nil
+}
+
+func openMappedBackend(path string, options MappedOptions) (*mappedBackend, error) {
+	core := &mappedBackend{path: path, live: map[StoreKey]interface{}{}}
+	if err := core.open(options.ExpectedKeys); err != nil {return nil, err}
+	return core, nil
+}
+
+func (core *mappedBackend) open(expectedKeys int) error {
+	file, err := os.OpenFile(core.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {return err}
+
+	size, err := prepareMappedFile(file, slotsFor(expectedKeys), minMappedData)
+	if err == nil {core.data, err = mapFile(file, size)}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	core.file = file
+
+	if !core.valid() {
+		_ = core.close()
+		return MappedFileError
+	}
+	if core.header(headerClean) == 0 {core.recount()} // not closed properly, so the counts may be out
+	core.setHeader(headerClean, 0)
+	core.generation++
+	return nil
+}
+
+// prepareMappedFile writes an empty table into a new (empty) file, and returns the file's size
+func prepareMappedFile(file *os.File, slots int, dataSpace int) (int, error) {
+	info, err := file.Stat()
+	if err != nil {return 0, err}
+	if info.Size() > 0 {return int(info.Size()), nil}
+
+	dataStart := mappedHeaderLen + slots*mappedSlotLen
+	size := dataStart + dataSpace
+	if err = file.Truncate(int64(size)); err != nil {return 0, err}
+
+	header := make([]byte, mappedHeaderLen)
+	copy(header, mappedMagic)
+	binary.LittleEndian.PutUint64(header[headerSlotCount:], uint64(slots))
+	binary.LittleEndian.PutUint64(header[headerDataEnd:], uint64(dataStart))
+	binary.LittleEndian.PutUint64(header[headerClean:], 1)
+	if _, err = file.WriteAt(header, 0); err != nil {return 0, err}
+	return size, nil
+}
+
+// slotsFor picks a table size that holds `keys` keys without being more than three quarters full
+func slotsFor(keys int) int {
+	slots := minMappedSlots
+	for keys*4 >= slots*3 {
+		slots *= 2
+	}
+	return slots
+}
+
+// valid checks the header makes sense, so a damaged file can't send us outside the mapping
+func (core *mappedBackend) valid() bool {
+	if len(core.data) < mappedHeaderLen || string(core.data[:len(mappedMagic)]) != mappedMagic {return false}
+
+	slots := core.header(headerSlotCount)
+	if slots < 1 || slots&(slots-1) != 0 || slots > uint64(len(core.data)/mappedSlotLen) {return false}
+
+	dataEnd := core.header(headerDataEnd)
+	return dataEnd >= uint64(core.dataStart()) && dataEnd <= uint64(len(core.data))
+}
+
+// recount works out the header counts from the slots
+func (core *mappedBackend) recount() {
+	used, tombstones, liveBytes := 0, 0, 0
+	for i := 0; i < core.slotCount(); i++ {
+		slot := core.slotAt(i)
+		switch core.u64(slot + slotHash) {
+		case emptySlot:
+		case tombstoneSlot:
+			tombstones++
+		default:
+			used++
+			liveBytes += core.recordLen(int(core.u64(slot + slotRecord)))
+		}
+	}
+
+	core.setHeader(headerUsed, uint64(used))
+	core.setHeader(headerTombstones, uint64(tombstones))
+	core.setHeader(headerDead, uint64(int(core.header(headerDataEnd))-core.dataStart()-liveBytes))
+}
+
+func (core *mappedBackend) close() error {
+	if core.data == nil {return nil}
+
+	core.setHeader(headerClean, 1)
+	err := syncMapping(core.data)
+	if unmapErr := unmapFile(core.data); err == nil {err = unmapErr}
+	if closeErr := core.file.Close(); err == nil {err = closeErr}
+	core.data, core.file = nil, nil
+	return err
+}
+
+func (core *mappedBackend) reopen() error {
+	if core.data != nil {return nil}
+	return core.open(0)
+}
+
+func (core *mappedBackend) flush() error {
+	if core.data == nil {return StoreNotOpenError}
+	return syncMapping(core.data)
+}
+
+func (core *mappedBackend) compact() error {
+	if core.data == nil {return StoreNotOpenError}
+	return core.rebuild(slotsFor(core.count()), 0)
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Backend">
+
+func (core *mappedBackend) get(key StoreKey) (StoreValue, bool) {
+	if core.data == nil {return nil, false}
+
+	i, found, _ := core.find(key)
+	if !found {return nil, false}
+	return &mappedEntry{core: core, key: key, slot: core.slotAt(i), generation: core.generation}, true
+}
+
+func (core *mappedBackend) set(key StoreKey, value StoreValue) error {
+	if core.data == nil {return StoreNotOpenError}
+
+	stored := value.GetValue()
+	encoded, err := EncodeValue(stored)
+	if err != nil {return err}
+
+	length := mappedRecordHeaderLen + len(key) + len(encoded.Type) + len(encoded.Value)
+	if uint64(length) > math.MaxUint32 {return RecordTooLargeError}
+	_, replacing, _ := core.find(key)
+	if err = core.makeRoom(replacing, length); err != nil {return err}
+
+	i, found, free := core.find(key)
+	offset := core.appendRecord(string(key), encoded.Type, encoded.Value)
+
+	if found {
+		slot := core.slotAt(i)
+		core.addHeader(headerDead, uint64(core.recordLen(int(core.u64(slot+slotRecord)))))
+		core.writeSlot(slot, offset, value.GetTimestamp(), expiryOf(value))
+	} else {
+		slot := core.slotAt(free)
+		if core.u64(slot+slotHash) == tombstoneSlot {core.addHeader(headerTombstones, math.MaxUint64)} // i.e. minus one
+		core.writeSlot(slot, offset, value.GetTimestamp(), expiryOf(value))
+		core.setU64(slot+slotHash, hashKey(string(key))) // last, so the slot is never live without its record
+		core.addHeader(headerUsed, 1)
+	}
+
+	if encoded.Type == typeJson {
+		core.live[key] = stored
+	} else {
+		delete(core.live, key)
+	}
+	return nil
+}
+
+func (core *mappedBackend) remove(key StoreKey) {
+	if core.data == nil {return}
+
+	i, found, _ := core.find(key)
+	if !found {return}
+
+	slot := core.slotAt(i)
+	core.addHeader(headerDead, uint64(core.recordLen(int(core.u64(slot+slotRecord)))))
+	core.setU64(slot+slotHash, tombstoneSlot)
+	core.addHeader(headerUsed, math.MaxUint64)
+	core.addHeader(headerTombstones, 1)
+	delete(core.live, key)
+}
+
+func (core *mappedBackend) count() int {
+	if core.data == nil {return 0}
+	return int(core.header(headerUsed))
+}
+
+func (core *mappedBackend) each(visit func(key StoreKey, value StoreValue) bool) {
+	if core.data == nil {return}
+
+	for i := 0; i < core.slotCount(); i++ {
+		slot := core.slotAt(i)
+		if core.u64(slot+slotHash) <= tombstoneSlot {continue}
+
+		key := StoreKey(core.recordKey(int(core.u64(slot + slotRecord))))
+		if !visit(key, &mappedEntry{core: core, key: key, slot: slot, generation: core.generation}) {return}
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Entries">
+
+func (entry *mappedEntry) GetValue() interface{} {
+	if value, ok := entry.core.live[entry.key]; ok {return value}
+
+	slot, ok := entry.slotNow()
+	if !ok {return nil}
+
+	record := int(entry.core.u64(slot + slotRecord))
+	encoded := TypedValue{
+		Type:  entry.core.recordType(record),
+		Value: append(json.RawMessage(nil), entry.core.recordValue(record)...), // the mapping can move, so never hold on to it
+	}
+	value, err := DecodeValue(encoded)
+	if err != nil {return encoded} // only if a registered type has changed shape since; keep what was stored rather than lose it
+	return value
+}
+
+func (entry *mappedEntry) GetTimestamp() time.Time {
+	slot, ok := entry.slotNow()
+	if !ok {return time.Time{}}
+	return timeFromNanos(atomic.LoadInt64(entry.core.accessTime(slot)))
+}
+
+func (entry *mappedEntry) SetTimestamp(t time.Time) {
+	slot, ok := entry.slotNow()
+	if !ok {return}
+	atomic.StoreInt64(entry.core.accessTime(slot), nanosFor(t))
+}
+
+func (entry *mappedEntry) expiresAt() time.Time {
+	slot, ok := entry.slotNow()
+	if !ok {return time.Time{}}
+	return timeFromNanos(int64(entry.core.u64(slot + slotExpires)))
+}
+
+func (entry *mappedEntry) typeName() string {
+	slot, ok := entry.slotNow()
+	if !ok {return ""}
+	return entry.core.recordType(int(entry.core.u64(slot + slotRecord)))
+}
+
+// slotNow finds the entry's slot, looking it up again if the table has been rebuilt since
+func (entry *mappedEntry) slotNow() (int, bool) {
+	if entry.core.data == nil {return 0, false}
+	if entry.generation == entry.core.generation {return entry.slot, true}
+
+	i, found, _ := entry.core.find(entry.key)
+	if !found {return 0, false}
+	entry.slot, entry.generation = entry.core.slotAt(i), entry.core.generation
+	return entry.slot, true
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Table">
+
+// find looks up a key. If it isn't there, `free` is the slot it should go in.
+func (core *mappedBackend) find(key StoreKey) (i int, found bool, free int) {
+	slots := core.slotCount()
+	hash := hashKey(string(key))
+	free = -1
+
+	i = int(hash & uint64(slots-1))
+	for probes := 0; probes < slots; probes++ {
+		slot := core.slotAt(i)
+		switch stored := core.u64(slot + slotHash); {
+		case stored == emptySlot:
+			if free < 0 {free = i}
+			return i, false, free
+		case stored == tombstoneSlot:
+			if free < 0 {free = i}
+		case stored == hash && string(core.recordPart(int(core.u64(slot+slotRecord)), 0)) == string(key): // no copy for the comparison
+			return i, true, free
+		}
+		i = (i + 1) & (slots - 1)
+	}
+	return -1, false, free // only when every slot is a tombstone; `makeRoom` never lets it get that far
+}
+
+// makeRoom rebuilds or grows the file if a record of `length` bytes (for a new key, unless `replacing`) won't fit well
+func (core *mappedBackend) makeRoom(replacing bool, length int) error {
+	slots, used, tombstones := core.slotCount(), int(core.header(headerUsed)), int(core.header(headerTombstones))
+	if !replacing && (used+tombstones+1)*4 > slots*3 {
+		if (used+1)*2 > slots {slots *= 2} // otherwise it's mostly tombstones, and a rebuild at this size clears them
+		return core.rebuild(slots, length)
+	}
+
+	dead, records := int(core.header(headerDead)), int(core.header(headerDataEnd))-core.dataStart()
+	if dead > minMappedData && dead*2 > records {return core.rebuild(slots, length)}
+
+	if int(core.header(headerDataEnd))+length > len(core.data) {return core.grow(length)}
+	return nil
+}
+
+// grow makes the file bigger, so there's room for at least `length` more bytes of records
+func (core *mappedBackend) grow(length int) error {
+	size := len(core.data) * 2
+	for size < int(core.header(headerDataEnd))+length {
+		size *= 2
+	}
+	if err := core.file.Truncate(int64(size)); err != nil {return err}
+
+	if err := unmapFile(core.data); err != nil {return err}
+	data, err := mapFile(core.file, size)
+	if err != nil {
+		core.data = nil // unusable until reopened
+		return err
+	}
+	core.data = data
+	return nil
+}
+
+// rebuild copies every live key into a new file with `slots` slots and room for `length` more bytes, then swaps it in
+func (core *mappedBackend) rebuild(slots int, length int) (err error) {
+	liveBytes := int(core.header(headerDataEnd)) - core.dataStart() - int(core.header(headerDead))
+	dataSpace := (liveBytes + length) * 2
+	if dataSpace < minMappedData {dataSpace = minMappedData}
+
+	tempPath := core.path + ".rebuild"
+	_ = os.Remove(tempPath) // left over from a crash
+	file, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {return err}
+
+	fresh := &mappedBackend{path: core.path, file: file}
+	defer func() {
+		if err == nil {return}
+		if fresh.data != nil {_ = unmapFile(fresh.data)}
+		_ = file.Close()
+		_ = os.Remove(tempPath)
+	}()
+
+	size, err := prepareMappedFile(file, slots, dataSpace)
+	if err != nil {return err}
+	if fresh.data, err = mapFile(file, size); err != nil {return err}
+
+	for i := 0; i < core.slotCount(); i++ {
+		slot := core.slotAt(i)
+		hash := core.u64(slot + slotHash)
+		if hash <= tombstoneSlot {continue}
+
+		record := int(core.u64(slot + slotRecord))
+		offset := fresh.appendRecord(core.recordKey(record), core.recordType(record), core.recordValue(record))
+		target := fresh.slotAt(fresh.freeSlotFor(hash))
+		atomic.StoreInt64(fresh.accessTime(target), atomic.LoadInt64(core.accessTime(slot)))
+		fresh.setU64(target+slotRecord, uint64(offset))
+		fresh.setU64(target+slotExpires, core.u64(slot+slotExpires))
+		fresh.setU64(target+slotHash, hash)
+	}
+	fresh.setHeader(headerUsed, core.header(headerUsed))
+	fresh.setHeader(headerClean, 0)
+
+	if err = syncMapping(fresh.data); err != nil {return err}
+	if err = os.Rename(tempPath, core.path); err != nil {return err}
+
+	// the new file is in place now, so failing to let go of the old one doesn't matter
+	_ = unmapFile(core.data)
+	_ = core.file.Close()
+	core.file, core.data = file, fresh.data
+	core.generation++
+	return nil
+}
+
+// freeSlotFor finds the first empty slot for a hash, for filling a new table that has no tombstones or duplicates
+func (core *mappedBackend) freeSlotFor(hash uint64) int {
+	mask := uint64(core.slotCount() - 1)
+	i := hash & mask
+	for core.u64(core.slotAt(int(i))+slotHash) != emptySlot {
+		i = (i + 1) & mask
+	}
+	return int(i)
+}
+
+func (core *mappedBackend) writeSlot(slot int, record int, lastAccess, expires time.Time) {
+	core.setU64(slot+slotRecord, uint64(record))
+	core.setU64(slot+slotExpires, uint64(nanosFor(expires)))
+	atomic.StoreInt64(core.accessTime(slot), nanosFor(lastAccess))
+}
+
+// appendRecord writes a record at the end of the data, which must have room for it, and returns its offset
+func (core *mappedBackend) appendRecord(key string, typeName string, value []byte) int {
+	offset := int(core.header(headerDataEnd))
+	binary.LittleEndian.PutUint32(core.data[offset:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(core.data[offset+4:], uint32(len(typeName)))
+	binary.LittleEndian.PutUint32(core.data[offset+8:], uint32(len(value)))
+
+	next := offset + mappedRecordHeaderLen
+	next += copy(core.data[next:], key)
+	next += copy(core.data[next:], typeName)
+	next += copy(core.data[next:], value)
+
+	core.setHeader(headerDataEnd, uint64(next))
+	return offset
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Reading the file">
+
+func (core *mappedBackend) slotCount() int { return int(core.header(headerSlotCount)) }
+func (core *mappedBackend) slotAt(i int) int { return mappedHeaderLen + i*mappedSlotLen }
+func (core *mappedBackend) dataStart() int { return core.slotAt(core.slotCount()) }
+
+func (core *mappedBackend) header(field int) uint64 { return core.u64(field) }
+func (core *mappedBackend) setHeader(field int, value uint64) { core.setU64(field, value) }
+func (core *mappedBackend) addHeader(field int, delta uint64) { core.setU64(field, core.u64(field)+delta) }
+
+func (core *mappedBackend) u64(offset int) uint64 { return binary.LittleEndian.Uint64(core.data[offset:]) }
+func (core *mappedBackend) setU64(offset int, value uint64) {
+	binary.LittleEndian.PutUint64(core.data[offset:], value)
+}
+
+// accessTime points at a slot's last access time. Slots are 8-byte aligned, and mappings start on a page.
+func (core *mappedBackend) accessTime(slot int) *int64 {
+	return (*int64)(unsafe.Pointer(&core.data[slot+slotAccess]))
+}
+
+// recordPart returns a part of the record at `offset`: 0 for the key, 1 for the type name, 2 for the value.
+// A damaged offset or length gives an empty part rather than a read outside the mapping.
+func (core *mappedBackend) recordPart(offset int, part int) []byte {
+	dataEnd := int(core.header(headerDataEnd))
+	if offset < core.dataStart() || offset+mappedRecordHeaderLen > dataEnd {return nil}
+
+	start := offset + mappedRecordHeaderLen
+	for i := 0; i < part; i++ {
+		start += int(binary.LittleEndian.Uint32(core.data[offset+4*i:]))
+	}
+	end := start + int(binary.LittleEndian.Uint32(core.data[offset+4*part:]))
+	if end > dataEnd {return nil}
+	return core.data[start:end]
+}
+
+func (core *mappedBackend) recordKey(offset int) string   { return string(core.recordPart(offset, 0)) }
+func (core *mappedBackend) recordType(offset int) string  { return string(core.recordPart(offset, 1)) }
+func (core *mappedBackend) recordValue(offset int) []byte { return core.recordPart(offset, 2) }
+
+// recordLen is the whole length of the record at `offset`, or zero if it's damaged
+func (core *mappedBackend) recordLen(offset int) int {
+	value := core.recordPart(offset, 2)
+	if value == nil {return 0}
+	return cap(core.data[offset:]) - cap(value[len(value):]) // from the start of the record to the end of its value
+}
+
+//</editor-fold>
+
+// hashKey is 64-bit FNV-1a, moved clear of the two special slot values
+func hashKey(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	if hash <= tombstoneSlot {hash += 2}
+	return hash
+}
+
+// nanosFor converts a time for a slot, keeping the zero time (which `UnixNano` can't represent) distinct
+func nanosFor(t time.Time) int64 {
+	if t.IsZero() {return math.MinInt64}
+	return t.UnixNano()
+}
+
+func timeFromNanos(nanos int64) time.Time {
+	if nanos == math.MinInt64 {return time.Time{}}
+	return time.Unix(0, nanos)
+}
+
+// isIndexedType is true for registered struct types with `kvindex` tags
+func isIndexedType(typeName string) bool {
+	registered, ok := registeredTypes.Load(typeName)
+	if !ok {return false}
+
+	goType := registered.(reflect.Type)
+	for goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+	return goType.Kind() == reflect.Struct && len(indexedFieldsOf(goType)) > 0
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package keyvaluestore
+
+import "os"
+
+func mapFile(file *os.File, size int) ([]byte, error) {
+	return nil, MappingNotSupportedError
+}
+
+func unmapFile(data []byte) error {
+	return MappingNotSupportedError
+}
+
+func syncMapping(data []byte) error {
+	return MappingNotSupportedError
+}
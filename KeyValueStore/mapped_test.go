@@ -0,0 +1,143 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openMappedOrSkip(t *testing.T, path string) *kvs.IndependentStore {
+	t.Helper()
+	store, err := kvs.OpenMapped(path, kvs.MappedOptions{})
+	if errors.Is(err, kvs.MappingNotSupportedError) {t.Skip("can't map files on this platform")}
+	if err != nil {t.Fatalf("OpenMapped failed with %v", err)}
+	return store
+}
+
+func TestMappedStoreSurvivesReopen(t *testing.T){
+	kvs.RegisterType(indexedUser{})
+	path := filepath.Join(t.TempDir(), "store.kvm")
+	store := openMappedOrSkip(t, path)
+
+	stamp := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	_ = store.Put("string-key", "value")
+	_ = store.Put("int-key", 1234)
+	_ = store.PutWithAge("aged-key", "old", stamp)
+	_ = store.PutWithExpiry("expiring-key", "soon", time.Hour)
+	_ = store.Put("deleted-key", "gone")
+	_ = store.Delete("deleted-key")
+	_, _ = store.ListPushRight("list-key", "a", 2, true)
+	_ = store.HashSet("hash-key", "name", "Sam")
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam"}, Email: "sam@example.com"})
+
+	if err := store.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+
+	reopened := openMappedOrSkip(t, path)
+	defer func() { _ = reopened.Close() }()
+
+	if v, _ := reopened.Get("string-key"); v != "value" {t.Errorf("Expected 'value', but got %#v", v)}
+	if v, _ := reopened.Get("int-key"); v != 1234 {t.Errorf("Expected 1234, but got %#v", v)}
+	if found := reopened.Contains("deleted-key"); found {t.Errorf("Expected 'deleted-key' to stay deleted")}
+	if age, _ := reopened.GetAge("aged-key"); !age.Equal(stamp) {t.Errorf("Expected %v, but got %v", stamp, age)}
+	if v, err := reopened.ListRange("list-key", 0, -1); err != nil || len(v) != 3 || v[1] != 2 || v[2] != true {
+		t.Errorf("Expected [a 2 true], but got %#v, %v", v, err)
+	}
+	if v, _ := reopened.HashGet("hash-key", "name"); v != "Sam" {t.Errorf("Expected 'Sam', but got %#v", v)}
+	if keys, err := reopened.FindBy("email", "sam@example.com"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected index to be rebuilt, but got %v, %v", keys, err)
+	}
+
+	// expiry is kept too
+	reopened.EvictOlderThan(time.Now().Add(time.Minute)) // nothing is that new
+	if found := reopened.Contains("expiring-key"); !found {t.Errorf("Expected 'expiring-key' to still be there")}
+	if keys := reopened.Keys(); len(keys) != 7 {t.Errorf("Expected 7 keys, but got %v", keys)}
+}
+
+func TestMappedStoreGrowsAndCompacts(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvm")
+	store := openMappedOrSkip(t, path)
+	defer func() { _ = store.Close() }()
+
+	// enough keys to rebuild the table a few times, and enough rewrites to fill it with dead records
+	const keyCount = 5000
+	for round := 0; round < 3; round++ {
+		for i := 0; i < keyCount; i++ {
+			if err := store.Put(kvs.StoreKey("key-"+strconv.Itoa(i)), i*round); err != nil {t.Fatalf("Put failed with %v", err)}
+		}
+	}
+	for i := 0; i < keyCount; i += 2 {
+		_ = store.Delete(kvs.StoreKey("key-" + strconv.Itoa(i)))
+	}
+
+	check := func(when string) {
+		if keys := store.Keys(); len(keys) != keyCount/2 {t.Errorf("%s: expected %d keys, but got %d", when, keyCount/2, len(keys))}
+		for i := 0; i < keyCount; i++ {
+			v, err := store.Get(kvs.StoreKey("key-" + strconv.Itoa(i)))
+			if i%2 == 0 && err != kvs.KeyNotPresentError {t.Fatalf("%s: expected key-%d to be gone, but got %v", when, i, v)}
+			if i%2 == 1 && v != i*2 {t.Fatalf("%s: expected key-%d to be %d, but got %#v (%v)", when, i, i*2, v, err)}
+		}
+	}
+	check("before compacting")
+
+	before, _ := os.Stat(path)
+	if err := store.Compact(); err != nil {t.Fatalf("Compact failed with %v", err)}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {t.Errorf("Expected compacting to shrink the file, but went from %d to %d bytes", before.Size(), after.Size())}
+	check("after compacting")
+}
+
+func TestMappedStoreRecoversFromUncleanClose(t *testing.T){
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.kvm")
+	store := openMappedOrSkip(t, path)
+	defer func() { _ = store.Close() }()
+
+	_ = store.Put("a", 1)
+	_ = store.Put("b", 2)
+	_ = store.Put("c", 3)
+	_ = store.Delete("b")
+	if err := store.Sync(); err != nil {t.Fatalf("Sync failed with %v", err)}
+
+	// a copy of the file while it's open is what a crash would leave behind
+	crashed := filepath.Join(dir, "crashed.kvm")
+	copyFile(t, path, crashed)
+
+	// and the crash came before the header's key count (at byte 24) was updated
+	file, err := os.OpenFile(crashed, os.O_RDWR, 0644)
+	if err != nil {t.Fatalf("Open failed with %v", err)}
+	_, _ = file.WriteAt([]byte{99, 0, 0, 0, 0, 0, 0, 0}, 24)
+	_ = file.Close()
+
+	recovered := openMappedOrSkip(t, crashed)
+	defer func() { _ = recovered.Close() }()
+	if keys := recovered.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {t.Errorf("Expected [a c], but got %v", keys)}
+	if description := recovered.String(); description != "Key value store (2 keys, is open = true)" {t.Errorf("Expected the key count to be fixed, but got '%s'", description)}
+	if v, _ := recovered.Get("c"); v != 3 {t.Errorf("Expected 3, but got %#v", v)}
+}
+
+func TestMappedStoreRejectsOtherFiles(t *testing.T){
+	path := filepath.Join(t.TempDir(), "not-mapped.kvs")
+	_ = os.WriteFile(path, []byte("KVS1 this is some other kind of file, long enough to have a header......"), 0644)
+
+	if _, err := kvs.OpenMapped(path, kvs.MappedOptions{}); !errors.Is(err, kvs.MappedFileError) && !errors.Is(err, kvs.MappingNotSupportedError) {
+		t.Errorf("Expected '%v', but got '%v'", kvs.MappedFileError, err)
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	source, err := os.Open(from)
+	if err != nil {t.Fatalf("Open failed with %v", err)}
+	defer func() { _ = source.Close() }()
+
+	target, err := os.Create(to)
+	if err != nil {t.Fatalf("Create failed with %v", err)}
+	defer func() { _ = target.Close() }()
+
+	if _, err = io.Copy(target, source); err != nil {t.Fatalf("Copy failed with %v", err)}
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package keyvaluestore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func mapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+func syncMapping(data []byte) error {
+	if len(data) < 1 {return nil}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {return errno}
+	return nil
+}
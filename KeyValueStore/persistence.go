@@ -0,0 +1,597 @@
+package keyvaluestore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Store files are a 4 byte magic marker, then a series of frames:
+//
+//     [payload length: uint32 LE][crc32 of payload: uint32 LE][payload]
+//
+// The payload is a flags byte followed by a `RecordLine` as JSON, which may be compressed and
+// encrypted (see encryption.go for the flags).
+// A store opened with `OpenFile` appends a frame for every change (a write-ahead log),
+// and `Compact` or `SaveSnapshot` write one 'put' frame per live key (a snapshot).
+// 'fence' frames carry the latest lease fencing token, so tokens keep increasing across reopens (see leases.go).
+// Both kinds of file are read the same way: replay the frames in order.
+
+var NotAStoreFileError = errors.New("the file is not a key value store file")
+var CorruptRecordError = errors.New("the store file contains a corrupt record")
+var NotPersistedError = errors.New("the store is not backed by a file")
+
+const (
+	fileMagic      = "KVS1"
+	frameHeaderLen = 8
+	maxFrameLen    = 64 << 20 // anything bigger than this is garbage, not a real record
+)
+
+// RecordOp is the kind of change a record makes
+type RecordOp string
+
+const (
+	OpPut    RecordOp = "put"
+	OpDelete RecordOp = "delete"
+	OpFence  RecordOp = "fence" // only in store files, never in exports or the change feed
+)
+
+// RecordLine is a single change to the store, as written in the store file.
+// It's also the line format used by `Export` and `Import`.
+type RecordLine struct {
+	Op        RecordOp        `json:"op"`
+	Key       StoreKey        `json:"key"`
+	Type      string          `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Timestamp time.Time       `json:"ts"`
+	Expires   *time.Time      `json:"exp,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"` // only set in the change feed
+	Token     uint64          `json:"token,omitempty"` // only set on 'fence' records
+}
+
+// FileOptions change how a store file is read and written
+type FileOptions struct {
+	// SkipCorruptRecords drops records that fail their checksum, rather than failing the whole open.
+	// Use this to recover what you can from a damaged file, then `Compact` to rewrite it.
+	SkipCorruptRecords bool
+
+	// CompressAbove compresses records whose value is more than this many bytes as JSON. Zero never compresses.
+	CompressAbove int
+
+	// EncryptionKey turns on AES-GCM encryption of every record written, and is used to read encrypted records.
+	// It must be 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+	EncryptionKey []byte
+
+	// OldEncryptionKeys are also tried when reading, for records written before the key was rotated
+	OldEncryptionKeys [][]byte
+}
+
+// FileStats describes the contents of a store file
+type FileStats struct {
+	FileSize       int64
+	Records        int
+	Puts           int
+	Deletes        int
+	LiveKeys       int
+	Compressed     int
+	Encrypted      int
+	CorruptRecords int
+	TornTailBytes  int64 // a partly written record at the end of the file, usually from a crash mid-write
+}
+
+type storeLog struct {
+	path    string
+	file    *os.File
+	options FileOptions
+	failed  error // once a write fails, the file is in an unknown state, so we refuse all later writes
+}
+
+//<editor-fold desc="Opening and closing">
+
+// OpenFile opens a store backed by the file at `path`, creating the file if needed.
+// The existing contents are loaded into memory, then every change is appended to the file.
+func OpenFile(path string, options FileOptions) (*IndependentStore, error) {
+	if err := options.validate(); err != nil {return nil, err}
+
+	store := OpenNew()
+	file, err := openFrameFile(path, options, func(line RecordLine, _ int64) error {
+		return store.applyLineLocked(line)
+	})
+	if err != nil {return nil, err}
+
+	store.log = &storeLog{
+		path:    path,
+		file:    file,
+		options: options,
+	}
+	return store, nil
+}
+
+// openFrameFile opens (or creates) a file of frames, replays it through `apply`,
+// and leaves it ready for new frames to be appended.
+func openFrameFile(path string, options FileOptions, apply func(line RecordLine, offset int64) error) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {return nil, err}
+
+	stats, goodLength, err := readFramesFrom(file, 0, options, apply)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	// Brand new file, or we need to cut off a torn record so new frames don't follow garbage
+	if stats.FileSize < int64(len(fileMagic)) {
+		if _, err = file.WriteAt([]byte(fileMagic), 0); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		goodLength = int64(len(fileMagic))
+	}
+	if stats.TornTailBytes > 0 {
+		if err = file.Truncate(goodLength); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	if _, err = file.Seek(goodLength, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// VerifyFile reads every record in a store file and checks the checksums, without changing anything.
+// The error is only for problems reading the file; corruption is reported in the stats.
+func VerifyFile(path string, options FileOptions) (FileStats, error) {
+	file, err := os.Open(path)
+	if err != nil {return FileStats{}, err}
+	defer func(file *os.File) { _ = file.Close() }(file)
+
+	options.SkipCorruptRecords = true // we want to count them all, not stop at the first
+	live := map[StoreKey]bool{}
+	stats, _, err := readStoreFile(file, options, func(line RecordLine) error {
+		if line.Op == OpFence {return nil}
+		live[line.Key] = line.Op == OpPut
+		return nil
+	})
+
+	for _, isLive := range live {
+		if isLive {stats.LiveKeys++}
+	}
+	return stats, err
+}
+
+// write appends a record to the store file. Once a write has failed, every later one fails the same way.
+func (log *storeLog) write(line RecordLine) error {
+	if log.failed != nil {return log.failed}
+	if log.file == nil {return StoreNotOpenError}
+
+	if err := writeFrame(log.file, line, log.options); err != nil {
+		log.failed = err
+		return err
+	}
+	return nil
+}
+
+func (log *storeLog) reopen() error {
+	if log.file != nil {return nil}
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {return err}
+
+	log.file = file
+	log.failed = nil
+	return nil
+}
+
+func (log *storeLog) close() error {
+	if log.file == nil {return nil}
+
+	err := log.file.Sync()
+	if closeErr := log.file.Close(); err == nil {err = closeErr}
+	log.file = nil
+	if err == nil {err = log.failed}
+	return err
+}
+
+// closeFilesLocked closes the change feed, the mapped file and the store file, if there are any.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) closeFilesLocked() error {
+	var err error
+	if receiver.feed != nil {err = receiver.feed.close()} // first, as it's written first
+	if receiver.core != nil {
+		if coreErr := receiver.core.close(); err == nil {err = coreErr}
+	}
+	if receiver.log != nil {
+		if logErr := receiver.log.close(); err == nil {err = logErr}
+	}
+	return err
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Writing">
+
+// Sync flushes the change feed and the store file to disk
+func (receiver *IndependentStore) Sync() error {
+	return receiver.SyncContext(context.Background())
+}
+
+// SyncContext is `Sync`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SyncContext(ctx context.Context) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.mutex.Unlock()
+
+	if receiver.feed != nil {
+		if err := receiver.feed.sync(); err != nil {return err}
+	}
+	if receiver.log == nil {return receiver.core.flush()}
+	if receiver.log.failed != nil {return receiver.log.failed}
+	return receiver.log.file.Sync()
+}
+
+// Compact rewrites the store file so that it holds just one record per live key
+func (receiver *IndependentStore) Compact() error {
+	return receiver.CompactContext(context.Background())
+}
+
+// CompactContext is `Compact`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) CompactContext(ctx context.Context) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.mutex.Unlock()
+
+	if receiver.log == nil {return receiver.core.compact()}
+	return receiver.rewriteLocked(receiver.log.options)
+}
+
+// SaveSnapshot writes every live key to a new store file at `path`.
+// Works for in-memory stores too, and the result can be opened with `OpenFile`.
+func (receiver *IndependentStore) SaveSnapshot(path string, options FileOptions) error {
+	return receiver.SaveSnapshotContext(context.Background(), path, options)
+}
+
+// SaveSnapshotContext is `SaveSnapshot`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) SaveSnapshotContext(ctx context.Context, path string, options FileOptions) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+	if err := options.validate(); err != nil {return err}
+
+	if err := receiver.rLockContext(ctx); err != nil {return err}
+	defer receiver.mutex.RUnlock()
+
+	tempPath := path + ".tmp"
+	if err := receiver.writeSnapshotLocked(tempPath, options); err != nil {return err}
+	return os.Rename(tempPath, path)
+}
+
+func (receiver *IndependentStore) writeSnapshotLocked(path string, options FileOptions) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {return err}
+	defer func() {
+		if closeErr := file.Close(); err == nil {err = closeErr}
+		if err != nil {_ = os.Remove(path)}
+	}()
+
+	buffer := bufio.NewWriter(file)
+	if _, err = buffer.WriteString(fileMagic); err != nil {return err}
+	if receiver.fencingToken > 0 {
+		fence := RecordLine{Op: OpFence, Token: receiver.fencingToken, Timestamp: time.Now()}
+		if err = writeFrame(buffer, fence, options); err != nil {return err}
+	}
+
+	lines, err := receiver.exportLocked()
+	if err != nil {return err}
+	for _, line := range lines {
+		if err = writeFrame(buffer, line, options); err != nil {return err}
+	}
+
+	if err = buffer.Flush(); err != nil {return err}
+	return file.Sync()
+}
+
+// appendLocked writes a record to the end of the change feed and the store file, if there are any.
+// The feed goes first, so nothing reaches the store file without being in the feed.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) appendLocked(line RecordLine) error {
+	if log := receiver.log; log != nil && log.failed != nil {return log.failed} // don't put a change in the feed that can't be kept
+
+	if receiver.feed != nil {
+		if err := receiver.feed.append(line); err != nil {return err}
+	}
+	if receiver.log != nil {
+		return receiver.log.write(line)
+	}
+	return nil
+}
+
+// persistLocked stores `collection` back at `key`, and writes it to the store file. Used after a collection has been changed in place.
+// If the key has gone (the collection was emptied), the removal is written instead.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) persistLocked(key StoreKey, collection interface{}) error {
+	stored, ok := receiver.core.get(key)
+	if !ok {
+		return receiver.appendLocked(RecordLine{Op: OpDelete, Key: key, Timestamp: time.Now()})
+	}
+
+	// a map backend already holds this collection, but a mapped one only has what was last written
+	value := &timestampWrapper{
+		lastAccess: stored.GetTimestamp(),
+		expires:    expiryOf(stored),
+		value:      collection,
+	}
+	if err := receiver.core.set(key, value); err != nil {return err}
+	if receiver.log == nil && receiver.feed == nil {return nil}
+
+	line, err := recordForValue(key, value)
+	if err != nil {return err}
+	return receiver.appendLocked(line)
+}
+
+func writeFrame(writer io.Writer, line RecordLine, options FileOptions) error {
+	body, err := json.Marshal(line)
+	if err != nil {return err}
+
+	flags, body, err := encodeBody(body, len(line.Value), options)
+	if err != nil {return err}
+	if len(body)+1 > maxFrameLen {return RecordTooLargeError} // we'd refuse to read it back
+
+	frame := make([]byte, frameHeaderLen+1, frameHeaderLen+1+len(body))
+	frame[frameHeaderLen] = flags
+	frame = append(frame, body...)
+	payload := frame[frameHeaderLen:]
+
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+
+	_, err = writer.Write(frame) // one write per frame, so a crash leaves at most one torn record
+	return err
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Reading">
+
+// readStoreFile replays every frame in the file through `apply`.
+// Returns the stats, and the length of the file up to the end of the last whole frame.
+func readStoreFile(file *os.File, options FileOptions, apply func(line RecordLine) error) (FileStats, int64, error) {
+	return readFramesFrom(file, 0, options, func(line RecordLine, _ int64) error {
+		return apply(line)
+	})
+}
+
+// readFramesFrom is `readStoreFile`, but starts at the frame at `start` (zero for the first frame),
+// and tells `apply` where each frame starts. The stats only count the frames that were read.
+func readFramesFrom(file *os.File, start int64, options FileOptions, apply func(line RecordLine, offset int64) error) (FileStats, int64, error) {
+	stats := FileStats{}
+	info, err := file.Stat()
+	if err != nil {return stats, 0, err}
+	stats.FileSize = info.Size()
+	if stats.FileSize == 0 {return stats, 0, nil}
+
+	offset := int64(len(fileMagic))
+	if start > offset {
+		offset = start
+		if _, err = file.Seek(start, io.SeekStart); err != nil {return stats, 0, err}
+	}
+	reader := bufio.NewReader(file)
+	if start <= int64(len(fileMagic)) {
+		magic := make([]byte, len(fileMagic))
+		if _, err = io.ReadFull(reader, magic); err != nil || string(magic) != fileMagic {
+			return stats, 0, NotAStoreFileError
+		}
+	}
+
+	header := make([]byte, frameHeaderLen)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {break}
+			if err == io.ErrUnexpectedEOF {
+				stats.TornTailBytes = stats.FileSize - offset
+				break
+			}
+			return stats, offset, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length < 1 || length > maxFrameLen || int64(length) > stats.FileSize-offset-frameHeaderLen {
+			// can't trust the length, so we can't find the next frame either
+			stats.TornTailBytes = stats.FileSize - offset
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(reader, payload); err != nil {return stats, offset, err}
+
+		line, err := decodePayload(payload, checksum, options)
+		if errors.Is(err, EncryptionKeyNeededError) || errors.Is(err, WrongEncryptionKeyError) {
+			// not corruption, and skipping would throw away every record, so always stop here
+			return stats, offset, err
+		}
+		if err != nil {
+			stats.CorruptRecords++
+			if !options.SkipCorruptRecords {
+				return stats, offset, fmt.Errorf("%w at offset %d: %v", CorruptRecordError, offset, err)
+			}
+		} else {
+			stats.Records++
+			if line.Op == OpDelete {stats.Deletes++} else if line.Op == OpPut {stats.Puts++}
+			if payload[0]&flagCompressed != 0 {stats.Compressed++}
+			if payload[0]&flagEncrypted != 0 {stats.Encrypted++}
+			if err = apply(line, offset); err != nil {return stats, offset, err}
+		}
+
+		offset += frameHeaderLen + int64(length)
+	}
+
+	return stats, offset, nil
+}
+
+func decodePayload(payload []byte, checksum uint32, options FileOptions) (RecordLine, error) {
+	line := RecordLine{}
+	if crc32.ChecksumIEEE(payload) != checksum {return line, errors.New("checksum does not match")}
+
+	body, err := decodeBody(payload[0], payload[1:], options)
+	if err != nil {return line, err}
+
+	err = json.Unmarshal(body, &line)
+	return line, err
+}
+
+// applyLineLocked loads a single record into the map, without writing it back to the file.
+// Caller must hold the write lock (or be the only one with the store, as when loading).
+func (receiver *IndependentStore) applyLineLocked(line RecordLine) error {
+	switch line.Op {
+	case OpDelete:
+		receiver.core.remove(line.Key)
+		receiver.unindexLocked(line.Key)
+		return nil
+
+	case OpPut:
+		wrapper, err := wrapperForRecord(line)
+		if err != nil {return err}
+		if err = receiver.core.set(line.Key, wrapper); err != nil {return err}
+		receiver.reindexLocked(line.Key, wrapper.value)
+		return nil
+
+	case OpFence:
+		if line.Token > receiver.fencingToken {receiver.fencingToken = line.Token}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown record op '%s'", line.Op)
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Export and import">
+
+// Export returns a 'put' record for every live key, ordered by key
+func (receiver *IndependentStore) Export() ([]RecordLine, error) {
+	return receiver.ExportContext(context.Background())
+}
+
+// ExportContext is `Export`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ExportContext(ctx context.Context) ([]RecordLine, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
+	defer receiver.mutex.RUnlock()
+
+	return receiver.exportLocked()
+}
+
+// ExportKey returns a 'put' record for a single key
+func (receiver *IndependentStore) ExportKey(key StoreKey) (RecordLine, error) {
+	return receiver.ExportKeyContext(context.Background(), key)
+}
+
+// ExportKeyContext is `ExportKey`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ExportKeyContext(ctx context.Context, key StoreKey) (RecordLine, error) {
+	if receiver == nil || !receiver.isOpen {return RecordLine{}, StoreNotOpenError}
+	if receiver.core == nil {return RecordLine{}, InvalidStoreError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return RecordLine{}, err}
+	defer receiver.mutex.RUnlock()
+
+	value, ok := receiver.core.get(key)
+	if !ok || isExpired(value, time.Now()) {return RecordLine{}, KeyNotPresentError}
+	return recordForValue(key, value)
+}
+
+// Import applies a single record to the store, as if it had been written with `PutWithAge` or `Delete`.
+// This goes through the normal write path, so it is persisted and will trigger hooks.
+func (receiver *IndependentStore) Import(line RecordLine) error {
+	return receiver.ImportContext(context.Background(), line)
+}
+
+// ImportContext is `Import`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ImportContext(ctx context.Context, line RecordLine) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
+
+	switch line.Op {
+	case OpDelete:
+		if _, ok := receiver.core.get(line.Key); !ok {return KeyNotPresentError}
+		return receiver.removeLocked(line.Key, ReasonDeleted)
+
+	case OpPut, "":
+		line.Op = OpPut
+		if line.Timestamp.IsZero() {line.Timestamp = time.Now()}
+		wrapper, err := wrapperForRecord(line)
+		if err != nil {return err}
+		return receiver.putLocked(line.Key, wrapper)
+
+	default:
+		return fmt.Errorf("unknown record op '%s'", line.Op)
+	}
+}
+
+func (receiver *IndependentStore) exportLocked() ([]RecordLine, error) {
+	now := time.Now()
+	lines := make([]RecordLine, 0, receiver.core.count())
+	var err error
+	receiver.core.each(func(key StoreKey, value StoreValue) bool {
+		if isExpired(value, now) {return true}
+		line, encodeErr := recordForValue(key, value)
+		if encodeErr != nil {
+			err = fmt.Errorf("could not encode key '%s': %w", key, encodeErr)
+			return false
+		}
+		lines = append(lines, line)
+		return true
+	})
+	if err != nil {return nil, err}
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Key < lines[j].Key })
+	return lines, nil
+}
+
+func recordForValue(key StoreKey, value StoreValue) (RecordLine, error) {
+	encoded, err := EncodeValue(value.GetValue())
+	if err != nil {return RecordLine{}, err}
+
+	line := RecordLine{
+		Op:        OpPut,
+		Key:       key,
+		Type:      encoded.Type,
+		Value:     encoded.Value,
+		Timestamp: value.GetTimestamp(),
+	}
+	if expires := expiryOf(value); !expires.IsZero() {
+		line.Expires = &expires
+	}
+	return line, nil
+}
+
+func wrapperForRecord(line RecordLine) (*timestampWrapper, error) {
+	value, err := DecodeValue(TypedValue{Type: line.Type, Value: line.Value})
+	if err != nil {return nil, fmt.Errorf("could not decode key '%s': %w", line.Key, err)}
+
+	wrapper := &timestampWrapper{
+		lastAccess: line.Timestamp,
+		value:      value,
+	}
+	if line.Expires != nil {wrapper.expires = *line.Expires}
+	return wrapper, nil
+}
+
+//</editor-fold>
@@ -0,0 +1,152 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSurvivesReopen(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+
+	store, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+
+	stamp := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	_ = store.Put("string-key", "value")
+	_ = store.Put("int-key", 1234)
+	_ = store.Put("float-key", float32(12.34))
+	_ = store.PutWithAge("aged-key", "old", stamp)
+	_ = store.Put("deleted-key", "gone")
+	_ = store.Delete("deleted-key")
+	_, _ = store.ListPushRight("list-key", "a", 2, true)
+	_, _ = store.SetAdd("set-key", "x", "y")
+	_ = store.HashSet("hash-key", "name", "Sam")
+	_ = store.SortedSetAdd("zset-key", "m", 1.5)
+
+	if err = store.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	defer func() { _ = reopened.Close() }()
+
+	// values come back as the type they went in as
+	if v, _ := reopened.Get("string-key"); v != "value" {t.Errorf("Expected 'value', but got %#v", v)}
+	if v, _ := reopened.Get("int-key"); v != 1234 {t.Errorf("Expected 1234, but got %#v", v)}
+	if v, _ := reopened.Get("float-key"); v != float32(12.34) {t.Errorf("Expected 12.34, but got %#v", v)}
+	if found := reopened.Contains("deleted-key"); found {t.Errorf("Expected 'deleted-key' to stay deleted")}
+	if age, _ := reopened.GetAge("aged-key"); !age.Equal(stamp) {t.Errorf("Expected %v, but got %v", stamp, age)}
+
+	if v, err := reopened.ListRange("list-key", 0, -1); err != nil || len(v) != 3 || v[1] != 2 || v[2] != true {
+		t.Errorf("Expected [a 2 true], but got %#v, %v", v, err)
+	}
+	if found, _ := reopened.SetIsMember("set-key", "y"); !found {t.Errorf("Expected set member to be restored")}
+	if v, _ := reopened.HashGet("hash-key", "name"); v != "Sam" {t.Errorf("Expected 'Sam', but got %#v", v)}
+	if v, _ := reopened.SortedSetScore("zset-key", "m"); v != 1.5 {t.Errorf("Expected 1.5, but got %v", v)}
+}
+
+func TestCompactKeepsOnlyLiveKeys(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	store, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+
+	for i := 0; i < 100; i++ {
+		_ = store.Put("churn", i)
+	}
+	_ = store.Put("keep", "me")
+
+	before, _ := kvs.VerifyFile(path, kvs.FileOptions{})
+	if err = store.Compact(); err != nil {t.Fatalf("Compact failed with %v", err)}
+	after, _ := kvs.VerifyFile(path, kvs.FileOptions{})
+
+	if before.Records != 101 {t.Errorf("Expected 101 records before compacting, but got %d", before.Records)}
+	if after.Records != 2 || after.LiveKeys != 2 {t.Errorf("Expected 2 records after compacting, but got %+v", after)}
+
+	// should still be able to write after the file is swapped
+	_ = store.Put("after", "compact")
+	_ = store.Close()
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	if v, _ := reopened.Get("churn"); v != 99 {t.Errorf("Expected 99, but got %#v", v)}
+	if v, _ := reopened.Get("after"); v != "compact" {t.Errorf("Expected 'compact', but got %#v", v)}
+}
+
+func TestTornTailIsDroppedOnOpen(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{})
+	_ = store.Put("first", 1)
+	_ = store.Put("second", 2)
+	_ = store.Close()
+
+	// chop the last few bytes off, as if we crashed mid-write
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {t.Fatal(err)}
+
+	stats, err := kvs.VerifyFile(path, kvs.FileOptions{})
+	if err != nil || stats.Records != 1 || stats.TornTailBytes == 0 {
+		t.Errorf("Expected one good record and a torn tail, but got %+v, %v", stats, err)
+	}
+
+	reopened, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	if found := reopened.Contains("second"); found {t.Errorf("Expected torn record to be dropped")}
+	_ = reopened.Put("third", 3)
+	_ = reopened.Close()
+
+	stats, _ = kvs.VerifyFile(path, kvs.FileOptions{})
+	if stats.Records != 2 || stats.TornTailBytes != 0 {
+		t.Errorf("Expected torn tail to be replaced, but got %+v", stats)
+	}
+}
+
+func TestCorruptRecordIsReported(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	store, _ := kvs.OpenFile(path, kvs.FileOptions{})
+	_ = store.Put("first", "aaaaaaaa")
+	_ = store.Put("second", "bbbbbbbb")
+	_ = store.Close()
+
+	// flip a byte inside the first record's value
+	data, _ := os.ReadFile(path)
+	for i := range data {
+		if data[i] == 'a' {
+			data[i] = 'z'
+			break
+		}
+	}
+	_ = os.WriteFile(path, data, 0644)
+
+	if _, err := kvs.OpenFile(path, kvs.FileOptions{}); !errors.Is(err, kvs.CorruptRecordError) {
+		t.Errorf("Expected '%v', but got '%v'", kvs.CorruptRecordError, err)
+	}
+
+	stats, _ := kvs.VerifyFile(path, kvs.FileOptions{})
+	if stats.CorruptRecords != 1 || stats.Records != 1 {t.Errorf("Expected one corrupt record, but got %+v", stats)}
+
+	recovered, err := kvs.OpenFile(path, kvs.FileOptions{SkipCorruptRecords: true})
+	if err != nil {t.Fatalf("OpenFile failed with %v", err)}
+	if v, _ := recovered.Get("second"); v != "bbbbbbbb" {t.Errorf("Expected the good record to load, but got %#v", v)}
+}
+
+func TestExportAndImportRoundTrip(t *testing.T){
+	source := kvs.OpenNew()
+	_ = source.Put("a", 1)
+	_ = source.Put("b", "two")
+	_, _ = source.SetAdd("c", "x")
+
+	lines, err := source.Export()
+	if err != nil || len(lines) != 3 {t.Fatalf("Expected 3 lines, but got %d, %v", len(lines), err)}
+	if lines[0].Key != "a" || lines[0].Type != "int" {t.Errorf("Unexpected first line %+v", lines[0])}
+
+	target := kvs.OpenNew()
+	for _, line := range lines {
+		if err = target.Import(line); err != nil {t.Errorf("Import failed with %v", err)}
+	}
+
+	if v, _ := target.Get("a"); v != 1 {t.Errorf("Expected 1, but got %#v", v)}
+	if found, _ := target.SetIsMember("c", "x"); !found {t.Errorf("Expected set to be imported")}
+}
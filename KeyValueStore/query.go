@@ -0,0 +1,705 @@
+package keyvaluestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A small query language over stored values:
+//
+//     WHERE age > 30 AND (name LIKE "S%" OR NOT active = true) ORDER BY age DESC LIMIT 10
+//
+// Every part is optional, so "" returns everything, ordered by key.
+// Fields are looked up on structs (by field name, json tag or kvindex tag, ignoring case),
+// maps with string keys, and hashes. Use dots for nested fields (`address.city`), and `_key`
+// for the store key itself. Comparisons are = != <> < <= > >= and LIKE (`%` for any run of
+// characters, `_` for one; case-sensitive). Strings can be in double or single quotes.
+// A field that is missing never matches, except with `= null`.
+//
+// If the WHERE clause has an `index = value` test at the top level, the index is used to skip
+// values that can't match. Values are still checked one by one if they don't carry that index, if
+// the query would read a different field than the index did (`name` can be a Go name, a json tag
+// or a kvindex tag), or if the query would compare it differently (`age = "30"` compares the number
+// 30 as text, but the index holds it as a number). So results are the same with or without indexes.
+
+var InvalidQueryError = errors.New("the query is not valid")
+
+// KeyField is the pseudo-field that gives the store key in a query
+const KeyField = "_key"
+
+// QueryResult is a single match from a query
+type QueryResult struct {
+	Key   StoreKey
+	Value interface{}
+}
+
+// Query is a parsed query, ready to run against any store
+type Query struct {
+	where      queryExpr // nil matches everything
+	orderBy    []string
+	descending bool
+	limit      int // zero for no limit
+}
+
+// Query parses and runs a query in one go
+func (receiver *IndependentStore) Query(text string) ([]QueryResult, error) {
+	return receiver.QueryContext(context.Background(), text)
+}
+
+// QueryContext is `Query`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) QueryContext(ctx context.Context, text string) ([]QueryResult, error) {
+	query, err := ParseQuery(text)
+	if err != nil {return nil, err}
+	return receiver.RunQueryContext(ctx, query)
+}
+
+// RunQuery finds the stored values that match a parsed query
+func (receiver *IndependentStore) RunQuery(query *Query) ([]QueryResult, error) {
+	return receiver.RunQueryContext(context.Background(), query)
+}
+
+// RunQueryContext is `RunQuery`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) RunQueryContext(ctx context.Context, query *Query) ([]QueryResult, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+	if query == nil {return nil, InvalidQueryError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
+	defer receiver.mutex.RUnlock()
+
+	now := time.Now()
+	results := []QueryResult{}
+	for i, key := range receiver.queryCandidatesLocked(query) {
+		if i%1000 == 999 { // a big scan can take a while, so don't keep going for a caller that has left
+			if err := checkContext(ctx); err != nil {return nil, err}
+		}
+
+		stored, ok := receiver.core.get(key)
+		if !ok || isExpired(stored, now) {continue}
+
+		value := stored.GetValue()
+		if query.where != nil && !query.where.matches(key, value) {continue}
+		results = append(results, QueryResult{Key: key, Value: value})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if len(query.orderBy) > 0 {
+			left, leftOk := resolveField(results[i].Key, results[i].Value, query.orderBy)
+			right, rightOk := resolveField(results[j].Key, results[j].Value, query.orderBy)
+			order := compareForSort(left, leftOk, right, rightOk)
+			if query.descending {order = -order}
+			if order != 0 {return order < 0}
+		}
+		return results[i].Key < results[j].Key
+	})
+
+	if query.limit > 0 && len(results) > query.limit {results = results[:query.limit]}
+	return results, nil
+}
+
+// queryCandidatesLocked picks the keys worth checking, using an index if the query allows it.
+// Caller must hold the lock.
+func (receiver *IndependentStore) queryCandidatesLocked(query *Query) []StoreKey {
+	candidates := make([]StoreKey, 0, receiver.core.count())
+
+	index, literal, ok := indexableEquality(query.where)
+	if _, known := receiver.indexes[index]; !ok || !known {
+		receiver.core.each(func(key StoreKey, _ StoreValue) bool {
+			candidates = append(candidates, key)
+			return true
+		})
+		return candidates
+	}
+
+	// the index only answers for values whose entry the query would compare the same way
+	lookup, _ := indexValue(reflect.ValueOf(literal))
+	answers := func(key StoreKey) bool {
+		for _, entry := range receiver.indexedKeys[key] {
+			if entry.name == index {return entry.queryable && indexKind(entry.value) == indexKind(lookup)}
+		}
+		return false
+	}
+
+	hits, _ := receiver.findByLocked(index, literal)
+	for _, key := range hits {
+		if answers(key) {candidates = append(candidates, key)}
+	}
+	// anything else might still have a matching field, so check those too
+	receiver.core.each(func(key StoreKey, _ StoreValue) bool {
+		if !answers(key) {candidates = append(candidates, key)}
+		return true
+	})
+	return candidates
+}
+
+// indexKind groups index values by how a query compares them, which is all numbers alike
+func indexKind(value interface{}) reflect.Kind {
+	switch value.(type) {
+	case int64, uint64, float64:
+		return reflect.Float64
+	}
+	return reflect.TypeOf(value).Kind()
+}
+
+// queryMatchesIndex says whether `field = literal` in a query gives the same answer as looking the literal up in the
+// index on `field`, for values of `structType`. The query has to find the indexed field by the index's name, and it
+// has to be a plain string, number or bool, which both compare the same way.
+func queryMatchesIndex(structType reflect.Type, field indexedField) bool {
+	path, ok := queryFieldPath(structType, field.name)
+	if !ok || !reflect.DeepEqual(path, field.fieldPath) {return false}
+
+	fieldType := structType.FieldByIndex(field.fieldPath).Type
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.String, reflect.Bool:
+		return fieldType.PkgPath() == "" // not a named type, which the query would compare by its text (and String method)
+	}
+	return false
+}
+
+// indexableEquality finds a `field = literal` test that must hold for the whole expression to match
+func indexableEquality(where queryExpr) (string, interface{}, bool) {
+	switch expr := where.(type) {
+	case *compareExpr:
+		if expr.op == "=" && len(expr.field) == 1 && expr.literal != nil && expr.field[0] != KeyField {
+			return expr.field[0], expr.literal, true
+		}
+	case *andExpr:
+		for _, part := range expr.parts {
+			if field, literal, ok := indexableEquality(part); ok {return field, literal, true}
+		}
+	}
+	return "", nil, false
+}
+
+//<editor-fold desc="Expressions">
+
+type queryExpr interface {
+	matches(key StoreKey, value interface{}) bool
+}
+
+type andExpr struct{ parts []queryExpr }
+type orExpr struct{ parts []queryExpr }
+type notExpr struct{ inner queryExpr }
+
+type compareExpr struct {
+	field   []string
+	op      string
+	literal interface{} // string, float64, bool or nil
+	like    *regexp.Regexp
+}
+
+func (expr *andExpr) matches(key StoreKey, value interface{}) bool {
+	for _, part := range expr.parts {
+		if !part.matches(key, value) {return false}
+	}
+	return true
+}
+
+func (expr *orExpr) matches(key StoreKey, value interface{}) bool {
+	for _, part := range expr.parts {
+		if part.matches(key, value) {return true}
+	}
+	return false
+}
+
+func (expr *notExpr) matches(key StoreKey, value interface{}) bool {
+	return !expr.inner.matches(key, value)
+}
+
+func (expr *compareExpr) matches(key StoreKey, value interface{}) bool {
+	fieldValue, found := resolveField(key, value, expr.field)
+	if found && fieldValue == nil {found = false}
+
+	if expr.literal == nil {
+		switch expr.op {
+		case "=":
+			return !found
+		case "!=":
+			return found
+		default:
+			return false
+		}
+	}
+	if !found {return false}
+
+	if expr.op == "LIKE" {
+		text, ok := fieldValue.(string)
+		return ok && expr.like.MatchString(text)
+	}
+
+	var order int
+	switch literal := expr.literal.(type) {
+	case float64:
+		number, ok := toFloat(fieldValue)
+		if !ok {return false}
+		order = compareFloats(number, literal)
+	case string:
+		text, ok := fieldValue.(string)
+		if !ok {text = fmt.Sprint(fieldValue)}
+		order = strings.Compare(text, literal)
+	case bool:
+		flag, ok := fieldValue.(bool)
+		if !ok || (expr.op != "=" && expr.op != "!=") {return false}
+		if flag != literal {order = 1}
+	}
+
+	switch expr.op {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Field lookup">
+
+// resolveField walks a dotted field path through structs, maps and hashes
+func resolveField(key StoreKey, value interface{}, path []string) (interface{}, bool) {
+	if len(path) == 1 && path[0] == KeyField {return string(key), true}
+
+	current := value
+	for _, name := range path {
+		next, ok := fieldOf(current, name)
+		if !ok {return nil, false}
+		current = next
+	}
+	return current, true
+}
+
+func fieldOf(value interface{}, name string) (interface{}, bool) {
+	switch v := value.(type) {
+	case *storeHash:
+		return lookupIgnoringCase(v.fields, name)
+	case map[string]interface{}:
+		return lookupIgnoringCase(v, name)
+	case TypedValue: // a type this program doesn't know; look inside the JSON instead
+		var decoded interface{}
+		if err := json.Unmarshal(v.Value, &decoded); err != nil {return nil, false}
+		return fieldOf(decoded, name)
+	}
+
+	reflected := reflect.ValueOf(value)
+	for reflected.Kind() == reflect.Ptr || reflected.Kind() == reflect.Interface {
+		if reflected.IsNil() {return nil, false}
+		reflected = reflected.Elem()
+	}
+
+	switch reflected.Kind() {
+	case reflect.Struct:
+		return structFieldByQueryName(reflected, name)
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {return nil, false}
+		for _, mapKey := range reflected.MapKeys() {
+			if strings.EqualFold(mapKey.String(), name) {return reflected.MapIndex(mapKey).Interface(), true}
+		}
+	}
+	return nil, false
+}
+
+func lookupIgnoringCase(fields map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := fields[name]; ok {return value, true}
+	for field, value := range fields {
+		if strings.EqualFold(field, name) {return value, true}
+	}
+	return nil, false
+}
+
+// structFieldByQueryName matches a field by its Go name, json tag or kvindex tag, ignoring case
+func structFieldByQueryName(structValue reflect.Value, name string) (interface{}, bool) {
+	field, found := structValue.Type().FieldByNameFunc(func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	})
+	if found && field.PkgPath == "" {
+		if value, ok := fieldByPath(structValue, field.Index); ok {return value.Interface(), true}
+	}
+
+	// fall back to tags, which FieldByNameFunc doesn't look at
+	var match reflect.Value
+	var walk func(current reflect.Value) bool
+	walk = func(current reflect.Value) bool {
+		currentType := current.Type()
+		for i := 0; i < currentType.NumField(); i++ {
+			field := currentType.Field(i)
+			if field.Anonymous {
+				embedded := current.Field(i)
+				if embedded.Kind() == reflect.Ptr {
+					if embedded.IsNil() {continue}
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct && walk(embedded) {return true}
+				continue
+			}
+			if field.PkgPath != "" {continue}
+
+			jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+			if strings.EqualFold(jsonName, name) || strings.EqualFold(field.Tag.Get(indexTag), name) {
+				match = current.Field(i)
+				return true
+			}
+		}
+		return false
+	}
+	if walk(structValue) {return match.Interface(), true}
+	return nil, false
+}
+
+// queryFieldPath finds the field that `structFieldByQueryName` reads for `name`, from the type alone.
+// For a value with a nil embedded pointer that could be a different field, but then the value has no index entry for it.
+func queryFieldPath(structType reflect.Type, name string) ([]int, bool) {
+	field, found := structType.FieldByNameFunc(func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	})
+	if found && field.PkgPath == "" {return field.Index, true}
+
+	onPath := map[reflect.Type]bool{} // a struct can embed a pointer to itself, so stop when we come back round
+	var walk func(current reflect.Type, path []int) ([]int, bool)
+	walk = func(current reflect.Type, path []int) ([]int, bool) {
+		onPath[current] = true
+		defer delete(onPath, current)
+		for i := 0; i < current.NumField(); i++ {
+			field := current.Field(i)
+			fieldPath := append(append([]int{}, path...), i)
+			if field.Anonymous {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Ptr {embedded = embedded.Elem()}
+				if embedded.Kind() == reflect.Struct && !onPath[embedded] {
+					if match, ok := walk(embedded, fieldPath); ok {return match, true}
+				}
+				continue
+			}
+			if field.PkgPath != "" {continue}
+
+			jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+			if strings.EqualFold(jsonName, name) || strings.EqualFold(field.Tag.Get(indexTag), name) {return fieldPath, true}
+		}
+		return nil, false
+	}
+	return walk(structType, nil)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float(), true
+	}
+	return 0, false
+}
+
+func compareFloats(left, right float64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	}
+	return 0
+}
+
+// compareForSort orders missing values last, numbers before strings, and everything else by its text
+func compareForSort(left interface{}, leftOk bool, right interface{}, rightOk bool) int {
+	leftOk, rightOk = leftOk && left != nil, rightOk && right != nil
+	if !leftOk || !rightOk {
+		switch {
+		case leftOk:
+			return -1
+		case rightOk:
+			return 1
+		}
+		return 0
+	}
+
+	leftNumber, leftIsNumber := toFloat(left)
+	rightNumber, rightIsNumber := toFloat(right)
+	switch {
+	case leftIsNumber && rightIsNumber:
+		return compareFloats(leftNumber, rightNumber)
+	case leftIsNumber:
+		return -1
+	case rightIsNumber:
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(left), fmt.Sprint(right))
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Parsing">
+
+type queryToken struct {
+	kind string // "word", "string", "number", "op", "(", ")", "eof"
+	text string
+}
+
+type queryParser struct {
+	tokens   []queryToken
+	position int
+}
+
+// ParseQuery checks and parses a query, so it can be run many times
+func ParseQuery(text string) (*Query, error) {
+	tokens, err := tokenizeQuery(text)
+	if err != nil {return nil, err}
+
+	parser := &queryParser{tokens: tokens}
+	query := &Query{}
+
+	if parser.isKeyword("WHERE") {
+		parser.position++
+		if query.where, err = parser.parseOr(); err != nil {return nil, err}
+	}
+
+	if parser.isKeyword("ORDER") {
+		parser.position++
+		if !parser.isKeyword("BY") {return nil, parser.fail("expected BY after ORDER")}
+		parser.position++
+		if query.orderBy, err = parser.parseField(); err != nil {return nil, err}
+		if parser.isKeyword("DESC") {
+			query.descending = true
+			parser.position++
+		} else if parser.isKeyword("ASC") {
+			parser.position++
+		}
+	}
+
+	if parser.isKeyword("LIMIT") {
+		parser.position++
+		token := parser.next()
+		limit, err := strconv.Atoi(token.text)
+		if token.kind != "number" || err != nil || limit < 1 {return nil, parser.fail("LIMIT needs a positive whole number")}
+		query.limit = limit
+	}
+
+	if parser.peek().kind != "eof" {return nil, parser.fail("unexpected '%s'", parser.peek().text)}
+	return query, nil
+}
+
+func (parser *queryParser) parseOr() (queryExpr, error) {
+	first, err := parser.parseAnd()
+	if err != nil {return nil, err}
+
+	parts := []queryExpr{first}
+	for parser.isKeyword("OR") {
+		parser.position++
+		next, err := parser.parseAnd()
+		if err != nil {return nil, err}
+		parts = append(parts, next)
+	}
+	if len(parts) == 1 {return first, nil}
+	return &orExpr{parts: parts}, nil
+}
+
+func (parser *queryParser) parseAnd() (queryExpr, error) {
+	first, err := parser.parseNot()
+	if err != nil {return nil, err}
+
+	parts := []queryExpr{first}
+	for parser.isKeyword("AND") {
+		parser.position++
+		next, err := parser.parseNot()
+		if err != nil {return nil, err}
+		parts = append(parts, next)
+	}
+	if len(parts) == 1 {return first, nil}
+	return &andExpr{parts: parts}, nil
+}
+
+func (parser *queryParser) parseNot() (queryExpr, error) {
+	if parser.isKeyword("NOT") {
+		parser.position++
+		inner, err := parser.parseNot()
+		if err != nil {return nil, err}
+		return &notExpr{inner: inner}, nil
+	}
+
+	if parser.peek().kind == "(" {
+		parser.position++
+		inner, err := parser.parseOr()
+		if err != nil {return nil, err}
+		if parser.next().kind != ")" {return nil, parser.fail("expected ')'")}
+		return inner, nil
+	}
+
+	return parser.parseComparison()
+}
+
+func (parser *queryParser) parseComparison() (queryExpr, error) {
+	field, err := parser.parseField()
+	if err != nil {return nil, err}
+
+	expr := &compareExpr{field: field}
+	token := parser.next()
+	switch {
+	case token.kind == "op":
+		expr.op = token.text
+		if expr.op == "<>" {expr.op = "!="}
+	case token.kind == "word" && strings.EqualFold(token.text, "LIKE"):
+		expr.op = "LIKE"
+	default:
+		return nil, parser.fail("expected a comparison after '%s'", strings.Join(field, "."))
+	}
+
+	literal := parser.next()
+	switch {
+	case literal.kind == "string":
+		expr.literal = literal.text
+	case literal.kind == "number":
+		number, err := strconv.ParseFloat(literal.text, 64)
+		if err != nil {return nil, parser.fail("'%s' is not a number", literal.text)}
+		expr.literal = number
+	case literal.kind == "word" && strings.EqualFold(literal.text, "true"):
+		expr.literal = true
+	case literal.kind == "word" && strings.EqualFold(literal.text, "false"):
+		expr.literal = false
+	case literal.kind == "word" && strings.EqualFold(literal.text, "null"):
+		expr.literal = nil
+		if expr.op != "=" && expr.op != "!=" {return nil, parser.fail("null can only be compared with = or !=")}
+	default:
+		return nil, parser.fail("expected a value to compare '%s' with", strings.Join(field, "."))
+	}
+
+	if expr.op == "LIKE" {
+		pattern, ok := expr.literal.(string)
+		if !ok {return nil, parser.fail("LIKE needs a string pattern")}
+		expr.like = likeToRegexp(pattern)
+	}
+	return expr, nil
+}
+
+func (parser *queryParser) parseField() ([]string, error) {
+	token := parser.next()
+	if token.kind != "word" || isQueryKeyword(token.text) {return nil, parser.fail("expected a field name, but got '%s'", token.text)}
+	return strings.Split(token.text, "."), nil
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.position]
+}
+
+func (parser *queryParser) next() queryToken {
+	token := parser.tokens[parser.position]
+	if token.kind != "eof" {parser.position++}
+	return token
+}
+
+func (parser *queryParser) isKeyword(keyword string) bool {
+	token := parser.peek()
+	return token.kind == "word" && strings.EqualFold(token.text, keyword)
+}
+
+func (parser *queryParser) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", InvalidQueryError, fmt.Sprintf(format, args...))
+}
+
+func isQueryKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "WHERE", "AND", "OR", "NOT", "LIKE", "ORDER", "BY", "ASC", "DESC", "LIMIT":
+		return true
+	}
+	return false
+}
+
+func tokenizeQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{kind: string(r), text: string(r)})
+			i++
+
+		case r == '"' || r == '\'':
+			var builder strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {j++}
+				builder.WriteRune(runes[j])
+			}
+			if j >= len(runes) {return nil, fmt.Errorf("%w: unterminated string", InvalidQueryError)}
+			tokens = append(tokens, queryToken{kind: "string", text: builder.String()})
+			i = j + 1
+
+		case strings.ContainsRune("=!<>", r):
+			op := string(r)
+			if i+1 < len(runes) && strings.ContainsRune("=>", runes[i+1]) {op += string(runes[i+1])}
+			switch op {
+			case "=", "!=", "<>", "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("%w: unknown operator '%s'", InvalidQueryError, op)
+			}
+			tokens = append(tokens, queryToken{kind: "op", text: op})
+			i += len(op)
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j, dotted := i+1, false
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || (runes[j] == '.' && !dotted)) {
+				if runes[j] == '.' {dotted = true}
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: "number", text: string(runes[i:j])})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {j++}
+			tokens = append(tokens, queryToken{kind: "word", text: string(runes[i:j])})
+			i = j
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected character '%c'", InvalidQueryError, r)
+		}
+	}
+	return append(tokens, queryToken{kind: "eof"}), nil
+}
+
+// likeToRegexp turns a SQL LIKE pattern into an anchored regular expression
+func likeToRegexp(pattern string) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteString("(?s)^") // so % and _ match newlines too
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			builder.WriteString(".*")
+		case '_':
+			builder.WriteString(".")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	builder.WriteString("$")
+	return regexp.MustCompile(builder.String())
+}
+
+//</editor-fold>
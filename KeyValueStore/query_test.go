@@ -0,0 +1,175 @@
+package keyvaluestore_test
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func resultKeys(results []kvs.QueryResult) []string {
+	keys := []string{}
+	for _, result := range results {
+		keys = append(keys, string(result.Key))
+	}
+	return keys
+}
+
+func expectKeys(t *testing.T, query string, results []kvs.QueryResult, err error, expected ...string){
+	t.Helper()
+	if err != nil {t.Fatalf("Query '%s' failed with %v", query, err)}
+	keys := resultKeys(results)
+	if len(keys) != len(expected) {t.Fatalf("Query '%s': expected %v, but got %v", query, expected, keys)}
+	for i := range expected {
+		if keys[i] != expected[i] {t.Fatalf("Query '%s': expected %v, but got %v", query, expected, keys)}
+	}
+}
+
+func queryStore() *kvs.IndependentStore {
+	store := kvs.OpenNew()
+	_ = store.Put("user:1", indexedUser{indexedPerson: indexedPerson{Name: "Sam", Age: 30}, Email: "sam@example.com"})
+	_ = store.Put("user:2", &indexedUser{indexedPerson: indexedPerson{Name: "Alex", Age: 45}, Email: "alex@example.com"})
+	_ = store.Put("user:3", indexedUser{indexedPerson: indexedPerson{Name: "Sophie", Age: 52}, Email: "sophie@example.com"})
+	_ = store.Put("map:1", map[string]interface{}{"name": "Steve", "age": 61, "address": map[string]interface{}{"city": "Leeds"}})
+	_ = store.Put("plain", "not a record")
+	return store
+}
+
+func TestQueryFiltersOrdersAndLimits(t *testing.T){
+	store := queryStore()
+
+	query := `WHERE age > 30 AND name LIKE "S%" ORDER BY age DESC LIMIT 10`
+	results, err := store.Query(query)
+	expectKeys(t, query, results, err, "map:1", "user:3")
+
+	query = `where (name = 'Sam' or age >= 50) and not name like "St_ve" order by age`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "user:1", "user:3")
+
+	query = `ORDER BY age LIMIT 2`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "user:1", "user:2")
+
+	// missing fields never match, and sort last
+	query = `WHERE age != 30 ORDER BY age`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "user:2", "user:3", "map:1")
+
+	query = `WHERE age = null`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "plain")
+
+	query = `WHERE address.city = "Leeds" OR _key LIKE "%:2"`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "map:1", "user:2")
+
+	if results, _ := store.Query(""); len(results) != 5 || results[0].Key != "map:1" {
+		t.Errorf("Expected an empty query to return everything by key, but got %v", resultKeys(results))
+	}
+}
+
+func TestQueryGivesSameResultsWithIndexes(t *testing.T){
+	store := queryStore()
+
+	// `name` is an index, but the map value doesn't carry it, so it must still be checked
+	query := `WHERE name = "Steve" OR name = "Sam"`
+	results, err := store.Query(query)
+	expectKeys(t, query, results, err, "map:1", "user:1")
+
+	query = `WHERE name = "Steve" AND age > 60`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "map:1")
+
+	query = `WHERE email = "alex@example.com"`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "user:2")
+	if results[0].Value.(*indexedUser).Age != 45 {t.Errorf("Expected stored value to be returned, but got %#v", results[0].Value)}
+}
+
+type taggedMember struct {
+	Age   int    `json:"age" kvindex:"age"`
+	Email string `json:"email" kvindex:"nick"` // an index named like another field
+	Nick  string `json:"nick"`
+}
+
+type plainMember struct {
+	Age   int    `json:"age"`
+	Email string `json:"email"`
+	Nick  string `json:"nick"`
+}
+
+func TestIndexesOnlySpeedQueriesUp(t *testing.T){
+	indexed, plain := kvs.OpenNew(), kvs.OpenNew()
+	_ = indexed.Put("m:1", taggedMember{Age: 30, Email: "sam@example.com", Nick: "Sammy"})
+	_ = indexed.Put("m:2", taggedMember{Age: 41, Email: "Sammy", Nick: "Al"})
+	_ = plain.Put("m:1", plainMember{Age: 30, Email: "sam@example.com", Nick: "Sammy"})
+	_ = plain.Put("m:2", plainMember{Age: 41, Email: "Sammy", Nick: "Al"})
+	if len(indexed.Indexes()) != 2 || len(plain.Indexes()) != 0 {t.Fatalf("Expected only the tagged store to have indexes, but got %v and %v", indexed.Indexes(), plain.Indexes())}
+
+	for _, query := range []string{
+		`WHERE age = 30`,
+		`WHERE age = "30"`,
+		`WHERE age = "41" AND nick = "Al"`,
+		`WHERE nick = "Sammy"`,
+		`WHERE email = "sam@example.com"`,
+		`WHERE email = "Sammy"`,
+	} {
+		withIndex, err := indexed.Query(query)
+		if err != nil {t.Fatalf("Query '%s' failed with %v", query, err)}
+		without, err := plain.Query(query)
+		expectKeys(t, query, withIndex, err, resultKeys(without)...)
+		if len(without) != 1 {t.Errorf("Query '%s': expected one match, but got %v", query, resultKeys(without))}
+	}
+}
+
+func TestInvalidQueriesAreRejected(t *testing.T){
+	store := queryStore()
+
+	for _, query := range []string{
+		`age > 30`,
+		`WHERE age >`,
+		`WHERE age > 30 AND`,
+		`WHERE (age > 30`,
+		`WHERE name LIKE 5`,
+		`WHERE age < null`,
+		`WHERE name = "unterminated`,
+		`ORDER age`,
+		`LIMIT 0`,
+		`WHERE age => 3`,
+		`WHERE age > 1.2.3`,
+		`WHERE age > 1` + strings.Repeat("0", 400),
+	} {
+		if _, err := store.Query(query); !errors.Is(err, kvs.InvalidQueryError) {
+			t.Errorf("Query '%s': expected '%v', but got '%v'", query, kvs.InvalidQueryError, err)
+		}
+	}
+}
+
+type taggedNode struct {
+	*taggedNode
+	Label string `json:"label" kvindex:"tag"`
+}
+
+func TestQueriesHandleSelfEmbeddingStructs(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.Put("node:1", taggedNode{taggedNode: &taggedNode{Label: "parent"}, Label: "child"})
+	_ = store.Put("node:2", taggedNode{Label: "other"})
+
+	query := `WHERE label = "child"`
+	results, err := store.Query(query)
+	expectKeys(t, query, results, err, "node:1")
+}
+
+func TestLikeMatchesAcrossLines(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.Put("note:1", map[string]interface{}{"text": "first line\nsecond line"})
+	_ = store.Put("note:2", map[string]interface{}{"text": "one line"})
+
+	query := `WHERE text LIKE "first%line"`
+	results, err := store.Query(query)
+	expectKeys(t, query, results, err, "note:1")
+
+	query = `WHERE text LIKE "first line_second line"`
+	results, err = store.Query(query)
+	expectKeys(t, query, results, err, "note:1")
+}
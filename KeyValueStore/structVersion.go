@@ -1,8 +1,11 @@
 package keyvaluestore
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -59,27 +62,47 @@ type IndependentStore struct {
 
 	// private
 	isOpen bool
-	coreMap map[StoreKey]StoreValue // interface always acts like a pointer?
+	core backend // where the keys and values live; a map unless opened with `OpenMapped`
 	mutex *sync.RWMutex
+	capacity int // zero for no limit
+	hooks storeHooks
+	pendingRemovals []removal // removed under the lock, waiting for hooks to be run
+	log *storeLog // nil unless opened with `OpenFile`
+	feed *changeFeed // nil unless `EnableChangeFeed` has been called
+	leases map[StoreKey]Lease
+	fencingToken uint64 // last token handed out with a lease
+	indexes map[string]map[interface{}]map[StoreKey]struct{} // index name => field value => keys
+	indexedKeys map[StoreKey][]indexEntry // what each key is indexed under, so it can be removed again
 
 	// public?
 	InstanceNum int
 }
 
 type timestampWrapper struct{
+	accessLock sync.Mutex // `Get` sets the timestamp while only holding the store's read lock
 	lastAccess time.Time
+	expires time.Time // zero for never
 	value interface{}
 }
-func (receiver *timestampWrapper) SetTimestamp(t time.Time) {receiver.lastAccess=t }
-func (receiver *timestampWrapper) GetTimestamp()time.Time   {return receiver.lastAccess}
+func (receiver *timestampWrapper) SetTimestamp(t time.Time) {
+	receiver.accessLock.Lock()
+	receiver.lastAccess=t
+	receiver.accessLock.Unlock()
+}
+func (receiver *timestampWrapper) GetTimestamp()time.Time {
+	receiver.accessLock.Lock()
+	defer receiver.accessLock.Unlock()
+	return receiver.lastAccess
+}
 func (receiver *timestampWrapper) GetValue()interface{}     {return receiver.value}
+func (receiver *timestampWrapper) expiresAt()time.Time      {return receiver.expires}
 
 // String satisfies the Stringer interface. It doesn't matter if we use `(receiver *IndependentStore)` or `(receiver IndependentStore)`
 func (receiver *IndependentStore) String() string {
 	receiver.mutex.RLock()
 	defer receiver.mutex.RUnlock()
 
-	return fmt.Sprintf("Key value store (%d keys, is open = %v)", len(receiver.coreMap), receiver.isOpen)
+	return fmt.Sprintf("Key value store (%d keys, is open = %v)", receiver.core.count(), receiver.isOpen)
 }
 
 // OpenNew is an alternative to `new(IndependentStore)`, used like `keyvaluestore.OpenNew()`
@@ -87,9 +110,12 @@ func OpenNew() *IndependentStore {
 	iNum++
 	store := IndependentStore{
 		isOpen: true,
-		coreMap: map[StoreKey]StoreValue{},// or `make(map[StoreKey]StoreValue),`, but this is considered 'oldthink'
+		core: newCore(),
 		InstanceNum: iNum, // you NEED a trailing comma if the closing brace is on a new line
 		mutex: &sync.RWMutex{},
+		leases: map[StoreKey]Lease{},
+		indexes: map[string]map[interface{}]map[StoreKey]struct{}{},
+		indexedKeys: map[StoreKey][]indexEntry{},
 	}
 	return &store
 }
@@ -101,6 +127,16 @@ func (receiver *IndependentStore)Open() error {
 	receiver.mutex.Lock()
 	defer receiver.mutex.Unlock()
 
+	if receiver.core != nil {
+		if err := receiver.core.reopen(); err != nil {return err}
+	}
+	if receiver.log != nil {
+		if err := receiver.log.reopen(); err != nil {return err}
+	}
+	if receiver.feed != nil {
+		if err := receiver.feed.reopen(); err != nil {return err}
+	}
+
 	receiver.isOpen = true
 	return nil
 }
@@ -113,7 +149,7 @@ func (receiver *IndependentStore)Close() error {
 	defer receiver.mutex.Unlock()
 
 	receiver.isOpen = false
-	return nil
+	return receiver.closeFilesLocked()
 }
 
 func CloseExisting(store *IndependentStore) error {
@@ -123,138 +159,262 @@ func CloseExisting(store *IndependentStore) error {
 	defer store.mutex.Unlock()
 
 	store.isOpen = false
-	return nil
+	return store.closeFilesLocked()
 }
 
 func PutValue(store *IndependentStore, key StoreKey, value interface{}) error {
 	if store == nil || !store.isOpen {return StoreNotOpenError}
-	if store.coreMap == nil {return InvalidStoreError}
+	if store.core == nil {return InvalidStoreError}
 
 	store.mutex.Lock()
-	defer store.mutex.Unlock()
+	defer store.unlockAndNotify()
 
-	store.coreMap[key] = &timestampWrapper{
+	return store.putLocked(key, &timestampWrapper{
 		lastAccess: time.Now(),
 		value:      value,
-	}
-
-	return nil
+	})
 }
 
 func (receiver *IndependentStore)Put(key StoreKey, value interface{}) error {
+	return receiver.PutContext(context.Background(), key, value)
+}
+
+// PutContext is `Put`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) PutContext(ctx context.Context, key StoreKey, value interface{}) error {
 	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
-	if receiver.coreMap == nil {return InvalidStoreError}
+	if receiver.core == nil {return InvalidStoreError}
 
-	receiver.mutex.Lock()
-	defer receiver.mutex.Unlock()
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
 
-	receiver.coreMap[key] = &timestampWrapper{
+	return receiver.putLocked(key, &timestampWrapper{
 		lastAccess: time.Now(),
 		value:      value,
+	})
+}
+
+// CompareAndSwap replaces the value at `key` with `replacement`, but only if the current value is `expected`
+// (as `reflect.DeepEqual` sees it). Returns false if the value was something else, or KeyNotPresentError if there is none.
+// Any expiry time is kept.
+func (receiver *IndependentStore) CompareAndSwap(key StoreKey, expected, replacement interface{}) (bool, error) {
+	return receiver.CompareAndSwapContext(context.Background(), key, expected, replacement)
+}
+
+// CompareAndSwapContext is `CompareAndSwap`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) CompareAndSwapContext(ctx context.Context, key StoreKey, expected, replacement interface{}) (bool, error) {
+	if receiver == nil || !receiver.isOpen {return false, StoreNotOpenError}
+	if receiver.core == nil {return false, InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return false, err}
+	defer receiver.unlockAndNotify()
+
+	now := time.Now()
+	current, ok := receiver.core.get(key)
+	if !ok || isExpired(current, now) {return false, KeyNotPresentError}
+	if !reflect.DeepEqual(current.GetValue(), expected) {return false, nil}
+
+	swapped := &timestampWrapper{
+		lastAccess: now,
+		expires:    expiryOf(current),
+		value:      replacement,
 	}
-	return nil
+
+	if err := receiver.putLocked(key, swapped); err != nil {return false, err}
+	return true, nil
 }
 
 func GetValue(store *IndependentStore, key StoreKey) (interface{}, error){
 	if store == nil || !store.isOpen {return "", StoreNotOpenError}
-	if store.coreMap == nil {return "", InvalidStoreError}
+	if store.core == nil {return "", InvalidStoreError}
 
 	store.mutex.RLock() // even though we technically write here; it's a timestamp, so we allow latest-writer-wins
 	defer store.mutex.RUnlock()
 
-	value, ok := store.coreMap[key]
-	if !ok {return "", KeyNotPresentError}
+	value, ok := store.core.get(key)
+	if !ok || isExpired(value, time.Now()) {return "", KeyNotPresentError}
 
 	value.SetTimestamp(time.Now())
 	return fmt.Sprintf("%v",value.GetValue()), nil // seems a bit mental, but is about the only way to cast interface to string
 }
 
 func (receiver *IndependentStore)Get(key StoreKey) (interface{}, error){
+	return receiver.GetContext(context.Background(), key)
+}
+
+// GetContext is `Get`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) GetContext(ctx context.Context, key StoreKey) (interface{}, error) {
 	if receiver == nil || !receiver.isOpen {return "", StoreNotOpenError}
-	if receiver.coreMap == nil {return "", InvalidStoreError}
-	value, ok := receiver.coreMap[key]
-	if !ok {return "", KeyNotPresentError}
+	if receiver.core == nil {return "", InvalidStoreError}
 
-	receiver.mutex.RLock() // even though we technically write here; it's a timestamp, so we allow latest-writer-wins
+	if err := receiver.rLockContext(ctx); err != nil {return "", err} // even though we technically write here; it's a timestamp, so we allow latest-writer-wins
 	defer receiver.mutex.RUnlock()
 
+	value, ok := receiver.core.get(key)
+	if !ok || isExpired(value, time.Now()) {return "", KeyNotPresentError}
+
 	value.SetTimestamp(time.Now())
 
 	return value.GetValue(), nil
 }
 
 func (receiver *IndependentStore)GetAge(key StoreKey) (time.Time, error){
+	return receiver.GetAgeContext(context.Background(), key)
+}
+
+// GetAgeContext is `GetAge`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) GetAgeContext(ctx context.Context, key StoreKey) (time.Time, error) {
 	if receiver == nil || !receiver.isOpen {return time.Time{}, StoreNotOpenError}
-	if receiver.coreMap == nil {return time.Time{}, InvalidStoreError}
-	value, ok := receiver.coreMap[key]
-	if !ok {return time.Time{}, KeyNotPresentError}
+	if receiver.core == nil {return time.Time{}, InvalidStoreError}
 
-	receiver.mutex.RLock()
+	if err := receiver.rLockContext(ctx); err != nil {return time.Time{}, err}
 	defer receiver.mutex.RUnlock()
 
+	value, ok := receiver.core.get(key)
+	if !ok || isExpired(value, time.Now()) {return time.Time{}, KeyNotPresentError}
+
 	return value.GetTimestamp(), nil
 }
 
 func DeleteValue(store *IndependentStore, key StoreKey) error{
 	if store == nil || !store.isOpen {return StoreNotOpenError}
-	if store.coreMap == nil {return InvalidStoreError}
-	if _, ok := store.coreMap[key]; !ok {return KeyNotPresentError}
+	if store.core == nil {return InvalidStoreError}
 
 	store.mutex.Lock()
-	defer store.mutex.Unlock()
+	defer store.unlockAndNotify()
 
-	delete(store.coreMap, key)
-	return nil
+	if _, ok := store.core.get(key); !ok {return KeyNotPresentError}
+
+	return store.removeLocked(key, ReasonDeleted)
 }
 
 func (receiver *IndependentStore)Delete(key StoreKey) error{
+	return receiver.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is `Delete`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) DeleteContext(ctx context.Context, key StoreKey) error {
 	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
-	if receiver.coreMap == nil {return InvalidStoreError}
-	if _, ok := receiver.coreMap[key]; !ok {return KeyNotPresentError}
+	if receiver.core == nil {return InvalidStoreError}
 
-	receiver.mutex.Lock()
-	defer receiver.mutex.Unlock()
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
 
-	delete(receiver.coreMap, key)
-	return nil
+	if _, ok := receiver.core.get(key); !ok {return KeyNotPresentError}
+
+	return receiver.removeLocked(key, ReasonDeleted)
 }
 
 func (receiver *IndependentStore)Contains(key StoreKey) bool{
-	if receiver == nil || !receiver.isOpen {return false}
-	if receiver.coreMap == nil {return false}
+	found, _ := receiver.ContainsContext(context.Background(), key)
+	return found
+}
 
-	receiver.mutex.RLock()
+// ContainsContext is `Contains`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) ContainsContext(ctx context.Context, key StoreKey) (bool, error) {
+	if receiver == nil || !receiver.isOpen {return false, StoreNotOpenError}
+	if receiver.core == nil {return false, InvalidStoreError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return false, err}
+	defer receiver.mutex.RUnlock()
+
+	value, ok := receiver.core.get(key)
+	return ok && !isExpired(value, time.Now()), nil
+}
+
+// Keys returns every key in the store, in sorted order
+func (receiver *IndependentStore) Keys() []StoreKey {
+	keys, _ := receiver.KeysContext(context.Background())
+	return keys
+}
+
+// KeysContext is `Keys`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) KeysContext(ctx context.Context) ([]StoreKey, error) {
+	if receiver == nil || !receiver.isOpen {return nil, StoreNotOpenError}
+	if receiver.core == nil {return nil, InvalidStoreError}
+
+	if err := receiver.rLockContext(ctx); err != nil {return nil, err}
 	defer receiver.mutex.RUnlock()
 
-	_, ok := receiver.coreMap[key]
-	return ok
+	now := time.Now()
+	keys := make([]StoreKey, 0, receiver.core.count())
+	receiver.core.each(func(key StoreKey, value StoreValue) bool {
+		if !isExpired(value, now) {keys = append(keys, key)}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
 }
 
 func (receiver *IndependentStore) PutWithAge(key StoreKey, value interface{}, timestamp time.Time) error {
+	return receiver.PutWithAgeContext(context.Background(), key, value, timestamp)
+}
+
+// PutWithAgeContext is `PutWithAge`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) PutWithAgeContext(ctx context.Context, key StoreKey, value interface{}, timestamp time.Time) error {
 	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
-	if receiver.coreMap == nil {return InvalidStoreError}
+	if receiver.core == nil {return InvalidStoreError}
 
-	receiver.mutex.Lock()
-	defer receiver.mutex.Unlock()
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
 
-	receiver.coreMap[key] = &timestampWrapper{
+	return receiver.putLocked(key, &timestampWrapper{
 		lastAccess: timestamp,
 		value:      value,
+	})
+}
+
+// putLocked stores a value (writing it to the store file first, if there is one), then makes room if the store is over capacity.
+// Caller must hold the write lock.
+func (receiver *IndependentStore) putLocked(key StoreKey, value StoreValue) error {
+	if receiver.log != nil || receiver.feed != nil {
+		line, err := recordForValue(key, value)
+		if err != nil {return err}
+		if err = receiver.appendLocked(line); err != nil {return err}
 	}
+
+	if err := receiver.core.set(key, value); err != nil {return err}
+	receiver.reindexLocked(key, value.GetValue())
+	receiver.enforceCapacityLocked(key)
+	return nil
+}
+
+// removeLocked takes a key out of the store, and queues up the removal hooks to run once the lock is released.
+// Caller must hold the write lock, and release it with `unlockAndNotify`
+func (receiver *IndependentStore) removeLocked(key StoreKey, reason RemovalReason) error {
+	stored, ok := receiver.core.get(key)
+	if !ok {return nil}
+	value := stored.GetValue() // before it goes: a mapped backend only reads values from its file
+
+	if err := receiver.appendLocked(RecordLine{Op: OpDelete, Key: key, Timestamp: time.Now()}); err != nil {return err}
+	receiver.core.remove(key)
+
+	receiver.unindexLocked(key)
+	receiver.pendingRemovals = append(receiver.pendingRemovals, removal{
+		key:    key,
+		value:  value,
+		reason: reason,
+	})
 	return nil
 }
 
 func (receiver *IndependentStore) EvictOlderThan(timestamp time.Time) {
-	if receiver == nil || !receiver.isOpen {return}
-	if receiver.coreMap == nil {return}
+	_ = receiver.EvictOlderThanContext(context.Background(), timestamp)
+}
 
-	receiver.mutex.Lock()
-	defer receiver.mutex.Unlock()
+// EvictOlderThanContext is `EvictOlderThan`, but gives up if `ctx` is done first
+func (receiver *IndependentStore) EvictOlderThanContext(ctx context.Context, timestamp time.Time) error {
+	if receiver == nil || !receiver.isOpen {return StoreNotOpenError}
+	if receiver.core == nil {return InvalidStoreError}
+
+	if err := receiver.lockContext(ctx); err != nil {return err}
+	defer receiver.unlockAndNotify()
 
-	for key, value := range receiver.coreMap {
+	receiver.core.each(func(key StoreKey, value StoreValue) bool {
 		realAge := value.GetTimestamp()
 		if realAge.After(timestamp) {
-			delete(receiver.coreMap, key)
+			_ = receiver.removeLocked(key, ReasonEvicted) // a failed write sticks, and is reported by the next Put or Close
 		}
-	}
+		return true
+	})
+	return nil
 }
\ No newline at end of file
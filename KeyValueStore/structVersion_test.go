@@ -292,4 +292,29 @@ func TestCanStoreAnything(t *testing.T){
 	}
 }
 
-func s(i int)string{return strconv.Itoa(i)}
\ No newline at end of file
+func s(i int)string{return strconv.Itoa(i)}
+
+func TestCompareAndSwap(t *testing.T){
+	store := kvs.OpenNew()
+
+	if _, err := store.CompareAndSwap("missing", 1, 2); err != kvs.KeyNotPresentError {
+		t.Errorf("Expected '%v', but got '%v'", kvs.KeyNotPresentError, err)
+	}
+
+	_ = store.Put("counter", 1)
+	if swapped, err := store.CompareAndSwap("counter", 5, 6); swapped || err != nil {
+		t.Errorf("Expected no swap when the value differs, but got %v, %v", swapped, err)
+	}
+	if swapped, err := store.CompareAndSwap("counter", 1, 2); !swapped || err != nil {
+		t.Errorf("Expected a swap, but got %v, %v", swapped, err)
+	}
+	if v, _ := store.Get("counter"); v != 2 {
+		t.Errorf("Expected '2', but got '%v'", v)
+	}
+
+	// values are compared deeply, so slices and maps work too
+	_ = store.Put("list", []string{"a"})
+	if swapped, _ := store.CompareAndSwap("list", []string{"a"}, []string{"a", "b"}); !swapped {
+		t.Errorf("Expected slices with the same contents to match")
+	}
+}
@@ -0,0 +1,179 @@
+package keyvaluestore
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Values are written to disk as a type name plus a JSON body, so that they come back as the
+// same Go type they went in as. Your own types need to be registered with `RegisterType` for
+// that to work (much like `gob.Register`). Anything we don't know about is written as plain
+// JSON and comes back as whatever `encoding/json` makes of it (maps, float64s, etc).
+// If a file names a type that hasn't been registered in this program (say, when kvctl opens a
+// service's store), the value comes back as a `TypedValue` and is written back out unchanged.
+
+// TypedValue is a stored value in its serialised form
+type TypedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+const (
+	typeNil       = "nil"
+	typeList      = "list"
+	typeSet       = "set"
+	typeHash      = "hash"
+	typeSortedSet = "zset"
+	typeJson      = "json"
+)
+
+// scalarTypes maps the reflected type name to a maker for that type.
+// `json.Unmarshal` into the pointer then gives us back the exact type.
+var scalarTypes = map[string]func() interface{}{
+	"string":    func() interface{} { return new(string) },
+	"bool":      func() interface{} { return new(bool) },
+	"int":       func() interface{} { return new(int) },
+	"int8":      func() interface{} { return new(int8) },
+	"int16":     func() interface{} { return new(int16) },
+	"int32":     func() interface{} { return new(int32) },
+	"int64":     func() interface{} { return new(int64) },
+	"uint":      func() interface{} { return new(uint) },
+	"uint8":     func() interface{} { return new(uint8) },
+	"uint16":    func() interface{} { return new(uint16) },
+	"uint32":    func() interface{} { return new(uint32) },
+	"uint64":    func() interface{} { return new(uint64) },
+	"float32":   func() interface{} { return new(float32) },
+	"float64":   func() interface{} { return new(float64) },
+	"[]uint8":   func() interface{} { return new([]byte) },
+	"time.Time": func() interface{} { return new(time.Time) },
+}
+
+var registeredTypes = sync.Map{} // type name => reflect.Type
+
+// RegisterType records the type of `example`, so that values of that type are read back from
+// store files as that type rather than as generic JSON. Register before opening any files.
+func RegisterType(example interface{}) {
+	if example == nil {return}
+	goType := reflect.TypeOf(example)
+	registeredTypes.Store(goType.String(), goType)
+}
+
+// EncodeValue converts a stored value to its serialised form
+func EncodeValue(value interface{}) (TypedValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return TypedValue{Type: typeNil, Value: json.RawMessage("null")}, nil
+
+	case *storeList:
+		items := make([]TypedValue, 0, len(v.items))
+		for _, item := range v.items {
+			encoded, err := EncodeValue(item)
+			if err != nil {return TypedValue{}, err}
+			items = append(items, encoded)
+		}
+		return marshalTyped(typeList, items)
+
+	case *storeSet:
+		members := make([]string, 0, len(v.members))
+		for member := range v.members {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return marshalTyped(typeSet, members)
+
+	case *storeHash:
+		fields := make(map[string]TypedValue, len(v.fields))
+		for field, item := range v.fields {
+			encoded, err := EncodeValue(item)
+			if err != nil {return TypedValue{}, err}
+			fields[field] = encoded
+		}
+		return marshalTyped(typeHash, fields)
+
+	case *storeSortedSet:
+		return marshalTyped(typeSortedSet, v.scores)
+
+	case TypedValue:
+		return v, nil
+	}
+
+	typeName := reflect.TypeOf(value).String()
+	if _, ok := scalarTypes[typeName]; ok {
+		return marshalTyped(typeName, value)
+	}
+	if _, ok := registeredTypes.Load(typeName); ok {
+		return marshalTyped(typeName, value)
+	}
+	return marshalTyped(typeJson, value)
+}
+
+// DecodeValue converts a serialised value back to the value that was stored
+func DecodeValue(encoded TypedValue) (interface{}, error) {
+	if maker, ok := scalarTypes[encoded.Type]; ok {
+		target := maker()
+		if err := json.Unmarshal(encoded.Value, target); err != nil {return nil, err}
+		return reflect.ValueOf(target).Elem().Interface(), nil
+	}
+
+	switch encoded.Type {
+	case typeNil:
+		return nil, nil
+
+	case typeList:
+		var items []TypedValue
+		if err := json.Unmarshal(encoded.Value, &items); err != nil {return nil, err}
+		list := &storeList{items: make([]interface{}, 0, len(items))}
+		for _, item := range items {
+			decoded, err := DecodeValue(item)
+			if err != nil {return nil, err}
+			list.items = append(list.items, decoded)
+		}
+		return list, nil
+
+	case typeSet:
+		var members []string
+		if err := json.Unmarshal(encoded.Value, &members); err != nil {return nil, err}
+		set := &storeSet{members: make(map[string]struct{}, len(members))}
+		for _, member := range members {
+			set.members[member] = struct{}{}
+		}
+		return set, nil
+
+	case typeHash:
+		var fields map[string]TypedValue
+		if err := json.Unmarshal(encoded.Value, &fields); err != nil {return nil, err}
+		hash := &storeHash{fields: make(map[string]interface{}, len(fields))}
+		for field, item := range fields {
+			decoded, err := DecodeValue(item)
+			if err != nil {return nil, err}
+			hash.fields[field] = decoded
+		}
+		return hash, nil
+
+	case typeSortedSet:
+		sorted := &storeSortedSet{scores: map[string]float64{}}
+		if err := json.Unmarshal(encoded.Value, &sorted.scores); err != nil {return nil, err}
+		return sorted, nil
+
+	case typeJson:
+		var value interface{}
+		if err := json.Unmarshal(encoded.Value, &value); err != nil {return nil, err}
+		return value, nil
+
+	default:
+		registered, ok := registeredTypes.Load(encoded.Type)
+		if !ok {return encoded, nil} // not registered here, so keep it as-is and write it back unchanged
+		target := reflect.New(registered.(reflect.Type))
+		if err := json.Unmarshal(encoded.Value, target.Interface()); err != nil {return nil, err}
+		return target.Elem().Interface(), nil
+	}
+}
+
+func marshalTyped(typeName string, value interface{}) (TypedValue, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {return TypedValue{}, err}
+	return TypedValue{Type: typeName, Value: raw}, nil
+}
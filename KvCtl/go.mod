@@ -0,0 +1,7 @@
+module KvCtl
+
+go 1.16
+
+replace KeyValueStore => ../KeyValueStore
+
+require KeyValueStore v0.0.0
@@ -0,0 +1,443 @@
+package main
+
+import (
+	kvs "KeyValueStore"
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+
+kvctl - look at and repair KeyValueStore files without writing a Go program.
+The store is opened offline, so don't point this at a file a running service has open.
+
+    kvctl -file store.kvs get <key>
+    kvctl -file store.kvs put [-type string] <key> <value>
+    kvctl -file store.kvs delete <key>
+    kvctl -file store.kvs scan [prefix]
+    kvctl -file store.kvs query 'WHERE age > 30 AND name LIKE "S%" ORDER BY age LIMIT 10'
+    kvctl -file store.kvs stats
+    kvctl -file store.kvs verify
+    kvctl -file store.kvs compact
+    kvctl -file store.kvs export [-format jsonl|csv] [-out path]
+    kvctl -file store.kvs import [-format jsonl|csv] <path or ->
+    kvctl -file store.kvs rewrite [-new-key-file path | -no-encryption] [-compress-above bytes]
+
+Add `-skip-corrupt` before the command to drop damaged records instead of refusing to open.
+`-skip-corrupt compact` is the way to repair a damaged file.
+For encrypted stores, add `-key-file` with the path of a file holding the key as hex.
+`rewrite` with `-new-key-file` rotates the key.
+
+*/
+
+const (
+	exitOk      = 0
+	exitFailed  = 1
+	exitBadArgs = 2
+)
+
+var csvHeader = []string{"key", "type", "value", "timestamp", "expires"}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run is the whole program, split out from `main` so tests can drive it
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	path := flags.String("file", "", "path to the store file (required)")
+	skipCorrupt := flags.Bool("skip-corrupt", false, "drop records that fail their checksum instead of failing")
+	keyFile := flags.String("key-file", "", "path to a file holding the encryption key as hex")
+	if err := flags.Parse(args); err != nil {return exitBadArgs}
+
+	if *path == "" || flags.NArg() < 1 {
+		_, _ = fmt.Fprintln(stderr, "usage: kvctl -file <path> [-skip-corrupt] <get|put|delete|scan|query|stats|verify|compact|export|import|rewrite> [args]")
+		return exitBadArgs
+	}
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	options := kvs.FileOptions{SkipCorruptRecords: *skipCorrupt}
+	if *keyFile != "" {
+		key, err := readKeyFile(*keyFile)
+		if err != nil {return failed(stderr, err)}
+		options.EncryptionKey = key
+	}
+
+	// `verify` reads the raw file; everything else goes through a store
+	if command == "verify" {
+		return verify(*path, options, stdout, stderr)
+	}
+
+	// Don't create a new empty file by accident when just looking
+	if command != "put" && command != "import" {
+		if _, err := os.Stat(*path); err != nil {
+			_, _ = fmt.Fprintf(stderr, "cannot open store: %v\r\n", err)
+			return exitFailed
+		}
+	}
+
+	store, err := kvs.OpenFile(*path, options)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "cannot open store: %v\r\n", err)
+		if errors.Is(err, kvs.CorruptRecordError) {
+			_, _ = fmt.Fprintln(stderr, "run with -skip-corrupt to ignore damaged records, or `-skip-corrupt compact` to repair")
+		}
+		return exitFailed
+	}
+
+	code := dispatch(store, *path, options, command, commandArgs, stdin, stdout, stderr)
+
+	if err = store.Close(); err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to close store: %v\r\n", err)
+		return exitFailed
+	}
+	return code
+}
+
+func dispatch(store *kvs.IndependentStore, path string, options kvs.FileOptions, command string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	switch command {
+	case "get":
+		return get(store, args, stdout, stderr)
+	case "put":
+		return put(store, args, stderr)
+	case "delete":
+		return remove(store, args, stderr)
+	case "scan":
+		return scan(store, args, stdout)
+	case "query":
+		return query(store, args, stdout, stderr)
+	case "stats":
+		return stats(store, path, options, stdout, stderr)
+	case "compact":
+		return compact(store, stderr)
+	case "export":
+		return export(store, args, stdout, stderr)
+	case "import":
+		return importLines(store, args, stdin, stdout, stderr)
+	case "rewrite":
+		return rewrite(store, options, args, stderr)
+	default:
+		_, _ = fmt.Fprintf(stderr, "unknown command '%s'\r\n", command)
+		return exitBadArgs
+	}
+}
+
+//<editor-fold desc="Commands">
+
+func get(store *kvs.IndependentStore, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {return usage(stderr, "get <key>")}
+
+	line, err := store.ExportKey(kvs.StoreKey(args[0]))
+	if err != nil {return failed(stderr, err)}
+
+	_, _ = fmt.Fprintf(stdout, "%s\n", line.Value)
+	return exitOk
+}
+
+func put(store *kvs.IndependentStore, args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	valueType := flags.String("type", "string", "value type: string, json, int, float64, bool, ...")
+	if err := flags.Parse(args); err != nil {return exitBadArgs}
+	if flags.NArg() != 2 {return usage(stderr, "put [-type string] <key> <value>")}
+
+	raw := json.RawMessage(flags.Arg(1))
+	if *valueType == "string" {
+		raw, _ = json.Marshal(flags.Arg(1))
+	}
+
+	err := store.Import(kvs.RecordLine{
+		Op:        kvs.OpPut,
+		Key:       kvs.StoreKey(flags.Arg(0)),
+		Type:      *valueType,
+		Value:     raw,
+		Timestamp: time.Now(),
+	})
+	if err != nil {return failed(stderr, err)}
+	return exitOk
+}
+
+func remove(store *kvs.IndependentStore, args []string, stderr io.Writer) int {
+	if len(args) != 1 {return usage(stderr, "delete <key>")}
+
+	if err := store.Delete(kvs.StoreKey(args[0])); err != nil {return failed(stderr, err)}
+	return exitOk
+}
+
+func scan(store *kvs.IndependentStore, args []string, stdout io.Writer) int {
+	prefix := ""
+	if len(args) > 0 {prefix = args[0]}
+
+	for _, key := range store.Keys() {
+		if !strings.HasPrefix(string(key), prefix) {continue}
+		line, err := store.ExportKey(key)
+		if err != nil {continue} // expired between listing and reading
+		_, _ = fmt.Fprintf(stdout, "%s\t%s\t%s\n", key, line.Type, line.Value)
+	}
+	return exitOk
+}
+
+func query(store *kvs.IndependentStore, args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 {return usage(stderr, "query '<WHERE ...> <ORDER BY ...> <LIMIT ...>'")}
+
+	results, err := store.Query(strings.Join(args, " "))
+	if err != nil {return failed(stderr, err)}
+
+	for _, result := range results {
+		line, err := store.ExportKey(result.Key)
+		if err != nil {continue} // expired between querying and reading
+		_, _ = fmt.Fprintf(stdout, "%s\t%s\t%s\n", result.Key, line.Type, line.Value)
+	}
+	return exitOk
+}
+
+func stats(store *kvs.IndependentStore, path string, options kvs.FileOptions, stdout, stderr io.Writer) int {
+	fileStats, err := kvs.VerifyFile(path, options)
+	if err != nil {return failed(stderr, err)}
+
+	lines, err := store.Export()
+	if err != nil {return failed(stderr, err)}
+
+	typeCounts := map[string]int{}
+	for _, line := range lines {
+		typeCounts[line.Type]++
+	}
+	typeNames := make([]string, 0, len(typeCounts))
+	for name, count := range typeCounts {
+		typeNames = append(typeNames, fmt.Sprintf("%s=%d", name, count))
+	}
+	sort.Strings(typeNames)
+
+	_, _ = fmt.Fprintf(stdout, "file size:       %d bytes\n", fileStats.FileSize)
+	_, _ = fmt.Fprintf(stdout, "records:         %d (%d puts, %d deletes)\n", fileStats.Records, fileStats.Puts, fileStats.Deletes)
+	_, _ = fmt.Fprintf(stdout, "live keys:       %d\n", len(lines))
+	_, _ = fmt.Fprintf(stdout, "garbage records: %d\n", fileStats.Records-len(lines))
+	_, _ = fmt.Fprintf(stdout, "encrypted:       %d records\n", fileStats.Encrypted)
+	_, _ = fmt.Fprintf(stdout, "compressed:      %d records\n", fileStats.Compressed)
+	_, _ = fmt.Fprintf(stdout, "corrupt records: %d\n", fileStats.CorruptRecords)
+	_, _ = fmt.Fprintf(stdout, "torn tail:       %d bytes\n", fileStats.TornTailBytes)
+	_, _ = fmt.Fprintf(stdout, "types:           %s\n", strings.Join(typeNames, " "))
+	return exitOk
+}
+
+func verify(path string, options kvs.FileOptions, stdout, stderr io.Writer) int {
+	fileStats, err := kvs.VerifyFile(path, options)
+	if err != nil {return failed(stderr, err)}
+
+	_, _ = fmt.Fprintf(stdout, "records: %d good, %d corrupt, %d torn tail bytes\n",
+		fileStats.Records, fileStats.CorruptRecords, fileStats.TornTailBytes)
+
+	if fileStats.CorruptRecords > 0 || fileStats.TornTailBytes > 0 {
+		_, _ = fmt.Fprintln(stdout, "FAILED")
+		return exitFailed
+	}
+	_, _ = fmt.Fprintln(stdout, "OK")
+	return exitOk
+}
+
+func compact(store *kvs.IndependentStore, stderr io.Writer) int {
+	if err := store.Compact(); err != nil {return failed(stderr, err)}
+	return exitOk
+}
+
+func rewrite(store *kvs.IndependentStore, options kvs.FileOptions, args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rewrite", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	newKeyFile := flags.String("new-key-file", "", "path to a file holding the new encryption key as hex")
+	noEncryption := flags.Bool("no-encryption", false, "write the file unencrypted")
+	compressAbove := flags.Int("compress-above", 0, "compress values bigger than this many bytes (0 for no compression)")
+	if err := flags.Parse(args); err != nil {return exitBadArgs}
+	if flags.NArg() != 0 || (*newKeyFile != "" && *noEncryption) {
+		return usage(stderr, "rewrite [-new-key-file path | -no-encryption] [-compress-above bytes]")
+	}
+
+	options.CompressAbove = *compressAbove
+	switch {
+	case *noEncryption:
+		options.EncryptionKey = nil
+	case *newKeyFile != "":
+		key, err := readKeyFile(*newKeyFile)
+		if err != nil {return failed(stderr, err)}
+		options.EncryptionKey = key
+	}
+
+	if err := store.RewriteFile(options); err != nil {return failed(stderr, err)}
+	return exitOk
+}
+
+func export(store *kvs.IndependentStore, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	outPath := flags.String("out", "", "file to write to (default stdout)")
+	if err := flags.Parse(args); err != nil {return exitBadArgs}
+
+	write := writeJsonLines
+	switch *format {
+	case "jsonl":
+	case "csv":
+		write = writeCsv
+	default:
+		return usage(stderr, "export [-format jsonl|csv] [-out path]")
+	}
+
+	lines, err := store.Export()
+	if err != nil {return failed(stderr, err)}
+
+	if *outPath == "" {
+		if err = write(stdout, lines); err != nil {return failed(stderr, err)}
+		return exitOk
+	}
+
+	file, err := os.Create(*outPath)
+	if err != nil {return failed(stderr, err)}
+	err = write(file, lines)
+	// closing is where a full disk shows up, so a failed close is a failed export
+	if closeErr := file.Close(); err == nil {err = closeErr}
+	if err != nil {return failed(stderr, err)}
+	return exitOk
+}
+
+func importLines(store *kvs.IndependentStore, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	if err := flags.Parse(args); err != nil {return exitBadArgs}
+	if flags.NArg() != 1 {return usage(stderr, "import [-format jsonl|csv] <path or ->")}
+
+	source := stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {return failed(stderr, err)}
+		defer func(file *os.File) { _ = file.Close() }(file)
+		source = file
+	}
+
+	var lines []kvs.RecordLine
+	var err error
+	switch *format {
+	case "jsonl":
+		lines, err = readJsonLines(source)
+	case "csv":
+		lines, err = readCsv(source)
+	default:
+		return usage(stderr, "import [-format jsonl|csv] <path or ->")
+	}
+	if err != nil {return failed(stderr, err)}
+
+	for _, line := range lines {
+		if err = store.Import(line); err != nil {
+			return failed(stderr, fmt.Errorf("key '%s': %w", line.Key, err))
+		}
+	}
+	_, _ = fmt.Fprintf(stdout, "imported %d records\n", len(lines))
+	return exitOk
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Formats">
+
+func writeJsonLines(target io.Writer, lines []kvs.RecordLine) error {
+	encoder := json.NewEncoder(target) // writes a newline after each value
+	for _, line := range lines {
+		if err := encoder.Encode(line); err != nil {return err}
+	}
+	return nil
+}
+
+func readJsonLines(source io.Reader) ([]kvs.RecordLine, error) {
+	var lines []kvs.RecordLine
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {continue}
+
+		line := kvs.RecordLine{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func writeCsv(target io.Writer, lines []kvs.RecordLine) error {
+	writer := csv.NewWriter(target)
+	if err := writer.Write(csvHeader); err != nil {return err}
+
+	for _, line := range lines {
+		expires := ""
+		if line.Expires != nil {expires = line.Expires.Format(time.RFC3339Nano)}
+		row := []string{string(line.Key), line.Type, string(line.Value), line.Timestamp.Format(time.RFC3339Nano), expires}
+		if err := writer.Write(row); err != nil {return err}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func readCsv(source io.Reader) ([]kvs.RecordLine, error) {
+	rows, err := csv.NewReader(source).ReadAll()
+	if err != nil {return nil, err}
+	if len(rows) < 1 {return nil, nil}
+	if strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") {
+		return nil, fmt.Errorf("expected csv header '%s'", strings.Join(csvHeader, ","))
+	}
+
+	lines := make([]kvs.RecordLine, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		line := kvs.RecordLine{
+			Op:    kvs.OpPut,
+			Key:   kvs.StoreKey(row[0]),
+			Type:  row[1],
+			Value: json.RawMessage(row[2]),
+		}
+		if line.Timestamp, err = time.Parse(time.RFC3339Nano, row[3]); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+2, err)
+		}
+		if row[4] != "" {
+			expires, err := time.Parse(time.RFC3339Nano, row[4])
+			if err != nil {return nil, fmt.Errorf("row %d: %w", i+2, err)}
+			line.Expires = &expires
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+//</editor-fold>
+
+// readKeyFile reads an encryption key written as hex, like the output of `openssl rand -hex 32`
+func readKeyFile(path string) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {return nil, err}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {return nil, fmt.Errorf("key file should hold the key as hex: %w", err)}
+	return key, nil
+}
+
+func usage(stderr io.Writer, message string) int {
+	_, _ = fmt.Fprintf(stderr, "usage: kvctl -file <path> %s\r\n", message)
+	return exitBadArgs
+}
+
+func failed(stderr io.Writer, err error) int {
+	_, _ = fmt.Fprintf(stderr, "error: %v\r\n", err)
+	return exitFailed
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func kvctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestPutGetDeleteAndScan(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+
+	if code, _, errs := kvctl(t, "", "-file", path, "put", "user:1", "Sam"); code != exitOk {
+		t.Fatalf("put failed: %s", errs)
+	}
+	if code, _, errs := kvctl(t, "", "-file", path, "put", "-type", "int", "user:2", "42"); code != exitOk {
+		t.Fatalf("put failed: %s", errs)
+	}
+	_, _, _ = kvctl(t, "", "-file", path, "put", "other", "x")
+
+	if _, out, _ := kvctl(t, "", "-file", path, "get", "user:1"); out != "\"Sam\"\n" {
+		t.Errorf("Expected '\"Sam\"', but got '%s'", out)
+	}
+
+	expected := "user:1\tstring\t\"Sam\"\nuser:2\tint\t42\n"
+	if _, out, _ := kvctl(t, "", "-file", path, "scan", "user:"); out != expected {
+		t.Errorf("Expected\r\n%s\r\nBut got\r\n%s\r\n", expected, out)
+	}
+
+	if code, _, _ := kvctl(t, "", "-file", path, "delete", "user:1"); code != exitOk {
+		t.Errorf("Expected delete to succeed")
+	}
+	if code, _, _ := kvctl(t, "", "-file", path, "get", "user:1"); code != exitFailed {
+		t.Errorf("Expected get of deleted key to fail, but got code %d", code)
+	}
+}
+
+func TestQuery(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	_, _, _ = kvctl(t, "", "-file", path, "put", "-type", "json", "user:1", `{"name":"Sam","age":30}`)
+	_, _, _ = kvctl(t, "", "-file", path, "put", "-type", "json", "user:2", `{"name":"Sophie","age":52}`)
+	_, _, _ = kvctl(t, "", "-file", path, "put", "-type", "myapp.User", "user:3", `{"name":"Steve","age":61}`) // a type kvctl doesn't know
+	_, _, _ = kvctl(t, "", "-file", path, "put", "-type", "json", "user:4", `{"name":"Alex","age":45}`)
+
+	expected := "user:3\tmyapp.User\t{\"name\":\"Steve\",\"age\":61}\nuser:2\tjson\t{\"age\":52,\"name\":\"Sophie\"}\n"
+	if code, out, errs := kvctl(t, "", "-file", path, "query", `WHERE age > 30 AND name LIKE "S%"`, "ORDER BY age DESC"); out != expected {
+		t.Errorf("Expected\r\n%s\r\nBut got %d\r\n%s%s\r\n", expected, code, out, errs)
+	}
+
+	if code, _, errs := kvctl(t, "", "-file", path, "query", "WHERE age >"); code != exitFailed || !strings.Contains(errs, "not valid") {
+		t.Errorf("Expected bad query to fail, but got %d: %s", code, errs)
+	}
+}
+
+func TestEncryptedStoresAndKeyRotation(t *testing.T){
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.kvs")
+	oldKey, newKey := filepath.Join(dir, "old.key"), filepath.Join(dir, "new.key")
+	_ = os.WriteFile(oldKey, []byte(strings.Repeat("01", 32)+"\n"), 0600)
+	_ = os.WriteFile(newKey, []byte(strings.Repeat("02", 32)+"\n"), 0600)
+
+	if code, _, errs := kvctl(t, "", "-file", path, "-key-file", oldKey, "put", "secret", "value"); code != exitOk {
+		t.Fatalf("put failed: %s", errs)
+	}
+	if code, _, errs := kvctl(t, "", "-file", path, "get", "secret"); code != exitFailed || !strings.Contains(errs, "encrypted") {
+		t.Errorf("Expected get without a key to fail, but got %d: %s", code, errs)
+	}
+
+	if code, _, errs := kvctl(t, "", "-file", path, "-key-file", oldKey, "rewrite", "-new-key-file", newKey); code != exitOk {
+		t.Fatalf("rewrite failed: %s", errs)
+	}
+	if code, _, _ := kvctl(t, "", "-file", path, "-key-file", oldKey, "get", "secret"); code != exitFailed {
+		t.Errorf("Expected old key to stop working, but got code %d", code)
+	}
+	if _, out, _ := kvctl(t, "", "-file", path, "-key-file", newKey, "stats"); !strings.Contains(out, "encrypted:       1 records") {
+		t.Errorf("Expected stats to show the encrypted record, but got\r\n%s", out)
+	}
+	if _, out, _ := kvctl(t, "", "-file", path, "-key-file", newKey, "get", "secret"); out != "\"value\"\n" {
+		t.Errorf("Expected '\"value\"', but got '%s'", out)
+	}
+}
+
+func TestReadCommandsDoNotCreateFiles(t *testing.T){
+	path := filepath.Join(t.TempDir(), "missing.kvs")
+
+	if code, _, _ := kvctl(t, "", "-file", path, "scan"); code != exitFailed {
+		t.Errorf("Expected scan of missing file to fail, but got code %d", code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no file to be created")
+	}
+}
+
+func TestExportImportBothFormats(t *testing.T){
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.kvs")
+	_, _, _ = kvctl(t, "", "-file", source, "put", "a", "hello, world")
+	_, _, _ = kvctl(t, "", "-file", source, "put", "-type", "json", "b", `{"name":"Sam"}`)
+
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			_, exported, errs := kvctl(t, "", "-file", source, "export", "-format", format)
+			if errs != "" {t.Fatalf("export failed: %s", errs)}
+
+			target := filepath.Join(dir, format+".kvs")
+			if code, out, errs := kvctl(t, exported, "-file", target, "import", "-format", format, "-"); code != exitOk {
+				t.Fatalf("import failed: %s", errs)
+			} else if out != "imported 2 records\n" {
+				t.Errorf("Unexpected import output '%s'", out)
+			}
+
+			if _, out, _ := kvctl(t, "", "-file", target, "get", "b"); out != "{\"name\":\"Sam\"}\n" {
+				t.Errorf("Expected json value to survive, but got '%s'", out)
+			}
+			if _, out, _ := kvctl(t, "", "-file", target, "get", "a"); out != "\"hello, world\"\n" {
+				t.Errorf("Expected string value to survive, but got '%s'", out)
+			}
+		})
+	}
+}
+
+func TestExportToFile(t *testing.T){
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.kvs")
+	_, _, _ = kvctl(t, "", "-file", source, "put", "a", "hello")
+
+	out := filepath.Join(dir, "export.jsonl")
+	if code, _, errs := kvctl(t, "", "-file", source, "export", "-out", out); code != exitOk {t.Fatalf("export failed: %s", errs)}
+	_, expected, _ := kvctl(t, "", "-file", source, "export")
+	if written, err := os.ReadFile(out); err != nil || string(written) != expected {t.Errorf("Expected '%s' in the file, but got '%s' (%v)", expected, written, err)}
+
+	// a device that's always full, so nothing written to it can be kept
+	if _, err := os.Stat("/dev/full"); err == nil {
+		if code, _, errs := kvctl(t, "", "-file", source, "export", "-out", "/dev/full"); code != exitFailed || errs == "" {
+			t.Errorf("Expected a failed export, but got %d '%s'", code, errs)
+		}
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T){
+	path := filepath.Join(t.TempDir(), "store.kvs")
+	_, _, _ = kvctl(t, "", "-file", path, "put", "first", "aaaaaaaa")
+	_, _, _ = kvctl(t, "", "-file", path, "put", "second", "bbbbbbbb")
+
+	if code, out, _ := kvctl(t, "", "-file", path, "verify"); code != exitOk || !strings.HasSuffix(out, "OK\n") {
+		t.Errorf("Expected clean file to verify, but got %d: %s", code, out)
+	}
+
+	data, _ := os.ReadFile(path)
+	_ = os.WriteFile(path, bytes.Replace(data, []byte("aaaa"), []byte("zzzz"), 1), 0644)
+
+	if code, _, _ := kvctl(t, "", "-file", path, "verify"); code != exitFailed {
+		t.Errorf("Expected damaged file to fail verify, but got code %d", code)
+	}
+	if code, _, _ := kvctl(t, "", "-file", path, "get", "second"); code != exitFailed {
+		t.Errorf("Expected damaged file to refuse to open, but got code %d", code)
+	}
+
+	if code, _, errs := kvctl(t, "", "-file", path, "-skip-corrupt", "compact"); code != exitOk {
+		t.Fatalf("repair failed: %s", errs)
+	}
+	if code, _, _ := kvctl(t, "", "-file", path, "verify"); code != exitOk {
+		t.Errorf("Expected repaired file to verify, but got code %d", code)
+	}
+	if _, out, _ := kvctl(t, "", "-file", path, "stats"); !strings.Contains(out, "live keys:       1") {
+		t.Errorf("Expected one live key after repair, but got\r\n%s", out)
+	}
+}
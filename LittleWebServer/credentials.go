@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Passwords are stored as PBKDF2-HMAC-SHA256 hashes with a random salt, in the form
+//
+//     pbkdf2-sha256$<iterations>$<salt, base64>$<derived key, base64>
+//
+// so the cost can be raised later without breaking existing hashes. Anything that stores
+// credentials only ever sees these strings, never the passwords.
+
+var UserExistsError = errors.New("a user with that name already exists")
+var UnknownUserError = errors.New("no user with that name exists")
+var BadPasswordHashError = errors.New("the stored password hash is not in a known format")
+
+const (
+	passwordHashScheme  = "pbkdf2-sha256"
+	DefaultPasswordCost = 310_000 // PBKDF2 iterations; the OWASP recommendation for HMAC-SHA256
+	passwordSaltBytes   = 16
+	passwordKeyBytes    = 32
+	minPasswordLength   = 8
+	maxPasswordLength   = 1024 // hashing is slow, so don't let anyone make it slower still
+	maxUsernameLength   = 64
+)
+
+// CredentialStore keeps a password hash and a list of roles for each username. It must be safe for concurrent use.
+type CredentialStore interface {
+	// Create adds a user with no roles, or fails with UserExistsError
+	Create(username string, passwordHash string) error
+	// Update replaces a user's password hash, or fails with UnknownUserError
+	Update(username string, passwordHash string) error
+	// Find returns a user's password hash, or fails with UnknownUserError
+	Find(username string) (string, error)
+	// Roles returns a user's roles, or fails with UnknownUserError
+	Roles(username string) ([]string, error)
+	// SetRoles replaces a user's roles, or fails with UnknownUserError
+	SetRoles(username string, roles []string) error
+}
+
+//<editor-fold desc="Hashing">
+
+// HashPassword makes a new salted hash of `password`, using `cost` iterations (DefaultPasswordCost if zero or less)
+func HashPassword(password string, cost int) (string, error) {
+	if cost <= 0 {cost = DefaultPasswordCost}
+
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {return "", err}
+
+	key := pbkdf2SHA256([]byte(password), salt, cost, passwordKeyBytes)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, cost,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword is true if `password` matches a hash from `HashPassword`. The comparison takes the same time wherever the first difference is.
+func CheckPassword(password string, passwordHash string) (bool, error) {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {return false, BadPasswordHashError}
+
+	cost, err := strconv.Atoi(parts[1])
+	if err != nil || cost < 1 {return false, BadPasswordHashError}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {return false, BadPasswordHashError}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) < 1 {return false, BadPasswordHashError}
+
+	actual := pbkdf2SHA256([]byte(password), salt, cost, len(expected))
+	return subtle.ConstantTimeCompare(actual, expected) == 1, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 from RFC 8018, with HMAC-SHA256 as the pseudo-random function
+func pbkdf2SHA256(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blockCount := (keyLength + hashLength - 1) / hashLength
+
+	key := make([]byte, 0, blockCount*hashLength)
+	blockIndex := make([]byte, 4)
+	u := make([]byte, 0, hashLength)
+	for block := 1; block <= blockCount; block++ {
+		// U1 = PRF(password, salt || INT(block)), then Un = PRF(password, Un-1); the block is U1 ^ U2 ^ ... ^ Uc
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex, uint32(block))
+		prf.Write(blockIndex)
+		u = prf.Sum(u[:0])
+		t := append([]byte{}, u...)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Rules">
+
+// validUsername allows letters, digits, '.', '_' and '-', so names are safe to put in logs and URLs
+func validUsername(username string) bool {
+	if len(username) < 1 || len(username) > maxUsernameLength {return false}
+	for _, c := range username {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !isDigit && c != '.' && c != '_' && c != '-' {return false}
+	}
+	return true
+}
+
+func validPassword(password string) bool {
+	return len(password) >= minPasswordLength && len(password) <= maxPasswordLength
+}
+
+//</editor-fold>
+
+//<editor-fold desc="In-memory store">
+
+// MemoryCredentialStore keeps credentials in a map, so they are lost when the server stops
+type MemoryCredentialStore struct {
+	lock   sync.RWMutex
+	hashes map[string]string
+	roles  map[string][]string
+}
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{hashes: map[string]string{}, roles: map[string][]string{}}
+}
+
+func (store *MemoryCredentialStore) Create(username string, passwordHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, exists := store.hashes[username]; exists {return UserExistsError}
+	store.hashes[username] = passwordHash
+	return nil
+}
+
+func (store *MemoryCredentialStore) Update(username string, passwordHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, exists := store.hashes[username]; !exists {return UnknownUserError}
+	store.hashes[username] = passwordHash
+	return nil
+}
+
+func (store *MemoryCredentialStore) Find(username string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	passwordHash, exists := store.hashes[username]
+	if !exists {return "", UnknownUserError}
+	return passwordHash, nil
+}
+
+func (store *MemoryCredentialStore) Roles(username string) ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if _, exists := store.hashes[username]; !exists {return nil, UnknownUserError}
+	return append([]string{}, store.roles[username]...), nil
+}
+
+func (store *MemoryCredentialStore) SetRoles(username string, roles []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, exists := store.hashes[username]; !exists {return UnknownUserError}
+	store.roles[username] = append([]string{}, roles...)
+	return nil
+}
+
+//</editor-fold>
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPbkdf2MatchesKnownVectors(t *testing.T){
+	// the widely published PBKDF2-HMAC-SHA256 test vectors, for P = "password", S = "salt"
+	vectors := []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, vector := range vectors {
+		actual := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), vector.iterations, 32))
+		if actual != vector.expected {t.Errorf("Expected '%v', but got '%v' for %d iterations", vector.expected, actual, vector.iterations)}
+	}
+
+	// keys longer than one hash are made of more blocks, and shorter ones are cut down
+	long := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), 1, 40))
+	if !strings.HasPrefix(long, vectors[0].expected) || len(long) != 80 {t.Errorf("Expected a 40 byte key starting with the 32 byte one, but got '%v'", long)}
+	short := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), 1, 16))
+	if short != vectors[0].expected[:32] {t.Errorf("Expected '%v', but got '%v'", vectors[0].expected[:32], short)}
+}
+
+func TestPasswordHashRoundTrip(t *testing.T){
+	hash, err := HashPassword("correct horse", 1000)
+	if err != nil {t.Fatalf("HashPassword failed with %v", err)}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$1000$") {t.Errorf("Expected the scheme and cost at the start, but got '%v'", hash)}
+	if strings.Contains(hash, "correct horse") {t.Errorf("Hash should not contain the password: '%v'", hash)}
+
+	if ok, err := CheckPassword("correct horse", hash); !ok || err != nil {t.Errorf("Expected 'true', but got '%v' (%v)", ok, err)}
+	if ok, err := CheckPassword("correct horsf", hash); ok || err != nil {t.Errorf("Expected 'false', but got '%v' (%v)", ok, err)}
+	if ok, err := CheckPassword("", hash); ok || err != nil {t.Errorf("Expected 'false', but got '%v' (%v)", ok, err)}
+
+	// the same password hashes differently each time
+	other, _ := HashPassword("correct horse", 1000)
+	if other == hash {t.Errorf("Expected different salts, but got the same hash twice: '%v'", hash)}
+}
+
+func TestCheckPasswordRejectsBadHashes(t *testing.T){
+	badHashes := []string{
+		"",
+		"correct",
+		"md5$1000$c2FsdA$a2V5",
+		"pbkdf2-sha256$0$c2FsdA$a2V5",
+		"pbkdf2-sha256$lots$c2FsdA$a2V5",
+		"pbkdf2-sha256$1000$not base64!$a2V5",
+		"pbkdf2-sha256$1000$c2FsdA$",
+		"pbkdf2-sha256$1000$c2FsdA$a2V5$extra",
+	}
+	for _, hash := range badHashes {
+		if ok, err := CheckPassword("password", hash); ok || err != BadPasswordHashError {
+			t.Errorf("Expected '%v', but got '%v' (%v) for '%s'", BadPasswordHashError, err, ok, hash)
+		}
+	}
+}
+
+func TestMemoryCredentialStore(t *testing.T){
+	store := NewMemoryCredentialStore()
+
+	if _, err := store.Find("sam"); err != UnknownUserError {t.Errorf("Expected '%v', but got '%v'", UnknownUserError, err)}
+	if err := store.Update("sam", "hash-1"); err != UnknownUserError {t.Errorf("Expected '%v', but got '%v'", UnknownUserError, err)}
+
+	if err := store.Create("sam", "hash-1"); err != nil {t.Errorf("Create failed with %v", err)}
+	if err := store.Create("sam", "hash-2"); err != UserExistsError {t.Errorf("Expected '%v', but got '%v'", UserExistsError, err)}
+	if hash, _ := store.Find("sam"); hash != "hash-1" {t.Errorf("Expected 'hash-1', but got '%v'", hash)}
+
+	if err := store.Update("sam", "hash-3"); err != nil {t.Errorf("Update failed with %v", err)}
+	if hash, _ := store.Find("sam"); hash != "hash-3" {t.Errorf("Expected 'hash-3', but got '%v'", hash)}
+
+	if roles, err := store.Roles("sam"); len(roles) != 0 || err != nil {t.Errorf("Expected no roles, but got '%v' (%v)", roles, err)}
+	roles := []string{"user"}
+	if err := store.SetRoles("sam", roles); err != nil {t.Errorf("SetRoles failed with %v", err)}
+	roles[0] = "changed afterwards"
+	if found, _ := store.Roles("sam"); len(found) != 1 || found[0] != "user" {t.Errorf("Expected '[user]', but got '%v'", found)}
+	if err := store.SetRoles("kim", roles); err != UnknownUserError {t.Errorf("Expected '%v', but got '%v'", UnknownUserError, err)}
+	if _, err := store.Roles("kim"); err != UnknownUserError {t.Errorf("Expected '%v', but got '%v'", UnknownUserError, err)}
+}
+
+func TestUsernameAndPasswordRules(t *testing.T){
+	for _, name := range []string{"ieb", "Sam.Smith", "user_1", "a-b"} {
+		if !validUsername(name) {t.Errorf("Expected '%s' to be a valid username", name)}
+	}
+	for _, name := range []string{"", "has space", "semi;colon", "sl/ash", "émile", strings.Repeat("x", 65)} {
+		if validUsername(name) {t.Errorf("Expected '%s' to be rejected", name)}
+	}
+
+	if validPassword("1234567") {t.Errorf("Expected a 7 character password to be rejected")}
+	if !validPassword("12345678") {t.Errorf("Expected an 8 character password to be accepted")}
+	if validPassword(strings.Repeat("x", 1025)) {t.Errorf("Expected a huge password to be rejected")}
+}
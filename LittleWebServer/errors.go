@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// Every error response has the same shape, so clients can handle them all in one place:
+//
+//     {"error":"input is invalid","code":"invalid_input","details":[{"field":"age","message":"must be at least 0"}]}
+//
+// `error` is for people, and may be reworded. `code` is for programs, and won't change. `details` is only there
+// when there's more to say, and `field` only when a detail is about one field of the request body.
+// The request id to quote when asking about an error is in the response's X-Request-ID header.
+
+const (
+	ErrCodeInvalidInput         = "invalid_input"
+	ErrCodeValidationFailed     = "validation_failed"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeConflict             = "conflict"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeTooManyRequests      = "too_many_requests"
+	ErrCodeInternal             = "internal_error"
+)
+
+type ErrorBody struct {
+	Error   string        `json:"error"`
+	Code    string        `json:"code"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+type ErrorDetail struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// internalErrorBody is written by hand, so sending it can't fail the way it did for the response that panicked
+const internalErrorBody = `{"error":"something went wrong on our side","code":"internal_error"}`
+
+// sendError writes an error response in the shape above
+func sendError(response http.ResponseWriter, status int, code, message string, details ...ErrorDetail) {
+	writeJson(response, status, ErrorBody{Error: message, Code: code, Details: details})
+}
+
+// recoverPanics turns a panic in a handler into a 500 response, and logs it with its stack. It goes inside
+// `logRequests`, so the log record has the request id, and the request is logged as a 500.
+func (serv *LittleServer)recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		guarded := &guardedResponse{ResponseWriter: response}
+		defer func() {
+			failure := recover()
+			if failure == nil {return}
+			if failure == http.ErrAbortHandler {panic(failure)} // the handler meant to drop the connection
+
+			logFor(response).Error("Panic while answering request", "panic", failure, "method", request.Method, "path", request.URL.Path, "stack", string(debug.Stack()))
+			if guarded.wroteHeader {
+				// too late for a 500; dropping the connection is the only way to show the response is broken
+				panic(http.ErrAbortHandler)
+			}
+
+			header := response.Header()
+			for name := range header {
+				if name != http.CanonicalHeaderKey(requestIdHeader) {header.Del(name)} // anything the handler set was for a response that's not coming
+			}
+			header.Set("Content-Type", "application/json")
+			response.WriteHeader(http.StatusInternalServerError)
+			_, _ = response.Write([]byte(internalErrorBody))
+		}()
+
+		next.ServeHTTP(guarded, request)
+	})
+}
+
+// guardedResponse notes whether the handler has started its response
+type guardedResponse struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (guarded *guardedResponse) WriteHeader(status int) {
+	guarded.wroteHeader = true
+	guarded.ResponseWriter.WriteHeader(status)
+}
+
+func (guarded *guardedResponse) Write(data []byte) (int, error) {
+	guarded.wroteHeader = true
+	return guarded.ResponseWriter.Write(data)
+}
+
+func (guarded *guardedResponse) Flush() {
+	if flusher, ok := guarded.ResponseWriter.(http.Flusher); ok {flusher.Flush()}
+}
+
+func (guarded *guardedResponse) Unwrap() http.ResponseWriter {return guarded.ResponseWriter}
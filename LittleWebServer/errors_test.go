@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPanicsBecomeJsonErrors(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	server.setupOnce.Do(server.setDefaults)
+	out := &bytes.Buffer{}
+	appLog = NewLogger(out, LogJson, LevelWarn)
+	defer server.SetUpLogging(false, true)
+
+	request := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	request.Header.Set(requestIdHeader, "oops-1")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError {t.Errorf("Expected %d, but got %d", http.StatusInternalServerError, response.Code)}
+	if body := response.Body.String(); body != internalErrorBody {t.Errorf("Expected '%s', but got '%s'", internalErrorBody, body)}
+	if kind := response.Header().Get("Content-Type"); kind != "application/json" {t.Errorf("Expected JSON, but got '%s'", kind)}
+	if id := response.Header().Get(requestIdHeader); id != "oops-1" {t.Errorf("Expected the request id to be kept, but got '%s'", id)}
+
+	records := logRecords(t, out)
+	if len(records) != 2 {t.Fatalf("Expected the panic and the request to be logged, but got %v", records)}
+	failure := records[0]
+	if failure["msg"] != "Panic while answering request" || failure["request_id"] != "oops-1" || failure["panic"] != "panic!" {t.Errorf("Unexpected record %v", failure)}
+	if stack, _ := failure["stack"].(string); !strings.Contains(stack, "goroutine") {t.Errorf("Expected a stack trace, but got '%s'", stack)}
+	if records[1]["msg"] != "request" || records[1]["status"] != float64(500) {t.Errorf("Expected the request to be logged as a 500, but got %v", records[1])}
+
+	if count := server.metrics.requests.Value(http.MethodGet, "/panic", "500"); count != 1 {t.Errorf("Expected one 500 to be counted, but got %v", count)}
+
+	// the server is fine afterwards
+	response = httptest.NewRecorder()
+	server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	if response.Code != http.StatusOK {t.Errorf("Expected %d, but got %d", http.StatusOK, response.Code)}
+}
+
+func TestRecoveryDropsHeadersForTheLostResponse(t *testing.T){
+	server := &LittleServer{}
+	server.SetUpLogging(false, true)
+	handler := server.recoverPanics(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.SetCookie(response, &http.Cookie{Name: "token", Value: "half-made"})
+		response.Header().Set("Location", "/user/1")
+		panic("after the headers were set, but before they were sent")
+	}))
+
+	response := httptest.NewRecorder()
+	response.Header().Set(requestIdHeader, "keep-me")
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/user", nil))
+
+	if response.Code != http.StatusInternalServerError {t.Errorf("Expected %d, but got %d", http.StatusInternalServerError, response.Code)}
+	if response.Header().Get("Set-Cookie") != "" || response.Header().Get("Location") != "" {t.Errorf("Expected the handler's headers to be dropped, but got %v", response.Header())}
+	if response.Header().Get(requestIdHeader) != "keep-me" {t.Errorf("Expected the request id to be kept")}
+}
+
+func TestRecoveryAbortsResponsesAlreadyStarted(t *testing.T){
+	server := &LittleServer{}
+	server.SetUpLogging(false, true)
+	handler := server.recoverPanics(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		writeJson(response, http.StatusOK, map[string]int{"half": 1})
+		panic("too late")
+	}))
+
+	defer func() {
+		if failure := recover(); failure != http.ErrAbortHandler {t.Errorf("Expected '%v', but got '%v'", http.ErrAbortHandler, failure)}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestErrorBodies(t *testing.T){
+	response := httptest.NewRecorder()
+	sendError(response, http.StatusBadRequest, ErrCodeInvalidInput, "input is invalid", ErrorDetail{Field: "age", Message: "must be at least 0"}, ErrorDetail{Message: "and something else"})
+
+	expected := `{"error":"input is invalid","code":"invalid_input","details":[{"field":"age","message":"must be at least 0"},{"message":"and something else"}]}`
+	if body := response.Body.String(); body != expected {t.Errorf("Expected '%s', but got '%s'", expected, body)}
+	if response.Code != http.StatusBadRequest {t.Errorf("Expected %d, but got %d", http.StatusBadRequest, response.Code)}
+}
@@ -2,4 +2,9 @@ module LittleWebServer
 
 go 1.16
 
-require github.com/golang-jwt/jwt v3.2.2+incompatible
+replace KeyValueStore => ../KeyValueStore
+
+require (
+	KeyValueStore v0.0.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+)
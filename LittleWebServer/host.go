@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// A Host runs a handler on a real port. It owns the http.Server, so it can set timeouts that stop slow
+// clients from holding connections open forever, and it can shut down without cutting off requests
+// that are half done:
+//
+//   1. stop accepting new connections
+//   2. wait for requests in flight to finish, up to `drainFor`, then close whatever is left
+//   3. flush and close the log file
+//
+// `Run` does all of that when the process gets SIGINT (Ctrl+C) or SIGTERM (from `kill`, or a container
+// being stopped). Tests can `Start` a host on port 0 to get a free port, then `Shutdown` it themselves.
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 10 * time.Second  // the whole request, body included. Bodies are small (see `maxBodyBytes`).
+	writeTimeout      = 30 * time.Second  // from the end of the request headers to the end of the response
+	idleTimeout       = 2 * time.Minute   // keep-alive connections with nothing going on
+	defaultDrainFor   = 20 * time.Second  // should be less than the time a container manager waits before SIGKILL
+)
+
+var HostNotStartedError = errors.New("the host has not been started")
+
+type Host struct {
+	server   *http.Server
+	listener net.Listener
+	served   chan error    // gets the result of `server.Serve` once it stops
+	drainFor time.Duration // how long to wait for requests in flight when shutting down
+	logFile  *os.File      // flushed and closed after shutdown, if set
+}
+
+// NewHost makes a host for `handler` on `address` (like ":6080", or "127.0.0.1:0" for any free port).
+// Nothing is listening until it's started.
+func NewHost(address string, handler http.Handler, logFile *os.File) *Host {
+	return &Host{
+		server: &http.Server{
+			Addr:              address,
+			Handler:           handler,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+			WriteTimeout:      writeTimeout,
+			IdleTimeout:       idleTimeout,
+			ErrorLog:          appLog.StdLogger(LevelWarn),
+		},
+		drainFor: defaultDrainFor,
+		logFile:  logFile,
+	}
+}
+
+// Start begins listening, and serves requests in the background
+func (host *Host) Start() error {
+	listener, err := net.Listen("tcp", host.server.Addr)
+	if err != nil {return err}
+
+	host.listener = listener
+	host.served = make(chan error, 1)
+	go func() {host.served <- host.server.Serve(listener)}()
+	return nil
+}
+
+// Address is where the host is listening, with the real port if it was started on port 0
+func (host *Host) Address() string {
+	if host.listener == nil {return host.server.Addr}
+	return host.listener.Addr().String()
+}
+
+// Shutdown stops taking new connections, and waits up to `drainFor` for the requests in flight.
+// Any still going after that are cut off, and the error is context.DeadlineExceeded.
+func (host *Host) Shutdown() error {
+	if host.served == nil {return HostNotStartedError}
+
+	ctx, cancel := context.WithTimeout(context.Background(), host.drainFor)
+	defer cancel()
+
+	err := host.server.Shutdown(ctx)
+	if err != nil {
+		appLog.Warn("Requests were still running at the deadline; closing their connections", "drain_for", host.drainFor)
+		_ = host.server.Close()
+	}
+	if serveErr := <-host.served; serveErr != http.ErrServerClosed {err = serveErr}
+	host.served = nil
+
+	appLog.Info("Server stopped")
+	host.closeLogFile()
+	return err
+}
+
+// Run starts the host, and shuts it down when a signal arrives on `stop` (see `shutdownSignals`),
+// or straight away if the server fails
+func (host *Host) Run(stop <-chan os.Signal) error {
+	if err := host.Start(); err != nil {
+		host.closeLogFile()
+		return err
+	}
+	appLog.Info("Listening", "address", host.Address())
+
+	select {
+	case sig := <-stop:
+		appLog.Info("Finishing requests in flight and shutting down", "signal", sig)
+		return host.Shutdown()
+	case err := <-host.served:
+		host.served <- err // so Shutdown can read it too
+		appLog.Error("Server failed", "error", err)
+		_ = host.Shutdown()
+		return err
+	}
+}
+
+// shutdownSignals delivers the signals that should stop the server
+func shutdownSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
+}
+
+// closeLogFile makes sure everything logged is on disk, then closes the file. Anything logged after
+// this goes to stderr instead.
+func (host *Host) closeLogFile() {
+	if host.logFile == nil {return}
+
+	if appLog.Writer() == host.logFile {appLog.SetOutput(os.Stderr)}
+	if log.Writer() == host.logFile {log.SetOutput(os.Stderr)}
+	_ = host.logFile.Sync()
+	_ = host.logFile.Close()
+	host.logFile = nil
+}
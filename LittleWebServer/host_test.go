@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTestHost runs `handler` on a free port, and shuts it down at the end of the test
+func startTestHost(t *testing.T, handler http.Handler) *Host {
+	host := NewHost("127.0.0.1:0", handler, nil)
+	if err := host.Start(); err != nil {t.Fatalf("Start failed with %v", err)}
+	t.Cleanup(func() {_ = host.Shutdown()})
+	return host
+}
+
+// slowHandler doesn't answer until `release` is closed, and says on `started` when each request arrives
+func slowHandler() (handler http.Handler, started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}, 10), make(chan struct{})
+	handler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		started <- struct{}{}
+		<-release
+		_, _ = response.Write([]byte("done"))
+	})
+	return handler, started, release
+}
+
+func TestHostServesOnAFreePort(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	host := startTestHost(t, server)
+
+	if strings.HasSuffix(host.Address(), ":0") {t.Fatalf("Expected a real port, but got '%s'", host.Address())}
+
+	response, err := http.Get("http://" + host.Address() + "/")
+	if err != nil {t.Fatalf("Request failed with %v", err)}
+	defer func() {_ = response.Body.Close()}()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "hello world") {t.Errorf("Expected the home page, but got %d '%s'", response.StatusCode, body)}
+
+	if host.server.ReadTimeout == 0 || host.server.WriteTimeout == 0 || host.server.IdleTimeout == 0 {t.Errorf("Expected timeouts to be set")}
+}
+
+func TestHostDrainsRequestsInFlight(t *testing.T){
+	handler, started, release := slowHandler()
+	host := NewHost("127.0.0.1:0", handler, nil)
+	if err := host.Start(); err != nil {t.Fatalf("Start failed with %v", err)}
+	address := host.Address()
+
+	type result struct {body string; err error}
+	inFlight := make(chan result, 1)
+	go func() {
+		response, err := http.Get("http://" + address + "/slow")
+		if err != nil {inFlight <- result{err: err}; return}
+		defer func() {_ = response.Body.Close()}()
+		body, err := ioutil.ReadAll(response.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {stopped <- host.Shutdown()}()
+
+	// new connections are refused while the old request finishes
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := http.Get("http://" + address + "/new")
+		if err != nil {break}
+		if time.Now().After(deadline) {t.Fatalf("Expected new connections to be refused")}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown returned (%v) before the request in flight finished", err)
+	default:
+	}
+
+	close(release)
+	if got := <-inFlight; got.err != nil || got.body != "done" {t.Errorf("Expected the request in flight to finish, but got '%s' (%v)", got.body, got.err)}
+	if err := <-stopped; err != nil {t.Errorf("Expected a clean shutdown, but got %v", err)}
+}
+
+func TestHostCutsOffRequestsAfterTheDrainDeadline(t *testing.T){
+	handler, started, release := slowHandler()
+	defer close(release)
+	host := NewHost("127.0.0.1:0", handler, nil)
+	host.drainFor = 50 * time.Millisecond
+	if err := host.Start(); err != nil {t.Fatalf("Start failed with %v", err)}
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + host.Address() + "/stuck")
+		failed <- err
+	}()
+	<-started
+
+	if err := host.Shutdown(); err != context.DeadlineExceeded {t.Errorf("Expected '%v', but got '%v'", context.DeadlineExceeded, err)}
+	if err := <-failed; err == nil {t.Errorf("Expected the stuck request to be cut off")}
+}
+
+func TestHostRunStopsOnSignalAndClosesTheLog(t *testing.T){
+	logFile, err := os.Create(filepath.Join(t.TempDir(), "app.log"))
+	if err != nil {t.Fatalf("Could not make log file: %v", err)}
+
+	originalLog := appLog
+	appLog = NewLogger(logFile, LogJson, LevelInfo)
+	defer func() {appLog = originalLog}()
+
+	host := NewHost("127.0.0.1:0", http.NotFoundHandler(), logFile)
+	stop := make(chan os.Signal, 1)
+	stop <- syscall.SIGTERM
+	if err = host.Run(stop); err != nil {t.Errorf("Expected a clean shutdown, but got %v", err)}
+
+	if _, err = logFile.Write([]byte("more")); err == nil {t.Errorf("Expected the log file to be closed")}
+	if appLog.Writer() != os.Stderr {t.Errorf("Expected logging to go back to stderr")}
+
+	written, _ := ioutil.ReadFile(logFile.Name())
+	if !strings.Contains(string(written), `"msg":"Server stopped"`) {t.Errorf("Expected the shutdown to be logged, but got '%s'", written)}
+}
+
+func TestHostRunFailsIfThePortIsTaken(t *testing.T){
+	first := startTestHost(t, http.NotFoundHandler())
+
+	second := NewHost(first.Address(), http.NotFoundHandler(), nil)
+	if err := second.Run(make(chan os.Signal)); err == nil {t.Errorf("Expected the second host to fail")}
+	if err := second.Shutdown(); err != HostNotStartedError {t.Errorf("Expected '%v', but got '%v'", HostNotStartedError, err)}
+}
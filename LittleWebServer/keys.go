@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Access tokens are signed by one key in a KeyRing, and name it in their `kid` header. Any key in the ring
+// can check a token, so keys can be rotated: add the new key (which then signs everything), and remove the
+// old one once the tokens it signed have expired.
+//
+// Keys are RS256 (RSA), ES256 (ECDSA on P-256) or HS512 (a shared secret). The public halves of the RSA and
+// ECDSA keys are published at /.well-known/jwks.json, so other services can check our tokens themselves.
+//
+// Keys come from the environment:
+//
+//     LWS_JWT_KEY_FILES   a comma separated list of `kid=path` PEM files. The first one signs new tokens.
+//                         A file with only a public key can check tokens, but not sign them.
+//     LWS_JWT_KEY         if there are no files: a PEM private key, or a secret of 32 bytes or more for HS512
+//     LWS_JWT_KEY_ID      the kid for LWS_JWT_KEY ("default" if not set)
+//
+// With none of these, there's a single HS512 development key, which is only suitable for development.
+
+var UnknownKeyError = errors.New("the token was not signed by any key we know")
+var UnsupportedKeyError = errors.New("the key is not an RSA, P-256 ECDSA or long enough HMAC key")
+var NoSigningKeyError = errors.New("there is no key to sign tokens with")
+
+const minHmacSecretBytes = 32
+
+type SigningKey struct {
+	Id     string
+	Method jwt.SigningMethod
+	sign   interface{} // []byte, *rsa.PrivateKey or *ecdsa.PrivateKey; nil if this key can only check tokens
+	verify interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// KeyRing holds the keys for signing and checking tokens. It is safe for concurrent use.
+type KeyRing struct {
+	lock    sync.RWMutex
+	keys    map[string]*SigningKey
+	current string // the kid that signs new tokens
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[string]*SigningKey{}}
+}
+
+//<editor-fold desc="Making keys">
+
+// NewHmacKey makes a shared-secret key. The secret must be at least 32 bytes.
+func NewHmacKey(id string, secret []byte) (*SigningKey, error) {
+	if len(secret) < minHmacSecretBytes {return nil, UnsupportedKeyError}
+	return &SigningKey{Id: id, Method: jwt.SigningMethodHS512, sign: secret, verify: secret}, nil
+}
+
+// NewAsymmetricKey wraps an *rsa.PrivateKey, *ecdsa.PrivateKey, or one of their public keys (which can only check tokens)
+func NewAsymmetricKey(id string, key interface{}) (*SigningKey, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, sign: k, verify: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, verify: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {return nil, UnsupportedKeyError}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodES256, sign: k, verify: &k.PublicKey}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {return nil, UnsupportedKeyError}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodES256, verify: k}, nil
+	default:
+		return nil, UnsupportedKeyError
+	}
+}
+
+// ParsePemKey reads a private or public key in PEM form (PKCS #1, SEC 1, PKCS #8 or PKIX)
+func ParsePemKey(id string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {return nil, fmt.Errorf("key '%s' is not PEM encoded", id)}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key '%s' is a '%s', which we can't use", id, block.Type)
+	}
+	if err != nil {return nil, fmt.Errorf("key '%s' could not be read: %w", id, err)}
+	return NewAsymmetricKey(id, key)
+}
+
+// keyRingFromEnvironment loads keys as described at the top of this file. It's nil (with no error) if none are set.
+func keyRingFromEnvironment(getEnv func(name string) string) (*KeyRing, error) {
+	ring := NewKeyRing()
+
+	if files := strings.TrimSpace(getEnv("LWS_JWT_KEY_FILES")); files != "" {
+		for _, entry := range strings.Split(files, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {return nil, fmt.Errorf("'%s' should look like 'kid=path'", entry)}
+
+			data, err := ioutil.ReadFile(filepath.Clean(parts[1]))
+			if err != nil {return nil, err}
+			key, err := ParsePemKey(parts[0], data)
+			if err != nil {return nil, err}
+			if err = ring.Add(key, false); err != nil {return nil, err}
+		}
+		first := strings.SplitN(strings.TrimSpace(strings.Split(files, ",")[0]), "=", 2)[0]
+		if err := ring.SetCurrent(first); err != nil {return nil, err}
+		return ring, nil
+	}
+
+	if secret := getEnv("LWS_JWT_KEY"); secret != "" {
+		id := getEnv("LWS_JWT_KEY_ID")
+		if id == "" {id = "default"}
+
+		var key *SigningKey
+		var err error
+		if strings.HasPrefix(strings.TrimSpace(secret), "-----BEGIN") {
+			key, err = ParsePemKey(id, []byte(secret))
+		} else {
+			key, err = NewHmacKey(id, []byte(secret))
+		}
+		if err != nil {return nil, err}
+		return ring, ring.Add(key, true)
+	}
+
+	return nil, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Using keys">
+
+// Add puts a key in the ring, replacing any with the same id. If `signWithIt`, it signs all new tokens from now on.
+func (ring *KeyRing) Add(key *SigningKey, signWithIt bool) error {
+	if signWithIt && key.sign == nil {return NoSigningKeyError}
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	ring.keys[key.Id] = key
+	if signWithIt {ring.current = key.Id}
+	return nil
+}
+
+// SetCurrent picks the key that signs new tokens
+func (ring *KeyRing) SetCurrent(id string) error {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	key, ok := ring.keys[id]
+	if !ok {return UnknownKeyError}
+	if key.sign == nil {return NoSigningKeyError}
+	ring.current = id
+	return nil
+}
+
+// Remove takes a key out of the ring, so tokens it signed are no longer accepted. The key that signs can't be removed.
+func (ring *KeyRing) Remove(id string) error {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	if id == ring.current {return errors.New("can't remove the key that signs new tokens; add another first")}
+	delete(ring.keys, id)
+	return nil
+}
+
+// Sign makes a token with the current key, naming it in the `kid` header
+func (ring *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	ring.lock.RLock()
+	key, ok := ring.keys[ring.current]
+	ring.lock.RUnlock()
+	if !ok {return "", NoSigningKeyError}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.sign)
+}
+
+// Parse checks a token against the key its `kid` names, and reads it into `claims`
+func (ring *KeyRing) Parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenStr, claims, ring.keyFor)
+}
+
+// keyFor finds the key to check a token with. The token must use the same algorithm as the key,
+// or an RSA public key could be passed off as an HMAC secret.
+func (ring *KeyRing) keyFor(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+
+	ring.lock.RLock()
+	key, ok := ring.keys[id]
+	ring.lock.RUnlock()
+
+	if !ok {return nil, UnknownKeyError}
+	if token.Method.Alg() != key.Method.Alg() {return nil, fmt.Errorf("key '%s' is for %s, but the token says %s", id, key.Method.Alg(), token.Method.Alg())}
+	return key.verify, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Publishing keys">
+
+// JsonWebKey is the public half of a key, as in RFC 7517 and RFC 7518
+type JsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Id        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`   // RSA modulus
+	E         string `json:"e,omitempty"`   // RSA exponent
+	Curve     string `json:"crv,omitempty"` // EC curve name
+	X         string `json:"x,omitempty"`   // EC point
+	Y         string `json:"y,omitempty"`
+}
+
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+// PublicKeys lists the keys that other services can check our tokens with. Shared secrets are never listed.
+func (ring *KeyRing) PublicKeys() JsonWebKeySet {
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	set := JsonWebKeySet{Keys: []JsonWebKey{}}
+	for _, key := range ring.keys {
+		encode := base64.RawURLEncoding.EncodeToString
+		published := JsonWebKey{Id: key.Id, Use: "sig", Algorithm: key.Method.Alg()}
+
+		switch public := key.verify.(type) {
+		case *rsa.PublicKey:
+			published.KeyType = "RSA"
+			published.N = encode(public.N.Bytes())
+			published.E = encode(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			published.KeyType = "EC"
+			published.Curve = public.Curve.Params().Name
+			published.X = encode(public.X.FillBytes(make([]byte, size)))
+			published.Y = encode(public.Y.FillBytes(make([]byte, size)))
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, published)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {return set.Keys[i].Id < set.Keys[j].Id})
+	return set
+}
+
+func sendPublicKeys(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Cache-Control", "public, max-age=300") // so checkers see a new key within a few minutes
+	writeJson(response, http.StatusOK, serv.keys.PublicKeys())
+}
+
+//</editor-fold>
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+var testEcKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+func mustKey(key *SigningKey, err error) *SigningKey {
+	if err != nil {panic(err)}
+	return key
+}
+
+func TestKeyRingSignsAndChecksEveryKind(t *testing.T){
+	keys := []*SigningKey{
+		mustKey(NewAsymmetricKey("rsa", testRsaKey)),
+		mustKey(NewAsymmetricKey("ec", testEcKey)),
+		mustKey(NewHmacKey("hmac", []byte(strings.Repeat("s", 32)))),
+	}
+
+	for _, key := range keys {
+		ring := NewKeyRing()
+		if err := ring.Add(key, true); err != nil {t.Fatalf("Add failed with %v", err)}
+
+		tokenStr, err := ring.Sign(&Claims{Username: "sam"})
+		if err != nil {t.Fatalf("Sign with %s failed with %v", key.Id, err)}
+
+		claims := &Claims{}
+		token, err := ring.Parse(tokenStr, claims)
+		if err != nil || !token.Valid || claims.Username != "sam" {t.Errorf("Expected a good token from %s, but got %v", key.Id, err)}
+		if token.Header["kid"] != key.Id || token.Header["alg"] != key.Method.Alg() {t.Errorf("Expected kid '%s', but got header %v", key.Id, token.Header)}
+	}
+}
+
+func TestKeyRingRotation(t *testing.T){
+	ring := NewKeyRing()
+	_ = ring.Add(mustKey(NewAsymmetricKey("old", testEcKey)), true)
+	oldToken, _ := ring.Sign(&Claims{Username: "sam"})
+
+	_ = ring.Add(mustKey(NewAsymmetricKey("new", testRsaKey)), true)
+	newToken, _ := ring.Sign(&Claims{Username: "sam"})
+
+	// both keys are good while the old tokens run out
+	for _, tokenStr := range []string{oldToken, newToken} {
+		if _, err := ring.Parse(tokenStr, &Claims{}); err != nil {t.Errorf("Expected the token to be accepted, but got %v", err)}
+	}
+	if token, _ := ring.Parse(newToken, &Claims{}); token.Header["kid"] != "new" {t.Errorf("Expected the new key to sign, but got %v", token.Header["kid"])}
+
+	// then the old one goes
+	if err := ring.Remove("new"); err == nil {t.Errorf("Expected not to be able to remove the signing key")}
+	if err := ring.Remove("old"); err != nil {t.Errorf("Remove failed with %v", err)}
+	if _, err := ring.Parse(oldToken, &Claims{}); err == nil || err.(*jwt.ValidationError).Inner != UnknownKeyError {
+		t.Errorf("Expected '%v', but got '%v'", UnknownKeyError, err)
+	}
+	if _, err := ring.Parse(newToken, &Claims{}); err != nil {t.Errorf("Expected the new token to be accepted, but got %v", err)}
+}
+
+func TestKeyRingRejectsForgedTokens(t *testing.T){
+	ring := NewKeyRing()
+	_ = ring.Add(mustKey(NewAsymmetricKey("rsa", testRsaKey)), true)
+
+	// an HMAC token keyed with the RSA public key (which anyone can get from jwks.json)
+	publicDer, _ := x509.MarshalPKIXPublicKey(&testRsaKey.PublicKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Username: "admin"})
+	forged.Header["kid"] = "rsa"
+	forgedStr, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+	if _, err := ring.Parse(forgedStr, &Claims{}); err == nil {t.Errorf("Expected a token with the wrong algorithm to be rejected")}
+
+	// tokens with no kid, or someone else's
+	other := NewKeyRing()
+	_ = other.Add(mustKey(NewHmacKey("rsa", []byte(strings.Repeat("x", 32)))), true)
+	otherStr, _ := other.Sign(&Claims{Username: "admin"})
+	if _, err := ring.Parse(otherStr, &Claims{}); err == nil {t.Errorf("Expected a token from another key to be rejected")}
+
+	unnamed := jwt.NewWithClaims(jwt.SigningMethodRS256, &Claims{Username: "admin"})
+	unnamedStr, _ := unnamed.SignedString(testRsaKey)
+	if _, err := ring.Parse(unnamedStr, &Claims{}); err == nil {t.Errorf("Expected a token with no kid to be rejected")}
+}
+
+func TestParsePemKeys(t *testing.T){
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRsaKey)})
+	sec1Der, _ := x509.MarshalECPrivateKey(testEcKey)
+	sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1Der})
+	pkcs8Der, _ := x509.MarshalPKCS8PrivateKey(testEcKey)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Der})
+	publicDer, _ := x509.MarshalPKIXPublicKey(&testRsaKey.PublicKey)
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})
+
+	expected := map[string]struct {
+		data    []byte
+		alg     string
+		canSign bool
+	}{
+		"pkcs1":  {pkcs1, "RS256", true},
+		"sec1":   {sec1, "ES256", true},
+		"pkcs8":  {pkcs8, "ES256", true},
+		"public": {public, "RS256", false},
+	}
+	for id, want := range expected {
+		key, err := ParsePemKey(id, want.data)
+		if err != nil {t.Errorf("%s: ParsePemKey failed with %v", id, err); continue}
+		if key.Method.Alg() != want.alg || (key.sign != nil) != want.canSign {t.Errorf("%s: expected %s (can sign = %v), but got %s", id, want.alg, want.canSign, key.Method.Alg())}
+	}
+
+	// keys that only check can't be made to sign
+	publicKey, _ := ParsePemKey("public", public)
+	if err := NewKeyRing().Add(publicKey, true); err != NoSigningKeyError {t.Errorf("Expected '%v', but got '%v'", NoSigningKeyError, err)}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if _, err := NewAsymmetricKey("p384", p384); err != UnsupportedKeyError {t.Errorf("Expected '%v', but got '%v'", UnsupportedKeyError, err)}
+	if _, err := NewHmacKey("short", []byte("too short")); err != UnsupportedKeyError {t.Errorf("Expected '%v', but got '%v'", UnsupportedKeyError, err)}
+	if _, err := ParsePemKey("junk", []byte("not a pem file")); err == nil {t.Errorf("Expected junk to be rejected")}
+}
+
+func TestKeyRingFromEnvironment(t *testing.T){
+	dir := t.TempDir()
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRsaKey)})
+	sec1Der, _ := x509.MarshalECPrivateKey(testEcKey)
+	sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1Der})
+	_ = os.WriteFile(filepath.Join(dir, "new.pem"), sec1, 0600)
+	_ = os.WriteFile(filepath.Join(dir, "old.pem"), pkcs1, 0600)
+
+	environment := func(values map[string]string) func(string) string {
+		return func(name string) string {return values[name]}
+	}
+
+	ring, err := keyRingFromEnvironment(environment(map[string]string{
+		"LWS_JWT_KEY_FILES": "2024-06=" + filepath.Join(dir, "new.pem") + ", 2024-01=" + filepath.Join(dir, "old.pem"),
+	}))
+	if err != nil {t.Fatalf("keyRingFromEnvironment failed with %v", err)}
+	tokenStr, _ := ring.Sign(&Claims{})
+	if token, _ := ring.Parse(tokenStr, &Claims{}); token == nil || token.Header["kid"] != "2024-06" {t.Errorf("Expected the first file to sign")}
+	if published := ring.PublicKeys(); len(published.Keys) != 2 {t.Errorf("Expected both keys, but got %v", published)}
+
+	ring, err = keyRingFromEnvironment(environment(map[string]string{"LWS_JWT_KEY": string(pkcs1), "LWS_JWT_KEY_ID": "from-env"}))
+	if err != nil || ring.PublicKeys().Keys[0].Id != "from-env" {t.Errorf("Expected a PEM key called 'from-env', but got %v", err)}
+	ring, err = keyRingFromEnvironment(environment(map[string]string{"LWS_JWT_KEY": strings.Repeat("z", 40)}))
+	if err != nil || ring == nil {t.Errorf("Expected an HMAC key, but got %v", err)}
+
+	if ring, err = keyRingFromEnvironment(environment(map[string]string{})); ring != nil || err != nil {t.Errorf("Expected nothing, but got %v, %v", ring, err)}
+	if _, err = keyRingFromEnvironment(environment(map[string]string{"LWS_JWT_KEY": "short"})); err == nil {t.Errorf("Expected a short secret to be rejected")}
+	if _, err = keyRingFromEnvironment(environment(map[string]string{"LWS_JWT_KEY_FILES": "no-kid.pem"})); err == nil {t.Errorf("Expected an entry without a kid to be rejected")}
+	if _, err = keyRingFromEnvironment(environment(map[string]string{"LWS_JWT_KEY_FILES": "a=" + filepath.Join(dir, "missing.pem")})); err == nil {t.Errorf("Expected a missing file to be rejected")}
+}
+
+func TestPublishedKeysCheckOurTokens(t *testing.T){
+	ring := NewKeyRing()
+	_ = ring.Add(mustKey(NewHmacKey("secret", []byte(strings.Repeat("s", 32)))), false)
+	_ = ring.Add(mustKey(NewAsymmetricKey("ec", testEcKey)), false)
+	_ = ring.Add(mustKey(NewAsymmetricKey("rsa", testRsaKey)), true)
+
+	server := &LittleServer{passwordCost: 1000, keys: ring}
+	server.SetUpLogging(false, true)
+	client := newTokenClient(t, server)
+
+	response := client.send(http.MethodGet, "/.well-known/jwks.json", "")
+	expectCode(t, response, http.StatusOK, "jwks")
+	published := JsonWebKeySet{}
+	if err := json.Unmarshal(response.Body.Bytes(), &published); err != nil {t.Fatalf("Bad key set: %v", err)}
+
+	// the shared secret is never published
+	if len(published.Keys) != 2 || published.Keys[0].Id != "ec" || published.Keys[1].Id != "rsa" {t.Fatalf("Expected the 'ec' and 'rsa' keys, but got %+v", published.Keys)}
+	ec := published.Keys[0]
+	if ec.KeyType != "EC" || ec.Curve != "P-256" || ec.Algorithm != "ES256" || len(ec.X) != 43 || len(ec.Y) != 43 {t.Errorf("Unexpected EC key: %+v", ec)}
+
+	// someone else can check our login token with only what we published
+	decode := func(value string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(data)
+	}
+	rsaJwk := published.Keys[1]
+	publicKey := &rsa.PublicKey{N: decode(rsaJwk.N), E: int(decode(rsaJwk.E).Int64())}
+	token, err := jwt.ParseWithClaims(client.cookies["token"], &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != rsaJwk.Id {return nil, errors.New("wrong key")}
+		return publicKey, nil
+	})
+	if err != nil || !token.Valid || token.Claims.(*Claims).Username != devUsername {t.Errorf("Expected our token to check out, but got %v", err)}
+}
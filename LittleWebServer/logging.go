@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Logs are one record per line, as JSON or logfmt, so they can be searched and filtered by field:
+//
+//     {"time":"2021-07-01T12:00:00.123Z","level":"info","msg":"request","request_id":"k3Jd8s0QmZpX1a2b","method":"GET","path":"/user/1","status":200,...}
+//     time=2021-07-01T12:00:00.123Z level=info msg=request request_id=k3Jd8s0QmZpX1a2b method=GET path=/user/1 status=200 ...
+//
+// Fields are given as key, value pairs after the message: `log.Warn("Could not read roles", "error", err)`.
+//
+// Every request gets an id, taken from its X-Request-ID header if the client (or a proxy) sent a sensible one,
+// and made up otherwise. It goes back in the response's X-Request-ID header, and on every record logged
+// while handling the request, so they can all be found from one. Handlers get that logger with `logFor(response)`.
+//
+// Header values that carry secrets (cookies, and so tokens) are never logged; see `redactHeaders`.
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug: return "debug"
+	case LevelInfo: return "info"
+	case LevelWarn: return "warn"
+	default: return "error"
+	}
+}
+
+type LogFormat int
+
+const (
+	LogJson LogFormat = iota
+	LogFmt
+)
+
+const (
+	requestIdHeader   = "X-Request-ID"
+	requestIdBytes    = 12  // of randomness, for ids we make up
+	maxRequestIdChars = 128 // longer ones from the client are replaced
+	redacted          = "[REDACTED]"
+)
+
+// sensitiveHeaders are never logged, by canonical name
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+	"X-Csrf-Token":        true,
+}
+
+// appLog is for everything that isn't part of a request. `SetUpLogging` replaces it.
+var appLog = NewLogger(os.Stderr, LogJson, LevelInfo)
+
+// logSink is where a Logger and all the loggers made from it with `With` write to
+type logSink struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format LogFormat
+	min    Level
+	now    func() time.Time
+}
+
+// Logger writes structured records at or above its level. It is safe for concurrent use.
+type Logger struct {
+	sink   *logSink
+	fields []interface{} // key, value pairs added to every record
+}
+
+func NewLogger(out io.Writer, format LogFormat, min Level) *Logger {
+	return &Logger{sink: &logSink{out: out, format: format, min: min, now: time.Now}}
+}
+
+// With makes a logger that adds some key, value pairs to every record, and writes where this one does
+func (logger *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyValues))
+	fields = append(append(fields, logger.fields...), keyValues...)
+	return &Logger{sink: logger.sink, fields: fields}
+}
+
+func (logger *Logger) Debug(msg string, keyValues ...interface{}) {logger.Log(LevelDebug, msg, keyValues...)}
+func (logger *Logger) Info(msg string, keyValues ...interface{})  {logger.Log(LevelInfo, msg, keyValues...)}
+func (logger *Logger) Warn(msg string, keyValues ...interface{})  {logger.Log(LevelWarn, msg, keyValues...)}
+func (logger *Logger) Error(msg string, keyValues ...interface{}) {logger.Log(LevelError, msg, keyValues...)}
+
+// Panic logs an error, then panics with the message and fields. Used where a request can't go on.
+func (logger *Logger) Panic(msg string, keyValues ...interface{}) {
+	logger.Log(LevelError, msg, keyValues...)
+	panic(msg + " " + string(encodeLogFmt(nil, keyValues)))
+}
+
+// Fatal logs an error, then stops the program
+func (logger *Logger) Fatal(msg string, keyValues ...interface{}) {
+	logger.Log(LevelError, msg, keyValues...)
+	os.Exit(1)
+}
+
+// Enabled is true if records at `level` are written
+func (logger *Logger) Enabled(level Level) bool {
+	logger.sink.lock.Lock()
+	defer logger.sink.lock.Unlock()
+	return level >= logger.sink.min
+}
+
+func (logger *Logger) Log(level Level, msg string, keyValues ...interface{}) {
+	sink := logger.sink
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if level < sink.min {return}
+
+	fields := append([]interface{}{"time", sink.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, logger.fields...)
+	fields = append(fields, keyValues...)
+
+	var line []byte
+	if sink.format == LogFmt {
+		line = encodeLogFmt(nil, fields)
+	} else {
+		line = encodeJsonRecord(fields)
+	}
+	_, _ = sink.out.Write(append(line, '\n'))
+}
+
+// Writer is where records go
+func (logger *Logger) Writer() io.Writer {
+	logger.sink.lock.Lock()
+	defer logger.sink.lock.Unlock()
+	return logger.sink.out
+}
+
+// SetOutput changes where records go, for this logger and every one sharing its output
+func (logger *Logger) SetOutput(out io.Writer) {
+	logger.sink.lock.Lock()
+	defer logger.sink.lock.Unlock()
+	logger.sink.out = out
+}
+
+// StdLogger makes a standard library logger (as http.Server wants) that writes each line as a record at `level`
+func (logger *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(lineWriter(func(line string) {logger.Log(level, line)}), "", 0)
+}
+
+type lineWriter func(line string)
+
+func (write lineWriter) Write(data []byte) (int, error) {
+	write(strings.TrimRight(string(data), "\r\n"))
+	return len(data), nil
+}
+
+//<editor-fold desc="Encoding">
+
+// logValue makes values that don't encode usefully (like errors, which are empty JSON objects) into text
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// pairs calls `each` with every key, value pair. A key with no value gets "(missing)".
+func pairs(keyValues []interface{}, each func(key string, value interface{})) {
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keyValues) {value = logValue(keyValues[i+1])}
+		each(key, value)
+	}
+}
+
+func encodeJsonRecord(keyValues []interface{}) []byte {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte('{')
+	pairs(keyValues, func(key string, value interface{}) {
+		if buffer.Len() > 1 {buffer.WriteByte(',')}
+		data, _ := json.Marshal(key)
+		buffer.Write(data)
+		buffer.WriteByte(':')
+
+		data, err := json.Marshal(value)
+		if err != nil {data, _ = json.Marshal(fmt.Sprint(value))}
+		buffer.Write(data)
+	})
+	buffer.WriteByte('}')
+	return buffer.Bytes()
+}
+
+func encodeLogFmt(line []byte, keyValues []interface{}) []byte {
+	pairs(keyValues, func(key string, value interface{}) {
+		if len(line) > 0 {line = append(line, ' ')}
+		line = append(line, logFmtText(key)...)
+		line = append(line, '=')
+		line = append(line, logFmtText(logFmtValue(value))...)
+	})
+	return line
+}
+
+func logFmtValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]string: // headers
+		keys := make([]string, 0, len(v))
+		for key := range v {keys = append(keys, key)}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, key := range keys {parts[i] = key + ":" + v[key]}
+		return strings.Join(parts, "; ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// logFmtText quotes text that would otherwise be read as more than one value
+func logFmtText(text string) string {
+	if text == "" {return `""`}
+	for _, char := range text {
+		if char == '=' || char == '"' || char == '\\' || unicode.IsSpace(char) || !unicode.IsPrint(char) {return strconv.Quote(text)}
+	}
+	return text
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Request logging">
+
+// loggedResponse notes what was sent, for the request log, and carries the request's logger for handlers
+type loggedResponse struct {
+	http.ResponseWriter
+	log    *Logger
+	status int
+	bytes  int64
+}
+
+func (logged *loggedResponse) WriteHeader(status int) {
+	if logged.status == 0 {logged.status = status}
+	logged.ResponseWriter.WriteHeader(status)
+}
+
+func (logged *loggedResponse) Write(data []byte) (int, error) {
+	if logged.status == 0 {logged.status = http.StatusOK}
+	written, err := logged.ResponseWriter.Write(data)
+	logged.bytes += int64(written)
+	return written, err
+}
+
+func (logged *loggedResponse) Flush() {
+	if flusher, ok := logged.ResponseWriter.(http.Flusher); ok {flusher.Flush()}
+}
+
+func (logged *loggedResponse) Unwrap() http.ResponseWriter {return logged.ResponseWriter}
+
+// logFor returns the logger for the request being answered by `response`, which adds its request id to every record.
+// Outside of `logRequests`, it's `appLog`. Middleware inside it can wrap the response, as long as they can `Unwrap` it.
+func logFor(response http.ResponseWriter) *Logger {
+	for {
+		if logged, ok := response.(*loggedResponse); ok {return logged.log}
+		wrapper, ok := response.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {return appLog}
+		response = wrapper.Unwrap()
+	}
+}
+
+// requestIdFrom uses the client's request id if it's short and plain enough to log safely, or makes one up
+func requestIdFrom(request *http.Request) string {
+	id := request.Header.Get(requestIdHeader)
+	if id == "" || len(id) > maxRequestIdChars {return newTokenString(requestIdBytes)}
+	for _, char := range id {
+		if char > unicode.MaxASCII || !(unicode.IsLetter(char) || unicode.IsDigit(char) || strings.ContainsRune("-_.:/+=", char)) {
+			return newTokenString(requestIdBytes)
+		}
+	}
+	return id
+}
+
+// redactHeaders flattens headers for logging, hiding the values of any that could carry secrets
+func redactHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			flat[name] = redacted
+		} else {
+			flat[name] = strings.Join(values, ", ")
+		}
+	}
+	return flat
+}
+
+//</editor-fold>
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger writes to a buffer, with the clock stopped
+func testLogger(format LogFormat, min Level) (*Logger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	logger := NewLogger(out, format, min)
+	logger.sink.now = func() time.Time {return time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)}
+	return logger, out
+}
+
+// logRecords reads JSON log lines
+func logRecords(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {continue}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {t.Fatalf("Log line '%s' is not JSON: %v", line, err)}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLoggerFormats(t *testing.T){
+	logger, out := testLogger(LogJson, LevelInfo)
+	logger.With("request_id", "abc").Warn("Could not read roles", "error", errors.New("disk on fire"), "count", 3)
+	expected := `{"time":"2021-07-01T12:00:00Z","level":"warn","msg":"Could not read roles","request_id":"abc","error":"disk on fire","count":3}` + "\n"
+	if out.String() != expected {t.Errorf("Expected '%s', but got '%s'", expected, out.String())}
+
+	logger, out = testLogger(LogFmt, LevelInfo)
+	logger.Info("request", "path", "/user/1", "note", `has "quotes" and spaces`, "empty", "", "took", 1500*time.Millisecond, "odd")
+	expected = `time=2021-07-01T12:00:00Z level=info msg=request path=/user/1 note="has \"quotes\" and spaces" empty="" took=1.5s odd=(missing)` + "\n"
+	if out.String() != expected {t.Errorf("Expected '%s', but got '%s'", expected, out.String())}
+}
+
+func TestLoggerLevels(t *testing.T){
+	logger, out := testLogger(LogJson, LevelWarn)
+	logger.Debug("no")
+	logger.Info("no")
+	logger.Warn("yes")
+	logger.Error("yes")
+
+	records := logRecords(t, out)
+	if len(records) != 2 || records[0]["level"] != "warn" || records[1]["level"] != "error" {t.Errorf("Expected a warning and an error, but got %v", records)}
+	if logger.Enabled(LevelInfo) || !logger.Enabled(LevelError) {t.Errorf("Expected only warnings and up to be enabled")}
+
+	// loggers made `With` more fields share the output, and don't change the original
+	out.Reset()
+	logger.With("a", 1).Warn("with")
+	logger.Warn("plain")
+	if records = logRecords(t, out); records[0]["a"] != float64(1) || records[1]["a"] != nil {t.Errorf("Expected only the first to have the extra field, but got %v", records)}
+
+	// the standard library logger adapter, as used by http.Server
+	out.Reset()
+	logger.StdLogger(LevelWarn).Printf("http: TLS handshake error from %s", "192.0.2.1")
+	if records = logRecords(t, out); len(records) != 1 || records[0]["msg"] != "http: TLS handshake error from 192.0.2.1" {t.Errorf("Unexpected records %v", records)}
+}
+
+func TestLoggerPanicLogsFirst(t *testing.T){
+	logger, out := testLogger(LogJson, LevelInfo)
+	defer func() {
+		if failure := recover(); failure != "Could not save user error=nope" {t.Errorf("Unexpected panic '%v'", failure)}
+		if records := logRecords(t, out); len(records) != 1 || records[0]["level"] != "error" {t.Errorf("Expected the error to be logged, but got %v", records)}
+	}()
+	logger.Panic("Could not save user", "error", errors.New("nope"))
+}
+
+func TestRedactHeaders(t *testing.T){
+	header := http.Header{}
+	header.Set("Cookie", "token=eyJhbGciOi...; refresh=abc")
+	header.Set("Authorization", "Bearer eyJhbGciOi...")
+	header.Set("Accept", "application/json")
+	header.Add("X-Things", "a")
+	header.Add("X-Things", "b")
+
+	flat := redactHeaders(header)
+	if flat["Cookie"] != redacted || flat["Authorization"] != redacted {t.Errorf("Expected secrets to be redacted, but got %v", flat)}
+	if flat["Accept"] != "application/json" || flat["X-Things"] != "a, b" {t.Errorf("Expected other headers to be kept, but got %v", flat)}
+}
+
+func TestRequestIds(t *testing.T){
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	made := requestIdFrom(request)
+	if len(made) < 16 || made == requestIdFrom(request) {t.Errorf("Expected new random ids, but got '%s'", made)}
+
+	request.Header.Set(requestIdHeader, "from-the-proxy.1234")
+	if id := requestIdFrom(request); id != "from-the-proxy.1234" {t.Errorf("Expected the client's id, but got '%s'", id)}
+
+	for _, bad := range []string{"has spaces", "line\nbreak", `quote"`, "ünïcode", strings.Repeat("x", maxRequestIdChars+1)} {
+		request.Header.Set(requestIdHeader, bad)
+		if id := requestIdFrom(request); id == bad {t.Errorf("Expected '%s' to be replaced", bad)}
+	}
+}
+
+func TestRequestsAreLogged(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, false)
+	out := &bytes.Buffer{}
+	appLog = NewLogger(out, LogJson, LevelInfo)
+	defer server.SetUpLogging(false, true)
+
+	// log in, which sets the token cookies
+	request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"ieb","password":"correct"}`))
+	request.Header.Set(requestIdHeader, "login-1")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	cookies := response.Header().Get("Set-Cookie")
+	if id := response.Header().Get(requestIdHeader); id != "login-1" {t.Errorf("Expected the request id to be echoed, but got '%s'", id)}
+
+	// then use the cookies, on a path that doesn't exist
+	out.Reset()
+	request = httptest.NewRequest(http.MethodGet, "/user/99", nil)
+	request.Header.Set("Cookie", cookies)
+	response = httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	requestId := response.Header().Get(requestIdHeader)
+	if requestId == "" {t.Fatalf("Expected a request id to be made up")}
+
+	records := logRecords(t, out)
+	if len(records) != 2 {t.Fatalf("Expected a handler record and a request record, but got %v", records)}
+	if records[0]["msg"] != "Attempted to access an invalid path" || records[0]["request_id"] != requestId {t.Errorf("Expected the handler's record to have the request id, but got %v", records[0])}
+
+	line := records[1]
+	if line["msg"] != "request" || line["request_id"] != requestId || line["method"] != "GET" || line["path"] != "/user/99" ||
+		line["status"] != float64(404) || line["bytes"] != float64(len(response.Body.String())) || line["duration_ms"] == nil {
+		t.Errorf("Unexpected request record %v", line)
+	}
+	headers, _ := line["headers"].(map[string]interface{})
+	if headers["Cookie"] != redacted {t.Errorf("Expected the cookie to be redacted, but got %v", headers)}
+	if strings.Contains(out.String(), strings.SplitN(strings.TrimPrefix(cookies, "token="), ";", 2)[0]) {t.Errorf("The token was logged: %s", out.String())}
+}
@@ -1,98 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 const(
 	httpPort = ":6080"
+	maxBodyBytes = 0xFFFF
+	userDbPath = "users.kvs"
+
+	// a user that every default credential store starts with, so there's something to log in as during development
+	devUsername = "ieb"
+	devPassword = "correct"
 )
 
 //<editor-fold desc="Boiler plate">
 
-var loginDetails = map[string]uint{
-	"ieb": hashStr("correct"),
-}
-
-func hashStr(s string) uint {
-	// NEVER ever use such a small and simple hash for passwords in a real system!
-	var mod uint = 65521
-	var a, b uint = 1, 0
-	for _, c := range s {
-		a = (a + uint(c)) % mod
-		b = (b + a) % mod
-	}
-	return (b << 16) | a
-}
-
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+type PasswordChange struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
 type Claims struct {
-	Username string `json:"un"`
-	jwt.StandardClaims
+	Username    string   `json:"un"`
+	SessionId   string   `json:"sid,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	jwt.StandardClaims // the token's own id is in `Id` (jti)
 }
 
-var jwtKey = []byte("Only suitable for development")
+// used to sign tokens if no keys are given (see keys.go)
+var jwtKey = []byte("Only suitable for development. Never use this in production!")
 
 type MyInputType struct {
-	ID int `json:"id"`
-	Name string `json:"name"`
-	Age int `json:"age"`
+	ID int `json:"id" validate:"min=0"`
+	Name string `json:"name" validate:"required,maxlen=100"`
+	Age int `json:"age" validate:"min=0,max=150"`
+	Owner string `json:"owner,omitempty" validate:"maxlen=64,pattern=[A-Za-z0-9._-]+"` // the username that can read and change this record, besides admins
 }
 
 type LittleServer struct {
-	userDb          map[int]MyInputType
+	userDb          UserRepository  // a MemoryUserRepository, if not set
 	lastSignIn      time.Time
 	useDetailedLogs bool
+	credentials     CredentialStore // a MemoryCredentialStore holding the dev user, if not set
+	passwordCost    int             // PBKDF2 iterations for new password hashes; DefaultPasswordCost if not set
+	sessions        SessionStore    // a MemorySessionStore, if not set
+	denylist        TokenDenylist   // a MemoryTokenDenylist, if not set
+	keys            *KeyRing        // just the HS512 development key, if not set
+	throttle        *LoginThrottle  // one with a MemoryAttemptStore, if not set
+	metrics         *Metrics        // a new set, if not set
+
+	setupOnce sync.Once
+	router    *Router
+	dummyHash string // checked against when the user doesn't exist, so a failed login takes the same time either way
 }
 
-var infoLog *log.Logger
-var warnLog *log.Logger
-var critLog *log.Logger
-
 func main(){
-	server := &LittleServer{
-		userDb: map[int]MyInputType{},
-	}
-	logFile := server.SetUpLogging(false, false)
-	defer func(file *os.File) { if file == nil {return}; _ = file.Close() }(logFile)
-
-	infoLog.Printf("Bringing up a server on http://localhost%s\r\n", httpPort)
-
-	// add a sample user at [0]
-	server.userDb[0] = MyInputType{
-		ID:   -1,
-		Name: "Sample user",
-		Age:  20,
+	server := &LittleServer{}
+	logFile := server.SetUpLogging(false, false) // closed by the host when it shuts down
+
+	appLog.Info("Bringing up a server", "url", "http://localhost"+httpPort)
+
+	keys, err := keyRingFromEnvironment(os.Getenv)
+	if err != nil {appLog.Fatal("Could not load signing keys", "error", err)}
+	server.keys = keys
+
+	users, err := OpenStoreUserRepository(userDbPath)
+	if err != nil {appLog.Fatal("Could not open user store", "error", err)}
+	defer func() { _ = users.Close() }()
+	server.userDb = users
+
+	// Change the cost to suit the hardware: a login should take a fair fraction of a second.
+	// `credentials` can be any CredentialStore; the default keeps them in memory, with the dev user.
+	server.passwordCost = DefaultPasswordCost
+
+	// add a sample user at [0], unless there's one from a previous run
+	if _, err = users.Find(0); err == UserNotFoundError {
+		err = users.Save(0, MyInputType{
+			ID:   -1,
+			Name: "Sample user",
+			Age:  20,
+		})
+		if err != nil {appLog.Fatal("Could not add sample user", "error", err)}
 	}
 
-	http.Handle("/", server)
-
 	// just to test the JWT import is ok
-	infoLog.Printf("JWT time: %v",jwt.TimeFunc())
+	appLog.Info("JWT time", "now", jwt.TimeFunc())
 
-	err := http.ListenAndServe(httpPort, nil)
-	if err != nil {
-		critLog.Fatalf("Server failed: %v", err)
+	// runs until Ctrl+C or SIGTERM, then lets requests in flight finish
+	host := NewHost(httpPort, server, logFile)
+	if err = host.Run(shutdownSignals()); err != nil {
+		appLog.Error("Server did not stop cleanly", "error", err)
 	}
 }
 
+// SetUpLogging sends logs to stderr, or to app.log, as JSON (or logfmt, if LWS_LOG_FORMAT=logfmt).
+// `onlyImportant` leaves out everything below warnings; otherwise each request is logged with its headers.
 func (serv *LittleServer)SetUpLogging(useLogFile, onlyImportant bool) (usingFile *os.File) {
 	logTarget := os.Stderr
 	if useLogFile {
-		file, err := os.OpenFile("app.log", os.O_CREATE|os.O_APPEND, 0644)
+		file, err := os.OpenFile("app.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
 			log.Fatalf("could not open log file: %v", err)
 		}
@@ -106,50 +132,85 @@ func (serv *LittleServer)SetUpLogging(useLogFile, onlyImportant bool) (usingFile
 		log.SetOutput(file)
 	}
 
-	infoLog = log.New(logTarget, "INFO:  ", log.Ldate|log.Ltime)
-	warnLog = log.New(logTarget, "WARN:  ", log.Ldate|log.Ltime)
-	critLog = log.New(logTarget, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-
-	if onlyImportant {
-		infoLog.SetOutput(ioutil.Discard)
-	}
+	format := LogJson
+	if os.Getenv("LWS_LOG_FORMAT") == "logfmt" {format = LogFmt}
+	level := LevelInfo
+	if onlyImportant {level = LevelWarn}
+	appLog = NewLogger(logTarget, format, level)
 
 	serv.useDetailedLogs = !onlyImportant
 	return
 }
 
+// setDefaults fills in anything not given when the server was made. Runs once, before the first request.
+func (serv *LittleServer)setDefaults() {
+	if serv.userDb == nil {
+		serv.userDb = NewMemoryUserRepository()
+	}
+	if serv.sessions == nil {
+		serv.sessions = NewMemorySessionStore()
+	}
+	if serv.denylist == nil {
+		serv.denylist = NewMemoryTokenDenylist()
+	}
+	if serv.throttle == nil {
+		serv.throttle = NewLoginThrottle(NewMemoryAttemptStore())
+	}
+	if serv.metrics == nil {
+		serv.metrics = NewMetrics()
+	}
+	if serv.keys == nil {
+		appLog.Warn("No signing keys were given, so using the development key. Don't do this in production!")
+		devKey, err := NewHmacKey("dev", jwtKey)
+		if err != nil {appLog.Fatal("Could not make dev key", "error", err)}
+		serv.keys = NewKeyRing()
+		_ = serv.keys.Add(devKey, true)
+	}
+	serv.router = serv.routes()
+
+	if serv.credentials == nil {
+		store := NewMemoryCredentialStore()
+		devHash, err := HashPassword(devPassword, serv.passwordCost)
+		if err != nil {appLog.Fatal("Could not hash dev password", "error", err)}
+		_ = store.Create(devUsername, devHash)
+		_ = store.SetRoles(devUsername, []string{RoleAdmin})
+		serv.credentials = store
+	}
+
+	dummyHash, err := HashPassword("not anyone's password", serv.passwordCost)
+	if err != nil {appLog.Fatal("Could not hash dummy password", "error", err)}
+	serv.dummyHash = dummyHash
+}
+
 func (serv *LittleServer)ServeHTTP(response http.ResponseWriter, request *http.Request){
+	serv.setupOnce.Do(serv.setDefaults)
+
 	// should never modify `request`
 	// `panic()` is restricted to the current request
-	if serv.useDetailedLogs {
-		infoLog.Printf("REQ/%s %s %s [%v]\r\n", request.Method, request.Host, request.URL.Path, request.Header)
-	} else {
-		infoLog.Printf("REQ/%s %s %s \r\n", request.Method, request.Host, request.URL.Path)
-	}
+	serv.router.ServeHTTP(response, request)
+}
 
-	// URL property has query parser built in
-	//request.URL.Query().Get("query-key") // => "query-value", given https://.../my/path?query-key=query-value
+// readJson decodes a request body into `target`, rejecting unknown fields and bodies over `maxBodyBytes`
+func readJson(response http.ResponseWriter, request *http.Request, target interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields() // strict mode
+	return decoder.Decode(target)
+}
 
-	// Break path into bits, trim off empty sections at the start
-	pathBits := strings.Split(request.URL.Path, "/")
-	for len(pathBits) > 0 && pathBits[0] == "" { // trim empty sections
-		pathBits = pathBits[1:]
-	}
+// writeJson sends `value` as the JSON body of a response
+func writeJson(response http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {logFor(response).Panic("Json marshal failed", "error", err)}
 
-	switch request.Method {
-	case http.MethodGet:
-		getHandler(serv, response, request, pathBits)
-	case http.MethodPost:
-		postHandler(serv, response, request, pathBits)
-	default:
-		unsupportedMethod(request.Method, response)
-	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	pWrite(data, response)
 }
 
 // pWrite writes to the response and panics on any error
 func pWrite(msg []byte, response http.ResponseWriter){
 	if _, err := response.Write(msg); err != nil {
-		warnLog.Panicf("Failed to write response: %v", err)
+		logFor(response).Panic("Failed to write response", "error", err)
 	}
 }
 
@@ -157,190 +218,611 @@ func pWrite(msg []byte, response http.ResponseWriter){
 
 //<editor-fold desc="Routing & auth">
 
-func postHandler(serv *LittleServer, response http.ResponseWriter, request *http.Request, pathBits []string) {
-	if len(pathBits) < 1{
-		invalidInput(response)
-		return
-	}
-
-	switch pathBits[0] {
-	case "user":
-		if !isAuthenticated(request, response) {return}
-		postUser(serv, pathBits[1:], response, request)
-
-	case "login":
-		handleLogin(serv, response, request)
+// routes lists every endpoint. Handlers read path parameters with `Params(request)`.
+func (serv *LittleServer)routes() *Router {
+	router := NewRouter()
+	router.Use(serv.measureRequests, serv.logRequests, serv.recoverPanics)
+
+	router.Get("/", func(response http.ResponseWriter, request *http.Request) {homePage(response)})
+	router.Get("/panic", func(response http.ResponseWriter, request *http.Request) {panic("panic!")})
+	router.Get("/picnic", func(response http.ResponseWriter, request *http.Request) {picnic(response)})
+	router.Get("/favicon.ico", func(response http.ResponseWriter, request *http.Request) {sendIcon(response)})
+	router.Get("/.well-known/jwks.json", serv.with(sendPublicKeys))
+	router.Get("/metrics", serv.with(sendMetrics))
+
+	router.Post("/login", serv.with(handleLogin))
+	router.Post("/refresh", serv.with(handleRefresh))
+	router.Post("/logout", serv.with(handleLogout))
+	router.Post("/register", serv.with(handleRegister))
+	router.Post("/password", serv.with(handlePasswordChange), serv.requireAuth)
+
+	// records are checked against their owner in the handlers; these only check for some kind of access
+	canRead, canWrite := RequirePermission(PermReadOwnUser), RequirePermission(PermWriteOwnUser)
+	users := router.Group("/user", serv.requireAuth)
+	users.Get("", serv.with(listAllUsers), RequirePermission(PermListUsers))
+	users.Post("", serv.with(createUser), canWrite)
+	users.Get("/{id:int}", serv.with(getUser), canRead)
+	users.Post("/{id:int}", serv.with(postUser), canWrite)
+	users.Put("/{id:int}", serv.with(replaceUser), canWrite)
+	users.Patch("/{id:int}", serv.with(patchUser), canWrite)
+	users.Delete("/{id:int}", serv.with(deleteUser), canWrite)
+
+	router.Put("/account/{username}/roles", serv.with(setRoles), serv.requireAuth, RequirePermission(PermManageRoles))
+
+	return router
+}
 
-	default:
-		notFound(response)
+// with adapts one of the page actions below into a handler for this server
+func (serv *LittleServer)with(action func(serv *LittleServer, response http.ResponseWriter, request *http.Request)) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		action(serv, response, request)
 	}
 }
 
-func getHandler(serv *LittleServer, response http.ResponseWriter, request *http.Request, pathBits []string) {
-	if len(pathBits) < 1{
-		homePage(response)
-		return
-	}
+// logRequests gives each request an id and its own logger (see logging.go), and logs it once it's answered
+func (serv *LittleServer)logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		started := time.Now()
+		requestId := requestIdFrom(request)
+		response.Header().Set(requestIdHeader, requestId)
+		logged := &loggedResponse{ResponseWriter: response, log: appLog.With("request_id", requestId)}
+
+		finished := false
+		defer func() {
+			status, level := logged.status, LevelInfo
+			if status == 0 {status = http.StatusOK}
+			if !finished {status = http.StatusInternalServerError} // a panic on its way out
+			if status >= 500 {level = LevelError}
+
+			fields := []interface{}{
+				"method", request.Method,
+				"path", request.URL.Path,
+				"status", status,
+				"bytes", logged.bytes,
+				"duration_ms", float64(time.Since(started).Microseconds()) / 1000,
+				"remote", remoteAddress(request),
+			}
+			if serv.useDetailedLogs {fields = append(fields, "host", request.Host, "headers", redactHeaders(request.Header))}
+			logged.log.Log(level, "request", fields...)
+		}()
 
-	switch pathBits[0] {
-	case "user":
-		if !isAuthenticated(request, response) {return}
-		getUser(serv, pathBits[1:], response)
+		next.ServeHTTP(logged, request)
+		finished = true
+	})
+}
 
-	case "panic":
-		panic("panic!")
-	case "picnic":
-		picnic(response)
-	case "favicon.ico":
-		sendIcon(response)
+// requireAuth only lets requests with a good token through. Handlers after it can read the token with `claimsOf(request)`.
+func (serv *LittleServer)requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		claims, ok := serv.authenticate(request, response)
+		if !ok {return}
+		next.ServeHTTP(response, request.WithContext(context.WithValue(request.Context(), claimsKey, claims)))
+	})
+}
 
-	default:
-		notFound(response)
-	}
+// claimsOf returns the token claims that `requireAuth` checked, or nil outside of it
+func claimsOf(request *http.Request) *Claims {
+	claims, _ := request.Context().Value(claimsKey).(*Claims)
+	return claims
 }
 
 func handleLogin(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
-
-	http.MaxBytesReader(response, request.Body, 0xFFFF)
-	decoder := json.NewDecoder(request.Body)
-	decoder.DisallowUnknownFields() // strict mode
 	suppliedCreds := Credentials{}
 
 	// Read input
-	if err := decoder.Decode(&suppliedCreds); err != nil {
-		warnLog.Printf("    Bad login struct: %v\r\n", err)
+	if err := readJson(response, request, &suppliedCreds); err != nil {
+		logFor(response).Warn("Bad login body", "error", err)
 		invalidInput(response)
 		return
 	}
 
-	// check password (very badly)
-	if knownPassword, ok := loginDetails[suppliedCreds.Username]; !ok {
-		invalidInput(response)
+	address := remoteAddress(request)
+	wait, allowed, err := serv.throttle.Attempt(suppliedCreds.Username, address)
+	if err != nil {logFor(response).Panic("Could not record login attempt", "error", err)}
+	if !allowed {
+		serv.metrics.logins.Inc(LoginThrottled)
+		tooManyRequests(wait, response)
 		return
-	} else if knownPassword != hashStr(suppliedCreds.Password) {
+	}
+
+	if !serv.passwordMatches(suppliedCreds.Username, suppliedCreds.Password) {
+		serv.metrics.logins.Inc(LoginFailed)
 		invalidInput(response)
 		return
 	}
+	serv.metrics.logins.Inc(LoginSucceeded)
+	if err = serv.throttle.Succeeded(suppliedCreds.Username, address); err != nil {logFor(response).Warn("Could not clear login attempts", "error", err)}
+
+	// Log-in is correct, start a session and return its tokens
+	roles, err := serv.credentials.Roles(suppliedCreds.Username)
+	if err != nil {logFor(response).Panic("Could not read roles", "error", err)}
+
+	refreshToken := newTokenString(refreshTokenBytes)
+	accessToken, claims := serv.signAccessToken(suppliedCreds.Username, roles, newTokenString(tokenIdBytes))
+	session := Session{
+		Id:          claims.SessionId,
+		Username:    suppliedCreds.Username,
+		RefreshHash: hashRefreshToken(refreshToken),
+		AccessId:    claims.Id,
+		AccessUntil: time.Unix(claims.ExpiresAt, 0),
+		ExpiresAt:   time.Now().Add(refreshTokenLifetime),
+	}
+	if err := serv.sessions.Create(session); err != nil {logFor(response).Panic("Could not store session", "error", err)}
+
+	setTokenCookies(response, accessToken, session.AccessUntil, refreshToken, session.ExpiresAt)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	pWrite([]byte(`{"message":"ok"}`), response)
+	serv.lastSignIn = time.Now()
+}
+
+// handleRefresh swaps a refresh token for a new access token and a new refresh token
+func handleRefresh(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	refreshCookie, err := request.Cookie("refresh")
+	if err != nil {
+		mustAuth(response)
+		return
+	}
+
+	presentedHash := hashRefreshToken(refreshCookie.Value)
+	found, err := serv.sessions.FindByRefresh(presentedHash)
+	if err != nil {
+		if err != UnknownSessionError {logFor(response).Warn("Could not read sessions", "error", err)}
+		clearTokenCookies(response)
+		mustAuth(response)
+		return
+	}
+
+	roles, err := serv.credentials.Roles(found.Username)
+	if err != nil {
+		if err != UnknownUserError {logFor(response).Warn("Could not read roles", "error", err)}
+		clearTokenCookies(response)
+		mustAuth(response)
+		return
+	}
+
+	refreshToken := newTokenString(refreshTokenBytes)
+	accessToken, claims := serv.signAccessToken(found.Username, roles, found.Id)
+	reused := false
+	var replaced Session
+	session, err := serv.sessions.Update(found.Id, func(session *Session) error {
+		if session.Revoked || time.Now().After(session.ExpiresAt) {return SessionEndedError}
+		if session.RefreshHash != presentedHash {
+			// an old refresh token, so someone else has (or had) a copy; nobody gets to use this session now
+			reused = true
+			session.Revoked = true
+			return nil
+		}
+
+		replaced = *session
+		session.RefreshHash = hashRefreshToken(refreshToken)
+		session.AccessId = claims.Id
+		session.AccessUntil = time.Unix(claims.ExpiresAt, 0)
+		session.ExpiresAt = time.Now().Add(refreshTokenLifetime)
+		return nil
+	})
+
+	if err != nil {
+		if err != SessionEndedError {logFor(response).Warn("Could not update session", "error", err)}
+		clearTokenCookies(response)
+		mustAuth(response)
+		return
+	}
+	if reused {
+		logFor(response).Warn("A refresh token was used twice, so its session was revoked", "user", session.Username, "session", session.Id)
+		serv.denylist.Deny(session.AccessId, session.AccessUntil)
+		clearTokenCookies(response)
+		mustAuth(response)
+		return
+	}
 
-	// Log-in is correct, build and return a token
-	expiration := time.Now().Add(5 * time.Minute)
+	serv.denylist.Deny(replaced.AccessId, replaced.AccessUntil) // one working access token per session
+	setTokenCookies(response, accessToken, session.AccessUntil, refreshToken, session.ExpiresAt)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	pWrite([]byte(`{"message":"ok"}`), response)
+}
+
+// handleLogout revokes the session of whichever token cookies are given, and clears them. It works even if they have expired.
+func handleLogout(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	sessionId := ""
+	if tokenCookie, err := request.Cookie("token"); err == nil {
+		claims, err := serv.parseAccessToken(tokenCookie.Value)
+		if claims != nil && (err == nil || isOnlyExpired(err)) {
+			sessionId = claims.SessionId
+			serv.denylist.Deny(claims.Id, time.Unix(claims.ExpiresAt, 0))
+		}
+	}
+	if refreshCookie, err := request.Cookie("refresh"); err == nil {
+		if session, err := serv.sessions.FindByRefresh(hashRefreshToken(refreshCookie.Value)); err == nil {
+			sessionId = session.Id
+		}
+	}
+
+	if sessionId != "" {
+		session, err := serv.sessions.Update(sessionId, func(session *Session) error {
+			session.Revoked = true
+			return nil
+		})
+		if err == nil {
+			serv.denylist.Deny(session.AccessId, session.AccessUntil)
+			logFor(response).Info("User logged out", "user", session.Username)
+		} else if err != UnknownSessionError {
+			logFor(response).Warn("Could not revoke session", "error", err)
+		}
+	}
+
+	clearTokenCookies(response)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	pWrite([]byte(`{"message":"logged out"}`), response)
+}
+
+// signAccessToken makes a new JWT for a session, with its own id
+func (serv *LittleServer)signAccessToken(username string, roles []string, sessionId string) (string, *Claims) {
 	claims := &Claims{
-		Username: suppliedCreds.Username,
+		Username:    username,
+		SessionId:   sessionId,
+		Roles:       roles,
+		Permissions: permissionsFor(roles),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expiration.Unix(),
+			Id:        newTokenString(tokenIdBytes),
+			ExpiresAt: time.Now().Add(accessTokenLifetime).Unix(),
 			Issuer:    "LittleWebServer",
-			Subject:   suppliedCreds.Username,
+			Subject:   username,
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	tokenStr, err := token.SignedString(jwtKey)
+	tokenStr, err := serv.keys.Sign(claims)
+	if err != nil {appLog.Panic("Could not create token", "error", err)}
+	return tokenStr, claims
+}
+
+func setTokenCookies(response http.ResponseWriter, accessToken string, accessUntil time.Time, refreshToken string, refreshUntil time.Time) {
+	http.SetCookie(response, &http.Cookie{
+		Name:     "token",
+		Value:    accessToken,
+		Path:     "/",
+		Expires:  accessUntil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(response, &http.Cookie{
+		Name:     "refresh",
+		Value:    refreshToken,
+		Path:     "/",
+		Expires:  refreshUntil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearTokenCookies(response http.ResponseWriter) {
+	for _, name := range []string{"token", "refresh"} {
+		http.SetCookie(response, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	}
+}
+
+// passwordMatches checks a login. Unknown users and wrong passwords take the same time, so the timing doesn't say which names exist.
+func (serv *LittleServer)passwordMatches(username, password string) bool {
+	passwordHash, err := serv.credentials.Find(username)
 	if err != nil {
-		warnLog.Panicf("Could not create token: %v", err)
+		if err != UnknownUserError {appLog.Warn("Could not read credentials", "error", err)}
+		_, _ = CheckPassword(password, serv.dummyHash)
+		return false
+	}
+
+	matches, err := CheckPassword(password, passwordHash)
+	if err != nil {appLog.Warn("Could not check password", "user", username, "error", err)}
+	return matches
+}
+
+func handleRegister(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	suppliedCreds := Credentials{}
+	if err := readJson(response, request, &suppliedCreds); err != nil {
+		logFor(response).Warn("Bad register body", "error", err)
+		invalidInput(response)
+		return
+	}
+	if !validUsername(suppliedCreds.Username) || !validPassword(suppliedCreds.Password) {
+		invalidInput(response)
 		return
 	}
 
-	http.SetCookie(response, &http.Cookie{
-		Name:    "token",
-		Value:   tokenStr,
-		Expires: expiration,
-	})
+	passwordHash, err := HashPassword(suppliedCreds.Password, serv.passwordCost)
+	if err != nil {logFor(response).Panic("Could not hash password", "error", err)}
+
+	if err = serv.credentials.Create(suppliedCreds.Username, passwordHash); err == UserExistsError {
+		conflict(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not store credentials", "error", err)
+	}
+	if err = serv.credentials.SetRoles(suppliedCreds.Username, []string{RoleUser}); err != nil {
+		logFor(response).Panic("Could not store roles", "error", err)
+	}
+
+	logFor(response).Info("Registered user", "user", suppliedCreds.Username)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	pWrite([]byte(`{"message":"registered"}`), response)
+}
 
+func handlePasswordChange(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	claims := claimsOf(request)
+	change := PasswordChange{}
+	if err := readJson(response, request, &change); err != nil {
+		logFor(response).Warn("Bad password change body", "error", err)
+		invalidInput(response)
+		return
+	}
+	if !validPassword(change.NewPassword) {
+		invalidInput(response)
+		return
+	}
+
+	if !serv.passwordMatches(claims.Username, change.OldPassword) {
+		forbidden(response)
+		return
+	}
+
+	passwordHash, err := HashPassword(change.NewPassword, serv.passwordCost)
+	if err != nil {logFor(response).Panic("Could not hash password", "error", err)}
+	if err = serv.credentials.Update(claims.Username, passwordHash); err != nil {
+		logFor(response).Panic("Could not store credentials", "error", err)
+	}
+	// anyone else holding this user's tokens may have stolen them, and must now log in with the new password
+	revoked, err := serv.revokeSessionsOf(claims.Username, claims.SessionId)
+	if err != nil {logFor(response).Panic("Could not revoke other sessions", "error", err)}
+
+	logFor(response).Info("User changed their password", "user", claims.Username, "revoked_sessions", revoked)
 	response.Header().Set("Content-Type", "application/json")
 	response.WriteHeader(http.StatusOK)
-	pWrite([]byte(`{"message":"ok"}`), response)
-	serv.lastSignIn = time.Now()
+	pWrite([]byte(`{"message":"password changed"}`), response)
+}
+
+// revokeSessionsOf revokes every session of `username` except `keep`, and denies their access tokens.
+// Returns how many were revoked.
+func (serv *LittleServer)revokeSessionsOf(username, keep string) (int, error) {
+	sessions, err := serv.sessions.FindByUsername(username)
+	if err != nil {return 0, err}
+
+	revoked := 0
+	for _, found := range sessions {
+		if found.Id == keep {continue}
+		session, err := serv.sessions.Update(found.Id, func(session *Session) error {
+			session.Revoked = true
+			return nil
+		})
+		if err == UnknownSessionError {continue} // gone since we looked
+		if err != nil {return revoked, err}
+		serv.denylist.Deny(session.AccessId, session.AccessUntil)
+		revoked++
+	}
+	return revoked, nil
 }
 
 func mustAuth(response http.ResponseWriter) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(http.StatusUnauthorized)
-	pWrite([]byte(`{"error":"must provide token cookie"}`), response)
-	infoLog.Printf("User supplied no auth token")
+	sendError(response, http.StatusUnauthorized, ErrCodeUnauthorized, "must provide token cookie")
+	logFor(response).Info("User supplied no auth token")
 }
-func isAuthenticated(request *http.Request, response http.ResponseWriter) bool {
+// authenticate checks the token cookie, and returns its claims if it's good. Otherwise, it writes a 401 response.
+func (serv *LittleServer)authenticate(request *http.Request, response http.ResponseWriter) (*Claims, bool) {
 	tokenCookie,err := request.Cookie("token")
 	if err != nil{
-		if err == http.ErrNoCookie{
-			mustAuth(response)
-			return false
-		}
+		mustAuth(response)
+		return nil, false
 	}
 
-	claims := &Claims{}
-	token,err := jwt.ParseWithClaims(tokenCookie.Value,
-		claims,
-		func(token *jwt.Token) (interface{}, error) {return jwtKey,nil },
-	)
+	claims, err := serv.parseAccessToken(tokenCookie.Value)
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid{
-			warnLog.Printf("JWT token does not match: %v", err)
+		if validation, ok := err.(*jwt.ValidationError); ok && validation.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			logFor(response).Warn("JWT token does not match", "error", err)
 		}
-		infoLog.Printf("Failed to parse token: %v", err)
+		logFor(response).Info("Failed to parse token", "error", err)
 		mustAuth(response)
-		return false
+		return nil, false
 	}
-	if !token.Valid {
-		infoLog.Printf("User presented a signed but invalid token")
+	if serv.denylist.IsDenied(claims.Id) {
+		logFor(response).Info("User presented a revoked token", "user", claims.Username)
 		mustAuth(response)
-		return false
+		return nil, false
 	}
 
-	return true
+	return claims, true
+}
+
+// parseAccessToken checks a token's signature and times. On an error, the claims are still returned if they could be read.
+func (serv *LittleServer)parseAccessToken(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	token,err := serv.keys.Parse(tokenStr, claims)
+	if err != nil {return claims, err}
+	if !token.Valid {return claims, errors.New("signed but invalid token")}
+	return claims, nil
+}
+
+// isOnlyExpired is true if a token from `parseAccessToken` is good apart from its age
+func isOnlyExpired(err error) bool {
+	validation, ok := err.(*jwt.ValidationError)
+	return ok && validation.Errors == jwt.ValidationErrorExpired
 }
 
 //</editor-fold>
 
 //<editor-fold desc="Page actions">
-func postUser(serv *LittleServer, path []string, response http.ResponseWriter, request *http.Request) {
-	if len(path) != 1 {invalidInput(response); return}
-	id,err := strconv.Atoi(path[0])
-	if err != nil {invalidInput(response); return}
+// createUser adds a user at the next free id
+func createUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	incomingUser, ok := readUser(response, request)
+	if !ok {return}
+	incomingUser.Owner = claimsOf(request).ownerFor(incomingUser.Owner)
+
+	id, err := serv.userDb.AddNext(incomingUser)
+	if err != nil {logFor(response).Panic("Could not save user", "error", err)}
+	incomingUser.ID = id
+
+	logFor(response).Info("Created user", "id", id)
+	response.Header().Set("Location", userLocation(id))
+	writeJson(response, http.StatusCreated, incomingUser)
+}
 
-	http.MaxBytesReader(response, request.Body, 0xFFFF)
-	decoder := json.NewDecoder(request.Body)
-	decoder.DisallowUnknownFields() // strict mode
-	incomingUser := MyInputType{}
-	if err = decoder.Decode(&incomingUser); err != nil {
-												   warnLog.Printf("    Bad struct: %v\r\n", err)
-												   invalidInput(response)
-												   return
-												   } else {
-			infoLog.Printf("    Read struct: %v\r\n", incomingUser)
-			serv.userDb[id] = incomingUser
-		}
+// postUser adds a user at the id in the path, if there isn't one already
+func postUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	id := Params(request).Int("id")
+	incomingUser, ok := readUser(response, request)
+	if !ok {return}
+	if err := matchPathId(&incomingUser, request); err != nil {
+		invalidFields(err.(ValidationError), response)
+		return
+	}
+	incomingUser.Owner = claimsOf(request).ownerFor(incomingUser.Owner)
+
+	if err := serv.userDb.Add(id, incomingUser); err == UserIdTakenError {
+		conflict(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not save user", "error", err)
+	}
+
+	response.Header().Set("Location", userLocation(id))
+	writeJson(response, http.StatusCreated, incomingUser)
+}
+
+// replaceUser swaps an existing user for the one in the request
+func replaceUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	incomingUser, ok := readUser(response, request)
+	if !ok {return}
+	if err := matchPathId(&incomingUser, request); err != nil {
+		invalidFields(err.(ValidationError), response)
+		return
+	}
+
+	claims := claimsOf(request)
+	updated, err := serv.userDb.Update(Params(request).Int("id"), func(current MyInputType) (MyInputType, error) {
+		if !claims.CanUse(current.Owner, PermWriteOwnUser, PermWriteAnyUser) {return current, NotPermittedError}
+		incomingUser.Owner = claims.ownerFor(incomingUser.Owner)
+		return incomingUser, nil
+	})
+	if err == UserNotFoundError {
+		notFound(response)
+		return
+	} else if err == NotPermittedError {
+		forbidden(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not save user", "error", err)
+	}
+
+	writeJson(response, http.StatusOK, updated)
 }
 
-func getUser(serv *LittleServer, path []string, response http.ResponseWriter) {
-	if len(path) < 1 {
-		listAllUsers(serv, response)
+// patchUser changes an existing user with a JSON merge patch, like `{"age":23}`
+func patchUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType != mergePatchContentType && mediaType != "application/json" {
+		unsupportedMediaType(mergePatchContentType, response)
 		return
 	}
 
-	// parse next part as int, return it
-	if id,err:=strconv.Atoi(path[0]); err != nil{
+	patch, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxBodyBytes))
+	if err != nil {
+		invalidInput(response)
+		return
+	}
+
+	claims := claimsOf(request)
+	updated, err := serv.userDb.Update(Params(request).Int("id"), func(current MyInputType) (MyInputType, error) {
+		if !claims.CanUse(current.Owner, PermWriteOwnUser, PermWriteAnyUser) {return current, NotPermittedError}
+		currentJson, err := json.Marshal(current)
+		if err != nil {return current, err}
+		patched, err := applyMergePatch(currentJson, patch)
+		if err != nil {return current, err}
+
+		changed := MyInputType{}
+		decoder := json.NewDecoder(bytes.NewReader(patched))
+		decoder.DisallowUnknownFields() // strict mode, as for the other user endpoints
+		if err = decoder.Decode(&changed); err != nil {return current, err}
+		changed.Owner = claims.ownerFor(changed.Owner)
+		if err = matchPathId(&changed, request); err != nil {return current, err}
+		return changed, Validate(changed)
+	})
+	if err == UserNotFoundError {
+		notFound(response)
+		return
+	} else if err == NotPermittedError {
+		forbidden(response)
+		return
+	} else if fields, ok := err.(ValidationError); ok {
+		invalidFields(fields, response)
+		return
+	} else if err != nil {
+		logFor(response).Warn("Bad patch", "error", err)
 		invalidInput(response)
 		return
-	} else {
-		if userDetails,ok := serv.userDb[id]; !ok{
-			notFound(response)
-			return
-		} else {
-			if data, err2 := json.Marshal(userDetails); err2 != nil {
-				warnLog.Panicf("Json marshal failed: %v", err2)
-			} else {
-				pWrite(data, response)
-			}
-		}
 	}
+
+	writeJson(response, http.StatusOK, updated)
 }
 
-func listAllUsers(serv *LittleServer, response http.ResponseWriter) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(http.StatusOK)
+func deleteUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	claims := claimsOf(request)
+	err := serv.userDb.DeleteIf(Params(request).Int("id"), func(current MyInputType) error {
+		if !claims.CanUse(current.Owner, PermWriteOwnUser, PermWriteAnyUser) {return NotPermittedError}
+		return nil
+	})
+	if err == UserNotFoundError {
+		notFound(response)
+		return
+	} else if err == NotPermittedError {
+		forbidden(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not delete user", "error", err)
+	}
 
-	data, err := json.Marshal(serv.userDb)
-	if err != nil {warnLog.Panicf("Json marshal failed: %v",err)}
-	pWrite(data, response)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func getUser(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	userDetails, err := serv.userDb.Find(Params(request).Int("id"))
+	if err == UserNotFoundError {
+		notFound(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not read user", "error", err)
+	}
+	if !claimsOf(request).CanUse(userDetails.Owner, PermReadOwnUser, PermReadAnyUser) {
+		forbidden(response)
+		return
+	}
+
+	writeJson(response, http.StatusOK, userDetails)
+}
+
+func listAllUsers(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	users, err := serv.userDb.All()
+	if err != nil {logFor(response).Panic("Could not read users", "error", err)}
+
+	writeJson(response, http.StatusOK, users)
+}
+
+// readUser reads a user from the request body, or writes a 400 or 422 response
+func readUser(response http.ResponseWriter, request *http.Request) (MyInputType, bool) {
+	incomingUser := MyInputType{}
+	if !readValid(response, request, &incomingUser) {return incomingUser, false}
+
+	logFor(response).Debug("Read user", "user", incomingUser)
+	return incomingUser, true
+}
+
+// matchPathId checks a user's ID against the one in the path. An ID that wasn't given is taken from the path.
+func matchPathId(user *MyInputType, request *http.Request) error {
+	id := Params(request).Int("id")
+	if user.ID != 0 && user.ID != id {return ValidationError{{Field: "id", Message: "must match the id in the path"}}}
+	user.ID = id
+	return nil
+}
+
+func userLocation(id int) string {
+	return "/user/" + strconv.Itoa(id)
 }
 
 func homePage(response http.ResponseWriter) {
@@ -357,32 +839,58 @@ func picnic(response http.ResponseWriter) {
 //</editor-fold>
 
 //<editor-fold desc="Canned responses">
+// These all send the error shape in errors.go
 
 func unsupportedMethod(method string, response http.ResponseWriter) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(http.StatusMethodNotAllowed)
-	pWrite([]byte(`{"error":"http method not supported"}`), response)
-	warnLog.Printf("Attempt to use %s which is not supported on this path", method)
+	sendError(response, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "http method not supported")
+	logFor(response).Warn("Attempt to use a method which is not supported on this path", "method", method)
 }
 
 func notFound(response http.ResponseWriter) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(http.StatusNotFound)
-	pWrite([]byte(`{"error":"page not found"}`), response)
-	warnLog.Printf("Attempted to access an invalid path")
+	sendError(response, http.StatusNotFound, ErrCodeNotFound, "page not found")
+	logFor(response).Warn("Attempted to access an invalid path")
+}
+
+func conflict(response http.ResponseWriter) {
+	sendError(response, http.StatusConflict, ErrCodeConflict, "already exists")
+	logFor(response).Warn("User tried to create something that already exists")
+}
+
+func forbidden(response http.ResponseWriter) {
+	sendError(response, http.StatusForbidden, ErrCodeForbidden, "not allowed")
+	logFor(response).Warn("User tried to do something they are not allowed to")
+}
+
+func unsupportedMediaType(accepted string, response http.ResponseWriter) {
+	response.Header().Set("Accept-Patch", accepted)
+	sendError(response, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "content type not supported",
+		ErrorDetail{Message: "send " + accepted})
+	logFor(response).Warn("User sent a body in a format we don't accept")
+}
+
+func tooManyRequests(wait time.Duration, response http.ResponseWriter) {
+	seconds := int((wait + time.Second - 1) / time.Second) // round up, so retrying on time works
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(response, http.StatusTooManyRequests, ErrCodeTooManyRequests, "too many attempts, try again later",
+		ErrorDetail{Message: fmt.Sprintf("try again in %v", time.Duration(seconds)*time.Second)})
+	logFor(response).Warn("Login attempts are being throttled", "retry_after_s", seconds)
 }
 
 func invalidInput(response http.ResponseWriter) {
-	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(http.StatusBadRequest)
-	pWrite([]byte(`{"error":"input is invalid"}`), response)
-	warnLog.Printf("User supplied malformed input")
+	sendError(response, http.StatusBadRequest, ErrCodeInvalidInput, "input is invalid")
+	logFor(response).Warn("User supplied malformed input")
+}
+
+// invalidFields is for input that could be read, but broke the rules in its `validate` tags
+func invalidFields(fields ValidationError, response http.ResponseWriter) {
+	sendError(response, http.StatusUnprocessableEntity, ErrCodeValidationFailed, "input failed validation", fields...)
+	logFor(response).Warn("User supplied input that failed validation", "fields", len(fields))
 }
 
 func sendIcon(response http.ResponseWriter) {
 	response.Header().Set("Content-Type", "image/svg+xml")
 	response.WriteHeader(http.StatusOK)
 	_, err := response.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><svg version="1.1" viewBox="0 0 48 48" xmlns="http://www.w3.org/2000/svg"><circle cx="24" cy="24" r="18" fill="#5b86bf"/></svg>`))
-	if err != nil {warnLog.Panicf("Failed to write favicon: %v",err)}
+	if err != nil {logFor(response).Panic("Failed to write favicon", "error", err)}
 }
 //</editor-fold>
\ No newline at end of file
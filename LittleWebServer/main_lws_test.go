@@ -16,15 +16,15 @@ func TestScanning(t *testing.T){
 }
 
 func TestPasswordProtection(t *testing.T){
-	server :=  &LittleServer{userDb: map[int]MyInputType{}}
+	server :=  &LittleServer{userDb: NewMemoryUserRepository()}
 	server.SetUpLogging(false, false)
-	server.userDb[0] = MyInputType{
+	_ = server.userDb.Save(0, MyInputType{
 		ID:   123,
 		Name: "Test user",
 		Age:  22,
-	}
+	})
 
-	expectedRejection := `{"error":"must provide token cookie"}`
+	expectedRejection := `{"error":"must provide token cookie","code":"unauthorized"}`
 	expectedSuccess := `{"id":123,"name":"Test user","age":22}`
 	loginString := `{ "username": "ieb", "password": "correct" }`
 
@@ -65,11 +65,121 @@ func TestPasswordProtection(t *testing.T){
 	}
 }
 
+func TestRegisterAndChangePassword(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+
+	send := func(path, body, cookie string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "http://localhost:6080"+path, strings.NewReader(body))
+		if cookie != "" {request.Header.Set("Cookie", cookie)}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	// Register a new user, but only once
+	response := send("/register", `{"username":"sam","password":"first password"}`, "")
+	if response.Code != http.StatusCreated {t.Errorf("Expected %d, but got %d", http.StatusCreated, response.Code)}
+	response = send("/register", `{"username":"sam","password":"other password"}`, "")
+	if response.Code != http.StatusConflict {t.Errorf("Expected %d, but got %d", http.StatusConflict, response.Code)}
+	response = send("/register", `{"username":"ieb","password":"other password"}`, "")
+	if response.Code != http.StatusConflict {t.Errorf("Expected the dev user to exist, but got %d", response.Code)}
+
+	// Bad names and short passwords are rejected
+	response = send("/register", `{"username":"bad name","password":"first password"}`, "")
+	if response.Code != http.StatusBadRequest {t.Errorf("Expected %d, but got %d", http.StatusBadRequest, response.Code)}
+	response = send("/register", `{"username":"kim","password":"short"}`, "")
+	if response.Code != http.StatusBadRequest {t.Errorf("Expected %d, but got %d", http.StatusBadRequest, response.Code)}
+
+	// Log in as the new user
+	response = send("/login", `{"username":"sam","password":"first password"}`, "")
+	if response.Code != http.StatusOK {t.Fatalf("Expected %d, but got %d", http.StatusOK, response.Code)}
+	cookieValue := response.Header().Get("Set-Cookie")
+
+	// Changing the password needs a token, and the current password
+	response = send("/password", `{"oldPassword":"first password","newPassword":"second password"}`, "")
+	if response.Code != http.StatusUnauthorized {t.Errorf("Expected %d, but got %d", http.StatusUnauthorized, response.Code)}
+	response = send("/password", `{"oldPassword":"wrong password","newPassword":"second password"}`, cookieValue)
+	if response.Code != http.StatusForbidden {t.Errorf("Expected %d, but got %d", http.StatusForbidden, response.Code)}
+	response = send("/password", `{"oldPassword":"first password","newPassword":"second password"}`, cookieValue)
+	if response.Code != http.StatusOK {t.Errorf("Expected %d, but got %d", http.StatusOK, response.Code)}
+
+	// Only the new password works now
+	response = send("/login", `{"username":"sam","password":"first password"}`, "")
+	if response.Code != http.StatusBadRequest {t.Errorf("Expected the old password to fail, but got %d", response.Code)}
+	response = send("/login", `{"username":"sam","password":"second password"}`, "")
+	if response.Code != http.StatusOK {t.Errorf("Expected the new password to work, but got %d", response.Code)}
+
+	// Unknown users look the same as wrong passwords
+	response = send("/login", `{"username":"nobody","password":"second password"}`, "")
+	if response.Code != http.StatusBadRequest {t.Errorf("Expected %d, but got %d", http.StatusBadRequest, response.Code)}
+}
+
+func TestUserCrud(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	cookieValue := logIn(t, server, devUsername, devPassword)
+
+	send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, "http://localhost:6080"+path, strings.NewReader(body))
+		request.Header.Set("Cookie", cookieValue)
+		if contentType != "" {request.Header.Set("Content-Type", contentType)}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+	expect := func(response *httptest.ResponseRecorder, code int, body string) {
+		t.Helper()
+		if response.Code != code {t.Errorf("Expected %d, but got %d", code, response.Code)}
+		if actual := response.Body.String(); actual != body {t.Errorf("Expected '%s', but got '%s'", body, actual)}
+		if body != "" && response.Header().Get("Content-Type") != "application/json" {t.Errorf("Expected a JSON content type, but got '%s'", response.Header().Get("Content-Type"))}
+	}
+
+	// Create with a server-assigned id
+	response := send(http.MethodPost, "/user", "", `{"name":"Sam","age":30}`)
+	expect(response, http.StatusCreated, `{"id":0,"name":"Sam","age":30}`)
+	if location := response.Header().Get("Location"); location != "/user/0" {t.Errorf("Expected '/user/0', but got '%s'", location)}
+
+	// Create at a given id, but only once
+	response = send(http.MethodPost, "/user/7", "", `{"id":7,"name":"Kim","age":40}`)
+	expect(response, http.StatusCreated, `{"id":7,"name":"Kim","age":40}`)
+	if location := response.Header().Get("Location"); location != "/user/7" {t.Errorf("Expected '/user/7', but got '%s'", location)}
+	expect(send(http.MethodPost, "/user/7", "", `{"id":7,"name":"Lee","age":50}`), http.StatusConflict, `{"error":"already exists","code":"conflict"}`)
+
+	expect(send(http.MethodGet, "/user/7", "", ""), http.StatusOK, `{"id":7,"name":"Kim","age":40}`)
+
+	// Replace
+	expect(send(http.MethodPut, "/user/7", "", `{"id":7,"name":"Kim Smith","age":41}`), http.StatusOK, `{"id":7,"name":"Kim Smith","age":41}`)
+	expect(send(http.MethodPut, "/user/8", "", `{"id":8,"name":"Nobody","age":1}`), http.StatusNotFound, `{"error":"page not found","code":"not_found"}`)
+	expect(send(http.MethodPut, "/user/7", "", `{"id":7,"shoeSize":9}`), http.StatusBadRequest, `{"error":"input is invalid","code":"invalid_input"}`)
+
+	// Merge patch: only the fields given change, and null clears a field (but the result must still be valid)
+	expect(send(http.MethodPatch, "/user/7", "application/merge-patch+json", `{"age":42}`), http.StatusOK, `{"id":7,"name":"Kim Smith","age":42}`)
+	expect(send(http.MethodPatch, "/user/7", "application/json", `{"name":null}`), http.StatusUnprocessableEntity, `{"error":"input failed validation","code":"validation_failed","details":[{"field":"name","message":"is required"}]}`)
+	expect(send(http.MethodPatch, "/user/7", "application/merge-patch+json", `{"shoeSize":9}`), http.StatusBadRequest, `{"error":"input is invalid","code":"invalid_input"}`)
+	expect(send(http.MethodPatch, "/user/7", "application/merge-patch+json", `{"age":"old"}`), http.StatusBadRequest, `{"error":"input is invalid","code":"invalid_input"}`)
+	expect(send(http.MethodPatch, "/user/8", "application/merge-patch+json", `{"age":1}`), http.StatusNotFound, `{"error":"page not found","code":"not_found"}`)
+	response = send(http.MethodPatch, "/user/7", "text/plain", `{"age":1}`)
+	expect(response, http.StatusUnsupportedMediaType, `{"error":"content type not supported","code":"unsupported_media_type","details":[{"message":"send application/merge-patch+json"}]}`)
+	if accepted := response.Header().Get("Accept-Patch"); accepted != "application/merge-patch+json" {t.Errorf("Expected 'application/merge-patch+json', but got '%s'", accepted)}
+
+	// Delete
+	expect(send(http.MethodDelete, "/user/7", "", ""), http.StatusNoContent, "")
+	expect(send(http.MethodDelete, "/user/7", "", ""), http.StatusNotFound, `{"error":"page not found","code":"not_found"}`)
+	expect(send(http.MethodGet, "/user/7", "", ""), http.StatusNotFound, `{"error":"page not found","code":"not_found"}`)
+
+	expect(send(http.MethodGet, "/user", "", ""), http.StatusOK, `{"0":{"id":0,"name":"Sam","age":30}}`)
+
+	// Methods that don't exist for a path are listed
+	response = send(http.MethodDelete, "/user", "", "")
+	if allow := response.Header().Get("Allow"); response.Code != http.StatusMethodNotAllowed || allow != "GET, POST" {t.Errorf("Expected a 405 allowing 'GET, POST', but got %d '%s'", response.Code, allow)}
+}
+
 func TestInvalidHttpMethods(t *testing.T) {
 	server := &LittleServer{}
 	server.SetUpLogging(false, false)
 
-	expected := `{"error":"http method not supported"}`
+	expected := `{"error":"http method not supported","code":"method_not_allowed"}`
 
 	notHandled := []string{
 		http.MethodConnect,
@@ -106,7 +216,7 @@ func TestLittleServer_ServeHTTP(t *testing.T) {
 
 		server.ServeHTTP(response, request)
 
-		expected := `{"error":"page not found"}`
+		expected := `{"error":"page not found","code":"not_found"}`
 		actual := response.Body.String()
 
 		if actual != expected {
@@ -128,4 +238,13 @@ func BenchmarkCallingServer(b *testing.B) {
 	}
 }
 
+func logIn(t *testing.T, server *LittleServer, username, password string) string {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost:6080/login", strings.NewReader(fmt.Sprintf(`{"username":%q,"password":%q}`, username, password)))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {t.Fatalf("Could not log in as '%s': %d %s", username, response.Code, response.Body.String())}
+	return response.Header().Get("Set-Cookie")
+}
+
 func startsWith(haystack, needle string)bool{return strings.Index(haystack, needle) == 0 }
\ No newline at end of file
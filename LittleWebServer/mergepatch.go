@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// JSON merge patches (RFC 7396) describe a change by example: every member of the patch replaces
+// the same member of the target, objects are merged member by member, and `null` removes a member.
+//
+//     target {"name":"Sam","age":30}  +  patch {"age":31,"name":null}  =>  {"age":31}
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// applyMergePatch returns `target` (a JSON document) changed by `patch`
+func applyMergePatch(target, patch []byte) ([]byte, error) {
+	var targetValue, patchValue interface{}
+	if err := decodeExact(target, &targetValue); err != nil {return nil, err}
+	if err := decodeExact(patch, &patchValue); err != nil {return nil, err}
+
+	return json.Marshal(mergeValue(targetValue, patchValue))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {return patch} // anything but an object replaces the target outright
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {targetObject = map[string]interface{}{}}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergeValue(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// decodeExact reads a single JSON value, keeping numbers exact
+func decodeExact(data []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(target)
+}
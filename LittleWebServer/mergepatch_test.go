@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestMergePatchExamplesFromTheRfc(t *testing.T){
+	// RFC 7396, appendix A
+	examples := []struct{ target, patch, expected string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, example := range examples {
+		actual, err := applyMergePatch([]byte(example.target), []byte(example.patch))
+		if err != nil || string(actual) != example.expected {
+			t.Errorf("Expected '%v', but got '%s' (%v) for %s + %s", example.expected, actual, err, example.target, example.patch)
+		}
+	}
+}
+
+func TestMergePatchKeepsNumbersExact(t *testing.T){
+	actual, err := applyMergePatch([]byte(`{"big":9007199254740993}`), []byte(`{"small":0.1}`))
+	if err != nil || string(actual) != `{"big":9007199254740993,"small":0.1}` {t.Errorf("Expected the numbers unchanged, but got '%s' (%v)", actual, err)}
+
+	if _, err = applyMergePatch([]byte(`{}`), []byte(`{"a":`)); err == nil {t.Errorf("Expected a bad patch to fail")}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /metrics serves the server's metrics in the Prometheus text format (version 0.0.4), for scraping:
+//
+//     lws_http_requests_total{method,route,status}            requests answered
+//     lws_http_request_duration_seconds{method,route,status}  histogram of how long they took
+//     lws_http_requests_in_flight                             requests being answered right now
+//     lws_logins_total{result}                                logins that succeeded, failed, or were throttled
+//     go_... and process_...                                  runtime stats, read at each scrape
+//
+// `route` is the pattern that matched (like "/user/{id:int}"), not the path, so there's a fixed number of
+// series however many ids are asked for. Requests that match no route are counted under "none". Likewise
+// `method` is "other" for anything but the standard methods, as net/http lets clients send any word.
+//
+// There's no login on /metrics, as scrapers can't easily use our cookies. It says nothing about users, but
+// if the server is reachable from outside, block /metrics at the edge.
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration histogram (the Prometheus defaults)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const (
+	LoginSucceeded = "success"
+	LoginFailed    = "failure"
+	LoginThrottled = "throttled"
+)
+
+// Metrics are everything /metrics reports. It is safe for concurrent use.
+type Metrics struct {
+	requests *CounterVec
+	duration *HistogramVec
+	inFlight *Gauge
+	logins   *CounterVec
+	started  time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: NewCounterVec("lws_http_requests_total", "HTTP requests answered.", "method", "route", "status"),
+		duration: NewHistogramVec("lws_http_request_duration_seconds", "Time taken to answer HTTP requests.", latencyBuckets, "method", "route", "status"),
+		inFlight: NewGauge("lws_http_requests_in_flight", "HTTP requests being answered."),
+		logins:   NewCounterVec("lws_logins_total", "Login attempts, by result.", "result"),
+		started:  time.Now(),
+	}
+}
+
+// observeRequest counts an answered request
+func (metrics *Metrics) observeRequest(method, route string, status int, took time.Duration) {
+	if route == "" {route = "none"}
+	method = methodLabel(method)
+	statusText := strconv.Itoa(status)
+	metrics.requests.Inc(method, route, statusText)
+	metrics.duration.Observe(took.Seconds(), method, route, statusText)
+}
+
+// methodLabel keeps made-up methods from adding series without limit
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// WriteTo writes every metric in the text format
+func (metrics *Metrics) WriteTo(out io.Writer) (int64, error) {
+	buffer := &bytes.Buffer{}
+	metrics.requests.writeTo(buffer)
+	metrics.duration.writeTo(buffer)
+	metrics.inFlight.writeTo(buffer)
+	metrics.logins.writeTo(buffer)
+	writeRuntimeMetrics(buffer, metrics.started)
+	return buffer.WriteTo(out)
+}
+
+// measureRequests keeps the request metrics. It should be the outermost middleware, so it times everything.
+func (serv *LittleServer)measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		serv.metrics.inFlight.Add(1)
+		started := time.Now()
+		measured := &measuredResponse{ResponseWriter: response}
+		request, route := noteRoute(request)
+
+		finished := false
+		defer func() {
+			status := measured.status
+			if status == 0 {status = http.StatusOK}
+			if !finished {status = http.StatusInternalServerError} // a panic on its way out
+			serv.metrics.observeRequest(request.Method, route.pattern, status, time.Since(started))
+			serv.metrics.inFlight.Add(-1)
+		}()
+
+		next.ServeHTTP(measured, request)
+		finished = true
+	})
+}
+
+// measuredResponse notes the status sent
+type measuredResponse struct {
+	http.ResponseWriter
+	status int
+}
+
+func (measured *measuredResponse) WriteHeader(status int) {
+	if measured.status == 0 {measured.status = status}
+	measured.ResponseWriter.WriteHeader(status)
+}
+
+func (measured *measuredResponse) Flush() {
+	if flusher, ok := measured.ResponseWriter.(http.Flusher); ok {flusher.Flush()}
+}
+
+func (measured *measuredResponse) Unwrap() http.ResponseWriter {return measured.ResponseWriter}
+
+func sendMetrics(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", metricsContentType)
+	response.WriteHeader(http.StatusOK)
+	if _, err := serv.metrics.WriteTo(response); err != nil {logFor(response).Warn("Could not send metrics", "error", err)}
+}
+
+//<editor-fold desc="Metric types">
+
+// CounterVec is a set of counters, one for each combination of label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+	lock       sync.Mutex
+	values     map[string]float64 // by joined label values
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Inc adds one to the counter with these label values, which must be in the order the labels were given
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *CounterVec) Add(amount float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.values[key] += amount
+}
+
+// Value is the count with these label values
+func (counter *CounterVec) Value(labelValues ...string) float64 {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	return counter.values[seriesKey(labelValues)]
+}
+
+func (counter *CounterVec) writeTo(buffer *bytes.Buffer) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	writeHeader(buffer, counter.name, counter.help, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		writeSample(buffer, counter.name, labelText(counter.labels, splitSeriesKey(key)), counter.values[key])
+	}
+}
+
+// Gauge is a single value that goes up and down
+type Gauge struct {
+	name, help string
+	value      int64
+}
+
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+func (gauge *Gauge) Add(amount int64) {atomic.AddInt64(&gauge.value, amount)}
+func (gauge *Gauge) Value() int64     {return atomic.LoadInt64(&gauge.value)}
+
+func (gauge *Gauge) writeTo(buffer *bytes.Buffer) {
+	writeHeader(buffer, gauge.name, gauge.help, "gauge")
+	writeSample(buffer, gauge.name, "", float64(gauge.Value()))
+}
+
+// HistogramVec is a set of histograms, one for each combination of label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending. +Inf is implied.
+	lock       sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative; the last is for +Inf
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe adds a value to the histogram with these label values
+func (vec *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	series, ok := vec.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(vec.buckets)+1)}
+		vec.series[key] = series
+	}
+	series.counts[sort.SearchFloat64s(vec.buckets, value)]++ // the first bucket with a bound >= value
+	series.sum += value
+}
+
+func (vec *HistogramVec) writeTo(buffer *bytes.Buffer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	writeHeader(buffer, vec.name, vec.help, "histogram")
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {keys = append(keys, key)}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series, labelValues := vec.series[key], splitSeriesKey(key)
+		labels := labelText(vec.labels, labelValues)
+
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			bound := "+Inf"
+			if i < len(vec.buckets) {bound = formatFloat(vec.buckets[i])}
+			writeSample(buffer, vec.name+"_bucket", labelText(append(append([]string{}, vec.labels...), "le"), append(append([]string{}, labelValues...), bound)), float64(cumulative))
+		}
+		writeSample(buffer, vec.name+"_sum", labels, series.sum)
+		writeSample(buffer, vec.name+"_count", labels, float64(cumulative))
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Runtime stats">
+
+func writeRuntimeMetrics(buffer *bytes.Buffer, started time.Time) {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+
+	single := func(name, help, kind string, value float64) {
+		writeHeader(buffer, name, help, kind)
+		writeSample(buffer, name, "", value)
+	}
+	single("go_goroutines", "Goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine()))
+	writeHeader(buffer, "go_info", "Information about the Go environment.", "gauge")
+	writeSample(buffer, "go_info", labelText([]string{"version"}, []string{runtime.Version()}), 1)
+	single("go_memstats_alloc_bytes", "Bytes allocated and still in use.", "gauge", float64(stats.Alloc))
+	single("go_memstats_alloc_bytes_total", "Bytes allocated, even if freed.", "counter", float64(stats.TotalAlloc))
+	single("go_memstats_sys_bytes", "Bytes obtained from the system.", "gauge", float64(stats.Sys))
+	single("go_memstats_heap_inuse_bytes", "Heap bytes in use.", "gauge", float64(stats.HeapInuse))
+	single("go_memstats_heap_objects", "Objects allocated on the heap.", "gauge", float64(stats.HeapObjects))
+	single("go_memstats_mallocs_total", "Heap objects allocated.", "counter", float64(stats.Mallocs))
+	single("go_memstats_frees_total", "Heap objects freed.", "counter", float64(stats.Frees))
+	single("go_memstats_gc_cpu_fraction", "Fraction of CPU time used by the garbage collector since the program started.", "gauge", stats.GCCPUFraction)
+	single("go_gc_cycles_total", "Completed garbage collection cycles.", "counter", float64(stats.NumGC))
+	single("go_gc_pause_seconds_total", "Time the world was stopped for garbage collection.", "counter", float64(stats.PauseTotalNs)/1e9)
+	single("go_memstats_last_gc_time_seconds", "When the last garbage collection finished, in seconds since the epoch.", "gauge", float64(stats.LastGC)/1e9)
+	single("process_start_time_seconds", "When the server started, in seconds since the epoch.", "gauge", float64(started.UnixNano())/1e9)
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Text format">
+
+// series keys join label values with a byte that can't be in valid UTF-8 text
+const seriesSeparator = "\xff"
+
+func seriesKey(labelValues []string) string {return strings.Join(labelValues, seriesSeparator)}
+
+func splitSeriesKey(key string) []string {return strings.Split(key, seriesSeparator)}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {keys = append(keys, key)}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(buffer *bytes.Buffer, name, help, kind string) {
+	buffer.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	buffer.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeSample(buffer *bytes.Buffer, name, labels string, value float64) {
+	buffer.WriteString(name + labels + " " + formatFloat(value) + "\n")
+}
+
+// labelText is `{name="value",...}`, or "" if there are no labels
+func labelText(names, values []string) string {
+	if len(names) < 1 {return ""}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {value = values[i]}
+		parts[i] = name + `="` + escape.Replace(value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1): return "+Inf"
+	case math.IsInf(value, -1): return "-Inf"
+	case math.IsNaN(value): return "NaN"
+	default: return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+//</editor-fold>
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounterAndGaugeFormat(t *testing.T){
+	counter := NewCounterVec("things_total", "Things.\nCounted.", "kind", "path")
+	counter.Inc("b", "/x")
+	counter.Add(2.5, "a", `say "hi"\`)
+	counter.Inc("b", "/x")
+
+	gauge := NewGauge("busy", "Busy things.")
+	gauge.Add(3)
+	gauge.Add(-1)
+
+	buffer := &bytes.Buffer{}
+	counter.writeTo(buffer)
+	gauge.writeTo(buffer)
+
+	expected := `# HELP things_total Things.\nCounted.
+# TYPE things_total counter
+things_total{kind="a",path="say \"hi\"\\"} 2.5
+things_total{kind="b",path="/x"} 2
+# HELP busy Busy things.
+# TYPE busy gauge
+busy 2
+`
+	if buffer.String() != expected {t.Errorf("Expected '%s', but got '%s'", expected, buffer.String())}
+}
+
+func TestHistogramFormat(t *testing.T){
+	histogram := NewHistogramVec("took_seconds", "Time taken.", []float64{0.1, 1}, "route")
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.Observe(value, "/a")
+	}
+
+	buffer := &bytes.Buffer{}
+	histogram.writeTo(buffer)
+
+	// buckets are cumulative, and a value on a bound goes in that bound's bucket
+	expected := `# HELP took_seconds Time taken.
+# TYPE took_seconds histogram
+took_seconds_bucket{route="/a",le="0.1"} 2
+took_seconds_bucket{route="/a",le="1"} 3
+took_seconds_bucket{route="/a",le="+Inf"} 4
+took_seconds_sum{route="/a"} 3.65
+took_seconds_count{route="/a"} 4
+`
+	if buffer.String() != expected {t.Errorf("Expected '%s', but got '%s'", expected, buffer.String())}
+}
+
+func TestMetricsAreSafeForConcurrentUse(t *testing.T){
+	metrics := NewMetrics()
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				metrics.inFlight.Add(1)
+				metrics.observeRequest("GET", "/", 200, time.Millisecond)
+				metrics.inFlight.Add(-1)
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			_, _ = metrics.WriteTo(&bytes.Buffer{})
+		}()
+	}
+	wait.Wait()
+
+	if count := metrics.requests.Value("GET", "/", "200"); count != 800 {t.Errorf("Expected 800, but got %v", count)}
+	if busy := metrics.inFlight.Value(); busy != 0 {t.Errorf("Expected 0, but got %v", busy)}
+}
+
+func TestMetricsEndpoint(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	send := func(method, url, body, cookie string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, url, strings.NewReader(body))
+		if cookie != "" {request.Header.Set("Cookie", cookie)}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	login := send(http.MethodPost, "/login", `{"username":"ieb","password":"correct"}`, "")
+	send(http.MethodPost, "/login", `{"username":"ieb","password":"wrong"}`, "")
+	cookie := login.Header().Get("Set-Cookie")
+	send(http.MethodGet, "/user/1", "", cookie)
+	send(http.MethodGet, "/user/2", "", cookie)
+	send(http.MethodGet, "/nowhere", "", "")
+	send("BREW", "/nowhere", "", "")
+	send("FROB", "/user/1", "", cookie)
+
+	response := send(http.MethodGet, "/metrics", "", "")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != metricsContentType {t.Fatalf("Unexpected response %d %v", response.Code, response.Header())}
+
+	body := response.Body.String()
+	for _, line := range []string{
+		`lws_http_requests_total{method="POST",route="/login",status="200"} 1`,
+		`lws_http_requests_total{method="POST",route="/login",status="400"} 1`,
+		`lws_http_requests_total{method="GET",route="/user/{id:int}",status="404"} 2`, // by route, not by path
+		`lws_http_requests_total{method="GET",route="none",status="404"} 1`,
+		`lws_http_requests_total{method="other",route="none",status="404"} 1`, // made-up methods share a series
+		`lws_http_requests_total{method="other",route="none",status="405"} 1`,
+		`lws_http_request_duration_seconds_count{method="GET",route="/user/{id:int}",status="404"} 2`,
+		`lws_http_request_duration_seconds_bucket{method="GET",route="/user/{id:int}",status="404",le="+Inf"} 2`,
+		`lws_http_requests_in_flight 1`, // this scrape
+		`lws_logins_total{result="success"} 1`,
+		`lws_logins_total{result="failure"} 1`,
+		"# TYPE go_goroutines gauge",
+		"# TYPE go_memstats_alloc_bytes gauge",
+		"# TYPE process_start_time_seconds gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {t.Errorf("Expected '%s' in the metrics", line)}
+	}
+	if strings.Contains(body, "BREW") || strings.Contains(body, "FROB") {t.Errorf("Expected no series for made-up methods")}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// Each user has a list of roles (kept in the CredentialStore), and each role grants a set of permissions.
+// Both go into the access token when it's made, so a change of roles applies from the next login or refresh.
+//
+// User records have an owner. Anyone with an `...Own` permission can use it on the records they own;
+// the `...Any` permissions cover everyone's records.
+
+var NotPermittedError = errors.New("the token does not allow that")
+
+const (
+	PermReadOwnUser  = "users:read:own"
+	PermWriteOwnUser = "users:write:own"
+	PermReadAnyUser  = "users:read:any"
+	PermWriteAnyUser = "users:write:any"
+	PermListUsers    = "users:list"
+	PermManageRoles  = "roles:manage"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// rolePermissions lists every role there is, and what it allows
+var rolePermissions = map[string][]string{
+	RoleUser:  {PermReadOwnUser, PermWriteOwnUser},
+	RoleAdmin: {PermReadOwnUser, PermWriteOwnUser, PermReadAnyUser, PermWriteAnyUser, PermListUsers, PermManageRoles},
+}
+
+type RoleChange struct {
+	Roles []string `json:"roles"`
+}
+
+// permissionsFor combines the permissions of some roles, in sorted order. Unknown roles add nothing.
+func permissionsFor(roles []string) []string {
+	seen := map[string]bool{}
+	var permissions []string
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			if seen[permission] {continue}
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+func knownRoles(roles []string) bool {
+	for _, role := range roles {
+		if _, ok := rolePermissions[role]; !ok {return false}
+	}
+	return true
+}
+
+// Can is true if the token grants `permission`
+func (claims *Claims) Can(permission string) bool {
+	if claims == nil {return false}
+	for _, granted := range claims.Permissions {
+		if granted == permission {return true}
+	}
+	return false
+}
+
+// CanUse is true if the token allows the `own` permission on a record owned by `owner`, or the `any` permission
+func (claims *Claims) CanUse(owner string, own, any string) bool {
+	if claims.Can(any) {return true}
+	return owner != "" && owner == claims.Username && claims.Can(own)
+}
+
+// ownerFor decides who owns a record being written: whoever was asked for, if the token can write anyone's records,
+// otherwise the token's own user
+func (claims *Claims) ownerFor(requested string) string {
+	if claims.Can(PermWriteAnyUser) {return requested}
+	return claims.Username
+}
+
+// RequirePermission only lets requests through if their token grants `permission`. Use it after `requireAuth`.
+func RequirePermission(permission string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if !claimsOf(request).Can(permission) {
+				forbidden(response)
+				return
+			}
+			next.ServeHTTP(response, request)
+		})
+	}
+}
+
+// setRoles replaces the roles of the user named in the path
+func setRoles(serv *LittleServer, response http.ResponseWriter, request *http.Request) {
+	change := RoleChange{}
+	if err := readJson(response, request, &change); err != nil || !knownRoles(change.Roles) {
+		invalidInput(response)
+		return
+	}
+	if change.Roles == nil {change.Roles = []string{}}
+
+	username := Params(request).String("username")
+	if err := serv.credentials.SetRoles(username, change.Roles); err == UnknownUserError {
+		notFound(response)
+		return
+	} else if err != nil {
+		logFor(response).Panic("Could not store roles", "error", err)
+	}
+
+	logFor(response).Info("Roles changed", "by", claimsOf(request).Username, "user", username, "roles", change.Roles)
+	writeJson(response, http.StatusOK, RoleChange{Roles: change.Roles})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPermissionsForRoles(t *testing.T){
+	if permissions := strings.Join(permissionsFor([]string{RoleUser}), ","); permissions != "users:read:own,users:write:own" {
+		t.Errorf("Expected 'users:read:own,users:write:own', but got '%v'", permissions)
+	}
+	if permissions := permissionsFor([]string{RoleUser, RoleAdmin, "nonsense"}); len(permissions) != 6 {t.Errorf("Expected 6 permissions, but got %v", permissions)}
+	if permissions := permissionsFor(nil); len(permissions) != 0 {t.Errorf("Expected no permissions, but got %v", permissions)}
+
+	if !knownRoles([]string{RoleUser, RoleAdmin}) || knownRoles([]string{RoleUser, "root"}) {t.Errorf("Expected only real roles to be known")}
+}
+
+func TestClaimsCanUseRecords(t *testing.T){
+	sam := &Claims{Username: "sam", Permissions: permissionsFor([]string{RoleUser})}
+	admin := &Claims{Username: "ieb", Permissions: permissionsFor([]string{RoleAdmin})}
+	var nobody *Claims
+
+	if !sam.CanUse("sam", PermReadOwnUser, PermReadAnyUser) {t.Errorf("Expected sam to read their own record")}
+	if sam.CanUse("kim", PermReadOwnUser, PermReadAnyUser) {t.Errorf("Expected sam not to read kim's record")}
+	if sam.CanUse("", PermReadOwnUser, PermReadAnyUser) {t.Errorf("Expected sam not to read records with no owner")}
+	if !admin.CanUse("kim", PermWriteOwnUser, PermWriteAnyUser) {t.Errorf("Expected admins to change anyone's record")}
+	if nobody.CanUse("", PermReadOwnUser, PermReadAnyUser) {t.Errorf("Expected no claims to allow nothing")}
+
+	if owner := sam.ownerFor("kim"); owner != "sam" {t.Errorf("Expected 'sam', but got '%v'", owner)}
+	if owner := admin.ownerFor("kim"); owner != "kim" {t.Errorf("Expected 'kim', but got '%v'", owner)}
+}
+
+func TestUsersOnlyReachTheirOwnRecords(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	admin := newTokenClient(t, server)
+	expectCode(t, admin.send(http.MethodPost, "/user/0", `{"id":0,"name":"Admin's record","age":50}`), http.StatusCreated, "admin create")
+
+	expectCode(t, admin.send(http.MethodPost, "/register", `{"username":"sam","password":"sam's password"}`), http.StatusCreated, "register")
+	sam := &tokenClient{t: t, server: server, cookies: map[string]string{}}
+	expectCode(t, sam.send(http.MethodPost, "/login", `{"username":"sam","password":"sam's password"}`), http.StatusOK, "login")
+
+	// records a user makes are theirs, whatever they ask for
+	response := sam.send(http.MethodPost, "/user", `{"name":"Sam","age":30,"owner":"ieb"}`)
+	expectCode(t, response, http.StatusCreated, "create own")
+	if body := response.Body.String(); body != `{"id":1,"name":"Sam","age":30,"owner":"sam"}` {t.Errorf("Expected sam to own the record, but got '%s'", body)}
+
+	expectCode(t, sam.send(http.MethodGet, "/user/1", ""), http.StatusOK, "read own")
+	expectCode(t, sam.send(http.MethodPut, "/user/1", `{"id":1,"name":"Sam","age":31,"owner":"ieb"}`), http.StatusOK, "replace own")
+	if user, _ := server.userDb.Find(1); user.Owner != "sam" || user.Age != 31 {t.Errorf("Expected sam to still own the record, but got '%v'", user)}
+
+	// but nobody else's
+	expectCode(t, sam.send(http.MethodGet, "/user/0", ""), http.StatusForbidden, "read other")
+	expectCode(t, sam.send(http.MethodPut, "/user/0", `{"id":0,"name":"Mine now","age":1}`), http.StatusForbidden, "replace other")
+	expectCode(t, sam.send(http.MethodDelete, "/user/0", ""), http.StatusForbidden, "delete other")
+	expectCode(t, sam.send(http.MethodGet, "/user", ""), http.StatusForbidden, "list")
+	expectCode(t, sam.send(http.MethodPut, "/account/sam/roles", `{"roles":["admin"]}`), http.StatusForbidden, "promote self")
+	if user, _ := server.userDb.Find(0); user.Name != "Admin's record" {t.Errorf("Expected the admin's record to be unchanged, but got '%v'", user)}
+
+	// admins can do all of that
+	expectCode(t, admin.send(http.MethodGet, "/user", ""), http.StatusOK, "admin list")
+	expectCode(t, admin.send(http.MethodGet, "/user/1", ""), http.StatusOK, "admin read")
+	response = admin.send(http.MethodPut, "/user/1", `{"id":1,"name":"Sam","age":32,"owner":"kim"}`)
+	if body := response.Body.String(); body != `{"id":1,"name":"Sam","age":32,"owner":"kim"}` {t.Errorf("Expected admins to change the owner, but got '%s'", body)}
+	expectCode(t, sam.send(http.MethodGet, "/user/1", ""), http.StatusForbidden, "read given away")
+
+	// roles can be changed by admins, and apply from the next refresh
+	expectCode(t, admin.send(http.MethodPut, "/account/sam/roles", `{"roles":["root"]}`), http.StatusBadRequest, "unknown role")
+	expectCode(t, admin.send(http.MethodPut, "/account/nobody/roles", `{"roles":["admin"]}`), http.StatusNotFound, "unknown user")
+	response = admin.send(http.MethodPut, "/account/sam/roles", `{"roles":["user","admin"]}`)
+	expectCode(t, response, http.StatusOK, "promote")
+	if body := response.Body.String(); body != `{"roles":["user","admin"]}` {t.Errorf("Expected the new roles, but got '%s'", body)}
+
+	expectCode(t, sam.send(http.MethodGet, "/user", ""), http.StatusForbidden, "list before refresh")
+	expectCode(t, sam.send(http.MethodPost, "/refresh", ""), http.StatusOK, "refresh")
+	expectCode(t, sam.send(http.MethodGet, "/user", ""), http.StatusOK, "list after refresh")
+	expectCode(t, sam.send(http.MethodDelete, "/user/0", ""), http.StatusNoContent, "delete as admin")
+}
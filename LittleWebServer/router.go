@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Router picks a handler by method and path. Patterns are split on '/', and each part is either
+// literal text or a parameter in braces, with an optional type:
+//
+//     GET /user/{id:int}    matches /user/12, and the handler reads `Params(request).Int("id")`
+//     GET /files/{name}     a string parameter, matching any one part of the path
+//
+// Routes are tried in the order they were added. If the path matches but the method doesn't, the
+// response is a 405 with an `Allow` header; if nothing matches the path, it's a 404.
+
+// Middleware wraps a handler with something to do before and/or after it
+type Middleware func(next http.Handler) http.Handler
+
+// PathParams are the values of the parameters in a route's pattern, already converted to their type
+type PathParams map[string]interface{}
+
+type contextKey int
+
+const (
+	paramsKey contextKey = iota
+	claimsKey
+	routeKey
+)
+
+type paramKind int
+
+const (
+	literalPart paramKind = iota
+	stringParam
+	intParam
+)
+
+type patternPart struct {
+	kind paramKind
+	text string // the literal text, or the parameter name
+}
+
+type route struct {
+	method  string
+	pattern []patternPart
+	text    string       // the pattern as written, with its groups' prefixes, like "/user/{id:int}"
+	handler http.Handler // with the middleware of its groups already applied
+}
+
+// routeNote is where the router writes the pattern of the route it picked, for middleware outside of it
+type routeNote struct {
+	pattern string // "" if no route matched
+}
+
+type Router struct {
+	routes     []*route
+	middleware []Middleware // around everything, including 404s and 405s
+	root       *RouteGroup
+}
+
+// RouteGroup adds routes under a shared path prefix, wrapped by a shared set of middleware
+type RouteGroup struct {
+	router     *Router
+	prefix     string
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	router := &Router{}
+	router.root = &RouteGroup{router: router}
+	return router
+}
+
+// Params returns the path parameters that the router matched for this request
+func Params(request *http.Request) PathParams {
+	params, _ := request.Context().Value(paramsKey).(PathParams)
+	return params
+}
+
+// noteRoute returns a request that the router will note its matched route on, for reading after it's served.
+// That's the only way middleware added with `Router.Use` can know the route, as it runs before the match.
+func noteRoute(request *http.Request) (*http.Request, *routeNote) {
+	note := &routeNote{}
+	return request.WithContext(context.WithValue(request.Context(), routeKey, note)), note
+}
+
+// Int returns an `{name:int}` parameter, or zero if there isn't one
+func (params PathParams) Int(name string) int {
+	value, _ := params[name].(int)
+	return value
+}
+
+// String returns a `{name}` parameter, or "" if there isn't one
+func (params PathParams) String(name string) string {
+	value, _ := params[name].(string)
+	return value
+}
+
+//<editor-fold desc="Building routes">
+
+// Use adds middleware around everything the router does. Call it before the first request.
+func (router *Router) Use(middleware ...Middleware) {
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// Group starts a set of routes under `prefix`, with their own middleware (inside the router's own)
+func (router *Router) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	return router.root.Group(prefix, middleware...)
+}
+
+func (router *Router) Handle(method, pattern string, handler http.Handler, middleware ...Middleware) {
+	router.root.Handle(method, pattern, handler, middleware...)
+}
+
+func (router *Router) Get(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.root.Get(pattern, handler, middleware...)
+}
+
+func (router *Router) Post(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.root.Post(pattern, handler, middleware...)
+}
+
+func (router *Router) Put(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.root.Put(pattern, handler, middleware...)
+}
+
+func (router *Router) Patch(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.root.Patch(pattern, handler, middleware...)
+}
+
+func (router *Router) Delete(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.root.Delete(pattern, handler, middleware...)
+}
+
+// Group starts a set of routes nested inside this one. The new group gets a copy of this group's middleware.
+func (group *RouteGroup) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	combined := append(append([]Middleware{}, group.middleware...), middleware...)
+	return &RouteGroup{router: group.router, prefix: group.prefix + prefix, middleware: combined}
+}
+
+// Use adds middleware to the routes added to this group from now on
+func (group *RouteGroup) Use(middleware ...Middleware) {
+	group.middleware = append(group.middleware, middleware...)
+}
+
+// Handle adds a route. The first middleware given is the outermost. Panics if the pattern is malformed.
+func (group *RouteGroup) Handle(method, pattern string, handler http.Handler, middleware ...Middleware) {
+	parts, err := parsePattern(group.prefix + pattern)
+	if err != nil {panic(fmt.Sprintf("bad route '%s %s': %v", method, group.prefix+pattern, err))}
+
+	handler = chain(handler, middleware)
+	handler = chain(handler, group.middleware)
+	text := "/" + strings.Join(splitPath(group.prefix+pattern), "/")
+	group.router.routes = append(group.router.routes, &route{method: method, pattern: parts, text: text, handler: handler})
+}
+
+func (group *RouteGroup) Get(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(http.MethodGet, pattern, handler, middleware...)
+}
+
+func (group *RouteGroup) Post(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(http.MethodPost, pattern, handler, middleware...)
+}
+
+func (group *RouteGroup) Put(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(http.MethodPut, pattern, handler, middleware...)
+}
+
+func (group *RouteGroup) Patch(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(http.MethodPatch, pattern, handler, middleware...)
+}
+
+func (group *RouteGroup) Delete(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(http.MethodDelete, pattern, handler, middleware...)
+}
+
+// chain wraps `handler` so that `middleware[0]` runs first
+func chain(handler http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+func parsePattern(pattern string) ([]patternPart, error) {
+	var parts []patternPart
+	seen := map[string]bool{}
+	for _, text := range splitPath(pattern) {
+		if !strings.HasPrefix(text, "{") {
+			if strings.ContainsAny(text, "{}") {return nil, fmt.Errorf("'%s' has a brace in the middle", text)}
+			parts = append(parts, patternPart{kind: literalPart, text: text})
+			continue
+		}
+		if !strings.HasSuffix(text, "}") {return nil, fmt.Errorf("'%s' is not closed", text)}
+
+		name, kindName := strings.TrimSuffix(text[1:], "}"), "string"
+		if split := strings.Index(name, ":"); split >= 0 {
+			name, kindName = name[:split], name[split+1:]
+		}
+		if name == "" {return nil, fmt.Errorf("'%s' has no name", text)}
+		if seen[name] {return nil, fmt.Errorf("'%s' is used twice", name)}
+		seen[name] = true
+
+		switch kindName {
+		case "string":
+			parts = append(parts, patternPart{kind: stringParam, text: name})
+		case "int":
+			parts = append(parts, patternPart{kind: intParam, text: name})
+		default:
+			return nil, fmt.Errorf("'%s' is not a known parameter type", kindName)
+		}
+	}
+	return parts, nil
+}
+
+// splitPath breaks a path into its parts, ignoring slashes at the start and end
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {return nil}
+	return strings.Split(path, "/")
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Serving">
+
+func (router *Router) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	chain(http.HandlerFunc(router.dispatch), router.middleware).ServeHTTP(response, request)
+}
+
+func (router *Router) dispatch(response http.ResponseWriter, request *http.Request) {
+	pathParts := splitPath(request.URL.Path)
+
+	var allowed []string
+	for _, candidate := range router.routes {
+		params, ok := candidate.match(pathParts)
+		if !ok {continue}
+		if candidate.method != request.Method {
+			allowed = append(allowed, candidate.method)
+			continue
+		}
+
+		if note, ok := request.Context().Value(routeKey).(*routeNote); ok {note.pattern = candidate.text}
+		ctx := context.WithValue(request.Context(), paramsKey, params)
+		candidate.handler.ServeHTTP(response, request.WithContext(ctx))
+		return
+	}
+
+	if len(allowed) < 1 {
+		notFound(response)
+		return
+	}
+	response.Header().Set("Allow", strings.Join(uniqueSorted(allowed), ", "))
+	unsupportedMethod(request.Method, response)
+}
+
+func (candidate *route) match(pathParts []string) (PathParams, bool) {
+	if len(pathParts) != len(candidate.pattern) {return nil, false}
+
+	params := PathParams{}
+	for i, part := range candidate.pattern {
+		switch part.kind {
+		case literalPart:
+			if pathParts[i] != part.text {return nil, false}
+		case stringParam:
+			params[part.text] = pathParts[i]
+		case intParam:
+			value, err := strconv.Atoi(pathParts[i])
+			if err != nil {return nil, false}
+			params[part.text] = value
+		}
+	}
+	return params, true
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for _, value := range values {
+		if len(unique) < 1 || value != unique[len(unique)-1] {unique = append(unique, value)}
+	}
+	return unique
+}
+
+//</editor-fold>
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveRoute(router *Router, method, path string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "http://localhost:6080"+path, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func writeText(text string) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		pWrite([]byte(text), response)
+	}
+}
+
+func TestRouterMatchesTypedParameters(t *testing.T){
+	(&LittleServer{}).SetUpLogging(false, true)
+	router := NewRouter()
+	router.Get("/user/{id:int}", func(response http.ResponseWriter, request *http.Request) {
+		id := Params(request).Int("id")
+		pWrite([]byte("user "+strings.Repeat("+", id)), response)
+	})
+	router.Get("/files/{folder}/{name}", func(response http.ResponseWriter, request *http.Request) {
+		params := Params(request)
+		pWrite([]byte(params.String("folder")+"|"+params.String("name")), response)
+	})
+	router.Get("/", writeText("home"))
+
+	cases := map[string]string{
+		"/user/3":           "user +++",
+		"/user/3/":          "user +++",
+		"/files/docs/a.txt": "docs|a.txt",
+		"/":                 "home",
+		"":                  "home",
+	}
+	for path, expected := range cases {
+		if actual := serveRoute(router, http.MethodGet, path).Body.String(); actual != expected {
+			t.Errorf("Expected '%v', but got '%v' for '%s'", expected, actual, path)
+		}
+	}
+
+	// parameters of the wrong type don't match
+	for _, path := range []string{"/user/three", "/user/", "/user/3/4", "/files/docs"} {
+		response := serveRoute(router, http.MethodGet, path)
+		if response.Code != http.StatusNotFound || response.Body.String() != `{"error":"page not found","code":"not_found"}` {
+			t.Errorf("Expected a 404 for '%s', but got %d: %v", path, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestRouterListsAllowedMethods(t *testing.T){
+	(&LittleServer{}).SetUpLogging(false, true)
+	router := NewRouter()
+	router.Get("/thing/{id:int}", writeText("get"))
+	router.Post("/thing/{id:int}", writeText("post"))
+	router.Handle(http.MethodDelete, "/thing/{name}", writeText("delete"))
+
+	response := serveRoute(router, http.MethodPut, "/thing/1")
+	if response.Code != http.StatusMethodNotAllowed {t.Errorf("Expected %d, but got %d", http.StatusMethodNotAllowed, response.Code)}
+	if allow := response.Header().Get("Allow"); allow != "DELETE, GET, POST" {t.Errorf("Expected 'DELETE, GET, POST', but got '%v'", allow)}
+	if body := response.Body.String(); body != `{"error":"http method not supported","code":"method_not_allowed"}` {t.Errorf("Expected the canned error, but got '%v'", body)}
+
+	// only the routes that match the path count
+	response = serveRoute(router, http.MethodPut, "/thing/one")
+	if allow := response.Header().Get("Allow"); allow != "DELETE" {t.Errorf("Expected 'DELETE', but got '%v'", allow)}
+
+	if body := serveRoute(router, http.MethodDelete, "/thing/1").Body.String(); body != "delete" {t.Errorf("Expected 'delete', but got '%v'", body)}
+}
+
+func TestRouterGroupsAndMiddleware(t *testing.T){
+	(&LittleServer{}).SetUpLogging(false, true)
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(response, request)
+			})
+		}
+	}
+	block := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			forbidden(response)
+		})
+	}
+
+	router := NewRouter()
+	router.Use(tag("outer"))
+	api := router.Group("/api", tag("api"))
+	v1 := api.Group("/v1", tag("v1"))
+	v1.Get("/ping", writeText("pong"), tag("route"))
+	api.Get("/secret", writeText("secret"), block)
+	router.Get("/open", writeText("open"))
+
+	if body := serveRoute(router, http.MethodGet, "/api/v1/ping").Body.String(); body != "pong" {t.Errorf("Expected 'pong', but got '%v'", body)}
+	if strings.Join(calls, ",") != "outer,api,v1,route" {t.Errorf("Expected 'outer,api,v1,route', but got '%v'", calls)}
+
+	calls = nil
+	if response := serveRoute(router, http.MethodGet, "/api/secret"); response.Code != http.StatusForbidden {t.Errorf("Expected %d, but got %d", http.StatusForbidden, response.Code)}
+	if strings.Join(calls, ",") != "outer,api" {t.Errorf("Expected 'outer,api', but got '%v'", calls)}
+
+	// the router's own middleware also sees requests that don't match anything
+	calls = nil
+	_ = serveRoute(router, http.MethodGet, "/nowhere")
+	if strings.Join(calls, ",") != "outer" {t.Errorf("Expected 'outer', but got '%v'", calls)}
+
+	calls = nil
+	_ = serveRoute(router, http.MethodGet, "/open")
+	if strings.Join(calls, ",") != "outer" {t.Errorf("Expected 'outer', but got '%v'", calls)}
+}
+
+func TestRouterRejectsBadPatterns(t *testing.T){
+	for _, pattern := range []string{"/a/{id", "/a/{}", "/a/{id:float}", "/a/x{id}", "/a/{id}/{id:int}"} {
+		func() {
+			defer func() {
+				if recover() == nil {t.Errorf("Expected '%s' to panic", pattern)}
+			}()
+			NewRouter().Get(pattern, writeText(""))
+		}()
+	}
+}
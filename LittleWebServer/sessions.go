@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A login starts a session. The session hands out short-lived access tokens (the JWT in the "token" cookie),
+// and a long-lived refresh token (the "refresh" cookie) that can be swapped for a new pair at POST /refresh.
+//
+// Each refresh token works once: using it replaces it. If an old one turns up again, someone has a copy
+// of it, so the whole session is revoked. Revoking a session (or logging out) puts its current access
+// token on the denylist, keyed by the token's `jti`, until that token would have expired anyway.
+// Changing a password revokes every other session of that user, in case one of them was stolen.
+// Only a hash of each refresh token is kept, so the session store can't be used to log in.
+
+var UnknownSessionError = errors.New("no session matches that refresh token")
+var SessionEndedError = errors.New("the session has been revoked or has expired")
+
+const (
+	accessTokenLifetime  = 5 * time.Minute
+	refreshTokenLifetime = 7 * 24 * time.Hour // since the last refresh
+	refreshTokenBytes    = 32
+	tokenIdBytes         = 16
+)
+
+type Session struct {
+	Id          string
+	Username    string
+	RefreshHash string    // hash of the only refresh token that's good for this session
+	AccessId    string    // `jti` of the latest access token
+	AccessUntil time.Time // when that access token expires
+	ExpiresAt   time.Time // when the refresh token expires
+	Revoked     bool
+}
+
+// SessionStore keeps sessions, and can find them by any refresh token they have ever handed out.
+// It must be safe for concurrent use.
+type SessionStore interface {
+	// Create adds a new session
+	Create(session Session) error
+	// FindByRefresh returns the session that issued a refresh token (by its hash), even if it has since been
+	// replaced, or fails with UnknownSessionError
+	FindByRefresh(refreshHash string) (Session, error)
+	// Find returns a session by id, or fails with UnknownSessionError
+	Find(id string) (Session, error)
+	// FindByUsername returns every session of a user that hasn't been revoked or expired, in no particular order
+	FindByUsername(username string) ([]Session, error)
+	// Update replaces a session by the result of `change`, with no other change in between.
+	// Fails with UnknownSessionError, or the error from `change` (in which case nothing is changed).
+	Update(id string, change func(session *Session) error) (Session, error)
+}
+
+// TokenDenylist remembers access tokens that were revoked before they expired. It must be safe for concurrent use.
+type TokenDenylist interface {
+	// Deny rejects the token with this `jti` until it expires
+	Deny(tokenId string, until time.Time)
+	IsDenied(tokenId string) bool
+}
+
+// newTokenString makes a random string, safe for cookies and URLs
+func newTokenString(bytes int) string {
+	data := make([]byte, bytes)
+	if _, err := rand.Read(data); err != nil {panic(err)} // the system's random source is broken; nothing is safe
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//<editor-fold desc="In-memory session store">
+
+// MemorySessionStore keeps sessions in maps, so everyone is logged out when the server stops
+type MemorySessionStore struct {
+	lock      sync.RWMutex
+	sessions  map[string]Session
+	byRefresh map[string]string // every refresh hash ever issued => session id
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]Session{}, byRefresh: map[string]string{}}
+}
+
+func (store *MemorySessionStore) Create(session Session) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.dropExpiredLocked(time.Now())
+	store.sessions[session.Id] = session
+	store.byRefresh[session.RefreshHash] = session.Id
+	return nil
+}
+
+func (store *MemorySessionStore) FindByRefresh(refreshHash string) (Session, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	id, ok := store.byRefresh[refreshHash]
+	if !ok {return Session{}, UnknownSessionError}
+	session, ok := store.sessions[id]
+	if !ok {return Session{}, UnknownSessionError}
+	return session, nil
+}
+
+func (store *MemorySessionStore) Find(id string) (Session, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	session, ok := store.sessions[id]
+	if !ok {return Session{}, UnknownSessionError}
+	return session, nil
+}
+
+func (store *MemorySessionStore) FindByUsername(username string) ([]Session, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now()
+	found := []Session{}
+	for _, session := range store.sessions {
+		if session.Username == username && !session.Revoked && !now.After(session.ExpiresAt) {found = append(found, session)}
+	}
+	return found, nil
+}
+
+func (store *MemorySessionStore) Update(id string, change func(session *Session) error) (Session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[id]
+	if !ok {return Session{}, UnknownSessionError}
+	if err := change(&session); err != nil {return Session{}, err}
+
+	session.Id = id
+	store.sessions[id] = session
+	store.byRefresh[session.RefreshHash] = id
+	return session, nil
+}
+
+// dropExpiredLocked forgets sessions that can't be refreshed any more, along with their old refresh hashes
+func (store *MemorySessionStore) dropExpiredLocked(now time.Time) {
+	for id, session := range store.sessions {
+		if now.After(session.ExpiresAt) {delete(store.sessions, id)}
+	}
+	for hash, id := range store.byRefresh {
+		if _, ok := store.sessions[id]; !ok {delete(store.byRefresh, hash)}
+	}
+}
+
+//</editor-fold>
+
+//<editor-fold desc="In-memory denylist">
+
+// MemoryTokenDenylist keeps revoked token ids in a map, until they expire
+type MemoryTokenDenylist struct {
+	lock   sync.RWMutex
+	denied map[string]time.Time
+}
+
+func NewMemoryTokenDenylist() *MemoryTokenDenylist {
+	return &MemoryTokenDenylist{denied: map[string]time.Time{}}
+}
+
+func (list *MemoryTokenDenylist) Deny(tokenId string, until time.Time) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	now := time.Now()
+	for id, expiry := range list.denied {
+		if now.After(expiry) {delete(list.denied, id)} // the token has expired, so it doesn't need denying
+	}
+	list.denied[tokenId] = until
+}
+
+func (list *MemoryTokenDenylist) IsDenied(tokenId string) bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	_, denied := list.denied[tokenId]
+	return denied
+}
+
+//</editor-fold>
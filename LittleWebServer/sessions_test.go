@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T){
+	store := NewMemorySessionStore()
+	if _, err := store.Find("nope"); err != UnknownSessionError {t.Errorf("Expected '%v', but got '%v'", UnknownSessionError, err)}
+
+	session := Session{Id: "s1", Username: "sam", RefreshHash: "first", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.Create(session); err != nil {t.Fatalf("Create failed with %v", err)}
+
+	updated, err := store.Update("s1", func(session *Session) error {
+		session.RefreshHash = "second"
+		return nil
+	})
+	if err != nil || updated.RefreshHash != "second" {t.Errorf("Expected 'second', but got '%v' (%v)", updated.RefreshHash, err)}
+
+	// old refresh hashes still find the session, so reuse can be spotted
+	for _, hash := range []string{"first", "second"} {
+		if found, err := store.FindByRefresh(hash); err != nil || found.Id != "s1" {t.Errorf("Expected 's1' for '%s', but got '%v' (%v)", hash, found.Id, err)}
+	}
+	if _, err = store.FindByRefresh("third"); err != UnknownSessionError {t.Errorf("Expected '%v', but got '%v'", UnknownSessionError, err)}
+
+	// only live sessions are found by user
+	_ = store.Create(Session{Id: "s3", Username: "sam", RefreshHash: "revoked", ExpiresAt: time.Now().Add(time.Hour), Revoked: true})
+	_ = store.Create(Session{Id: "s4", Username: "kim", RefreshHash: "kim's", ExpiresAt: time.Now().Add(time.Hour)})
+	if found, err := store.FindByUsername("sam"); err != nil || len(found) != 1 || found[0].Id != "s1" {t.Errorf("Expected just 's1', but got %v (%v)", found, err)}
+
+	// a failed change changes nothing
+	_, err = store.Update("s1", func(session *Session) error {
+		session.Revoked = true
+		return SessionEndedError
+	})
+	if found, _ := store.Find("s1"); err != SessionEndedError || found.Revoked {t.Errorf("Expected no change, but got '%v' (%v)", found, err)}
+
+	// expired sessions are dropped when new ones arrive
+	_, _ = store.Update("s1", func(session *Session) error {
+		session.ExpiresAt = time.Now().Add(-time.Second)
+		return nil
+	})
+	_ = store.Create(Session{Id: "s2", RefreshHash: "other", ExpiresAt: time.Now().Add(time.Hour)})
+	if _, err = store.FindByRefresh("first"); err != UnknownSessionError {t.Errorf("Expected '%v', but got '%v'", UnknownSessionError, err)}
+}
+
+func TestMemoryTokenDenylist(t *testing.T){
+	list := NewMemoryTokenDenylist()
+	list.Deny("old", time.Now().Add(-time.Second))
+	list.Deny("current", time.Now().Add(time.Minute))
+
+	if !list.IsDenied("current") {t.Errorf("Expected 'current' to be denied")}
+	if list.IsDenied("other") {t.Errorf("Expected 'other' not to be denied")}
+	if list.IsDenied("old") {t.Errorf("Expected 'old' to be dropped once it expired")}
+}
+
+// tokenClient keeps cookies between requests, like a browser
+type tokenClient struct {
+	t       *testing.T
+	server  *LittleServer
+	cookies map[string]string
+}
+
+func (client *tokenClient) send(method, path, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "http://localhost:6080"+path, strings.NewReader(body))
+	for name, value := range client.cookies {
+		request.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	response := httptest.NewRecorder()
+	client.server.ServeHTTP(response, request)
+
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(client.cookies, cookie.Name)
+		} else {
+			client.cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return response
+}
+
+func (client *tokenClient) copy() *tokenClient {
+	cookies := map[string]string{}
+	for name, value := range client.cookies {
+		cookies[name] = value
+	}
+	return &tokenClient{t: client.t, server: client.server, cookies: cookies}
+}
+
+func newTokenClient(t *testing.T, server *LittleServer) *tokenClient {
+	client := &tokenClient{t: t, server: server, cookies: map[string]string{}}
+	if response := client.send(http.MethodPost, "/login", `{"username":"ieb","password":"correct"}`); response.Code != http.StatusOK {
+		t.Fatalf("Could not log in: %d", response.Code)
+	}
+	if client.cookies["token"] == "" || client.cookies["refresh"] == "" {t.Fatalf("Expected both cookies, but got %v", client.cookies)}
+	return client
+}
+
+func expectCode(t *testing.T, response *httptest.ResponseRecorder, code int, what string) {
+	t.Helper()
+	if response.Code != code {t.Errorf("%s: expected %d, but got %d", what, code, response.Code)}
+}
+
+func TestRefreshTokensRotate(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	client := newTokenClient(t, server)
+	before := client.copy()
+
+	expectCode(t, client.send(http.MethodPost, "/refresh", ""), http.StatusOK, "refresh")
+	if client.cookies["token"] == before.cookies["token"] || client.cookies["refresh"] == before.cookies["refresh"] {
+		t.Errorf("Expected both tokens to change")
+	}
+
+	// the new access token works, and the one it replaced doesn't
+	expectCode(t, client.send(http.MethodGet, "/user", ""), http.StatusOK, "new access token")
+	expectCode(t, before.send(http.MethodGet, "/user", ""), http.StatusUnauthorized, "replaced access token")
+
+	// and it keeps going
+	expectCode(t, client.send(http.MethodPost, "/refresh", ""), http.StatusOK, "second refresh")
+	expectCode(t, client.send(http.MethodGet, "/user", ""), http.StatusOK, "second access token")
+
+	// without a refresh token, or with a made-up one, there's nothing to refresh
+	stranger := &tokenClient{t: t, server: server, cookies: map[string]string{}}
+	expectCode(t, stranger.send(http.MethodPost, "/refresh", ""), http.StatusUnauthorized, "no refresh token")
+	stranger.cookies["refresh"] = "made-up"
+	expectCode(t, stranger.send(http.MethodPost, "/refresh", ""), http.StatusUnauthorized, "made-up refresh token")
+}
+
+func TestReusedRefreshTokenRevokesTheSession(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	victim := newTokenClient(t, server)
+	thief := victim.copy() // a copy of the cookies, taken before the victim refreshes
+
+	expectCode(t, victim.send(http.MethodPost, "/refresh", ""), http.StatusOK, "victim refresh")
+
+	// the thief's refresh token has already been used, so the session is revoked...
+	response := thief.send(http.MethodPost, "/refresh", "")
+	expectCode(t, response, http.StatusUnauthorized, "reused refresh token")
+	if len(thief.cookies) != 0 {t.Errorf("Expected the cookies to be cleared, but got %v", thief.cookies)}
+
+	// ...which logs the victim out too, as there's no telling which of them is the real user
+	expectCode(t, victim.send(http.MethodGet, "/user", ""), http.StatusUnauthorized, "victim access token")
+	expectCode(t, victim.send(http.MethodPost, "/refresh", ""), http.StatusUnauthorized, "victim refresh token")
+
+	// other sessions for the same user are fine
+	other := newTokenClient(t, server)
+	expectCode(t, other.send(http.MethodGet, "/user", ""), http.StatusOK, "other session")
+}
+
+func TestLogoutRevokesTheSession(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	client := newTokenClient(t, server)
+	stolen := client.copy()
+
+	response := client.send(http.MethodPost, "/logout", "")
+	expectCode(t, response, http.StatusOK, "logout")
+	if body := response.Body.String(); body != `{"message":"logged out"}` {t.Errorf("Expected '{\"message\":\"logged out\"}', but got '%s'", body)}
+	if len(client.cookies) != 0 {t.Errorf("Expected the cookies to be cleared, but got %v", client.cookies)}
+
+	// copies of the tokens don't work either
+	expectCode(t, stolen.send(http.MethodGet, "/user", ""), http.StatusUnauthorized, "access token after logout")
+	expectCode(t, stolen.copy().send(http.MethodPost, "/refresh", ""), http.StatusUnauthorized, "refresh token after logout")
+
+	// logging out twice, or without being logged in, is harmless
+	expectCode(t, client.send(http.MethodPost, "/logout", ""), http.StatusOK, "second logout")
+
+	// logging out with only the refresh token still revokes everything
+	client = newTokenClient(t, server)
+	accessOnly := client.copy()
+	delete(client.cookies, "token")
+	expectCode(t, client.send(http.MethodPost, "/logout", ""), http.StatusOK, "logout with refresh token")
+	expectCode(t, accessOnly.send(http.MethodGet, "/user", ""), http.StatusUnauthorized, "access token after refresh-only logout")
+}
+
+func TestPasswordChangeRevokesOtherSessions(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	thief := newTokenClient(t, server) // a session on another device, whose tokens were stolen
+	victim := newTokenClient(t, server)
+
+	response := victim.send(http.MethodPost, "/password", `{"oldPassword":"correct","newPassword":"a new password"}`)
+	expectCode(t, response, http.StatusOK, "password change")
+
+	expectCode(t, thief.send(http.MethodGet, "/user", ""), http.StatusUnauthorized, "stolen access token")
+	expectCode(t, thief.send(http.MethodPost, "/refresh", ""), http.StatusUnauthorized, "stolen refresh token")
+
+	// the session that changed the password carries on
+	expectCode(t, victim.send(http.MethodGet, "/user", ""), http.StatusOK, "current access token")
+	expectCode(t, victim.send(http.MethodPost, "/refresh", ""), http.StatusOK, "current refresh token")
+}
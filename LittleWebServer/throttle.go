@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Logins are throttled by username and by the address they come from, each with its own policy.
+// Every attempt counts as a failure until the password turns out to be right, so a burst of attempts
+// sent all at once is throttled as well as a steady stream.
+//
+// A few failures are free. After that, each one doubles the wait before the next attempt is allowed,
+// and enough of them lock the username or address out for a while. Failures are forgotten some time
+// after the last one.
+//
+// The address is the connection's own. If the server is ever put behind a proxy, the proxy needs to do its
+// own throttling, as X-Forwarded-For can be set to anything by the client.
+
+type ThrottlePolicy struct {
+	FreeAttempts int           // failures allowed before there's any wait
+	BaseDelay    time.Duration // wait after the first failure that isn't free; doubles with each after that
+	MaxDelay     time.Duration
+	LockoutAfter int           // failures that lock out for `LockoutFor`, rather than backing off. Zero for never.
+	LockoutFor   time.Duration
+	ForgetAfter  time.Duration // since the last failure. Should be longer than `LockoutFor`.
+}
+
+var usernamePolicy = ThrottlePolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   15 * time.Minute,
+	ForgetAfter:  time.Hour,
+}
+
+// more generous than for usernames, as many people can share one address
+var addressPolicy = ThrottlePolicy{
+	FreeAttempts: 20,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 100,
+	LockoutFor:   15 * time.Minute,
+	ForgetAfter:  time.Hour,
+}
+
+// AttemptRecord is what's known about recent failures for one username or address
+type AttemptRecord struct {
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+	ForgetAt     time.Time // the record can be thrown away after this
+}
+
+// AttemptStore keeps attempt records by key. It must be safe for concurrent use.
+type AttemptStore interface {
+	// Update changes the record for `key` (starting from an empty one if there is none), with no other change in between
+	Update(key string, change func(record *AttemptRecord)) (AttemptRecord, error)
+	// Clear forgets the record for `key`
+	Clear(key string) error
+}
+
+// LoginThrottle decides whether a login attempt may go ahead
+type LoginThrottle struct {
+	store     AttemptStore
+	byUser    ThrottlePolicy
+	byAddress ThrottlePolicy
+	now       func() time.Time
+}
+
+func NewLoginThrottle(store AttemptStore) *LoginThrottle {
+	return &LoginThrottle{store: store, byUser: usernamePolicy, byAddress: addressPolicy, now: time.Now}
+}
+
+// delayAfter is how long to wait after a number of failures
+func (policy ThrottlePolicy) delayAfter(failures int) time.Duration {
+	if policy.LockoutAfter > 0 && failures >= policy.LockoutAfter {return policy.LockoutFor}
+	if failures <= policy.FreeAttempts {return 0}
+
+	delay := policy.BaseDelay
+	for i := policy.FreeAttempts + 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {delay = policy.MaxDelay}
+	return delay
+}
+
+// Attempt records a login attempt, unless the username or address is being made to wait, in which case
+// it says how long for. Call `Succeeded` if the password turns out to be right.
+func (throttle *LoginThrottle) Attempt(username, address string) (time.Duration, bool, error) {
+	if wait, err := throttle.attemptOne("addr:"+address, throttle.byAddress); err != nil || wait > 0 {return wait, false, err}
+	if wait, err := throttle.attemptOne("user:"+username, throttle.byUser); err != nil || wait > 0 {return wait, false, err}
+	return 0, true, nil
+}
+
+func (throttle *LoginThrottle) attemptOne(key string, policy ThrottlePolicy) (time.Duration, error) {
+	now := throttle.now()
+	var wait time.Duration
+	_, err := throttle.store.Update(key, func(record *AttemptRecord) {
+		if now.After(record.ForgetAt) {*record = AttemptRecord{}}
+		if now.Before(record.BlockedUntil) {
+			wait = record.BlockedUntil.Sub(now)
+			return
+		}
+
+		record.Failures++
+		record.LastFailure = now
+		record.BlockedUntil = now.Add(policy.delayAfter(record.Failures))
+		record.ForgetAt = now.Add(policy.ForgetAfter)
+	})
+	return wait, err
+}
+
+// Succeeded clears the username's failures, and takes back the attempt counted against the address
+func (throttle *LoginThrottle) Succeeded(username, address string) error {
+	if err := throttle.store.Clear("user:" + username); err != nil {return err}
+
+	_, err := throttle.store.Update("addr:"+address, func(record *AttemptRecord) {
+		if record.Failures < 1 {return}
+		record.Failures--
+		record.BlockedUntil = record.LastFailure.Add(throttle.byAddress.delayAfter(record.Failures))
+	})
+	return err
+}
+
+// remoteAddress is the IP address of the far end of the connection, without the port
+func remoteAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {return request.RemoteAddr}
+	return host
+}
+
+//<editor-fold desc="In-memory attempt store">
+
+// MemoryAttemptStore keeps attempt records in a map, throwing them away once they're out of date
+type MemoryAttemptStore struct {
+	lock    sync.Mutex
+	records map[string]AttemptRecord
+	updates int
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{records: map[string]AttemptRecord{}}
+}
+
+func (store *MemoryAttemptStore) Update(key string, change func(record *AttemptRecord)) (AttemptRecord, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.updates++
+	if store.updates%1024 == 0 {store.dropForgottenLocked(time.Now())} // often enough to stay small, rare enough to be cheap
+
+	record := store.records[key]
+	change(&record)
+	store.records[key] = record
+	return record, nil
+}
+
+func (store *MemoryAttemptStore) Clear(key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.records, key)
+	return nil
+}
+
+func (store *MemoryAttemptStore) dropForgottenLocked(now time.Time) {
+	for key, record := range store.records {
+		if now.After(record.ForgetAt) {delete(store.records, key)}
+	}
+}
+
+//</editor-fold>
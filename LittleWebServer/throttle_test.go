@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottleDelaysBackOff(t *testing.T){
+	policy := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second, LockoutAfter: 10, LockoutFor: time.Hour}
+	expected := map[int]time.Duration{
+		0: 0, 1: 0, 3: 0,
+		4: time.Second, 5: 2 * time.Second, 6: 4 * time.Second, 7: 8 * time.Second,
+		8: 10 * time.Second, 9: 10 * time.Second, // capped
+		10: time.Hour, 50: time.Hour, // locked out
+	}
+	for failures, delay := range expected {
+		if actual := policy.delayAfter(failures); actual != delay {t.Errorf("Expected %v after %d failures, but got %v", delay, failures, actual)}
+	}
+
+	policy.LockoutAfter = 0
+	if actual := policy.delayAfter(50); actual != 10*time.Second {t.Errorf("Expected no lockout, but got %v", actual)}
+}
+
+// fakeClock lets tests move time on without waiting
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {return clock.now}
+func (clock *fakeClock) Advance(by time.Duration) {clock.now = clock.now.Add(by)}
+
+func newTestThrottle() (*LoginThrottle, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)}
+	throttle := NewLoginThrottle(NewMemoryAttemptStore())
+	throttle.now = clock.Now
+	return throttle, clock
+}
+
+func TestThrottleByUsername(t *testing.T){
+	throttle, clock := newTestThrottle()
+	attempt := func(username, address string) (time.Duration, bool) {
+		wait, allowed, err := throttle.Attempt(username, address)
+		if err != nil {t.Fatalf("Attempt failed with %v", err)}
+		return wait, allowed
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, allowed := attempt("sam", "192.0.2.1"); !allowed {t.Fatalf("Expected attempt %d to be allowed", i+1)}
+	}
+	if wait, allowed := attempt("sam", "192.0.2.1"); allowed || wait != time.Second {t.Errorf("Expected a 1s wait, but got %v (%v)", wait, allowed)}
+
+	// other addresses don't help, and other usernames aren't affected
+	if _, allowed := attempt("sam", "198.51.100.7"); allowed {t.Errorf("Expected sam to be throttled from any address")}
+	if _, allowed := attempt("kim", "192.0.2.1"); !allowed {t.Errorf("Expected kim to be allowed")}
+
+	// each failure doubles the wait
+	clock.Advance(time.Second)
+	if _, allowed := attempt("sam", "192.0.2.1"); !allowed {t.Errorf("Expected an attempt after waiting to be allowed")}
+	if wait, _ := attempt("sam", "192.0.2.1"); wait != 2*time.Second {t.Errorf("Expected a 2s wait, but got %v", wait)}
+
+	// until it locks out
+	for i := 0; i < 5; i++ {
+		clock.Advance(5 * time.Minute)
+		_, _ = attempt("sam", "192.0.2.1")
+	}
+	if wait, _ := attempt("sam", "192.0.2.1"); wait != 15*time.Minute {t.Errorf("Expected a 15m lockout, but got %v", wait)}
+
+	// failures are forgotten after a while
+	clock.Advance(2 * time.Hour)
+	for i := 0; i < 4; i++ {
+		if _, allowed := attempt("sam", "192.0.2.1"); !allowed {t.Errorf("Expected attempt %d after the lockout to be allowed", i+1)}
+	}
+
+	// and cleared by getting the password right
+	clock.Advance(time.Hour)
+	_, _ = attempt("sam", "192.0.2.1")
+	_, _ = attempt("sam", "192.0.2.1")
+	_ = throttle.Succeeded("sam", "192.0.2.1")
+	for i := 0; i < 4; i++ {
+		if _, allowed := attempt("sam", "192.0.2.1"); !allowed {t.Errorf("Expected attempt %d after a success to be allowed", i+1)}
+	}
+}
+
+func TestThrottleByAddress(t *testing.T){
+	throttle, _ := newTestThrottle()
+
+	// password spraying: one attempt at each of lots of usernames
+	for i := 0; i < addressPolicy.FreeAttempts+1; i++ {
+		if _, allowed, _ := throttle.Attempt("user"+string(rune('a'+i)), "192.0.2.1"); !allowed {t.Fatalf("Expected attempt %d to be allowed", i+1)}
+	}
+	if wait, allowed, _ := throttle.Attempt("someone-else", "192.0.2.1"); allowed || wait != time.Second {t.Errorf("Expected a 1s wait, but got %v (%v)", wait, allowed)}
+	if _, allowed, _ := throttle.Attempt("someone-else", "192.0.2.2"); !allowed {t.Errorf("Expected other addresses to be allowed")}
+
+	// good logins from a busy address don't count against it
+	throttle, _ = newTestThrottle()
+	for i := 0; i < 3*addressPolicy.FreeAttempts; i++ {
+		if _, allowed, _ := throttle.Attempt("sam", "192.0.2.1"); !allowed {t.Fatalf("Expected good login %d to be allowed", i+1)}
+		_ = throttle.Succeeded("sam", "192.0.2.1")
+	}
+}
+
+func TestLoginIsThrottled(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	server.setupOnce.Do(server.setDefaults)
+	clock := &fakeClock{now: time.Now()}
+	server.throttle.now = clock.Now
+
+	login := func(password string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "http://localhost:6080/login", strings.NewReader(`{"username":"ieb","password":"`+password+`"}`))
+		request.RemoteAddr = "192.0.2.1:5678"
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	for i := 0; i < 4; i++ {
+		expectCode(t, login("wrong"), http.StatusBadRequest, "wrong password")
+	}
+	response := login("wrong")
+	expectCode(t, response, http.StatusTooManyRequests, "throttled")
+	if retry := response.Header().Get("Retry-After"); retry != "1" {t.Errorf("Expected 'Retry-After: 1', but got '%s'", retry)}
+	if body := response.Body.String(); body != `{"error":"too many attempts, try again later","code":"too_many_requests","details":[{"message":"try again in 1s"}]}` {t.Errorf("Unexpected body '%s'", body)}
+
+	// even the right password has to wait
+	expectCode(t, login("correct"), http.StatusTooManyRequests, "right password while throttled")
+
+	clock.Advance(1500 * time.Millisecond)
+	expectCode(t, login("correct"), http.StatusOK, "right password after waiting")
+	expectCode(t, login("wrong"), http.StatusBadRequest, "wrong password after a success")
+}
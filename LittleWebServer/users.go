@@ -0,0 +1,268 @@
+package main
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var UserNotFoundError = errors.New("no user with that id exists")
+var UserIdTakenError = errors.New("a user with that id already exists")
+
+// UserRepository keeps the user records served under /user. It must be safe for concurrent use.
+type UserRepository interface {
+	// Find returns the user with this id, or fails with UserNotFoundError
+	Find(id int) (MyInputType, error)
+	// Save adds or replaces the user with this id
+	Save(id int, user MyInputType) error
+	// Add adds a user with this id, or fails with UserIdTakenError
+	Add(id int, user MyInputType) error
+	// AddNext adds a user with an id that is free and that AddNext has never given out before, sets the user's ID field to match, and returns the id
+	AddNext(user MyInputType) (int, error)
+	// Update replaces the user with this id by the result of `change`, with no other change in between.
+	// Fails with UserNotFoundError, or the error from `change` (in which case nothing is changed).
+	Update(id int, change func(user MyInputType) (MyInputType, error)) (MyInputType, error)
+	// Delete removes the user with this id, or fails with UserNotFoundError
+	Delete(id int) error
+	// DeleteIf removes the user with this id if `check` passes, with no other change in between.
+	// Fails with UserNotFoundError, or the error from `check` (in which case nothing is deleted).
+	DeleteIf(id int, check func(user MyInputType) error) error
+	// All returns every user, by id
+	All() (map[int]MyInputType, error)
+}
+
+//<editor-fold desc="In-memory repository">
+
+// MemoryUserRepository keeps users in a map, so they are lost when the server stops
+type MemoryUserRepository struct {
+	lock   sync.RWMutex
+	users  map[int]MyInputType
+	nextId int
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[int]MyInputType{}}
+}
+
+func (repo *MemoryUserRepository) Find(id int) (MyInputType, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	user, ok := repo.users[id]
+	if !ok {return MyInputType{}, UserNotFoundError}
+	return user, nil
+}
+
+func (repo *MemoryUserRepository) Save(id int, user MyInputType) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.users[id] = user
+	return nil
+}
+
+func (repo *MemoryUserRepository) Add(id int, user MyInputType) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, taken := repo.users[id]; taken {return UserIdTakenError}
+	repo.users[id] = user
+	return nil
+}
+
+func (repo *MemoryUserRepository) AddNext(user MyInputType) (int, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for {
+		id := repo.nextId
+		repo.nextId++
+		if _, taken := repo.users[id]; taken {continue} // added with `Add` or `Save`
+
+		user.ID = id
+		repo.users[id] = user
+		return id, nil
+	}
+}
+
+func (repo *MemoryUserRepository) Update(id int, change func(user MyInputType) (MyInputType, error)) (MyInputType, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	current, ok := repo.users[id]
+	if !ok {return MyInputType{}, UserNotFoundError}
+	changed, err := change(current)
+	if err != nil {return MyInputType{}, err}
+
+	repo.users[id] = changed
+	return changed, nil
+}
+
+func (repo *MemoryUserRepository) Delete(id int) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, ok := repo.users[id]; !ok {return UserNotFoundError}
+	delete(repo.users, id)
+	return nil
+}
+
+func (repo *MemoryUserRepository) DeleteIf(id int, check func(user MyInputType) error) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	current, ok := repo.users[id]
+	if !ok {return UserNotFoundError}
+	if err := check(current); err != nil {return err}
+
+	delete(repo.users, id)
+	return nil
+}
+
+func (repo *MemoryUserRepository) All() (map[int]MyInputType, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	all := make(map[int]MyInputType, len(repo.users))
+	for id, user := range repo.users {
+		all[id] = user
+	}
+	return all, nil
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Key value store repository">
+
+const userKeyPrefix = "user:"
+const nextUserIdKey = "next-user-id"
+
+// StoreUserRepository keeps users in a key value store, one key per user (`user:<id>`), plus the next id for `AddNext`.
+// The store does its own locking, so reads need nothing more. Changes that read before they write
+// take `lock`, which assumes this is the only thing writing users to the store.
+type StoreUserRepository struct {
+	store *kvs.IndependentStore
+	lock  sync.Mutex
+}
+
+// OpenStoreUserRepository opens (or creates) a store file for users at `path`
+func OpenStoreUserRepository(path string) (*StoreUserRepository, error) {
+	kvs.RegisterType(MyInputType{}) // so users are read back from the file as users, not generic JSON
+	store, err := kvs.OpenFile(path, kvs.FileOptions{})
+	if err != nil {return nil, err}
+	return &StoreUserRepository{store: store}, nil
+}
+
+// NewStoreUserRepository uses a store that's already open. Register `MyInputType` before opening it from a file.
+func NewStoreUserRepository(store *kvs.IndependentStore) *StoreUserRepository {
+	return &StoreUserRepository{store: store}
+}
+
+func userKey(id int) kvs.StoreKey {
+	return kvs.StoreKey(userKeyPrefix + strconv.Itoa(id))
+}
+
+func (repo *StoreUserRepository) Find(id int) (MyInputType, error) {
+	value, err := repo.store.Get(userKey(id))
+	if err == kvs.KeyNotPresentError {return MyInputType{}, UserNotFoundError}
+	if err != nil {return MyInputType{}, err}
+
+	user, ok := value.(MyInputType)
+	if !ok {return MyInputType{}, UserNotFoundError} // something else is using our key
+	return user, nil
+}
+
+func (repo *StoreUserRepository) Save(id int, user MyInputType) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	return repo.store.Put(userKey(id), user)
+}
+
+func (repo *StoreUserRepository) Add(id int, user MyInputType) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if repo.store.Contains(userKey(id)) {return UserIdTakenError}
+	return repo.store.Put(userKey(id), user)
+}
+
+func (repo *StoreUserRepository) AddNext(user MyInputType) (int, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	id := 0
+	if value, err := repo.store.Get(nextUserIdKey); err == nil {
+		id, _ = value.(int)
+	} else if err != kvs.KeyNotPresentError {
+		return 0, err
+	}
+
+	for repo.store.Contains(userKey(id)) { // added with `Add` or `Save`
+		id++
+	}
+
+	user.ID = id
+	if err := repo.store.Put(userKey(id), user); err != nil {return 0, err}
+	if err := repo.store.Put(nextUserIdKey, id+1); err != nil {return 0, err}
+	return id, nil
+}
+
+func (repo *StoreUserRepository) Update(id int, change func(user MyInputType) (MyInputType, error)) (MyInputType, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	current, err := repo.Find(id)
+	if err != nil {return MyInputType{}, err}
+	changed, err := change(current)
+	if err != nil {return MyInputType{}, err}
+
+	if err = repo.store.Put(userKey(id), changed); err != nil {return MyInputType{}, err}
+	return changed, nil
+}
+
+func (repo *StoreUserRepository) Delete(id int) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	err := repo.store.Delete(userKey(id))
+	if err == kvs.KeyNotPresentError {return UserNotFoundError}
+	return err
+}
+
+func (repo *StoreUserRepository) DeleteIf(id int, check func(user MyInputType) error) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	current, err := repo.Find(id)
+	if err != nil {return err}
+	if err = check(current); err != nil {return err}
+
+	err = repo.store.Delete(userKey(id))
+	if err == kvs.KeyNotPresentError {return UserNotFoundError}
+	return err
+}
+
+func (repo *StoreUserRepository) All() (map[int]MyInputType, error) {
+	all := map[int]MyInputType{}
+	for _, key := range repo.store.Keys() {
+		if !strings.HasPrefix(string(key), userKeyPrefix) {continue}
+		id, err := strconv.Atoi(strings.TrimPrefix(string(key), userKeyPrefix))
+		if err != nil {continue}
+
+		user, err := repo.Find(id)
+		if err == UserNotFoundError {continue} // deleted since we listed the keys
+		if err != nil {return nil, err}
+		all[id] = user
+	}
+	return all, nil
+}
+
+// Close writes out anything pending and closes the store file
+func (repo *StoreUserRepository) Close() error {
+	return repo.store.Close()
+}
+
+//</editor-fold>
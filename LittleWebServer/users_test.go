@@ -0,0 +1,248 @@
+package main
+
+import (
+	kvs "KeyValueStore"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Every repository should behave the same, so each test runs against all of them
+func eachRepository(t *testing.T, test func(t *testing.T, repo UserRepository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryUserRepository())
+	})
+	t.Run("key value store", func(t *testing.T) {
+		repo, err := OpenStoreUserRepository(filepath.Join(t.TempDir(), "users.kvs"))
+		if err != nil {t.Fatalf("OpenStoreUserRepository failed with %v", err)}
+		defer func() { _ = repo.Close() }()
+		test(t, repo)
+	})
+}
+
+func TestUserRepositoryBasics(t *testing.T){
+	eachRepository(t, func(t *testing.T, repo UserRepository) {
+		if _, err := repo.Find(1); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+		if err := repo.Delete(1); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+
+		sam := MyInputType{ID: 1, Name: "Sam", Age: 30}
+		kim := MyInputType{ID: 2, Name: "Kim", Age: 40}
+		if err := repo.Save(1, sam); err != nil {t.Fatalf("Save failed with %v", err)}
+		if err := repo.Save(2, kim); err != nil {t.Fatalf("Save failed with %v", err)}
+		if user, err := repo.Find(1); user != sam || err != nil {t.Errorf("Expected '%v', but got '%v' (%v)", sam, user, err)}
+
+		sam.Age = 31
+		_ = repo.Save(1, sam)
+		if user, _ := repo.Find(1); user != sam {t.Errorf("Expected '%v', but got '%v'", sam, user)}
+
+		all, err := repo.All()
+		if err != nil || len(all) != 2 || all[1] != sam || all[2] != kim {t.Errorf("Expected both users, but got '%v' (%v)", all, err)}
+
+		// changing the result of `All` doesn't change the repository
+		delete(all, 1)
+		if _, err = repo.Find(1); err != nil {t.Errorf("Expected user 1 to still be there, but got '%v'", err)}
+
+		if err = repo.Delete(1); err != nil {t.Errorf("Delete failed with %v", err)}
+		if _, err = repo.Find(1); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+		if all, _ = repo.All(); len(all) != 1 {t.Errorf("Expected one user, but got '%v'", all)}
+	})
+}
+
+func TestUserRepositoryAddAndUpdate(t *testing.T){
+	eachRepository(t, func(t *testing.T, repo UserRepository) {
+		sam := MyInputType{ID: 5, Name: "Sam", Age: 30}
+		if err := repo.Add(1, sam); err != nil {t.Fatalf("Add failed with %v", err)}
+		if err := repo.Add(1, sam); err != UserIdTakenError {t.Errorf("Expected '%v', but got '%v'", UserIdTakenError, err)}
+
+		// the next ids skip anything already used
+		first, err := repo.AddNext(MyInputType{Name: "Kim"})
+		if first != 0 || err != nil {t.Errorf("Expected 0, but got %v (%v)", first, err)}
+		second, _ := repo.AddNext(MyInputType{Name: "Lee"})
+		if second != 2 {t.Errorf("Expected 2, but got %v", second)}
+		if user, _ := repo.Find(2); user.ID != 2 || user.Name != "Lee" {t.Errorf("Expected the ID to be set, but got '%v'", user)}
+
+		// and deleted ids are not used again
+		_ = repo.Delete(2)
+		if third, _ := repo.AddNext(MyInputType{Name: "Max"}); third != 3 {t.Errorf("Expected 3, but got %v", third)}
+
+		updated, err := repo.Update(1, func(user MyInputType) (MyInputType, error) {
+			user.Age++
+			return user, nil
+		})
+		if updated.Age != 31 || err != nil {t.Errorf("Expected age 31, but got '%v' (%v)", updated, err)}
+		if user, _ := repo.Find(1); user.Age != 31 {t.Errorf("Expected age 31, but got '%v'", user)}
+
+		// a failed change changes nothing
+		failure := errors.New("nope")
+		_, err = repo.Update(1, func(user MyInputType) (MyInputType, error) {
+			return MyInputType{}, failure
+		})
+		if err != failure {t.Errorf("Expected '%v', but got '%v'", failure, err)}
+		if user, _ := repo.Find(1); user.Age != 31 {t.Errorf("Expected age 31, but got '%v'", user)}
+
+		_, err = repo.Update(99, func(user MyInputType) (MyInputType, error) {return user, nil})
+		if err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+	})
+}
+
+func TestUserRepositoryDeleteIf(t *testing.T){
+	eachRepository(t, func(t *testing.T, repo UserRepository) {
+		_ = repo.Save(1, MyInputType{ID: 1, Name: "Sam", Owner: "sam"})
+
+		// a failed check deletes nothing
+		failure := errors.New("not yours")
+		if err := repo.DeleteIf(1, func(user MyInputType) error {return failure}); err != failure {t.Errorf("Expected '%v', but got '%v'", failure, err)}
+		if _, err := repo.Find(1); err != nil {t.Errorf("Expected the user to be kept, but got '%v'", err)}
+
+		checked := MyInputType{}
+		err := repo.DeleteIf(1, func(user MyInputType) error {
+			checked = user
+			return nil
+		})
+		if err != nil || checked.Owner != "sam" {t.Errorf("Expected the check to see the user, but got '%v' (%v)", checked, err)}
+		if _, err = repo.Find(1); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+
+		if err = repo.DeleteIf(1, func(user MyInputType) error {return nil}); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+	})
+}
+
+func TestUserRepositoryIsSafeForConcurrentUse(t *testing.T){
+	eachRepository(t, func(t *testing.T, repo UserRepository) {
+		const writers = 8
+		const perWriter = 50
+
+		var wait sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wait.Add(2)
+			go func(w int) {
+				defer wait.Done()
+				for i := 0; i < perWriter; i++ {
+					id := w*perWriter + i
+					if err := repo.Save(id, MyInputType{ID: id, Name: fmt.Sprintf("user %d", id), Age: i}); err != nil {t.Errorf("Save failed with %v", err)}
+					if i%5 == 0 {_ = repo.Delete(id)}
+				}
+			}(w)
+			go func() { // readers racing the writers
+				defer wait.Done()
+				for i := 0; i < perWriter; i++ {
+					if _, err := repo.All(); err != nil {t.Errorf("All failed with %v", err)}
+					_, _ = repo.Find(i)
+				}
+			}()
+		}
+		wait.Wait()
+
+		// updates and new ids don't get lost either
+		for w := 0; w < writers; w++ {
+			wait.Add(2)
+			go func() {
+				defer wait.Done()
+				for i := 0; i < perWriter; i++ {
+					_, _ = repo.Update(1, func(user MyInputType) (MyInputType, error) {
+						user.Age++
+						return user, nil
+					})
+				}
+			}()
+			go func() {
+				defer wait.Done()
+				if _, err := repo.AddNext(MyInputType{}); err != nil {t.Errorf("AddNext failed with %v", err)}
+			}()
+		}
+		wait.Wait()
+
+		if user, _ := repo.Find(1); user.Age != 1+writers*perWriter {t.Errorf("Expected age %d, but got '%v'", 1+writers*perWriter, user)}
+		all, err := repo.All()
+		expected := writers * (perWriter - perWriter/5) + writers
+		if err != nil || len(all) != expected {t.Errorf("Expected %d users, but got %d (%v)", expected, len(all), err)}
+	})
+}
+
+func TestStoreUserRepositorySurvivesRestart(t *testing.T){
+	path := filepath.Join(t.TempDir(), "users.kvs")
+	repo, err := OpenStoreUserRepository(path)
+	if err != nil {t.Fatalf("OpenStoreUserRepository failed with %v", err)}
+
+	sam := MyInputType{ID: 7, Name: "Sam", Age: 30}
+	_ = repo.Save(7, sam)
+	_ = repo.Save(8, MyInputType{Name: "Gone"})
+	_ = repo.Delete(8)
+	if err = repo.Close(); err != nil {t.Fatalf("Close failed with %v", err)}
+
+	reopened, err := OpenStoreUserRepository(path)
+	if err != nil {t.Fatalf("OpenStoreUserRepository failed with %v", err)}
+	defer func() { _ = reopened.Close() }()
+
+	if user, err := reopened.Find(7); user != sam || err != nil {t.Errorf("Expected '%v', but got '%v' (%v)", sam, user, err)}
+	if all, _ := reopened.All(); len(all) != 1 {t.Errorf("Expected one user, but got '%v'", all)}
+}
+
+func TestStoreUserRepositoryIgnoresOtherKeys(t *testing.T){
+	store := kvs.OpenNew()
+	_ = store.Put("user:1", "not a user")
+	_ = store.Put("user:not-a-number", MyInputType{})
+	_ = store.Put("other", MyInputType{})
+	repo := NewStoreUserRepository(store)
+
+	if _, err := repo.Find(1); err != UserNotFoundError {t.Errorf("Expected '%v', but got '%v'", UserNotFoundError, err)}
+	if all, err := repo.All(); len(all) != 0 || err != nil {t.Errorf("Expected no users, but got '%v' (%v)", all, err)}
+}
+
+func TestConcurrentRequestsToUserEndpoints(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost:6080/login", strings.NewReader(`{"username":"ieb","password":"correct"}`))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	cookieValue := response.Header().Get("Set-Cookie")
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(2)
+		go func(i int) {
+			defer wait.Done()
+			body := fmt.Sprintf(`{"id":%d,"name":"user %d","age":%d}`, i, i, i)
+			request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:6080/user/%d", i), strings.NewReader(body))
+			request.Header.Set("Cookie", cookieValue)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			if response.Code != http.StatusCreated {t.Errorf("Expected %d, but got %d", http.StatusCreated, response.Code)}
+		}(i)
+		go func() {
+			defer wait.Done()
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost:6080/user", nil)
+			request.Header.Set("Cookie", cookieValue)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			if response.Code != http.StatusOK {t.Errorf("Expected %d, but got %d", http.StatusOK, response.Code)}
+		}()
+	}
+	wait.Wait()
+
+	if all, _ := server.userDb.All(); len(all) != 20 {t.Errorf("Expected 20 users, but got %d", len(all))}
+}
+
+// brokenUserRepository fails every conditional delete, like a repository whose storage has gone away
+type brokenUserRepository struct {
+	*MemoryUserRepository
+}
+
+func (repo brokenUserRepository) DeleteIf(int, func(MyInputType) error) error {
+	return errors.New("disk on fire")
+}
+
+func TestDeleteUserFailsWhenTheRepositoryDoes(t *testing.T){
+	server := &LittleServer{passwordCost: 1000, userDb: brokenUserRepository{NewMemoryUserRepository()}}
+	server.SetUpLogging(false, true)
+	admin := newTokenClient(t, server)
+
+	expectCode(t, admin.send(http.MethodPost, "/user/1", `{"id":1,"name":"Sam","age":30}`), http.StatusCreated, "create")
+	expectCode(t, admin.send(http.MethodDelete, "/user/1", ""), http.StatusInternalServerError, "delete")
+	expectCode(t, admin.send(http.MethodGet, "/user/1", ""), http.StatusOK, "still there")
+}
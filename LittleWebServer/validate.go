@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Request bodies are checked against rules in their `validate` struct tags, after they're decoded:
+//
+//     Name string `json:"name" validate:"required,maxlen=100"`
+//     Age  int    `json:"age" validate:"min=0,max=150"`
+//
+//     required         not the zero value: not 0, "", nil or empty
+//     min=N, max=N     for numbers, the smallest and largest allowed value
+//     minlen=N,        for strings, slices and maps, the fewest and most characters (not bytes) or items
+//       maxlen=N
+//     pattern=RE       for strings, a regular expression the whole value must match. Must be the last rule,
+//                      as everything after `pattern=` is the expression, commas and all.
+//
+// Empty strings, slices and maps that aren't `required` are taken as not given, and skip the other rules.
+// Nested structs are checked too, with their fields named like "address.street". Types that contain
+// themselves (through a pointer, like a linked list) are fine, as is a value that points back into itself.
+//
+// Breaking the rules is a ValidationError, which handlers send with `invalidFields` as a 422 listing every
+// field that's wrong. `readValid` does all of it: decode, validate, and send any error.
+// A malformed tag is a programming error, so it panics the first time its type is checked.
+
+// ValidationError lists what's wrong with each field that broke a rule
+type ValidationError []ErrorDetail
+
+func (fields ValidationError) Error() string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {parts[i] = field.Field + " " + field.Message}
+	return "invalid input: " + strings.Join(parts, "; ")
+}
+
+type fieldRules struct {
+	index    []int  // of the field in its struct, for reflect.Value.FieldByIndex
+	name     string // as in the JSON
+	kind     reflect.Kind
+	required bool
+	min, max *float64
+	minLen   int
+	maxLen   int // -1 for no limit
+	pattern  *regexp.Regexp
+	nested   reflect.Type // for struct fields; its rules come from rulesFor when a value is checked
+}
+
+// rulesByType caches the parsed rules of each struct type checked so far
+var rulesByType sync.Map // reflect.Type => []fieldRules
+
+// Validate checks a struct (or pointer to one) against its tags. It returns a ValidationError, or nil if all is well.
+func Validate(value interface{}) error {
+	target := reflect.Indirect(reflect.ValueOf(value))
+	if target.Kind() != reflect.Struct {panic(fmt.Sprintf("can only validate structs, not %v", target.Kind()))}
+
+	checked := map[uintptr]bool{}
+	if target.CanAddr() {checked[target.Addr().Pointer()] = true}
+	failures := checkFields(target, rulesFor(target.Type()), "", checked)
+	if len(failures) > 0 {return failures}
+	return nil
+}
+
+func rulesFor(structType reflect.Type) []fieldRules {
+	if cached, ok := rulesByType.Load(structType); ok {return cached.([]fieldRules)}
+	rules, err := parseRules(structType, map[reflect.Type]bool{})
+	if err != nil {panic(fmt.Sprintf("bad validate tag on %v: %v", structType, err))}
+	return rules
+}
+
+//<editor-fold desc="Parsing tags">
+
+// parseRules reads the rules of a struct type, and caches them. Nested struct types are parsed too, so a bad
+// tag anywhere fails straight away, but only once each: `parsing` holds the types already on the way down.
+func parseRules(structType reflect.Type, parsing map[reflect.Type]bool) ([]fieldRules, error) {
+	parsing[structType] = true
+	var all []fieldRules
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {continue} // unexported, so never decoded
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {continue}
+		if name == "" {name = field.Name}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {fieldType = fieldType.Elem()}
+		rules := fieldRules{index: field.Index, name: name, kind: fieldType.Kind(), maxLen: -1}
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if err := rules.parseTag(tag); err != nil {return nil, fmt.Errorf("field '%s': %w", field.Name, err)}
+		}
+		if rules.kind == reflect.Struct {
+			rules.nested = fieldType
+			if _, cached := rulesByType.Load(fieldType); !cached && !parsing[fieldType] {
+				if _, err := parseRules(fieldType, parsing); err != nil {return nil, err}
+			}
+		}
+		if rules.required || rules.min != nil || rules.max != nil || rules.minLen > 0 || rules.maxLen >= 0 || rules.pattern != nil || rules.nested != nil {
+			all = append(all, rules)
+		}
+	}
+
+	// the rules only name nested types, so they're complete even if a type above this one is still being parsed
+	rulesByType.Store(structType, all)
+	return all, nil
+}
+
+func (rules *fieldRules) parseTag(tag string) error {
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "pattern=") {
+			rule, tag = tag, ""
+		} else if comma := strings.Index(tag, ","); comma >= 0 {
+			rule, tag = tag[:comma], tag[comma+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		name, argument := rule, ""
+		if equals := strings.Index(rule, "="); equals >= 0 {name, argument = rule[:equals], rule[equals+1:]}
+
+		var err error
+		switch name {
+		case "required":
+			rules.required = true
+		case "min", "max":
+			if !isNumberKind(rules.kind) {return fmt.Errorf("'%s' is only for numbers", name)}
+			var limit float64
+			if limit, err = strconv.ParseFloat(argument, 64); err != nil {return fmt.Errorf("'%s' needs a number: %w", rule, err)}
+			if name == "min" {rules.min = &limit} else {rules.max = &limit}
+		case "minlen", "maxlen":
+			if !hasLength(rules.kind) {return fmt.Errorf("'%s' is only for strings, slices and maps", name)}
+			var limit int
+			if limit, err = strconv.Atoi(argument); err != nil || limit < 0 {return fmt.Errorf("'%s' needs a whole number", rule)}
+			if name == "minlen" {rules.minLen = limit} else {rules.maxLen = limit}
+		case "pattern":
+			if rules.kind != reflect.String {return fmt.Errorf("'pattern' is only for strings")}
+			if rules.pattern, err = regexp.Compile(`^(?:` + argument + `)$`); err != nil {return err}
+		default:
+			return fmt.Errorf("'%s' is not a known rule", name)
+		}
+	}
+	return nil
+}
+
+func isNumberKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func hasLength(kind reflect.Kind) bool {
+	return kind == reflect.String || kind == reflect.Slice || kind == reflect.Map || kind == reflect.Array
+}
+
+//</editor-fold>
+
+//<editor-fold desc="Checking values">
+
+// checkFields checks the fields of a struct value. `checked` holds the pointers already followed, so a value that
+// points back into itself is only checked once.
+func checkFields(target reflect.Value, rules []fieldRules, prefix string, checked map[uintptr]bool) ValidationError {
+	var failures ValidationError
+	for _, field := range rules {
+		name := prefix + field.name
+		value := target.FieldByIndex(field.index)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				if field.required {failures = append(failures, ErrorDetail{Field: name, Message: "is required"})}
+				continue
+			}
+			if field.kind == reflect.Struct {
+				if checked[value.Pointer()] {continue}
+				checked[value.Pointer()] = true
+			}
+			value = value.Elem()
+		}
+
+		if field.kind == reflect.Struct {
+			failures = append(failures, checkFields(value, rulesFor(field.nested), name+".", checked)...)
+			continue
+		}
+		if message := field.check(value); message != "" {
+			failures = append(failures, ErrorDetail{Field: name, Message: message})
+		}
+	}
+	return failures
+}
+
+// check returns what's wrong with a value, or "" if nothing is. Only the first broken rule is reported.
+func (rules *fieldRules) check(value reflect.Value) string {
+	if value.IsZero() || (hasLength(rules.kind) && value.Len() == 0) {
+		if rules.required {return "is required"}
+		if hasLength(rules.kind) {return ""} // not given, and that's allowed
+	}
+
+	if isNumberKind(rules.kind) {
+		number := numberOf(value)
+		if rules.min != nil && number < *rules.min {return "must be at least " + formatFloat(*rules.min)}
+		if rules.max != nil && number > *rules.max {return "must be at most " + formatFloat(*rules.max)}
+		return ""
+	}
+
+	if hasLength(rules.kind) {
+		length, unit := value.Len(), "items"
+		if rules.kind == reflect.String {length, unit = utf8.RuneCountInString(value.String()), "characters"}
+		if length < rules.minLen {return fmt.Sprintf("must have at least %d %s", rules.minLen, unit)}
+		if rules.maxLen >= 0 && length > rules.maxLen {return fmt.Sprintf("must have at most %d %s", rules.maxLen, unit)}
+	}
+	if rules.pattern != nil && !rules.pattern.MatchString(value.String()) {return "is not in the right format"}
+	return ""
+}
+
+func numberOf(value reflect.Value) float64 {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	default:
+		return value.Float()
+	}
+}
+
+//</editor-fold>
+
+// readValid decodes a request body into `target` and checks it with `Validate`. If that fails, it sends
+// a 400 (for a body that can't be decoded) or a 422 (for one that breaks the rules), and returns false.
+func readValid(response http.ResponseWriter, request *http.Request, target interface{}) bool {
+	if err := readJson(response, request, target); err != nil {
+		logFor(response).Warn("Bad request body", "error", err)
+		invalidInput(response)
+		return false
+	}
+	if err := Validate(target); err != nil {
+		invalidFields(err.(ValidationError), response)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testAddress struct {
+	Street string `json:"street" validate:"required"`
+}
+
+type testForm struct {
+	Name     string            `json:"name" validate:"required,minlen=2,maxlen=5"`
+	Score    float64           `json:"score" validate:"min=-1.5,max=10"`
+	Count    uint              `json:"count" validate:"max=3"`
+	Code     string            `json:"code" validate:"pattern=[A-Z]{2,3}"` // the comma belongs to the pattern
+	Tags     []string          `json:"tags" validate:"maxlen=2"`
+	Extra    map[string]string `json:"extra" validate:"required"`
+	Nickname *string           `json:"nickname" validate:"required,maxlen=3"`
+	Address  testAddress       `json:"address"`
+	Ignored  int               `json:"-" validate:"min=5"`
+	untagged int
+}
+
+func validTestForm() testForm {
+	nickname := "Jo"
+	return testForm{Name: "Sam", Score: 1, Code: "AB", Extra: map[string]string{"a": "b"}, Nickname: &nickname, Address: testAddress{Street: "High St"}}
+}
+
+func TestValidatePassesGoodInput(t *testing.T){
+	form := validTestForm()
+	if err := Validate(form); err != nil {t.Errorf("Expected no error, but got '%v'", err)}
+	if err := Validate(&form); err != nil {t.Errorf("Expected no error for a pointer, but got '%v'", err)}
+
+	// limits are inclusive, and optional strings can be left out
+	form.Score, form.Count, form.Code, form.Tags = 10, 3, "", []string{"a", "b"}
+	if err := Validate(form); err != nil {t.Errorf("Expected no error, but got '%v'", err)}
+	form.Name = "ÅÄÖÜß" // five characters, but more bytes
+	if err := Validate(form); err != nil {t.Errorf("Expected no error, but got '%v'", err)}
+}
+
+func TestValidateListsEveryBadField(t *testing.T){
+	long := "Joanna"
+	form := testForm{Name: "S", Score: -2, Count: 4, Code: "ABCD", Tags: []string{"a", "b", "c"}, Extra: map[string]string{}, Nickname: &long, Ignored: 1}
+
+	err := Validate(form)
+	expected := ValidationError{
+		{Field: "name", Message: "must have at least 2 characters"},
+		{Field: "score", Message: "must be at least -1.5"},
+		{Field: "count", Message: "must be at most 3"},
+		{Field: "code", Message: "is not in the right format"},
+		{Field: "tags", Message: "must have at most 2 items"},
+		{Field: "extra", Message: "is required"},
+		{Field: "nickname", Message: "must have at most 3 characters"},
+		{Field: "address.street", Message: "is required"},
+	}
+	if !reflect.DeepEqual(err, expected) {t.Errorf("Expected '%v', but got '%v'", expected, err)}
+
+	form = validTestForm()
+	form.Name, form.Nickname = "", nil
+	err = Validate(form)
+	expected = ValidationError{{Field: "name", Message: "is required"}, {Field: "nickname", Message: "is required"}}
+	if !reflect.DeepEqual(err, expected) {t.Errorf("Expected '%v', but got '%v'", expected, err)}
+	if !strings.Contains(err.Error(), "name is required") {t.Errorf("Expected a readable error, but got '%v'", err)}
+}
+
+type testNode struct {
+	Name     string      `json:"name" validate:"required"`
+	Next     *testNode   `json:"next"`
+	Children []testNode  `json:"children"`
+	Owner    *testPerson `json:"owner"`
+}
+
+type testPerson struct {
+	Nickname string    `json:"nickname" validate:"maxlen=3"`
+	Friend   *testNode `json:"friend"` // round the loop, through another type
+}
+
+func TestValidateRecursiveTypes(t *testing.T){
+	list := testNode{Name: "a", Next: &testNode{Name: "b", Next: &testNode{}}, Owner: &testPerson{Nickname: "Sam", Friend: &testNode{}}}
+	err := Validate(list)
+	expected := ValidationError{{Field: "next.next.name", Message: "is required"}, {Field: "owner.friend.name", Message: "is required"}}
+	if !reflect.DeepEqual(err, expected) {t.Errorf("Expected '%v', but got '%v'", expected, err)}
+
+	// a value that points back into itself is checked once
+	loop := &testNode{Name: "loop"}
+	loop.Next = loop
+	loop.Owner = &testPerson{Nickname: "Joanna", Friend: loop}
+	err = Validate(loop)
+	expected = ValidationError{{Field: "owner.nickname", Message: "must have at most 3 characters"}}
+	if !reflect.DeepEqual(err, expected) {t.Errorf("Expected '%v', but got '%v'", expected, err)}
+}
+
+func TestValidatePanicsOnBadTags(t *testing.T){
+	badTypes := []interface{}{
+		struct{ A string `validate:"min=1"` }{},
+		struct{ A int `validate:"maxlen=1"` }{},
+		struct{ A int `validate:"pattern=x"` }{},
+		struct{ A int `validate:"max=lots"` }{},
+		struct{ A string `validate:"pattern=("` }{},
+		struct{ A string `validate:"shiny"` }{},
+		struct{ Inner *struct{ B int `validate:"maxlen=1"` } }{}, // found before there's ever a value to follow
+	}
+	for _, value := range badTypes {
+		func() {
+			defer func() {
+				if recover() == nil {t.Errorf("Expected %T to panic", value)}
+			}()
+			_ = Validate(value)
+		}()
+	}
+}
+
+func TestUserValidation(t *testing.T){
+	server := &LittleServer{passwordCost: 1000}
+	server.SetUpLogging(false, true)
+	cookieValue := logIn(t, server, devUsername, devPassword)
+
+	send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Cookie", cookieValue)
+		if contentType != "" {request.Header.Set("Content-Type", contentType)}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+	expect := func(response *httptest.ResponseRecorder, code int, body string) {
+		t.Helper()
+		if response.Code != code {t.Errorf("Expected %d, but got %d", code, response.Code)}
+		if actual := response.Body.String(); actual != body {t.Errorf("Expected '%s', but got '%s'", body, actual)}
+	}
+
+	expect(send(http.MethodPost, "/user/3", "", `{"id":3,"name":"","age":-1,"owner":"not a username"}`), http.StatusUnprocessableEntity,
+		`{"error":"input failed validation","code":"validation_failed","details":[{"field":"name","message":"is required"},{"field":"age","message":"must be at least 0"},{"field":"owner","message":"is not in the right format"}]}`)
+	expect(send(http.MethodPost, "/user", "", `{"name":"`+strings.Repeat("x", 101)+`","age":200}`), http.StatusUnprocessableEntity,
+		`{"error":"input failed validation","code":"validation_failed","details":[{"field":"name","message":"must have at most 100 characters"},{"field":"age","message":"must be at most 150"}]}`)
+
+	// the ID has to match the path, or be left out
+	idMismatch := `{"error":"input failed validation","code":"validation_failed","details":[{"field":"id","message":"must match the id in the path"}]}`
+	expect(send(http.MethodPost, "/user/3", "", `{"id":4,"name":"Sam","age":30}`), http.StatusUnprocessableEntity, idMismatch)
+	expect(send(http.MethodPost, "/user/3", "", `{"name":"Sam","age":30}`), http.StatusCreated, `{"id":3,"name":"Sam","age":30}`)
+	expect(send(http.MethodPut, "/user/3", "", `{"id":4,"name":"Sam","age":31}`), http.StatusUnprocessableEntity, idMismatch)
+	expect(send(http.MethodPatch, "/user/3", mergePatchContentType, `{"id":4}`), http.StatusUnprocessableEntity, idMismatch)
+
+	// patches are checked once they're applied, and leave the user alone if they fail
+	expect(send(http.MethodPatch, "/user/3", mergePatchContentType, `{"age":-5}`), http.StatusUnprocessableEntity,
+		`{"error":"input failed validation","code":"validation_failed","details":[{"field":"age","message":"must be at least 0"}]}`)
+	expect(send(http.MethodGet, "/user/3", "", ""), http.StatusOK, `{"id":3,"name":"Sam","age":30}`)
+
+	// bodies that can't be read at all are still a 400
+	expect(send(http.MethodPost, "/user/5", "", `{"name":`), http.StatusBadRequest, `{"error":"input is invalid","code":"invalid_input"}`)
+}